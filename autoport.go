@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+)
+
+// How many ports above the configured one AutoPort tries before giving up.
+const autoPortAttempts = 100
+
+// The local ports AutoPort has handed out to our own destinations, so two of our tracks never end up on the same one.
+var claimedPorts = struct {
+	sync.Mutex
+	ports map[string]bool
+}{ports: make(map[string]bool)}
+
+// Finds how far the ports a destination on this machine uses (its RTP port, and its RTCP and FEC ports when those are
+// forwarded) need moving up so none of them is bound by another process, e.g. another instance's receiver, or used by
+// another of our destinations. The ports are claimed until releasePorts is called with the returned keys.
+// Destinations on other machines are left alone, we have no way of telling which of their ports are in use.
+func claimFreePorts(address string, port int, fecPort int) (int, []string, error) {
+	ip, local := localAddress(address)
+	if !local {
+		return 0, nil, nil
+	}
+
+	claimedPorts.Lock()
+	defer claimedPorts.Unlock()
+	for offset := 0; offset < autoPortAttempts; offset++ {
+		ports := []int{port + offset}
+		if *ForwardRTCP && !*ForwardRTCPMux {
+			ports = append(ports, port+offset+1)
+		}
+		if *ForwardFEC {
+			ports = append(ports, fecPort+offset)
+		}
+		if keys, ok := portsFree(ip, ports); ok {
+			for _, key := range keys {
+				claimedPorts.ports[key] = true
+			}
+			return offset, keys, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("no free port on %s from %d to %d", address, port, port+autoPortAttempts-1)
+}
+
+// Releases ports claimed by claimFreePorts, once the destination using them is closed.
+func releasePorts(keys []string) {
+	claimedPorts.Lock()
+	defer claimedPorts.Unlock()
+	for _, key := range keys {
+		delete(claimedPorts.ports, key)
+	}
+}
+
+// Whether every port is unclaimed and can be bound on ip, along with their claim keys. Receivers bind the port they
+// listen on, so a port we can bind has no receiver on it.
+func portsFree(ip net.IP, ports []int) ([]string, bool) {
+	keys := make([]string, 0, len(ports))
+	for _, port := range ports {
+		if port > math.MaxUint16 {
+			return nil, false
+		}
+		key := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+		if claimedPorts.ports[key] {
+			return nil, false
+		}
+		listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			return nil, false
+		}
+		listener.Close()
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// Resolves a forwarding address and reports whether it is one of this machine's own unicast addresses.
+func localAddress(address string) (net.IP, bool) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address, "0"))
+	if err != nil || addr.IP.IsMulticast() {
+		return nil, false
+	}
+	if addr.IP.IsLoopback() {
+		return addr.IP, true
+	}
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, false
+	}
+	for _, interfaceAddr := range interfaceAddrs {
+		if ipNet, ok := interfaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return addr.IP, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How much of each new delay measurement goes into a track's smoothed delay, the rest is what it was. Smooths over the
+// network jitter and UE's pacing of a frame's packets, like the 1/16 of RFC 3550's jitter.
+const avSyncSmoothing = 1.0 / 16
+
+// avSyncMonitor - Estimates how far apart UE's audio and video are when they reach us, from their capture times. Each
+// track's sender reports map its RTP timestamps to UE's wall clock, so the delay from capture to arrival can be
+// measured per track. Those delays include the offset between UE's clock and ours, the same for every track, so the
+// difference between the video's and an audio track's is how much later the video arrives than the audio captured
+// at the same time. That is what a receiver playing both as they arrive is out of sync by. Updated from the tracks'
+// forwarding loops, started over with each session.
+type avSyncMonitor struct {
+	mu     sync.Mutex
+	tracks map[string]*avSyncTrack
+}
+
+type avSyncTrack struct {
+	kind  webrtc.RTPCodecType
+	stats *trackStats
+	// Smoothed delay from capture (on UE's clock) to arrival (on ours).
+	delay time.Duration
+	// For audio tracks, whether the offset to the video is over MaxSyncDriftMs and has been logged.
+	outOfSync bool
+}
+
+var avSync = &avSyncMonitor{tracks: make(map[string]*avSyncTrack)}
+
+// Forgets the tracks of the previous session, their sender reports' mappings don't apply to the new one's.
+func (m *avSyncMonitor) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, track := range m.tracks {
+		track.stats.clearSyncOffset()
+	}
+	m.tracks = make(map[string]*avSyncTrack)
+}
+
+// Records the arrival of a packet with the given RTP timestamp, for video only the last packet of a frame, and updates
+// the audio tracks' offsets to the video. Does nothing until the track has had a sender report.
+func (m *avSyncMonitor) packet(stats *trackStats, kind webrtc.RTPCodecType, clock *senderReportClock, rtpTime uint32, now time.Time) {
+	captureTime, ok := clock.captureTime(rtpTime)
+	if !ok {
+		return
+	}
+	// The difference in UQ32.32 seconds, signed so a clock UE has ahead of ours works too.
+	delay := time.Duration(float64(int64(toNTPTime(now)-captureTime)) / (1 << 32) * float64(time.Second))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	track, ok := m.tracks[stats.name]
+	if !ok {
+		track = &avSyncTrack{kind: kind, stats: stats, delay: delay}
+		m.tracks[stats.name] = track
+	}
+	track.delay += time.Duration(float64(delay-track.delay) * avSyncSmoothing)
+
+	// The first video track is the one the audio is compared to, i.e. "video".
+	video := m.tracks[trackName(webrtc.RTPCodecTypeVideo, 0)]
+	if video == nil {
+		return
+	}
+	if kind == webrtc.RTPCodecTypeAudio {
+		m.checkLocked(track, video.delay-track.delay)
+		return
+	}
+	if track != video {
+		return
+	}
+	for _, audio := range m.tracks {
+		if audio.kind == webrtc.RTPCodecTypeAudio {
+			m.checkLocked(audio, video.delay-audio.delay)
+		}
+	}
+}
+
+// Stores an audio track's offset to the video, positive when the video is behind, and logs when it goes over
+// MaxSyncDriftMs and when it is back to a quarter below it. The margin keeps an offset right at the limit from logging
+// on every packet.
+func (m *avSyncMonitor) checkLocked(audio *avSyncTrack, offset time.Duration) {
+	audio.stats.setSyncOffset(offset)
+	if *MaxSyncDriftMs <= 0 {
+		return
+	}
+	limit := time.Duration(*MaxSyncDriftMs) * time.Millisecond
+	drift := offset
+	if drift < 0 {
+		drift = -drift
+	}
+	if !audio.outOfSync && drift > limit {
+		audio.outOfSync = true
+		log.Printf("Warning: %s and video are out of sync by more than -MaxSyncDriftMs %d, %s. The bridge forwards them as they arrive, so receivers playing them that way are too. Receivers syncing with the forwarded sender reports (-ForwardRTCP) can make up for it. If it keeps growing, a new session may help.", audio.stats.name, *MaxSyncDriftMs, describeSyncOffset(offset))
+	} else if audio.outOfSync && drift <= limit*3/4 {
+		audio.outOfSync = false
+		log.Printf("%s and video are back in sync, %s.", audio.stats.name, describeSyncOffset(offset))
+	}
+}
+
+// e.g. "video 120ms behind" or "video 40ms ahead".
+func describeSyncOffset(offset time.Duration) string {
+	if offset < 0 {
+		return fmt.Sprintf("video %s ahead", (-offset).Round(time.Millisecond))
+	}
+	return fmt.Sprintf("video %s behind", offset.Round(time.Millisecond))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The most packets we hold back for one batched write.
+const maxBatchPackets = 32
+
+// batchWriter - ipv4.PacketConn and ipv6.PacketConn, both take the same message type.
+type batchWriter interface {
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// udpBatch - Holds the forwarded packets of a video frame and sends them with a single sendmmsg call once the frame is
+// complete, rather than one write syscall per packet.
+type udpBatch struct {
+	writer  batchWriter
+	buffers [][]byte
+	pending []ipv4.Message
+}
+
+func newUDPBatch(conn *net.UDPConn) *udpBatch {
+	var writer batchWriter = ipv4.NewPacketConn(conn)
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		writer = ipv6.NewPacketConn(conn)
+	}
+	b := &udpBatch{writer: writer, buffers: make([][]byte, maxBatchPackets)}
+	for i := range b.buffers {
+		b.buffers[i] = make([]byte, 0, 1500+rtpMaxAddedHeaderBytes)
+	}
+	return b
+}
+
+// Reports whether a packet should be sent with the batch already pending (false) or the pending batch must be flushed
+// first because the packet starts a new frame.
+func (b *udpBatch) startsNewFrame(packet []byte) bool {
+	return len(b.pending) > 0 && rtpTimestamp(b.pending[0].Buffers[0]) != rtpTimestamp(packet)
+}
+
+// Adds a copy of the packet to the batch, returns whether the batch should now be flushed: it ends the frame (marker
+// bit) or the batch is full.
+func (b *udpBatch) add(packet []byte) bool {
+	buffer := append(b.buffers[len(b.pending)][:0], packet...)
+	b.pending = append(b.pending, ipv4.Message{Buffers: [][]byte{buffer}})
+	return packet[1]&rtpMarkerBit != 0 || len(b.pending) == maxBatchPackets
+}
+
+// Sends the pending packets, returns the sizes of those sent and the error that stopped the rest, e.g. ECONNREFUSED
+// when the receiver isn't listening.
+func (b *udpBatch) flush() ([]int, error) {
+	var sent []int
+	messages := b.pending
+	b.pending = b.pending[:0]
+	for len(messages) > 0 {
+		n, err := b.writer.WriteBatch(messages, 0)
+		for _, message := range messages[:n] {
+			sent = append(sent, len(message.Buffers[0]))
+		}
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			break
+		}
+		messages = messages[n:]
+	}
+	return sent, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Creates a batching destination forwarding to a test receiver on localhost.
+func createTestBatchDestination(t *testing.T) (*udpConn, *net.UDPConn) {
+	t.Helper()
+	destination, receiver := createTestDestination(t, 96)
+	destination.batch = newUDPBatch(destination.conn)
+	return destination, receiver
+}
+
+func TestUDPBatchFlushesFrame(t *testing.T) {
+	destination, receiver := createTestBatchDestination(t)
+	stats := &trackStats{name: "video"}
+	for i := 0; i < 3; i++ {
+		writeRTP(destination, marshalTestPacket(t, rtp.Header{SequenceNumber: uint16(i), Timestamp: 1000, Marker: i == 2}, testIDRPayload), stats)
+	}
+	for i := 0; i < 3; i++ {
+		if sequence := binary.BigEndian.Uint16(readTestDatagram(t, receiver)[2:]); sequence != uint16(i) {
+			t.Errorf("packet %d of the frame arrived as %d", i, sequence)
+		}
+	}
+	if len(destination.batch.pending) != 0 {
+		t.Errorf("%d packets still batched after the frame ended", len(destination.batch.pending))
+	}
+}
+
+func TestUDPBatchFlushError(t *testing.T) {
+	destination, _ := createTestBatchDestination(t)
+	destination.batch.add(marshalTestPacket(t, rtp.Header{Timestamp: 1000}, testIDRPayload))
+	destination.conn.Close()
+	sent, err := destination.batch.flush()
+	if err == nil {
+		t.Fatal("flushing to a closed socket succeeded")
+	}
+	if len(sent) != 0 {
+		t.Errorf("%d packets reported sent", len(sent))
+	}
+
+	// The forwarding loop drops and counts the batch rather than going down itself. Only a refusal takes the
+	// destination down.
+	stats := &trackStats{name: "video"}
+	destination.batch.add(marshalTestPacket(t, rtp.Header{Timestamp: 1000}, testIDRPayload))
+	destination.batch.add(marshalTestPacket(t, rtp.Header{Timestamp: 1000}, testIDRPayload))
+	flushBatch(destination, stats, time.Now())
+	if destination.state.down {
+		t.Error("destination down after a batch write error other than a refusal")
+	}
+	if stats.writeErrors != 2 {
+		t.Errorf("%d write errors counted, want the batch's 2", stats.writeErrors)
+	}
+}
+
+func TestUDPSinkCloseFlushesBatch(t *testing.T) {
+	destination, receiver := createTestBatchDestination(t)
+	sink := newUDPSink(udpConns{destination}, &trackStats{name: "video"})
+	// The track ends part way through a frame.
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 7, Timestamp: 1000}, Payload: testIDRPayload}
+	raw, err := packet.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Raw = raw
+	sink.writeRTP(packet)
+	if len(destination.batch.pending) != 1 {
+		t.Fatalf("%d packets batched, want 1", len(destination.batch.pending))
+	}
+	sink.close()
+	if sequence := binary.BigEndian.Uint16(readTestDatagram(t, receiver)[2:]); sequence != 7 {
+		t.Errorf("forwarded %d, want the batched 7", sequence)
+	}
+}
+
+func TestPauseFlushesBatch(t *testing.T) {
+	listener, port := listenTestReceiver(t)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+	setFlag(t, "BatchWrites", "true")
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+	t.Cleanup(func() { bridgeStats.track("video").setPaused(false) })
+
+	// One long frame that never ends, so only a full batch or the pause sends anything.
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ue.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err = negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	written := 0
+	write := func() {
+		_ = track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(written), Timestamp: 1000}, Payload: testIDRPayload})
+		written++
+	}
+	readSequence := func() int {
+		return int(binary.BigEndian.Uint16(readTestDatagram(t, listener)[2:]))
+	}
+	// Packets written before the track is bound go nowhere, the first batch starts with whichever came first.
+	first := -1
+	b := make([]byte, 1600)
+	for first < 0 {
+		if written > 500 {
+			t.Fatal("no batch forwarded")
+		}
+		write()
+		listener.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if n, err := listener.Read(b); err == nil && n > 4 {
+			first = int(binary.BigEndian.Uint16(b[2:]))
+		}
+	}
+	for last := first; last < first+maxBatchPackets-1; {
+		last = readSequence()
+	}
+	// Leave 3 packets batched.
+	for written < first+maxBatchPackets+3 {
+		write()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	bridgeStats.track("video").setPaused(true)
+	write()
+	for last := first + maxBatchPackets - 1; last < first+maxBatchPackets+2; {
+		last = readSequence()
+	}
+}
+
+// Sends frames of 10 packets to a test receiver, batched or one write per packet.
+func benchmarkWriteRTP(b *testing.B, batch bool) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer receiver.Close()
+	destination, err := createUDPConnection("127.0.0.1", receiver.LocalAddr().(*net.UDPAddr).Port, 96)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer destination.close()
+	if batch {
+		destination.batch = newUDPBatch(destination.conn)
+	}
+	// Drained so the writes aren't dropped by the kernel for the receiver's full buffer.
+	go func() {
+		buffer := make([]byte, 1600)
+		for {
+			if _, err := receiver.Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+
+	frame := make([][]byte, 10)
+	for i := range frame {
+		packet, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: uint16(i), Marker: i == len(frame)-1}, Payload: make([]byte, 1200)}).Marshal()
+		if err != nil {
+			b.Fatal(err)
+		}
+		frame[i] = packet
+	}
+	stats := &trackStats{name: "video"}
+	b.SetBytes(int64(len(frame) * len(frame[0])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, packet := range frame {
+			binary.BigEndian.PutUint32(packet[4:], uint32(i))
+			writeRTP(destination, packet, stats)
+		}
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWriteRTP(b, true)
+}
+
+func BenchmarkWriteSingle(b *testing.B) {
+	benchmarkWriteRTP(b, false)
+}
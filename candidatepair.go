@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How many selected pairs a session keeps, the oldest are dropped after this.
+const maxCandidatePairHistory = 100
+
+// candidateEnd - One side of a selected candidate pair as GET /ice returns it.
+type candidateEnd struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+}
+
+func newCandidateEnd(candidate *webrtc.ICECandidate) candidateEnd {
+	return candidateEnd{Type: candidate.Typ.String(), Protocol: candidate.Protocol.String(), Address: candidate.Address, Port: candidate.Port}
+}
+
+// e.g. "relay udp 203.0.113.7:3478".
+func (c candidateEnd) String() string {
+	return fmt.Sprintf("%s %s %s:%d", c.Type, c.Protocol, c.Address, c.Port)
+}
+
+// selectedCandidatePair - A pair ICE selected during the session and when.
+type selectedCandidatePair struct {
+	Time   time.Time    `json:"time"`
+	Local  candidateEnd `json:"local"`
+	Remote candidateEnd `json:"remote"`
+}
+
+// The pairs ICE selected in the current session, oldest first, for GET /ice. UE's connection can move to another pair
+// mid-session, e.g. from host to relay candidates when the direct path breaks, which often explains a quality drop.
+var candidatePairs struct {
+	mu      sync.Mutex
+	history []selectedCandidatePair
+}
+
+// Times the selected pair changed after the first was selected, over all sessions, for StatsD.
+var candidatePairChanges uint64
+
+// Logs and keeps every pair ICE selects for the peer connection, starting the session's history afresh.
+func watchCandidatePairs(peerConnection *webrtc.PeerConnection) {
+	candidatePairs.mu.Lock()
+	candidatePairs.history = nil
+	candidatePairs.mu.Unlock()
+
+	peerConnection.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		selected := selectedCandidatePair{Time: time.Now(), Local: newCandidateEnd(pair.Local), Remote: newCandidateEnd(pair.Remote)}
+
+		candidatePairs.mu.Lock()
+		var previous *selectedCandidatePair
+		if len(candidatePairs.history) > 0 {
+			previous = &candidatePairs.history[len(candidatePairs.history)-1]
+		}
+		if previous == nil {
+			sessionPrintln(fmt.Sprintf("ICE selected candidate pair: local %s, remote %s.", selected.Local, selected.Remote))
+		} else {
+			atomic.AddUint64(&candidatePairChanges, 1)
+			log.Printf("ICE candidate pair changed from local %s, remote %s to local %s, remote %s.", previous.Local, previous.Remote, selected.Local, selected.Remote)
+		}
+		candidatePairs.history = append(candidatePairs.history, selected)
+		if len(candidatePairs.history) > maxCandidatePairHistory {
+			candidatePairs.history = candidatePairs.history[1:]
+		}
+		candidatePairs.mu.Unlock()
+	})
+}
+
+// Returns a copy of the current session's selected pairs, oldest first.
+func candidatePairHistory() []selectedCandidatePair {
+	candidatePairs.mu.Lock()
+	defer candidatePairs.mu.Unlock()
+	return append([]selectedCandidatePair{}, candidatePairs.history...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// The abs-capture-time RTP header extension, see http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time
+const absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+// senderReportClock - Maps a track's RTP timestamps to Unreal Engine's wall clock using the latest RTCP sender report.
+// Updated from the RTCP read loop and used from the forwarding loop.
+type senderReportClock struct {
+	mu      sync.Mutex
+	clock   rtpClock
+	ntpTime uint64
+	rtpTime uint32
+	valid   bool
+}
+
+func newSenderReportClock(clock rtpClock) *senderReportClock {
+	return &senderReportClock{clock: clock}
+}
+
+// Records the NTP/RTP time mapping from a sender report.
+func (c *senderReportClock) update(ntpTime uint64, rtpTime uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ntpTime, c.rtpTime, c.valid = ntpTime, rtpTime, true
+}
+
+// Returns the 64 bit NTP capture time of a packet with the given RTP timestamp, false if we have had no sender report yet.
+func (c *senderReportClock) captureTime(rtpTime uint32) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.valid || c.clock == 0 {
+		return 0, false
+	}
+	// The difference is signed so packets from just before the sender report map correctly too.
+	elapsed := rtpTimestampDiff(c.rtpTime, rtpTime)
+	// UQ32.32 seconds, elapsed/clockRate seconds shifted into the fixed point position.
+	return uint64(int64(c.ntpTime) + elapsed<<32/int64(c.clock)), true
+}
+
+// The 8 byte abs-capture-time extension payload (without the optional clock offset).
+func marshalAbsCaptureTime(ntpTime uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, ntpTime)
+	return b
+}
+
+// The most an added abs-capture-time extension grows a packet by: the extension header, the element's ID/length byte, its payload and padding.
+const rtpMaxAddedHeaderBytes = 4 + 1 + 8 + 3
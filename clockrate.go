@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The RTP clock rates we assume when a codec doesn't carry one, 90kHz for video (RFC 3551) and 48kHz for Opus (RFC 7587).
+const (
+	videoClockRate = 90000
+	audioClockRate = 48000
+)
+
+// rtpClock - The RTP clock rate of a track in Hz. Anything converting between RTP timestamps and time goes through this
+// so e.g. 3000 ticks is a 30fps video frame but 62.5ms of Opus audio.
+type rtpClock uint32
+
+// Returns the RTP clock of a track from its negotiated codec, falling back to the usual rate for its kind.
+func trackClock(track *webrtc.TrackRemote) rtpClock {
+	if clockRate := track.Codec().ClockRate; clockRate != 0 {
+		return rtpClock(clockRate)
+	}
+	clockRate := uint32(audioClockRate)
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		clockRate = videoClockRate
+	}
+	log.Printf("No clock rate negotiated for %s track (%s), assuming %dHz.", track.Kind(), track.Codec().MimeType, clockRate)
+	return rtpClock(clockRate)
+}
+
+// The wall clock duration of a number of RTP timestamp ticks.
+func (c rtpClock) duration(ticks int64) time.Duration {
+	return time.Duration(ticks * int64(time.Second) / int64(c))
+}
+
+// The number of RTP timestamp ticks in a wall clock duration.
+func (c rtpClock) ticks(d time.Duration) int64 {
+	return int64(d) * int64(c) / int64(time.Second)
+}
+
+// The signed number of ticks from one RTP timestamp to another, treating a jump of more than half the timestamp space
+// as wraparound so e.g. a packet from just before a sender report is a small negative difference.
+func rtpTimestampDiff(from uint32, to uint32) int64 {
+	return int64(int32(to - from))
+}
+
+// jitterEstimator - RFC 3550 (section 6.4.1, appendix A.8) interarrival jitter of a track, in the track's clock units.
+type jitterEstimator struct {
+	clock       rtpClock
+	started     bool
+	lastArrival time.Time
+	lastRTPTime uint32
+	jitter      float64
+}
+
+// Updates the estimate with a packet's RTP timestamp and arrival time, returns the current jitter.
+func (j *jitterEstimator) update(rtpTime uint32, arrival time.Time) time.Duration {
+	if j.started {
+		// D(i-1,i), the difference in relative transit time, in RTP ticks.
+		d := float64(j.clock.ticks(arrival.Sub(j.lastArrival)) - rtpTimestampDiff(j.lastRTPTime, rtpTime))
+		if d < 0 {
+			d = -d
+		}
+		j.jitter += (d - j.jitter) / 16
+	}
+	j.started, j.lastArrival, j.lastRTPTime = true, arrival, rtpTime
+	return j.clock.duration(int64(j.jitter))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTPClockConversions(t *testing.T) {
+	tests := []struct {
+		name     string
+		clock    rtpClock
+		ticks    int64
+		duration time.Duration
+	}{
+		{"25fps video frame", videoClockRate, 3600, 40 * time.Millisecond},
+		{"20ms Opus frame", audioClockRate, 960, 20 * time.Millisecond},
+		{"3000 Opus ticks", audioClockRate, 3000, 62500 * time.Microsecond},
+		{"20ms G.722 frame", 8000, 160, 20 * time.Millisecond},
+		{"negative", videoClockRate, -90000, -time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.clock.duration(test.ticks); got != test.duration {
+				t.Errorf("%d ticks at %dHz last %s, want %s", test.ticks, test.clock, got, test.duration)
+			}
+			if got := test.clock.ticks(test.duration); got != test.ticks {
+				t.Errorf("%s at %dHz is %d ticks, want %d", test.duration, test.clock, got, test.ticks)
+			}
+		})
+	}
+}
+
+func TestRTPTimestampDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to uint32
+		want     int64
+	}{
+		{"forwards", 1000, 4000, 3000},
+		{"backwards", 4000, 1000, -3000},
+		{"forwards across wraparound", 0xffffff00, 0x100, 0x200},
+		{"backwards across wraparound", 0x100, 0xffffff00, -0x200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rtpTimestampDiff(test.from, test.to); got != test.want {
+				t.Errorf("diff is %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestJitterEstimatorClocks(t *testing.T) {
+	start := time.Unix(1000, 0)
+	for _, clock := range []rtpClock{videoClockRate, audioClockRate} {
+		// Packets every 20ms, on time...
+		onTime := &jitterEstimator{clock: clock}
+		var jitter time.Duration
+		for i := 0; i < 100; i++ {
+			jitter = onTime.update(uint32(clock.ticks(time.Duration(i)*20*time.Millisecond)), start.Add(time.Duration(i)*20*time.Millisecond))
+		}
+		if jitter != 0 {
+			t.Errorf("%dHz: jitter of packets arriving on time is %s", clock, jitter)
+		}
+
+		// ...and alternately 4ms late, which converges on a jitter of 4ms whatever the clock rate.
+		late := &jitterEstimator{clock: clock}
+		for i := 0; i < 1000; i++ {
+			arrival := start.Add(time.Duration(i) * 20 * time.Millisecond)
+			if i%2 == 1 {
+				arrival = arrival.Add(4 * time.Millisecond)
+			}
+			jitter = late.update(uint32(clock.ticks(time.Duration(i)*20*time.Millisecond)), arrival)
+		}
+		if jitter < 3900*time.Microsecond || jitter > 4100*time.Microsecond {
+			t.Errorf("%dHz: jitter of packets alternately 4ms late is %s, want about 4ms", clock, jitter)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// errCodecFallback - The session was ended so a new one can negotiate the video with the fallback codec.
+var errCodecFallback = errors.New("switching the video codec")
+
+// codecFallback - The video codec the receiver couldn't decode is swapped for the other of H264 and VP8 by replacing the
+// session, as the offer/answer of a new one is the only point where we can change which codecs we accept. The codec
+// set here sticks for the sessions after the switch too, until another fallback switches it back.
+var codecFallback struct {
+	mu sync.Mutex
+	// The video codec the current session negotiated, empty until its video track arrives.
+	negotiated string
+	// The only video codec we accept, or empty to accept Pion's defaults.
+	only string
+	// Ends the current session, nil between sessions.
+	endSession func()
+}
+
+// Notes the video codec the current session negotiated, the one a fallback switches away from.
+func noteVideoCodec(mimeType string) {
+	codecFallback.mu.Lock()
+	defer codecFallback.mu.Unlock()
+	codecFallback.negotiated = mimeType
+}
+
+// Sets how the current session is ended for a fallback, nil once it has ended.
+func setCodecFallbackEnder(endSession func()) {
+	codecFallback.mu.Lock()
+	defer codecFallback.mu.Unlock()
+	codecFallback.endSession = endSession
+	if endSession == nil {
+		codecFallback.negotiated = ""
+	}
+}
+
+// Switches the video to the other of H264 and VP8 and ends the current session so a new one negotiates it, returning
+// the codec switched to.
+func requestCodecFallback() (string, error) {
+	codecFallback.mu.Lock()
+	defer codecFallback.mu.Unlock()
+	if codecFallback.endSession == nil || codecFallback.negotiated == "" {
+		return "", errors.New("no video track is being forwarded")
+	}
+	next := webrtc.MimeTypeH264
+	if strings.EqualFold(codecFallback.negotiated, webrtc.MimeTypeH264) {
+		next = webrtc.MimeTypeVP8
+	}
+	codecFallback.only = next
+	codecFallback.endSession()
+	codecFallback.endSession = nil
+	return next, nil
+}
+
+// The video codec all sessions are restricted to after a fallback, or empty.
+func fallbackVideoCodec() string {
+	codecFallback.mu.Lock()
+	defer codecFallback.mu.Unlock()
+	return codecFallback.only
+}
+
+// Registers the codecs we accept from UE, Pion's defaults unless a fallback restricted the video to one codec. The
+// restricted set keeps Pion's audio codecs and its parameters for the video codec.
+func registerCodecs(m *webrtc.MediaEngine) error {
+	only := fallbackVideoCodec()
+	if only == "" {
+		return m.RegisterDefaultCodecs()
+	}
+
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, PayloadType: 111},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return err
+		}
+	}
+
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	video := []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: feedback}, PayloadType: 96},
+	}
+	if strings.EqualFold(only, webrtc.MimeTypeH264) {
+		video = nil
+		for _, h264 := range []struct {
+			profileLevelID string
+			payloadType    webrtc.PayloadType
+		}{{"42001f", 102}, {"42e01f", 125}, {"640032", 123}} {
+			fmtp := fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s", h264.profileLevelID)
+			video = append(video, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: feedback},
+				PayloadType:        h264.payloadType,
+			})
+		}
+	}
+	for _, codec := range video {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+
+	for _, kind := range bothKinds {
+		for _, extension := range []string{
+			"urn:ietf:params:rtp-hdrext:sdes:mid",
+			"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+			"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+		} {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, kind); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// hintedStream - What a receiver needs to know about one forwarded track to play it.
+type hintedStream struct {
+	kind        webrtc.RTPCodecType
+	address     string
+	port        int
+	payloadType uint8
+	codec       webrtc.RTPCodecParameters
+}
+
+func newHintedStream(destination *udpConn, track *webrtc.TrackRemote) hintedStream {
+	return hintedStream{
+		kind:        track.Kind(),
+		address:     destination.address,
+		port:        destination.port,
+		payloadType: destination.payloadType,
+		codec:       track.Codec(),
+	}
+}
+
+// commandHints - Collects the streams we forward as UE's tracks arrive, and each time writes an SDP describing them
+// and logs an FFplay/FFmpeg command line that plays them from it.
+type commandHints struct {
+	mu      sync.Mutex
+	streams map[string]hintedStream
+}
+
+func newCommandHints() *commandHints {
+	return &commandHints{streams: make(map[string]hintedStream)}
+}
+
+// Adds the named track's stream (as sent to its first destination) and refreshes the SDP and command hint.
+func (h *commandHints) add(name string, destination *udpConn, track *webrtc.TrackRemote) {
+	if *CommandHint == "none" {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.streams[name] = newHintedStream(destination, track)
+
+	names := make([]string, 0, len(h.streams))
+	for n := range h.streams {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	streams := make([]hintedStream, 0, len(names))
+	for _, n := range names {
+		streams = append(streams, h.streams[n])
+	}
+
+	if err := ioutil.WriteFile(*CommandHintSDPFile, []byte(negotiatedSDP(streams)), 0644); err != nil {
+		log.Printf("Error writing SDP for the command hint. Error: %s", err.Error())
+		return
+	}
+	command := hintCommand(*CommandHint, *CommandHintSDPFile)
+	sessionPrintln(fmt.Sprintf("To play the forwarded streams run: %s", command))
+	if *CommandHintFile != "" {
+		if err := ioutil.WriteFile(*CommandHintFile, []byte(command+"\n"), 0644); err != nil {
+			log.Printf("Error writing command hint file. Error: %s", err.Error())
+		}
+	}
+}
+
+// An SDP describing the forwarded streams for a receiver, like rtp-forwarder.sdp but from the negotiated codecs and
+// the ports, payload types and options we actually forward with.
+func negotiatedSDP(streams []hintedStream) string {
+	address := "127.0.0.1"
+	if len(streams) > 0 {
+		address = streams[0].address
+	}
+	// A multicast group's connection address carries its TTL (RFC 4566 section 5.7), receivers join the group from it.
+	connection := address
+	if *ForwardingMulticast {
+		connection = fmt.Sprintf("%s/%d", address, *MulticastTTL)
+	}
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- 0 0 IN IP4 %s", address),
+		"s=Pion WebRTC",
+		fmt.Sprintf("c=IN IP4 %s", connection),
+		"t=0 0",
+	}
+	for _, stream := range streams {
+		lines = append(lines, fmt.Sprintf("m=%s %d RTP/AVP %d", stream.kind, stream.port, stream.payloadType))
+		lines = append(lines, codecSDPLines(stream)...)
+		if *ForwardRTCP && *ForwardRTCPMux {
+			lines = append(lines, "a=rtcp-mux")
+		}
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// The rtpmap, fmtp and extmap lines describing how a forwarded stream is encoded, shared by every SDP we generate.
+func codecSDPLines(stream hintedStream) []string {
+	// e.g. opus/48000/2 or H264/90000, FFmpeg matches the encoding names case insensitively.
+	codecName := strings.TrimPrefix(strings.TrimPrefix(stream.codec.MimeType, "video/"), "audio/")
+	rtpmap := fmt.Sprintf("a=rtpmap:%d %s/%d", stream.payloadType, codecName, stream.codec.ClockRate)
+	if stream.codec.Channels > 0 {
+		rtpmap += fmt.Sprintf("/%d", stream.codec.Channels)
+	}
+	lines := []string{rtpmap}
+	if stream.codec.SDPFmtpLine != "" {
+		lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", stream.payloadType, stream.codec.SDPFmtpLine))
+	}
+	if *AttachCaptureTime {
+		lines = append(lines, fmt.Sprintf("a=extmap:%d %s", *CaptureTimeExtensionID, absCaptureTimeURI))
+	}
+	return lines
+}
+
+// The command line that plays (ffplay) or records (ffmpeg) the streams described by the SDP file.
+func hintCommand(tool string, sdpPath string) string {
+	if strings.ContainsAny(sdpPath, " \t") {
+		sdpPath = fmt.Sprintf("%q", sdpPath)
+	}
+	if tool == "ffmpeg" {
+		return fmt.Sprintf("ffmpeg -protocol_whitelist file,udp,rtp -fflags nobuffer -i %s -c copy ue-stream.mkv", sdpPath)
+	}
+	return fmt.Sprintf("ffplay -fflags nobuffer -flags low_delay -protocol_whitelist file,udp,rtp -i %s", sdpPath)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// subcommand - One mode of the program, e.g. "run" or "record", with the flags that make sense for it.
+type subcommand struct {
+	name    string
+	summary string
+	// The names of the package level flags this subcommand accepts, ignored if allFlags is set.
+	sharedFlags []string
+	allFlags    bool
+	// Registers the subcommand's own flags and returns the function that runs it once the flags are parsed.
+	setup func(fs *flag.FlagSet) func()
+}
+
+// The package level flags every mode that talks to Cirrus and UE needs.
+var sessionFlags = []string{
+	"CirrusAddress", "CirrusPort", "CirrusTLS", "CirrusClientCert", "CirrusClientKey", "InitiateOffer",
+	"WSMaxMessageBytes", "ICELite", "DisableTrickle", "ICEGatheringTimeoutMs", "WSPingIntervalMs", "Reconnect",
+	"ReconnectDelayMs", "ReconnectMaxDelayMs", "OnPeerFailed", "RespondToPing", "StrictSignalling",
+	"StrictSignallingDisconnect", "RTCPIntervalMs", "RTCPSendPLI", "RTCPSendREMB", "REMB", "RTCPMeasureRTT",
+	"RTCPAppKeepalive", "RTCPAppName", "RTCPAppSubtype", "StatsIntervalMs", "PprofPort", "PanicBehavior",
+	"ReconnectJitter", "SessionID", "EnableExtension", "MaxSessionDurationMs", "ControlPort", "SaveOfferPath",
+	"SaveAnswerPath", "LogSignallingRTT", "AnswerDirection", "NDJSONSignalling", "ForceDTLSRole", "StatsDAddress",
+	"StatsDPrefix", "WaitForConfig", "CirrusOrigin", "RTCPVideoIntervalMs", "RTCPAudioIntervalMs", "ValidateMessages",
+	"MaxSignallingErrors", "EchoAnswer", "MaxSDPBytes", "NegotiationRetries", "NegotiationRetryDelayMs",
+	"ExpectedFingerprint", "REMBRampMs", "REMBRampStart", "SDPTransformCommand", "SDPTransformTimeoutMs", "Interface",
+	"ExtensionID", "MaxWSWriteErrors", "ICEUfrag", "ICEPwd",
+}
+
+// The package level flags that describe the forwarded RTP streams.
+var streamFlags = []string{
+	"RTPVideoForwardingPort", "RTPAudioForwardingPort", "RTPVideoPayloadType", "RTPAudioPayloadType",
+}
+
+var subcommands = []*subcommand{
+	{
+		name:     "run",
+		summary:  "Connect to Cirrus and forward UE's streams over RTP, the default when no subcommand is given.",
+		allFlags: true,
+		setup: func(fs *flag.FlagSet) func() {
+			return func() { runSessions(setupMediaForwarding) }
+		},
+	},
+	{
+		name:        "record",
+		summary:     "Connect to Cirrus and record UE's streams to H264 and Ogg/Opus files instead of forwarding them.",
+		sharedFlags: sessionFlags,
+		setup:       setupRecordCommand,
+	},
+	{
+		name:        "probe",
+		summary:     "Connect to Cirrus, negotiate with UE and print the codecs, extensions and tracks it offers, without forwarding.",
+		sharedFlags: sessionFlags,
+		setup:       setupProbeCommand,
+	},
+	{
+		name:        "selftest",
+		summary:     "Stream test media through the forwarder from an in-process WebRTC peer and check it arrives on the RTP ports.",
+		sharedFlags: append(append([]string{}, streamFlags...), "VideoSSRC", "AudioSSRC", "PanicBehavior"),
+		setup:       setupSelftestCommand,
+	},
+	{
+		name:    "listcodecs",
+		summary: "List the codecs the bridge offers to UE.",
+		setup: func(fs *flag.FlagSet) func() {
+			return listCodecs
+		},
+	},
+	{
+		name:        "checksdp",
+		summary:     "Check an SDP file for the receiver (e.g. rtp-forwarder.sdp) matches the forwarded streams.",
+		sharedFlags: append(append([]string{}, streamFlags...), "ForwardRTCP", "ForwardRTCPMux"),
+		setup:       setupCheckSDPCommand,
+	},
+}
+
+func findSubcommand(name string) *subcommand {
+	for _, cmd := range subcommands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printSubcommands() {
+	fmt.Fprintf(os.Stderr, "\nSubcommands:\n")
+	for _, cmd := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", cmd.name, cmd.summary)
+	}
+}
+
+// Creates the flag set for the subcommand, holding just the package level flags it accepts so the others are rejected.
+func (c *subcommand) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if c.allFlags || containsString(c.sharedFlags, f.Name) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n\n%s\n\nFlags:\n", os.Args[0], c.name, c.summary)
+		fs.PrintDefaults()
+		if c.name == "run" {
+			printSubcommands()
+		}
+	}
+	return fs
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints the codecs and payload types of the offer the bridge would send UE.
+func listCodecs() {
+	peerConnection, err := createPeerConnection(nil)
+	if err != nil {
+		exitWithError(withExitCode(exitPeerConnection, fmt.Errorf("error creating peer connection: %w", err)))
+	}
+	defer peerConnection.Close()
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		exitWithError(fmt.Errorf("error creating offer: %w", err))
+	}
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		exitWithError(fmt.Errorf("error parsing offer: %w", err))
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		fmt.Println(fmt.Sprintf("%s:", media.MediaName.Media))
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.Atoi(format)
+			if err != nil {
+				continue
+			}
+			codec, err := parsed.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+			line := fmt.Sprintf("  %3d %s/%d", payloadType, codec.Name, codec.ClockRate)
+			if codec.EncodingParameters != "" {
+				line += "/" + codec.EncodingParameters
+			}
+			if codec.Fmtp != "" {
+				line += " " + codec.Fmtp
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+func setupCheckSDPCommand(fs *flag.FlagSet) func() {
+	sdpFile := fs.String("SDPFile", "rtp-forwarder.sdp", "The SDP file to check.")
+	return func() {
+		problems, err := checkSDPFile(*sdpFile)
+		if err != nil {
+			exitWithError(err)
+		}
+		if len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			exitWithError(fmt.Errorf("%s does not match the forwarded streams", *sdpFile))
+		}
+		fmt.Println(fmt.Sprintf("%s matches the forwarded streams.", *sdpFile))
+	}
+}
+
+// Returns what doesn't match between the SDP file and the streams the flags say we forward.
+func checkSDPFile(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SDP file: %w", err)
+	}
+	// Hand written SDP files often lack the final line ending, which the SDP parser needs.
+	if !strings.HasSuffix(string(contents), "\n") {
+		contents = append(contents, '\n')
+	}
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal(contents); err != nil {
+		return nil, fmt.Errorf("error parsing SDP file: %w", err)
+	}
+
+	var problems []string
+	check := func(kind webrtc.RTPCodecType, port int, payloadType uint, codecName string) {
+		var media *sdp.MediaDescription
+		for _, m := range parsed.MediaDescriptions {
+			if m.MediaName.Media == kind.String() {
+				media = m
+				break
+			}
+		}
+		if media == nil {
+			problems = append(problems, fmt.Sprintf("No %s media section.", kind))
+			return
+		}
+		if media.MediaName.Port.Value != port {
+			problems = append(problems, fmt.Sprintf("The %s port is %d but we forward to %d.", kind, media.MediaName.Port.Value, port))
+		}
+		if !containsString(media.MediaName.Formats, strconv.Itoa(int(payloadType))) {
+			problems = append(problems, fmt.Sprintf("The %s media section does not list payload type %d.", kind, payloadType))
+		} else if codec, err := parsed.GetCodecForPayloadType(uint8(payloadType)); err != nil {
+			problems = append(problems, fmt.Sprintf("No rtpmap for %s payload type %d.", kind, payloadType))
+		} else if !strings.EqualFold(codec.Name, codecName) {
+			problems = append(problems, fmt.Sprintf("The %s payload type %d is mapped to %s, UE sends %s.", kind, payloadType, codec.Name, codecName))
+		}
+		if _, rtcpMux := media.Attribute("rtcp-mux"); rtcpMux != (*ForwardRTCP && *ForwardRTCPMux) {
+			if rtcpMux {
+				problems = append(problems, fmt.Sprintf("The %s media section has a=rtcp-mux but we are not forwarding RTCP with -ForwardRTCPMux.", kind))
+			} else {
+				problems = append(problems, fmt.Sprintf("The %s media section needs a=rtcp-mux for -ForwardRTCPMux.", kind))
+			}
+		}
+	}
+	check(webrtc.RTPCodecTypeVideo, *RTPVideoForwardingPort, *RTPVideoPayloadType, "H264")
+	check(webrtc.RTPCodecTypeAudio, *RTPAudioForwardingPort, *RTPAudioPayloadType, "OPUS")
+	return problems, nil
+}
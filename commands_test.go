@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSessionFlagsICECredentials(t *testing.T) {
+	for _, name := range []string{"record", "probe"} {
+		t.Run(name, func(t *testing.T) {
+			// Restored when the test ends, set below through the subcommand's flags.
+			setFlag(t, "ICEUfrag", "")
+			setFlag(t, "ICEPwd", "")
+			ufrag, pwd := "testufrag", "testpasswordtestpassword"
+			if err := findSubcommand(name).flagSet().Parse([]string{"-ICEUfrag", ufrag, "-ICEPwd", pwd}); err != nil {
+				t.Fatalf("%s doesn't take the ICE credentials: %s", name, err)
+			}
+
+			bridge, err := createPeerConnection(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { bridge.Close() })
+			ue := newTestUE(t)
+			addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+			offer, err := ue.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ue.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			if err = bridge.SetRemoteDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			sent, err := createAnswer(bridge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var answer webrtc.SessionDescription
+			if err = json.Unmarshal([]byte(sent), &answer); err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range []string{"a=ice-ufrag:" + ufrag + "\r\n", "a=ice-pwd:" + pwd + "\r\n"} {
+				if !strings.Contains(answer.SDP, line) {
+					t.Errorf("answer has no %q", strings.TrimSpace(line))
+				}
+			}
+		})
+	}
+}
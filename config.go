@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// cirrusConfig - Cirrus' config message, sent when we connect, with the options its players create their peer
+// connections with.
+type cirrusConfig struct {
+	PeerConnectionOptions *peerConnectionOptions `json:"peerConnectionOptions"`
+}
+
+// peerConnectionOptions - The RTCConfiguration from Cirrus' config message, as a browser player would get it.
+type peerConnectionOptions struct {
+	ICEServers         []cirrusICEServer `json:"iceServers"`
+	BundlePolicy       string            `json:"bundlePolicy"`
+	RTCPMuxPolicy      string            `json:"rtcpMuxPolicy"`
+	ICETransportPolicy string            `json:"iceTransportPolicy"`
+}
+
+// cirrusICEServer - An RTCIceServer, whose urls can be a single URL or a list of them.
+type cirrusICEServer struct {
+	URLs       json.RawMessage `json:"urls"`
+	Username   string          `json:"username"`
+	Credential string          `json:"credential"`
+}
+
+// Parses the peerConnectionOptions out of a config message, nil if it has none.
+func parseCirrusConfig(message []byte) (*peerConnectionOptions, error) {
+	var config cirrusConfig
+	if err := json.Unmarshal(message, &config); err != nil {
+		return nil, err
+	}
+	return config.PeerConnectionOptions, nil
+}
+
+// Applies the options to the configuration we create our peer connection with, returning what was applied for the
+// logs. An option Pion doesn't know is an error, rather than creating a peer connection the signalling server didn't
+// ask for.
+func (o *peerConnectionOptions) apply(config *webrtc.Configuration) ([]string, error) {
+	var applied []string
+	for _, server := range o.ICEServers {
+		urls, err := server.urls()
+		if err != nil {
+			return nil, err
+		}
+		iceServer := webrtc.ICEServer{URLs: urls, Username: server.Username}
+		if server.Credential != "" {
+			iceServer.Credential = server.Credential
+		}
+		config.ICEServers = append(config.ICEServers, iceServer)
+		applied = append(applied, fmt.Sprintf("iceServers=%s", strings.Join(urls, ",")))
+	}
+	if o.BundlePolicy != "" {
+		if err := unmarshalPolicy(o.BundlePolicy, &config.BundlePolicy); err != nil || config.BundlePolicy == 0 {
+			return nil, fmt.Errorf("unknown bundlePolicy %q", o.BundlePolicy)
+		}
+		applied = append(applied, fmt.Sprintf("bundlePolicy=%s", config.BundlePolicy))
+	}
+	if o.RTCPMuxPolicy != "" {
+		if err := unmarshalPolicy(o.RTCPMuxPolicy, &config.RTCPMuxPolicy); err != nil || config.RTCPMuxPolicy == 0 {
+			return nil, fmt.Errorf("unknown rtcpMuxPolicy %q", o.RTCPMuxPolicy)
+		}
+		applied = append(applied, fmt.Sprintf("rtcpMuxPolicy=%s", config.RTCPMuxPolicy))
+	}
+	if o.ICETransportPolicy != "" {
+		if err := unmarshalPolicy(o.ICETransportPolicy, &config.ICETransportPolicy); err != nil || config.ICETransportPolicy == 0 {
+			return nil, fmt.Errorf("unknown iceTransportPolicy %q", o.ICETransportPolicy)
+		}
+		applied = append(applied, fmt.Sprintf("iceTransportPolicy=%s", config.ICETransportPolicy))
+	}
+	return applied, nil
+}
+
+func (s cirrusICEServer) urls() ([]string, error) {
+	var url string
+	if err := json.Unmarshal(s.URLs, &url); err == nil {
+		return []string{url}, nil
+	}
+	var urls []string
+	if err := json.Unmarshal(s.URLs, &urls); err != nil {
+		return nil, fmt.Errorf("ICE server urls %s are not a URL or a list of them", string(s.URLs))
+	}
+	return urls, nil
+}
+
+// Pion's policies unmarshal from their RTCConfiguration names, e.g. "max-bundle", and are 0 for a name they don't know.
+func unmarshalPolicy(name string, policy json.Unmarshaler) error {
+	quoted, err := json.Marshal(name)
+	if err != nil {
+		return err
+	}
+	return policy.UnmarshalJSON(quoted)
+}
+
+// replayConn - A signalling connection that hands out messages read ahead of the control loop before reading more,
+// so nothing Cirrus sent while we waited for its config is lost.
+type replayConn struct {
+	signallingConn
+	queued []queuedMessage
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+func (c *replayConn) NextReader() (int, io.Reader, error) {
+	if len(c.queued) > 0 {
+		message := c.queued[0]
+		c.queued = c.queued[1:]
+		return message.messageType, bytes.NewReader(message.data), nil
+	}
+	return c.signallingConn.NextReader()
+}
+
+// Reads from Cirrus until its config message arrives, for WaitForConfig, returning the options it carries and the
+// connection the control loop should read from, which replays the messages that came before the config.
+func waitForConfig(conn signallingConn) (*peerConnectionOptions, signallingConn, error) {
+	replay := &replayConn{signallingConn: conn}
+	for {
+		messageType, message, err := readLimitedMessage(conn, int64(*WSMaxMessageBytes))
+		if tooBig, ok := err.(*messageTooBigError); ok {
+			log.Printf("Skipping websocket message: %s", tooBig.Error())
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("waiting for config: %w", err)
+		}
+		var typed struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(message, &typed) != nil || typed.Type != "config" {
+			replay.queued = append(replay.queued, queuedMessage{messageType, message})
+			continue
+		}
+		options, err := parseCirrusConfig(message)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing config: %w", err)
+		}
+		return options, replay, nil
+	}
+}
+
+// Handles a config message in the control loop. With WaitForConfig its options were applied before the peer connection
+// was created, otherwise the peer connection already exists and we can only say what we didn't apply. Returns an error
+// if the message doesn't unmarshal.
+func handleConfig(message []byte) error {
+	if *WaitForConfig {
+		sessionPrintln("Got another config message, the peer connection keeps the options of the first.")
+		return nil
+	}
+	options, err := parseCirrusConfig(message)
+	if err != nil {
+		log.Printf("Error parsing config message. Error: %s", err.Error())
+		return err
+	}
+	if options == nil {
+		sessionPrintln("Got config message without peerConnectionOptions.")
+		return nil
+	}
+	sessionPrintln("Got config message with peerConnectionOptions, set -WaitForConfig to create the peer connection with them.")
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errConfigChanged - The session was ended so a new one forwards with the configuration ConfigWatchURL changed to.
+var errConfigChanged = errors.New("the watched forwarding configuration changed")
+
+// How long to wait before watching again after the config source failed, e.g. while Consul or etcd restarts.
+const configWatchRetryDelay = 5 * time.Second
+
+// The flags a watched configuration may change, the ones deciding where and how the tracks are forwarded. They are
+// only read when a session sets up its tracks, so a new session picks up the new values.
+var watchedConfigFlags = []string{
+	"ForwardingAddress", "RTPVideoForwardingPort", "RTPAudioForwardingPort", "RTPVideoPayloadType",
+	"RTPAudioPayloadType", "VideoSSRC", "AudioSSRC", "ReceiverCount", "ReceiverPortStride", "ReceiverPorts", "RouteScript",
+}
+
+// configSource - Where ConfigWatchURL's key lives, e.g. Consul or etcd.
+type configSource interface {
+	// Blocks until the key's value differs from the one at index, 0 returning the current value straight away. Returns
+	// the value, nil if the key doesn't exist, and the index to wait on for the next change. A source may also return
+	// after a while with its index unchanged, e.g. when a Consul blocking query times out.
+	next(index uint64) ([]byte, uint64, error)
+}
+
+// Creates the source for a ConfigWatchURL, consul://host:port/key or etcd://host:port/key.
+func newConfigSource(watchURL string) (configSource, error) {
+	parsed, err := url.Parse(watchURL)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(parsed.Path, "/")
+	if parsed.Host == "" || key == "" {
+		return nil, fmt.Errorf("%q has no host or key, expected consul://host:port/key or etcd://host:port/key", watchURL)
+	}
+	switch parsed.Scheme {
+	case "consul":
+		return &consulSource{base: "http://" + parsed.Host, key: key}, nil
+	case "etcd":
+		return &etcdSource{base: "http://" + parsed.Host, key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %q, expected consul or etcd", parsed.Scheme)
+}
+
+// consulSource - A key in Consul's KV store, watched with blocking queries.
+type consulSource struct {
+	base string
+	key  string
+}
+
+// Longer than the wait Consul is asked for, so only a dead connection times out.
+var configWatchClient = &http.Client{Timeout: 6 * time.Minute}
+
+func (c *consulSource) next(index uint64) ([]byte, uint64, error) {
+	response, err := configWatchClient.Get(fmt.Sprintf("%s/v1/kv/%s?raw=true&wait=5m&index=%d", c.base, c.key, index))
+	if err != nil {
+		return nil, index, err
+	}
+	defer response.Body.Close()
+	value, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, index, err
+	}
+	next, err := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, index, fmt.Errorf("Consul's answer has no X-Consul-Index")
+	}
+	// Consul's index can go backwards, e.g. after a restore, then the wait has to start over.
+	if next < index {
+		next = 0
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return value, next, nil
+	case http.StatusNotFound:
+		return nil, next, nil
+	}
+	return nil, index, fmt.Errorf("Consul answered %s: %s", response.Status, strings.TrimSpace(string(value)))
+}
+
+// etcdSource - A key in etcd v3, read and watched through its JSON gateway.
+type etcdSource struct {
+	base string
+	key  string
+}
+
+// etcdKeyValue - A key's value as etcd's JSON gateway writes it, bytes in base64 and 64-bit numbers as strings.
+type etcdKeyValue struct {
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+func (e *etcdSource) post(path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := configWatchClient.Post(e.base+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, fmt.Errorf("etcd answered %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+func (e *etcdSource) next(index uint64) ([]byte, uint64, error) {
+	key := base64.StdEncoding.EncodeToString([]byte(e.key))
+	if index == 0 {
+		response, err := e.post("/v3/kv/range", map[string]string{"key": key})
+		if err != nil {
+			return nil, index, err
+		}
+		defer response.Body.Close()
+		var result struct {
+			Header struct {
+				Revision string `json:"revision"`
+			} `json:"header"`
+			KVs []etcdKeyValue `json:"kvs"`
+		}
+		if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+			return nil, index, err
+		}
+		revision, err := strconv.ParseUint(result.Header.Revision, 10, 64)
+		if err != nil {
+			return nil, index, fmt.Errorf("etcd's answer has no revision")
+		}
+		if len(result.KVs) == 0 {
+			return nil, revision, nil
+		}
+		value, err := base64.StdEncoding.DecodeString(result.KVs[0].Value)
+		return value, revision, err
+	}
+
+	// The watch streams a result per batch of changes, starting with one saying it was created.
+	response, err := e.post("/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{"key": key, "start_revision": strconv.FormatUint(index+1, 10)},
+	})
+	if err != nil {
+		return nil, index, err
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Result struct {
+				Events []struct {
+					Type string       `json:"type"`
+					KV   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+		}
+		if err = decoder.Decode(&message); err == io.EOF {
+			return nil, index, errors.New("etcd ended the watch")
+		} else if err != nil {
+			return nil, index, err
+		}
+		events := message.Result.Events
+		if len(events) == 0 {
+			continue
+		}
+		last := events[len(events)-1]
+		revision, err := strconv.ParseUint(last.KV.ModRevision, 10, 64)
+		if err != nil {
+			return nil, index, fmt.Errorf("etcd's event has no revision")
+		}
+		if last.Type == "DELETE" {
+			return nil, revision, nil
+		}
+		value, err := base64.StdEncoding.DecodeString(last.KV.Value)
+		return value, revision, err
+	}
+}
+
+// Parses a watched configuration, a JSON object of flag names and values such as
+//
+//	{"ForwardingAddress": "10.0.0.5", "RTPVideoForwardingPort": 5002}
+//
+// into the values to set, as flag.Set takes them. Only watchedConfigFlags may be set, flags the object leaves out keep
+// their current value.
+func parseWatchedConfig(value []byte) (map[string]string, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %w", err)
+	}
+	config := map[string]string{}
+	for name, raw := range object {
+		allowed := false
+		for _, watched := range watchedConfigFlags {
+			allowed = allowed || watched == name
+		}
+		if !allowed {
+			return nil, fmt.Errorf("%s can't be changed, only %s", name, strings.Join(watchedConfigFlags, ", "))
+		}
+		setting := string(raw)
+		var text string
+		if json.Unmarshal(raw, &text) == nil {
+			setting = text
+		}
+		if err := checkWatchedSetting(name, setting); err != nil {
+			return nil, err
+		}
+		config[name] = setting
+	}
+	if err := checkWatchedReceivers(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Checks ReceiverPorts as validateFlags does, with the flags as the config would set them: the ones it leaves out
+// keep their current value.
+func checkWatchedReceivers(config map[string]string) error {
+	setting := func(name string) string {
+		if value, ok := config[name]; ok {
+			return value
+		}
+		return flag.Lookup(name).Value.String()
+	}
+	number := func(name string) int {
+		// Already checked by checkWatchedSetting, or the flag's own value.
+		n, _ := strconv.Atoi(setting(name))
+		return n
+	}
+	receiverPorts := setting("ReceiverPorts")
+	if receiverPorts == "" {
+		return nil
+	}
+	if number("ReceiverCount") != 1 {
+		return fmt.Errorf("invalid ReceiverPorts %q: it gives the number of receivers, ReceiverCount must be 1", receiverPorts)
+	}
+	ports := forwardingPortsFor(number("RTPAudioForwardingPort"), number("RTPVideoForwardingPort"))
+	if _, _, err := receiverBlockFor(receiverPorts, 1, number("ReceiverPortStride"), ports); err != nil {
+		return fmt.Errorf("invalid ReceiverPorts %q: %w", receiverPorts, err)
+	}
+	return nil
+}
+
+// Checks a setting would be accepted by its flag and by validateFlags, which only runs at startup. Settings that
+// depend on others, such as ReceiverPorts, are checked together by checkWatchedReceivers.
+func checkWatchedSetting(name string, setting string) error {
+	var err error
+	switch value := flag.Lookup(name).Value.(flag.Getter).Get().(type) {
+	case string:
+		if name == "RouteScript" && setting != "" {
+			_, err = parseRouteScript(setting)
+		} else if name == "ForwardingAddress" && setting == "" {
+			err = errors.New("empty")
+		}
+	case int:
+		var number int
+		if number, err = strconv.Atoi(setting); err == nil {
+			if strings.HasSuffix(name, "Port") && (number < 1 || number > 65535) {
+				err = errors.New("must be 1 to 65535")
+			} else if number < 1 {
+				err = errors.New("must be 1 or more")
+			}
+		}
+	case uint:
+		var number uint64
+		if number, err = strconv.ParseUint(setting, 10, 32); err == nil && strings.HasSuffix(name, "PayloadType") && number > 127 {
+			err = errors.New("must be 0 to 127")
+		}
+	default:
+		err = fmt.Errorf("unsupported flag type %T", value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, setting, err)
+	}
+	return nil
+}
+
+// The configuration waiting to be applied when the next session starts, and how to end the current one.
+var configWatch struct {
+	mu      sync.Mutex
+	pending map[string]string
+	// Ends the current session, nil between sessions.
+	endSession func()
+}
+
+// Sets how the current session is ended for a configuration change, nil once it has ended.
+func setConfigChangeEnder(endSession func()) {
+	configWatch.mu.Lock()
+	defer configWatch.mu.Unlock()
+	configWatch.endSession = endSession
+}
+
+// Sets the pending configuration as the flags, between sessions so nothing is reading them.
+func applyWatchedConfig() {
+	configWatch.mu.Lock()
+	defer configWatch.mu.Unlock()
+	pending := configWatch.pending
+	configWatch.pending = nil
+
+	var applied []string
+	for name, setting := range pending {
+		if flag.Lookup(name).Value.String() == setting {
+			continue
+		}
+		// Already checked by parseWatchedConfig.
+		flag.Set(name, setting)
+		applied = append(applied, fmt.Sprintf("-%s=%s", name, setting))
+	}
+	if len(applied) > 0 {
+		sort.Strings(applied)
+		log.Printf("Applied the forwarding configuration from -ConfigWatchURL: %s", strings.Join(applied, " "))
+	}
+}
+
+// Reads the key's current value, applying it before the first session, then watches it for changes until the process
+// exits. A change that would forward differently ends the current session, the new one forwards with it.
+func startConfigWatch(source configSource) {
+	value, index, err := source.next(0)
+	if err != nil {
+		log.Printf("Error reading the forwarding configuration from -ConfigWatchURL, starting with the flags as given. Error: %s", err.Error())
+	} else {
+		queueWatchedConfig(value)
+		applyWatchedConfig()
+	}
+
+	go func() {
+		for {
+			value, next, err := source.next(index)
+			if err != nil {
+				log.Printf("Error watching -ConfigWatchURL, trying again in %s. Error: %s", configWatchRetryDelay, err.Error())
+				time.Sleep(configWatchRetryDelay)
+				continue
+			}
+			if next == index {
+				continue
+			}
+			index = next
+			if queueWatchedConfig(value) {
+				configWatch.mu.Lock()
+				if configWatch.endSession != nil {
+					log.Println("The forwarding configuration from -ConfigWatchURL changed, starting a new session with it.")
+					configWatch.endSession()
+					configWatch.endSession = nil
+				}
+				configWatch.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Parses a value of the watched key and queues what it changes for the next session, returning whether it changes
+// anything. A value that doesn't parse is logged and ignored, as is a deleted key: the flags keep what they were set to.
+func queueWatchedConfig(value []byte) bool {
+	if value == nil {
+		log.Println("The -ConfigWatchURL key doesn't exist, keeping the current forwarding configuration.")
+		return false
+	}
+	config, err := parseWatchedConfig(value)
+	if err != nil {
+		log.Printf("Error in the forwarding configuration from -ConfigWatchURL, keeping the current one. Error: %s", err.Error())
+		return false
+	}
+
+	configWatch.mu.Lock()
+	defer configWatch.mu.Unlock()
+	changed := false
+	for name, setting := range config {
+		if flag.Lookup(name).Value.String() != setting {
+			changed = true
+		}
+	}
+	configWatch.pending = config
+	return changed
+}
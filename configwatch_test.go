@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWatchedConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		// Flags set before parsing, as name=value.
+		flags []string
+		want  map[string]string
+		err   string
+	}{
+		{"strings and numbers", `{"ForwardingAddress": "10.0.0.5", "RTPVideoForwardingPort": 5002, "RTPVideoPayloadType": 96}`, nil,
+			map[string]string{"ForwardingAddress": "10.0.0.5", "RTPVideoForwardingPort": "5002", "RTPVideoPayloadType": "96"}, ""},
+		{"empty object", `{}`, nil, map[string]string{}, ""},
+		{"not an object", `["ForwardingAddress"]`, nil, nil, "not a JSON object"},
+		{"flag that can't be watched", `{"DisableTrickle": true}`, nil, nil, "DisableTrickle can't be changed"},
+		{"empty address", `{"ForwardingAddress": ""}`, nil, nil, "invalid ForwardingAddress"},
+		{"port out of range", `{"RTPAudioForwardingPort": 70000}`, nil, nil, "must be 1 to 65535"},
+		{"port not a number", `{"RTPAudioForwardingPort": "audio"}`, nil, nil, "invalid RTPAudioForwardingPort"},
+		{"payload type out of range", `{"RTPVideoPayloadType": 128}`, nil, nil, "must be 0 to 127"},
+		{"receiver count", `{"ReceiverCount": 0}`, nil, nil, "must be 1 or more"},
+		{"route script", `{"RouteScript": "nonsense"}`, nil, nil, "invalid RouteScript"},
+		{"receiver ports", `{"ReceiverPorts": "6000:4"}`, nil, map[string]string{"ReceiverPorts": "6000:4"}, ""},
+		{"receiver ports cleared", `{"ReceiverPorts": ""}`, []string{"ReceiverCount=2"}, map[string]string{"ReceiverPorts": ""}, ""},
+		{"receiver ports not base:count", `{"ReceiverPorts": "abc"}`, nil, nil, "invalid ReceiverPorts"},
+		{"receiver ports with no receivers", `{"ReceiverPorts": "6000:0"}`, nil, nil, "not a positive number"},
+		{"receiver ports with a receiver count", `{"ReceiverPorts": "5000:8"}`, []string{"ReceiverCount=2"}, nil, "ReceiverCount must be 1"},
+		{"receiver ports and count in the same config", `{"ReceiverPorts": "5000:8", "ReceiverCount": 2}`, nil, nil, "ReceiverCount must be 1"},
+		{"receiver count reset with receiver ports", `{"ReceiverPorts": "5000:8", "ReceiverCount": 1}`, []string{"ReceiverCount=2"},
+			map[string]string{"ReceiverPorts": "5000:8", "ReceiverCount": "1"}, ""},
+		{"receiver ports out of range", `{"ReceiverPorts": "65500:8"}`, nil, nil, "above 65535"},
+		// The stride comes from the config along with the ports.
+		{"receiver ports out of range with the config's stride", `{"ReceiverPorts": "60000:8", "ReceiverPortStride": 1000}`, nil, nil, "above 65535"},
+		{"receiver ports out of range on an existing setting", `{"RTPVideoForwardingPort": 9000}`, []string{"ReceiverPorts=65534:1"}, nil, "above 65535"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "RTPAudioForwardingPort", "4000")
+			setFlag(t, "RTPVideoForwardingPort", "4002")
+			setFlag(t, "ReceiverCount", "1")
+			setFlag(t, "ReceiverPorts", "")
+			setFlag(t, "ReceiverPortStride", "10")
+			for _, f := range test.flags {
+				setFlag(t, f[:strings.Index(f, "=")], f[strings.Index(f, "=")+1:])
+			}
+			config, err := parseWatchedConfig([]byte(test.value))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("returned %v, %v, want an error saying %q", config, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config, test.want) {
+				t.Errorf("returned %v, want %v", config, test.want)
+			}
+		})
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		index  uint64
+		status int
+		// Consul's X-Consul-Index, none if empty.
+		consulIndex string
+		value       []byte
+		next        uint64
+		err         string
+	}{
+		{"first read", 0, http.StatusOK, "12", []byte(`{"ReceiverCount": 2}`), 12, ""},
+		{"changed", 12, http.StatusOK, "15", []byte(`{"ReceiverCount": 3}`), 15, ""},
+		{"wait timed out", 15, http.StatusOK, "15", []byte(`{"ReceiverCount": 3}`), 15, ""},
+		// e.g. after Consul was restored from a snapshot.
+		{"index went backwards", 15, http.StatusOK, "3", []byte(`{"ReceiverCount": 3}`), 0, ""},
+		{"key missing", 12, http.StatusNotFound, "13", nil, 13, ""},
+		{"error", 12, http.StatusInternalServerError, "13", nil, 12, "Consul answered 500"},
+		{"no index", 12, http.StatusOK, "", nil, 12, "no X-Consul-Index"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/kv/ue/forwarding" {
+					t.Errorf("asked for %s", r.URL.Path)
+				}
+				if index := r.URL.Query().Get("index"); index != fmt.Sprint(test.index) {
+					t.Errorf("waited on index %s, want %d", index, test.index)
+				}
+				if test.consulIndex != "" {
+					w.Header().Set("X-Consul-Index", test.consulIndex)
+				}
+				w.WriteHeader(test.status)
+				w.Write(test.value)
+			}))
+			t.Cleanup(server.Close)
+			source := &consulSource{base: server.URL, key: "ue/forwarding"}
+			value, next, err := source.next(test.index)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("returned %v, want an error saying %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != string(test.value) && test.err == "" {
+				t.Errorf("value is %q, want %q", value, test.value)
+			}
+			if next != test.next {
+				t.Errorf("next index is %d, want %d", next, test.next)
+			}
+		})
+	}
+}
+
+// Serves etcd's JSON gateway for the key, answering range requests with kvs and watches with the lines of watch.
+func newTestEtcd(t *testing.T, revision string, kvs string, watch []string) *etcdSource {
+	t.Helper()
+	key := base64.StdEncoding.EncodeToString([]byte("ue/forwarding"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request map[string]interface{}
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("request %q isn't JSON: %s", body, err)
+		}
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			if request["key"] != key {
+				t.Errorf("range asked for key %v, want %s", request["key"], key)
+			}
+			fmt.Fprintf(w, `{"header":{"revision":%q},"kvs":%s}`, revision, kvs)
+		case "/v3/watch":
+			create, _ := request["create_request"].(map[string]interface{})
+			if create["key"] != key || create["start_revision"] != "8" {
+				t.Errorf("watch asked for %v, want key %s from revision 8", create, key)
+			}
+			for _, line := range watch {
+				fmt.Fprintln(w, line)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &etcdSource{base: server.URL, key: "ue/forwarding"}
+}
+
+func TestEtcdSourceRange(t *testing.T) {
+	value := base64.StdEncoding.EncodeToString([]byte(`{"ReceiverCount": 2}`))
+	source := newTestEtcd(t, "7", `[{"value":"`+value+`","mod_revision":"5"}]`, nil)
+	got, next, err := source.next(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The store's revision rather than the key's, so the watch starts after everything already seen.
+	if string(got) != `{"ReceiverCount": 2}` || next != 7 {
+		t.Errorf("returned %q at revision %d, want the key's value at 7", got, next)
+	}
+
+	missing := newTestEtcd(t, "7", `[]`, nil)
+	if got, next, err = missing.next(0); err != nil || got != nil || next != 7 {
+		t.Errorf("missing key returned %q, %d, %v, want nil at revision 7", got, next, err)
+	}
+	broken := newTestEtcd(t, "", `[]`, nil)
+	if _, _, err = broken.next(0); err == nil {
+		t.Error("answer without a revision accepted")
+	}
+}
+
+func TestEtcdSourceWatch(t *testing.T) {
+	created := `{"result":{"header":{"revision":"7"},"created":true}}`
+	put := func(value string, revision string) string {
+		return `{"result":{"events":[{"type":"PUT","kv":{"value":"` + base64.StdEncoding.EncodeToString([]byte(value)) + `","mod_revision":"` + revision + `"}}]}}`
+	}
+	tests := []struct {
+		name  string
+		watch []string
+		value string
+		next  uint64
+		err   string
+	}{
+		{"changed", []string{created, put(`{"ReceiverCount": 3}`, "9")}, `{"ReceiverCount": 3}`, 9, ""},
+		{"last of a batch", []string{created, `{"result":{"events":[` +
+			`{"type":"PUT","kv":{"value":"` + base64.StdEncoding.EncodeToString([]byte(`{"ReceiverCount": 3}`)) + `","mod_revision":"9"}},` +
+			`{"type":"PUT","kv":{"value":"` + base64.StdEncoding.EncodeToString([]byte(`{"ReceiverCount": 4}`)) + `","mod_revision":"10"}}]}}`},
+			`{"ReceiverCount": 4}`, 10, ""},
+		{"deleted", []string{created, `{"result":{"events":[{"type":"DELETE","kv":{"mod_revision":"11"}}]}}`}, "", 11, ""},
+		{"watch ended", []string{created}, "", 7, "etcd ended the watch"},
+		{"no revision", []string{created, put("{}", "")}, "", 7, "no revision"},
+		{"not base64", []string{created, `{"result":{"events":[{"type":"PUT","kv":{"value":"!","mod_revision":"9"}}]}}`}, "", 9, "illegal base64"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := newTestEtcd(t, "7", "[]", test.watch)
+			value, next, err := source.next(7)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("returned %v, want an error saying %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if test.err == "" && string(value) != test.value {
+				t.Errorf("value is %q, want %q", value, test.value)
+			}
+			if test.value == "" && test.err == "" && value != nil {
+				t.Errorf("deleted key returned %q, want nil", value)
+			}
+			if next != test.next {
+				t.Errorf("next revision is %d, want %d", next, test.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Track names as trackName makes them, e.g. video, audio or audio1.
+var controlTrackName = regexp.MustCompile(`^(audio|video)[0-9]*$`)
+
+// Serves the control API on localhost:port, letting operators change what a running bridge forwards:
+//
+//	POST /track/<name>/pause   stop forwarding the track, e.g. /track/video/pause
+//	POST /track/<name>/resume  start forwarding it again
+//	POST /codec/fallback       the receiver can't decode the video, switch it between H264 and VP8 (needs
+//	                           AllowCodecFallback)
+//	GET  /sdp                  the current session's local and remote SDP as JSON (needs EchoAnswer)
+//	GET  /ice                  the ICE candidate pairs the current session selected as JSON, oldest first (needs
+//	                           EchoAnswer)
+//	GET  /fingerprints         the current session's local and remote DTLS certificate fingerprints as JSON
+//
+// Like the pprof server it only listens on localhost, anything that can reach it can change what we forward.
+func startControlServer(port int) {
+	addr := fmt.Sprintf("localhost:%d", port)
+	fmt.Println(fmt.Sprintf("Serving the control API on http://%s/", addr))
+	handler := newControlHandler()
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Printf("Error serving the control API: %s", err.Error())
+		}
+	}()
+}
+
+// The control API's endpoints, behind the checks of sameHostOnly.
+func newControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/track/", handleTrackControl)
+	mux.HandleFunc("/codec/fallback", handleCodecFallback)
+	mux.HandleFunc("/sdp", handleSDP)
+	mux.HandleFunc("/ice", handleICE)
+	mux.HandleFunc("/fingerprints", handleFingerprints)
+	return sameHostOnly(mux)
+}
+
+// Listening on localhost doesn't keep out web pages open in a browser on this host: they can send it a form POST, or
+// point a hostname of theirs at 127.0.0.1 and read what it returns. So we only answer requests addressed to localhost,
+// and POSTs that didn't come from another origin or as a form, which a page can send without a CORS preflight.
+func sameHostOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refusal := controlRequestRefusal(r); refusal != "" {
+			http.Error(w, refusal, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns why the request is refused, or "" if it is answered.
+func controlRequestRefusal(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host != "localhost" && !isLoopbackIP(host) {
+		return fmt.Sprintf("The control API only answers requests to localhost, not %s.", r.Host)
+	}
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Sprintf("Cross-origin requests from %s aren't allowed.", origin)
+		}
+	}
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data" || contentType == "text/plain" {
+		return fmt.Sprintf("Form posts (%s) aren't allowed.", contentType)
+	}
+	return ""
+}
+
+func isLoopbackIP(host string) bool {
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// Pauses or resumes a track. The state is kept with the track's stats, so it carries over to the same track in later
+// sessions and a track can be paused before it arrives.
+func handleTrackControl(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/track/"), "/")
+	if len(parts) != 2 || !controlTrackName.MatchString(parts[0]) || (parts[1] != "pause" && parts[1] != "resume") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, paused := parts[0], parts[1] == "pause"
+	bridgeStats.track(name).setPaused(paused)
+	state := "resumed"
+	if paused {
+		state = "paused"
+	}
+	log.Printf("Forwarding of %s track %s through the control API.", name, state)
+	fmt.Fprintf(w, "%s %s\n", name, state)
+}
+
+// Switches the video codec for a receiver that can't decode the one negotiated, by starting a new session with UE.
+func handleCodecFallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Use POST.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !*AllowCodecFallback {
+		http.Error(w, "Codec fallback needs -AllowCodecFallback.", http.StatusForbidden)
+		return
+	}
+	codec, err := requestCodecFallback()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Can't fall back: %s.", err.Error()), http.StatusConflict)
+		return
+	}
+	log.Printf("Codec fallback to %s requested through the control API.", codec)
+	fmt.Fprintf(w, "switching video to %s\n", codec)
+}
+
+// Returns the current session's local and remote SDP, to inspect what was negotiated without digging through the logs.
+func handleSDP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Use GET.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !*EchoAnswer {
+		http.Error(w, "Serving the SDP needs -EchoAnswer.", http.StatusForbidden)
+		return
+	}
+	sdp, ok := currentSDP()
+	if !ok {
+		http.Error(w, "No session is running.", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(sdp); err != nil {
+		log.Printf("Error writing the SDP to the control API. Error: %s", err.Error())
+	}
+}
+
+// Returns the candidate pairs ICE selected in the current session, to tie a quality drop to UE's connection moving to
+// another path.
+func handleICE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Use GET.", http.StatusMethodNotAllowed)
+		return
+	}
+	if !*EchoAnswer {
+		http.Error(w, "Serving the ICE candidate pairs needs -EchoAnswer.", http.StatusForbidden)
+		return
+	}
+	if !sessionLive() {
+		http.Error(w, "No session is running.", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(candidatePairHistory()); err != nil {
+		log.Printf("Error writing the ICE candidate pairs to the control API. Error: %s", err.Error())
+	}
+}
+
+func handleFingerprints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Use GET.", http.StatusMethodNotAllowed)
+		return
+	}
+	fingerprints, ok := currentFingerprints()
+	if !ok {
+		http.Error(w, "No session is running.", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(fingerprints); err != nil {
+		log.Printf("Error writing the DTLS fingerprints to the control API. Error: %s", err.Error())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlRequestOrigin(t *testing.T) {
+	t.Cleanup(func() { bridgeStats.track("video").setPaused(false) })
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		host        string
+		origin      string
+		contentType string
+		want        int
+	}{
+		{"POST from curl", http.MethodPost, "/track/video/pause", "localhost:8090", "", "", http.StatusOK},
+		{"POST from our own origin", http.MethodPost, "/track/video/pause", "localhost:8090", "http://localhost:8090", "", http.StatusOK},
+		{"POST to a loopback address", http.MethodPost, "/track/video/resume", "127.0.0.1:8090", "", "", http.StatusOK},
+		{"POST to an IPv6 loopback address", http.MethodPost, "/track/video/resume", "[::1]:8090", "", "", http.StatusOK},
+		{"POST with a JSON body", http.MethodPost, "/track/video/pause", "localhost:8090", "", "application/json", http.StatusOK},
+		{"POST from another origin", http.MethodPost, "/track/video/pause", "localhost:8090", "http://example.com", "", http.StatusForbidden},
+		{"POST from another port", http.MethodPost, "/track/video/pause", "localhost:8090", "http://localhost:8080", "", http.StatusForbidden},
+		{"POST from an opaque origin", http.MethodPost, "/track/video/pause", "localhost:8090", "null", "", http.StatusForbidden},
+		{"form POST", http.MethodPost, "/track/video/pause", "localhost:8090", "", "application/x-www-form-urlencoded", http.StatusForbidden},
+		{"multipart form POST", http.MethodPost, "/track/video/pause", "localhost:8090", "", "multipart/form-data; boundary=x", http.StatusForbidden},
+		{"text POST", http.MethodPost, "/track/video/pause", "localhost:8090", "", "text/plain;charset=UTF-8", http.StatusForbidden},
+		{"POST to a rebound hostname", http.MethodPost, "/track/video/pause", "example.com:8090", "http://example.com:8090", "", http.StatusForbidden},
+		{"GET from a rebound hostname", http.MethodGet, "/fingerprints", "example.com:8090", "", "", http.StatusForbidden},
+		// No session is running, but the request got through to the endpoint.
+		{"GET from another origin", http.MethodGet, "/fingerprints", "localhost:8090", "http://example.com", "", http.StatusConflict},
+	}
+	handler := newControlHandler()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "http://"+test.host+test.path, nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("answered %d %q, want %d", w.Code, w.Body.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestControlRequestRefusedBeforeHandling(t *testing.T) {
+	t.Cleanup(func() { bridgeStats.track("audio").setPaused(false) })
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:8090/track/audio/pause", nil)
+	r.Header.Set("Origin", "http://example.com")
+	newControlHandler().ServeHTTP(httptest.NewRecorder(), r)
+	if bridgeStats.track("audio").isPaused() {
+		t.Error("a refused request paused the track")
+	}
+}
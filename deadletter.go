@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetterRecord - A line of the dead-letter file, one per forwarding failure event of a destination.
+type deadLetterRecord struct {
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"`
+	// "down" when the destination starts refusing our packets, "up" when it accepts them again, "closed" when the
+	// track stopped forwarding while it was still down, "error" for a packet lost to any other write error.
+	Event string `json:"event"`
+	Error string `json:"error,omitempty"`
+	// Packets not sent to the destination while it was down, and for how long it was.
+	Dropped uint64 `json:"dropped"`
+	DownMs  int64  `json:"downMs"`
+}
+
+// deadLetterLog - Appends the forwarding failures of the destinations to DeadLetterPath as JSON lines, so they can be
+// audited after the fact without digging through the logs. Once the file reaches DeadLetterMaxBytes it is moved to
+// DeadLetterPath.1, replacing the one before, and a new file is started.
+type deadLetterLog struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var deadLetters = &deadLetterLog{}
+
+// Opens the file to append to, as validateFlags does to check it can be written.
+func openDeadLetterFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Appends a record, a no-op without DeadLetterPath. Errors are logged, the forwarding carries on regardless.
+func (l *deadLetterLog) write(record deadLetterRecord) {
+	if *DeadLetterPath == "" {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error marshalling dead-letter record: %s", err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && *DeadLetterMaxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > *DeadLetterMaxBytes {
+		l.file.Close()
+		l.file = nil
+		if err := os.Rename(*DeadLetterPath, *DeadLetterPath+".1"); err != nil {
+			log.Printf("Error rotating dead-letter file %s: %s", *DeadLetterPath, err.Error())
+		}
+	}
+	if l.file == nil {
+		file, err := openDeadLetterFile(*DeadLetterPath)
+		if err != nil {
+			log.Printf("Error opening dead-letter file %s: %s", *DeadLetterPath, err.Error())
+			return
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			log.Printf("Error opening dead-letter file %s: %s", *DeadLetterPath, err.Error())
+			return
+		}
+		l.file, l.size = file, info.Size()
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing dead-letter file %s: %s", *DeadLetterPath, err.Error())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How many consecutive probes must be sent without a refusal before a down destination is considered up again.
+// UDP reports an ICMP port unreachable on the write after the one that caused it, so one clean probe proves nothing.
+const destinationProbesToRecover = 2
+
+// destinationState - Whether a forwarding destination is accepting our packets, so we stop writing to receivers that
+// aren't listening (e.g. while they restart) and notice when they come back. Only used from the forwarding goroutine.
+type destinationState struct {
+	down      bool
+	downSince time.Time
+	lastProbe time.Time
+	// Consecutive probes sent without a refusal while down.
+	cleanProbes int
+	// Packets not sent while down.
+	dropped uint64
+}
+
+// Reports whether a packet should be written now, while down only one packet per probe interval is let through.
+func (s *destinationState) shouldWrite(now time.Time, probeInterval time.Duration) bool {
+	if !s.down {
+		return true
+	}
+	if now.Sub(s.lastProbe) >= probeInterval {
+		s.lastProbe = now
+		return true
+	}
+	s.dropped++
+	return false
+}
+
+// Records the outcome of a write, err is nil if it was sent. Returns whether the destination just came back up. Only a
+// refusal means the receiver is gone, other errors (e.g. EMSGSIZE for one oversize packet, ENOBUFS during a burst)
+// lose that packet but leave the destination as it was.
+func (s *destinationState) wrote(err error, now time.Time, name string) bool {
+	if err != nil && !isConnectionRefused(err) {
+		// A probe that didn't get through doesn't show the receiver is back.
+		s.cleanProbes = 0
+		if s.down {
+			s.dropped++
+		}
+		deadLetters.write(deadLetterRecord{Time: now, Destination: name, Event: "error", Error: err.Error(), Dropped: 1})
+		return false
+	}
+	if err != nil {
+		s.cleanProbes = 0
+		if !s.down {
+			s.down, s.downSince, s.lastProbe, s.dropped = true, now, now, 0
+			log.Printf("Destination %s is down (connection refused), probing every %dms", name, *DestinationProbeIntervalMs)
+			deadLetters.write(deadLetterRecord{Time: now, Destination: name, Event: "down", Error: "connection refused"})
+		}
+		s.dropped++
+		return false
+	}
+	if !s.down {
+		return false
+	}
+	s.cleanProbes++
+	if s.cleanProbes < destinationProbesToRecover {
+		return false
+	}
+	log.Printf("Destination %s is up again after %s, dropped %d packets", name, now.Sub(s.downSince).Round(time.Millisecond), s.dropped)
+	deadLetters.write(s.record(now, name, "up"))
+	s.down, s.cleanProbes = false, 0
+	return true
+}
+
+// The dead-letter record of an event ending a time the destination was down.
+func (s *destinationState) record(now time.Time, name string, event string) deadLetterRecord {
+	return deadLetterRecord{Time: now, Destination: name, Event: event, Dropped: s.dropped, DownMs: now.Sub(s.downSince).Milliseconds()}
+}
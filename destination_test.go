@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Reads the records written to the dead-letter file at path.
+func readTestDeadLetters(t *testing.T, path string) []deadLetterRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []deadLetterRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("dead-letter line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestDestinationStateWrote(t *testing.T) {
+	refused := &os.SyscallError{Syscall: "write", Err: syscall.ECONNREFUSED}
+	tooBig := &os.SyscallError{Syscall: "write", Err: syscall.EMSGSIZE}
+	tests := []struct {
+		name   string
+		writes []error
+		down   bool
+		events []string
+	}{
+		{"sent", []error{nil, nil}, false, nil},
+		{"refused", []error{nil, refused}, true, []string{"down"}},
+		{"oversize packet", []error{tooBig, nil}, false, []string{"error"}},
+		{"buffer full", []error{&os.SyscallError{Syscall: "write", Err: syscall.ENOBUFS}}, false, []string{"error"}},
+		{"network unreachable", []error{&os.SyscallError{Syscall: "write", Err: syscall.ENETUNREACH}}, false, []string{"error"}},
+		{"back up after clean probes", []error{refused, nil, nil}, false, []string{"down", "up"}},
+		// A probe that failed otherwise doesn't count towards the destination being back.
+		{"probe error", []error{refused, nil, tooBig, nil}, true, []string{"down", "error"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+			setFlag(t, "DeadLetterPath", path)
+			old := deadLetters
+			deadLetters = &deadLetterLog{}
+			t.Cleanup(func() {
+				if deadLetters.file != nil {
+					deadLetters.file.Close()
+				}
+				deadLetters = old
+			})
+			var s destinationState
+			now := time.Now()
+			for _, err := range test.writes {
+				s.wrote(err, now, "127.0.0.1:4002")
+				now = now.Add(time.Second)
+			}
+			if s.down != test.down {
+				t.Errorf("down is %v, want %v", s.down, test.down)
+			}
+			records := readTestDeadLetters(t, path)
+			if len(records) != len(test.events) {
+				t.Fatalf("dead-lettered %v, want events %v", records, test.events)
+			}
+			for i, record := range records {
+				if record.Event != test.events[i] {
+					t.Errorf("event %d is %q, want %q", i, record.Event, test.events[i])
+				}
+				if record.Event == "down" && record.Error != "connection refused" {
+					t.Errorf("down recorded with error %q", record.Error)
+				}
+				if record.Event == "error" && (record.Error == "" || record.Error == "connection refused" || record.Dropped != 1) {
+					t.Errorf("write error recorded as %+v, want its own error and 1 dropped", record)
+				}
+			}
+		})
+	}
+}
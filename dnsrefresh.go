@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The longest a re-resolution may take, so a DNS server that doesn't answer doesn't hold up the next one for long.
+const dnsRefreshTimeout = 5 * time.Second
+
+// dnsWatch - With DNSRefreshMs, re-resolves a destination given as a hostname, e.g. a receiver service whose pods are
+// replaced in a rolling update, so we don't keep sending to an address nothing listens on any more.
+type dnsWatch struct {
+	// The address to move the destination to, picked up by the forwarding loop. Holds the latest one only.
+	resolved chan *net.UDPAddr
+	done     chan struct{}
+}
+
+// Starts re-resolving every destination given as a hostname every interval.
+func (u udpConns) watchDNS(interval time.Duration) {
+	for _, udpConnection := range u {
+		if net.ParseIP(udpConnection.address) != nil {
+			continue
+		}
+		udpConnection.dns = &dnsWatch{resolved: make(chan *net.UDPAddr, 1), done: make(chan struct{})}
+		current := udpConnection.conn.RemoteAddr().(*net.UDPAddr)
+		go udpConnection.dns.run(udpConnection.address, current, interval)
+	}
+}
+
+// Stops re-resolving the destinations, when the track stops forwarding.
+func (u udpConns) stopWatchingDNS() {
+	for _, udpConnection := range u {
+		if udpConnection.dns != nil {
+			close(udpConnection.dns.done)
+		}
+	}
+}
+
+// Resolves host every interval until done is closed. The destination only moves once current isn't one of the host's
+// addresses any more, so a host with several of them doesn't have us switching back and forth between them.
+func (w *dnsWatch) run(host string, current *net.UDPAddr, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		timeout := dnsRefreshTimeout
+		if interval < timeout {
+			timeout = interval
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			// Logged once per outage, the destination keeps its address until the host resolves again.
+			if !failing {
+				log.Printf("Error re-resolving %s, still forwarding to %s. Error: %v", host, current.IP, err)
+				failing = true
+			}
+			continue
+		}
+		if failing {
+			log.Printf("%s resolves again.", host)
+			failing = false
+		}
+		next := pickResolvedIP(addrs, current.IP)
+		if next == nil {
+			continue
+		}
+		log.Printf("%s now resolves to %s instead of %s, moving its destination.", host, next, current.IP)
+		current = &net.UDPAddr{IP: next, Port: current.Port}
+		// Only the latest address matters if the forwarding loop hasn't picked up the one before yet.
+		select {
+		case <-w.resolved:
+		default:
+		}
+		w.resolved <- current
+	}
+}
+
+// Returns the address to move to, nil while current is still one of the host's. Prefers the family of current, the
+// one the destination was first resolved to.
+func pickResolvedIP(addrs []net.IPAddr, current net.IP) net.IP {
+	for _, addr := range addrs {
+		if addr.IP.Equal(current) {
+			return nil
+		}
+	}
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == (current.To4() != nil) {
+			return addr.IP
+		}
+	}
+	return addrs[0].IP
+}
+
+// Moves the destinations whose hostname resolved to a new address, from the forwarding loop. Called for every packet,
+// so a move is picked up with the next packet read.
+func (u udpConns) moveResolved(name string, stats *trackStats) {
+	for _, udpConnection := range u {
+		if udpConnection.dns == nil {
+			continue
+		}
+		select {
+		case addr := <-udpConnection.dns.resolved:
+			if err := udpConnection.redial(addr.IP, stats); err != nil {
+				log.Printf("Error moving %s to %s, still forwarding %s to the old address. Error: %s", udpConnection.address, addr.IP, name, err.Error())
+				continue
+			}
+			sessionPrintln(fmt.Sprintf("Forwarding %s to %s:%d at %s now.", name, udpConnection.address, udpConnection.port, addr.IP))
+			// A new receiver has none of the stream so far, ask UE for a keyframe it can start decoding on.
+			if udpConnection.onRecovered != nil {
+				udpConnection.onRecovered()
+			}
+		default:
+		}
+	}
+}
+
+// Replaces the destination's sockets with ones to ip, with the same ports and socket options. The new sockets are set
+// up before the old ones are closed, if that fails the destination keeps the old ones.
+func (u *udpConn) redial(ip net.IP, stats *trackStats) error {
+	address := ip.String()
+	replacement, err := createUDPConnection(address, u.port, u.payloadType)
+	if err != nil {
+		return err
+	}
+	var fecConn, rtcpConn *net.UDPConn
+	if u.fecConn != nil {
+		fec, err := createUDPConnection(address, u.fecConn.RemoteAddr().(*net.UDPAddr).Port, uint8(*FECPayloadType))
+		if err != nil {
+			replacement.conn.Close()
+			return fmt.Errorf("error creating FEC udp connection: %w", err)
+		}
+		fecConn = fec.conn
+	}
+	if u.rtcpConn != nil {
+		rtcp, err := createUDPConnection(address, u.port+1, u.payloadType)
+		if err != nil {
+			replacement.conn.Close()
+			if fecConn != nil {
+				fecConn.Close()
+			}
+			return fmt.Errorf("error creating RTCP udp connection: %w", err)
+		}
+		rtcpConn = rtcp.conn
+	}
+
+	// What is batched so far belongs to the old receiver's stream.
+	if u.batch != nil && len(u.batch.pending) > 0 {
+		flushBatch(u, stats, time.Now())
+	}
+	u.mu.Lock()
+	old := []*net.UDPConn{u.conn, u.fecConn, u.rtcpConn}
+	u.conn, u.fecConn, u.rtcpConn = replacement.conn, fecConn, rtcpConn
+	if u.batch != nil {
+		u.batch = newUDPBatch(u.conn)
+	}
+	// The old receiver being down says nothing about the new one.
+	u.state = destinationState{}
+	u.mu.Unlock()
+	for _, conn := range old {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	// Listening for the receiver on the old sockets stopped when they were closed.
+	if u.receiver != nil && atomic.LoadInt32(&u.receiver.seen) == 0 {
+		u.startReceiverListeners()
+	}
+	return nil
+}
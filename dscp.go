@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// The DSCP names operators usually configure their QoS policies with (RFC 2474, 2597, 3246 and 5865).
+var dscpNames = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"VA": 44, "EF": 46,
+}
+
+// Parses a DSCP given by name (e.g. EF, AF41) or as a number from 0 to 63.
+func parseDSCP(value string) (int, error) {
+	if dscp, ok := dscpNames[strings.ToUpper(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("%q is not a DSCP name or a number from 0 to 63", value)
+	}
+	return dscp, nil
+}
+
+// Marks the packets sent on the connection with the DSCP, in the upper six bits of the IPv4 ToS or IPv6 traffic class
+// byte. Failing to is logged rather than fatal, the packets just go without the marking.
+func setDSCP(conn *net.UDPConn, dscp int) {
+	var err error
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		err = ipv6.NewConn(conn).SetTrafficClass(dscp << 2)
+	} else {
+		err = ipv4.NewConn(conn).SetTOS(dscp << 2)
+	}
+	if err != nil {
+		log.Printf("Error setting DSCP %d on the connection to %s. Error: %s", dscp, conn.RemoteAddr(), err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long after ICE connects the DTLS handshake may take before we log that it looks stalled.
+const dtlsStallTimeout = 10 * time.Second
+
+// Parses ForceDTLSRole, "auto" leaves the role to Pion and is returned as DTLSRoleAuto.
+func parseDTLSRole(value string) (webrtc.DTLSRole, error) {
+	switch value {
+	case "auto":
+		return webrtc.DTLSRoleAuto, nil
+	case "client":
+		return webrtc.DTLSRoleClient, nil
+	case "server":
+		return webrtc.DTLSRoleServer, nil
+	}
+	return 0, fmt.Errorf("%q is not \"auto\", \"client\" or \"server\"", value)
+}
+
+// The a=setup attribute of a description, from its first media section that has one or else its session level.
+func sdpSetup(desc *webrtc.SessionDescription) string {
+	if desc == nil {
+		return ""
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return ""
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if setup, ok := media.Attribute("setup"); ok {
+			return setup
+		}
+	}
+	setup, _ := parsed.Attribute("setup")
+	return setup
+}
+
+// Works out our DTLS role from the a=setup attributes of our and UE's descriptions (RFC 8842), the error says how
+// they conflict when they don't give us one.
+func negotiatedDTLSRole(local, remote string) (string, error) {
+	switch {
+	case local == "active" && remote != "active":
+		return "client", nil
+	case local == "passive" && remote != "passive":
+		return "server", nil
+	case local == "actpass" && remote == "active":
+		return "server", nil
+	case local == "actpass" && remote == "passive":
+		return "client", nil
+	}
+	return "", fmt.Errorf("we have a=setup:%s and UE has a=setup:%s, which doesn't make one of us the DTLS client and the other the server", local, remote)
+}
+
+func describeDTLSRoles(peerConnection *webrtc.PeerConnection) (string, string, string, error) {
+	local, remote := sdpSetup(peerConnection.LocalDescription()), sdpSetup(peerConnection.RemoteDescription())
+	role, err := negotiatedDTLSRole(local, remote)
+	return local, remote, role, err
+}
+
+// Called once ICE has connected. Logs a conflict in the negotiated DTLS roles straight away, and if the handshake
+// hasn't completed within dtlsStallTimeout, logs that it looks stalled along with the roles, as a handshake where both
+// sides wait for the other (or both send a ClientHello) connects ICE but never gets any media through.
+func watchDTLSHandshake(peerConnection *webrtc.PeerConnection) {
+	if _, _, _, err := describeDTLSRoles(peerConnection); err != nil {
+		log.Printf("Warning: DTLS role conflict, %s. Try -ForceDTLSRole.", err.Error())
+	}
+	time.AfterFunc(dtlsStallTimeout, func() {
+		state := peerConnection.ConnectionState()
+		if state != webrtc.PeerConnectionStateConnecting && state != webrtc.PeerConnectionStateNew {
+			return
+		}
+		local, remote, role, err := describeDTLSRoles(peerConnection)
+		if err != nil {
+			role = "unresolved"
+		}
+		log.Printf("Warning: ICE connected %s ago but the DTLS handshake hasn't completed (we have a=setup:%s, UE has a=setup:%s, our role %s). "+
+			"If this keeps happening, try -ForceDTLSRole.", dtlsStallTimeout, local, remote, role)
+	})
+}
+
+// Logs the DTLS role we ended up with, once the peer connection is connected.
+func logDTLSRole(peerConnection *webrtc.PeerConnection) {
+	local, remote, role, err := describeDTLSRoles(peerConnection)
+	if err != nil {
+		log.Printf("Connected with a DTLS role conflict, %s.", err.Error())
+		return
+	}
+	sessionPrintln(fmt.Sprintf("DTLS role: %s (we have a=setup:%s, UE has a=setup:%s).", role, local, remote))
+}
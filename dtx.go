@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Reports whether an Opus packet is a DTX (discontinuous transmission) frame, which UE's encoder sends instead of audio
+// during silence, followed by a gap of up to 400ms before the next. After the TOC byte (RFC 6716 section 3.1) it
+// carries at most one byte of frame data, as a single frame (code 0) that the decoder turns into comfort noise. This is
+// how libwebrtc tells them apart too.
+func opusDTXFrame(payload []byte) bool {
+	switch len(payload) {
+	case 1:
+		return true
+	case 2:
+		return payload[0]&0x03 == 0
+	default:
+		return false
+	}
+}
+
+// dtxDetector - Notices when an Opus track goes silent with DTX and when its audio comes back, for HandleDTX, so the
+// gaps between the packets during silence are logged as intentional rather than taken for a stall. Only used from the
+// track's forwarding loop.
+type dtxDetector struct {
+	name   string
+	silent bool
+	since  time.Time
+}
+
+// Returns a detector for the track, nil if it isn't Opus.
+func newDTXDetector(name string, codec webrtc.RTPCodecParameters) *dtxDetector {
+	if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+		return nil
+	}
+	return &dtxDetector{name: name}
+}
+
+// Notes an Opus packet read from the track, logging when the silence starts and ends.
+func (d *dtxDetector) packet(payload []byte, now time.Time) {
+	silent := opusDTXFrame(payload)
+	if silent == d.silent {
+		return
+	}
+	if silent {
+		sessionPrintln(fmt.Sprintf("%s track is silent, UE's Opus encoder is using DTX. Gaps between its packets are expected until the audio resumes.", d.name))
+	} else {
+		sessionPrintln(fmt.Sprintf("%s track audio resumed after %s of DTX silence.", d.name, now.Sub(d.since).Round(time.Millisecond)))
+	}
+	d.silent, d.since = silent, now
+}
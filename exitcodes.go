@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes, so supervisors and scripts can tell failure modes apart. These are stable, see the README.
+const (
+	exitOK    = 0
+	exitError = 1
+	// 2 is left to the Go runtime, which exits with it on an unrecovered panic.
+	exitConfig           = 3
+	exitWebsocketDial    = 4
+	exitPeerConnection   = 5
+	exitSignallingClosed = 6
+	exitPeerFailed       = 7
+)
+
+// The failure modes of a session with their own exit code, for errors.Is. The error itself still wraps what failed,
+// e.g. the websocket dial error, for errors.As.
+var (
+	errConfig            = errors.New("invalid configuration")
+	errWebsocketDial     = errors.New("could not dial the Cirrus websocket")
+	errPeerConnection    = errors.New("could not create the peer connection")
+	errSignallingClosed  = errors.New("the signalling closed before connecting to UE")
+	exitCodeFailureModes = map[int]error{
+		exitConfig:           errConfig,
+		exitWebsocketDial:    errWebsocketDial,
+		exitPeerConnection:   errPeerConnection,
+		exitSignallingClosed: errSignallingClosed,
+		exitPeerFailed:       errPeerFailed,
+	}
+)
+
+// codedError - An error that should end the process with a specific exit code.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+
+func (e *codedError) Unwrap() error { return e.err }
+
+// Matches the failure mode of the error's exit code, e.g. errWebsocketDial for exitWebsocketDial.
+func (e *codedError) Is(target error) bool {
+	mode, ok := exitCodeFailureModes[e.code]
+	return ok && mode == target
+}
+
+// Wraps err so the process exits with code if err ends it.
+func withExitCode(code int, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// Logs err and exits with the exit code it carries, or exitError if it doesn't carry one.
+func exitWithError(err error) {
+	code := exitError
+	var coded *codedError
+	if errors.As(err, &coded) {
+		code = coded.code
+	}
+	log.Println(err)
+	os.Exit(code)
+}
+
+// Logs a configuration problem and exits with exitConfig.
+func exitConfigError(format string, args ...interface{}) {
+	exitWithError(withExitCode(exitConfig, fmt.Errorf(format, args...)))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// The highest ID of the one-byte header extension form, which is what UE and Pion use.
+const maxExtensionID = 14
+
+// Names for the header extensions Pion always registers, which ExtensionID can pin but EnableExtension needn't add.
+var pionHeaderExtensions = map[string]string{
+	"mid":          sdp.SDESMidURI,
+	"rid":          sdp.SDESRTPStreamIDURI,
+	"repaired-rid": "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// extensionPin - A header extension's URI and the ID ExtensionID pins it to.
+type extensionPin struct {
+	uri string
+	id  int
+}
+
+// Parses an ExtensionID, name:id or uri:id with the name as EnableExtension takes it or mid, rid or repaired-rid.
+func parseExtensionID(value string) (extensionPin, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 {
+		return extensionPin{}, fmt.Errorf("%q is not name:id", value)
+	}
+	id, err := strconv.Atoi(value[i+1:])
+	if err != nil || id < 1 || id > maxExtensionID {
+		return extensionPin{}, fmt.Errorf("%q has ID %q, must be 1 to %d", value, value[i+1:], maxExtensionID)
+	}
+	name := value[:i]
+	if uri, ok := pionHeaderExtensions[name]; ok {
+		return extensionPin{uri, id}, nil
+	}
+	extension, err := parseHeaderExtension(name)
+	if err != nil {
+		return extensionPin{}, err
+	}
+	return extensionPin{extension.uri, id}, nil
+}
+
+// Parses every ExtensionID, no two of which may pin the same extension or ID.
+func parseExtensionIDs() ([]extensionPin, error) {
+	var pins []extensionPin
+	uris, ids := map[string]bool{}, map[int]bool{}
+	for _, value := range *ExtensionID {
+		pin, err := parseExtensionID(value)
+		if err != nil {
+			return nil, err
+		}
+		if uris[pin.uri] {
+			return nil, fmt.Errorf("%s is pinned more than once", pin.uri)
+		}
+		if ids[pin.id] {
+			return nil, fmt.Errorf("ID %d is pinned more than once", pin.id)
+		}
+		uris[pin.uri], ids[pin.id] = true, true
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// An a=extmap attribute's value, e.g. "3 urn:ietf:params:rtp-hdrext:sdes:mid" or "5/recvonly uri attributes".
+// Returns ok false for one that doesn't parse.
+func parseExtmap(value string) (id int, uri string, ok bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(strings.SplitN(fields[0], "/", 2)[0])
+	return id, fields[1], err == nil
+}
+
+// Moves the header extensions ExtensionID pins to their IDs in our offer, so UE's answer, and the packets it sends,
+// use them. Pion numbers the extensions in the order they were registered and has no way to pick their IDs, so the
+// offer we send is rewritten instead. Pion keeps its own as the local description and reads the IDs from UE's answer,
+// so it still finds the extensions in UE's packets. Extensions on an ID that is pinned to another move to the lowest
+// free one. An ID means the same extension in every media section (they are bundled), so they are renumbered the same
+// way everywhere. On error the offer is returned unchanged.
+func pinExtensionIDs(offer webrtc.SessionDescription) webrtc.SessionDescription {
+	if len(*ExtensionID) == 0 {
+		return offer
+	}
+	// Already checked by validateFlags.
+	pins, _ := parseExtensionIDs()
+	// Parsed afresh rather than with offer.Unmarshal, which returns Pion's own copy as it generated it.
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		log.Printf("Error parsing our offer to pin -ExtensionID, sending it as is. Error: %s", err.Error())
+		return offer
+	}
+
+	current := map[string]int{}
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			if id, uri, ok := parseExtmap(attribute.Value); attribute.Key == "extmap" && ok {
+				current[uri] = id
+			}
+		}
+	}
+	renumbered, taken := map[int]int{}, map[int]bool{}
+	for _, pin := range pins {
+		taken[pin.id] = true
+		if id, ok := current[pin.uri]; ok {
+			renumbered[id] = pin.id
+		} else {
+			log.Printf("Warning: -ExtensionID pins %s, but it isn't in our offer. Register it with -EnableExtension.", pin.uri)
+		}
+	}
+	// The others in the order of their IDs, so the renumbering is the same each time.
+	var others []int
+	for _, id := range current {
+		if _, ok := renumbered[id]; !ok {
+			others = append(others, id)
+		}
+	}
+	sort.Ints(others)
+	for _, id := range others {
+		if !taken[id] {
+			renumbered[id], taken[id] = id, true
+		}
+	}
+	for _, id := range others {
+		if _, ok := renumbered[id]; ok {
+			continue
+		}
+		free := 1
+		for free <= maxExtensionID && taken[free] {
+			free++
+		}
+		if free > maxExtensionID {
+			log.Println("Warning: no header extension IDs left to move our offer's extensions to for -ExtensionID, sending it as is.")
+			return offer
+		}
+		renumbered[id], taken[free] = free, true
+	}
+
+	for _, media := range parsed.MediaDescriptions {
+		for i, attribute := range media.Attributes {
+			if id, _, ok := parseExtmap(attribute.Value); attribute.Key == "extmap" && ok {
+				rest := strings.TrimPrefix(attribute.Value, strconv.Itoa(id))
+				media.Attributes[i].Value = strconv.Itoa(renumbered[id]) + rest
+			}
+		}
+	}
+	munged, err := parsed.Marshal()
+	if err != nil {
+		log.Printf("Error marshalling our offer with -ExtensionID pinned, sending it as is. Error: %s", err.Error())
+		return offer
+	}
+	return webrtc.SessionDescription{Type: offer.Type, SDP: string(munged)}
+}
+
+// Checks the answer, UE's or ours, negotiated each extension ExtensionID pins on its ID, logging the ones it didn't.
+// When UE offers, its offer picks the IDs and our answer has to use them.
+func checkExtensionIDs(answer webrtc.SessionDescription) {
+	if len(*ExtensionID) == 0 {
+		return
+	}
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		return
+	}
+	// Already checked by validateFlags.
+	pins, _ := parseExtensionIDs()
+	negotiated := map[string]int{}
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			if id, uri, ok := parseExtmap(attribute.Value); attribute.Key == "extmap" && ok {
+				negotiated[uri] = id
+			}
+		}
+	}
+	var matched []string
+	for _, pin := range pins {
+		id, ok := negotiated[pin.uri]
+		switch {
+		case !ok:
+			log.Printf("Warning: the answer doesn't negotiate %s, which -ExtensionID pins to %d. UE won't send it.", pin.uri, pin.id)
+		case id != pin.id:
+			log.Printf("Warning: the answer negotiates %s as ID %d, not the %d -ExtensionID pins. Receivers expecting %d won't find it in the forwarded packets.", pin.uri, id, pin.id, pin.id)
+		default:
+			matched = append(matched, fmt.Sprintf("%s=%d", pin.uri, id))
+		}
+	}
+	if len(matched) > 0 {
+		sessionPrintln(fmt.Sprintf("Header extensions negotiated on the IDs -ExtensionID pins: %s.", strings.Join(matched, ", ")))
+	}
+}
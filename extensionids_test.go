@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Returns the ID of each header extension URI the SDP negotiates, after checking every media section uses the same.
+func testExtmapIDs(t *testing.T, s string) map[string]int {
+	t.Helper()
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(s)); err != nil {
+		t.Fatalf("parsing %q: %s", s, err)
+	}
+	ids := map[string]int{}
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			id, uri, ok := parseExtmap(attribute.Value)
+			if attribute.Key != "extmap" || !ok {
+				continue
+			}
+			if other, seen := ids[uri]; seen && other != id {
+				t.Errorf("%s is ID %d in one media section and %d in another", uri, other, id)
+			}
+			ids[uri] = id
+		}
+	}
+	return ids
+}
+
+func TestParseExtensionIDs(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []extensionPin
+		err    string
+	}{
+		{[]string{"mid:5"}, []extensionPin{{sdp.SDESMidURI, 5}}, ""},
+		{[]string{"transport-cc:3", "urn:3gpp:video-orientation:14"}, []extensionPin{{sdp.TransportCCURI, 3}, {"urn:3gpp:video-orientation", 14}}, ""},
+		{[]string{"mid"}, nil, "is not name:id"},
+		{[]string{"mid:15"}, nil, "must be 1 to 14"},
+		{[]string{"mid:0"}, nil, "must be 1 to 14"},
+		{[]string{"unknown:3"}, nil, "unknown header extension"},
+		{[]string{"mid:3", "mid:4"}, nil, "pinned more than once"},
+		{[]string{"mid:3", "rid:3"}, nil, "ID 3 is pinned more than once"},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.values, ","), func(t *testing.T) {
+			setFlag(t, "ExtensionID", strings.Join(test.values, ","))
+			pins, err := parseExtensionIDs()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("returned %v, want an error saying %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pins) != len(test.want) {
+				t.Fatalf("returned %v, want %v", pins, test.want)
+			}
+			for i := range pins {
+				if pins[i] != test.want[i] {
+					t.Errorf("pin %d is %v, want %v", i, pins[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Creates the offer our peer connection makes with transport-cc registered, mid to transport-cc on IDs 1 to 4.
+func createTestExtensionOffer(t *testing.T) (*webrtc.PeerConnection, webrtc.SessionDescription) {
+	t.Helper()
+	setFlag(t, "EnableExtension", "transport-cc")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	offer, err := bridge.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{sdp.SDESMidURI: 1, sdp.SDESRTPStreamIDURI: 2, "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id": 3, sdp.TransportCCURI: 4}
+	if got := testExtmapIDs(t, offer.SDP); !equalExtmapIDs(got, want) {
+		t.Fatalf("Pion's offer has extensions %v, the test expects %v", got, want)
+	}
+	return bridge, offer
+}
+
+func equalExtmapIDs(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for uri, id := range a {
+		if b[uri] != id {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPinExtensionIDs(t *testing.T) {
+	repairedRID := "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	tests := []struct {
+		pins string
+		want map[string]int
+	}{
+		{"", map[string]int{sdp.SDESMidURI: 1, sdp.SDESRTPStreamIDURI: 2, repairedRID: 3, sdp.TransportCCURI: 4}},
+		// The extension on the pinned ID moves to the lowest free one.
+		{"transport-cc:1", map[string]int{sdp.TransportCCURI: 1, sdp.SDESRTPStreamIDURI: 2, repairedRID: 3, sdp.SDESMidURI: 4}},
+		{"mid:9", map[string]int{sdp.SDESMidURI: 9, sdp.SDESRTPStreamIDURI: 2, repairedRID: 3, sdp.TransportCCURI: 4}},
+		{"transport-cc:2,mid:3", map[string]int{sdp.TransportCCURI: 2, sdp.SDESMidURI: 3, sdp.SDESRTPStreamIDURI: 1, repairedRID: 4}},
+		// Already on its ID.
+		{"rid:2", map[string]int{sdp.SDESMidURI: 1, sdp.SDESRTPStreamIDURI: 2, repairedRID: 3, sdp.TransportCCURI: 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.pins, func(t *testing.T) {
+			_, offer := createTestExtensionOffer(t)
+			setFlag(t, "ExtensionID", test.pins)
+			pinned := pinExtensionIDs(offer)
+			if pinned.Type != webrtc.SDPTypeOffer {
+				t.Errorf("offer became an %s", pinned.Type)
+			}
+			if got := testExtmapIDs(t, pinned.SDP); !equalExtmapIDs(got, test.want) {
+				t.Errorf("offer has extensions %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPinExtensionIDsNotInOffer(t *testing.T) {
+	_, offer := createTestExtensionOffer(t)
+	setFlag(t, "ExtensionID", "abs-send-time:1")
+	logged := captureLog(t)
+	pinned := pinExtensionIDs(offer)
+	if !strings.Contains(logged.String(), "isn't in our offer") {
+		t.Errorf("logged %q, want a warning that abs-send-time isn't offered", logged.String())
+	}
+	// Its ID is still kept free.
+	if got := testExtmapIDs(t, pinned.SDP); got[sdp.SDESMidURI] != 5 {
+		t.Errorf("offer has extensions %v, want mid moved off the pinned ID to 5", got)
+	}
+}
+
+// Our offer is pinned, and UE's answer negotiates the pinned IDs.
+func TestExtensionIDsInOfferAndAnswer(t *testing.T) {
+	setFlag(t, "ExtensionID", "mid:5")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	ue := newTestUE(t)
+
+	sent, err := createOffer(bridge, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offer webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(sent), &offer); err != nil {
+		t.Fatal(err)
+	}
+	if got := testExtmapIDs(t, offer.SDP)[sdp.SDESMidURI]; got != 5 {
+		t.Errorf("sent offer has mid on ID %d, want 5", got)
+	}
+	// Pion keeps the local description it created.
+	if got := testExtmapIDs(t, bridge.LocalDescription().SDP)[sdp.SDESMidURI]; got != 1 {
+		t.Errorf("local description has mid on ID %d, want Pion's 1", got)
+	}
+
+	if err = ue.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := ue.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if got := testExtmapIDs(t, answer.SDP)[sdp.SDESMidURI]; got != 5 {
+		t.Errorf("UE's answer has mid on ID %d, want the pinned 5", got)
+	}
+	if err = bridge.SetRemoteDescription(answer); err != nil {
+		t.Errorf("could not apply UE's answer to the pinned offer: %s", err)
+	}
+}
+
+// When UE offers, our answer follows its IDs and the mismatch is only logged.
+func TestExtensionIDsInAnswer(t *testing.T) {
+	setFlag(t, "ExtensionID", "mid:5")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	offer, err := ue.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err = bridge.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	offered := testExtmapIDs(t, offer.SDP)
+	if offered[sdp.SDESMidURI] == 5 {
+		t.Fatal("UE's offer already has mid on the pinned ID")
+	}
+
+	logged := captureLog(t)
+	sent, err := createAnswer(bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(sent), &answer); err != nil {
+		t.Fatal(err)
+	}
+	for uri, id := range testExtmapIDs(t, answer.SDP) {
+		if id != offered[uri] {
+			t.Errorf("our answer has %s on ID %d, want UE's %d", uri, id, offered[uri])
+		}
+	}
+	// Pion leaves mid out of its answer, the check warns either way: on its own ID it isn't the pinned one.
+	if !strings.Contains(logged.String(), sdp.SDESMidURI) || !strings.Contains(logged.String(), "-ExtensionID pins") {
+		t.Errorf("logged %q, want a warning that mid isn't negotiated on the pinned ID", logged.String())
+	}
+	if err = ue.SetRemoteDescription(answer); err != nil {
+		t.Errorf("UE could not apply our answer: %s", err)
+	}
+}
+
+func TestCheckExtensionIDs(t *testing.T) {
+	section := "m=video 9 UDP/TLS/RTP/SAVPF 102\r\nc=IN IP4 0.0.0.0\r\na=mid:0\r\na=recvonly\r\n"
+	session := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name    string
+		extmaps string
+		warning string
+	}{
+		{"on the pinned ID", "a=extmap:5 " + sdp.SDESMidURI + "\r\n", ""},
+		{"on another ID", "a=extmap:1 " + sdp.SDESMidURI + "\r\n", "as ID 1, not the 5"},
+		{"with a direction", "a=extmap:1/recvonly " + sdp.SDESMidURI + "\r\n", "as ID 1, not the 5"},
+		{"not negotiated", "a=extmap:5 " + sdp.TransportCCURI + "\r\n", "doesn't negotiate " + sdp.SDESMidURI},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "ExtensionID", "mid:5")
+			logged := captureLog(t)
+			checkExtensionIDs(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: session + section + test.extmaps})
+			if test.warning == "" {
+				if logged.String() != "" {
+					t.Errorf("logged %q, want no warning", logged.String())
+				}
+				return
+			}
+			if !strings.Contains(logged.String(), test.warning) {
+				t.Errorf("logged %q, want a warning saying %q", logged.String(), test.warning)
+			}
+		})
+	}
+}
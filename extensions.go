@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// headerExtension - An RTP header extension EnableExtension can register, and the kinds of media it applies to.
+type headerExtension struct {
+	uri   string
+	kinds []webrtc.RTPCodecType
+}
+
+var bothKinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+
+// The header extensions EnableExtension knows by name.
+var headerExtensions = map[string]headerExtension{
+	"abs-send-time":     {sdp.ABSSendTimeURI, bothKinds},
+	"transport-cc":      {sdp.TransportCCURI, bothKinds},
+	"video-orientation": {"urn:3gpp:video-orientation", []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}},
+	"playout-delay":     {"http://www.webrtc.org/experiments/rtp-hdrext/playout-delay", []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}},
+}
+
+// stringListFlag - A flag that can be repeated, each value can also be a comma separated list.
+type stringListFlag []string
+
+// Defines a stringListFlag on the command line, like flag.String does for a single value.
+func stringList(name string, usage string) *stringListFlag {
+	l := &stringListFlag{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *stringListFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringListFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Looks up a header extension by name, a URI is registered for both audio and video.
+func parseHeaderExtension(value string) (headerExtension, error) {
+	if extension, ok := headerExtensions[value]; ok {
+		return extension, nil
+	}
+	if strings.Contains(value, ":") {
+		return headerExtension{value, bothKinds}, nil
+	}
+	names := make([]string, 0, len(headerExtensions))
+	for name := range headerExtensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return headerExtension{}, fmt.Errorf("unknown header extension %q, must be a URI or one of %s", value, strings.Join(names, ", "))
+}
+
+// Registers the EnableExtension header extensions in the media engine, so they're offered/accepted and their IDs are
+// negotiated, alongside Pion's defaults.
+func registerHeaderExtensions(m *webrtc.MediaEngine) error {
+	for _, value := range *EnableExtension {
+		// Already checked by validateFlags.
+		extension, _ := parseHeaderExtension(value)
+		for _, kind := range extension.kinds {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension.uri}, kind); err != nil {
+				return fmt.Errorf("registering %s for %s: %w", extension.uri, kind, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// ULPFEC (RFC 5109) generation for the forwarded RTP streams.
+// Every group of up to FECGroupSize forwarded packets is protected by one level 0 FEC packet, so a receiver that supports
+// ULPFEC can recover any single packet lost from the group. FEC packets keep the media SSRC but have their own payload
+// type and sequence numbers, and are sent to their own port (a separate RTP session, RFC 5109 section 9).
+
+const (
+	rtpHeaderLength   = 12
+	fecHeaderLength   = 10
+	fecLevel0Length   = 4
+	fecMaxShortMaskSN = 16
+)
+
+// ulpfecEncoder - Builds FEC packets over groups of forwarded packets.
+type ulpfecEncoder struct {
+	payloadType uint8
+	groupSize   int
+	seq         uint16
+	// The marshalled media packets of the current group, all within 16 sequence numbers of the first.
+	group [][]byte
+}
+
+func newULPFECEncoder(payloadType uint8, groupSize int) *ulpfecEncoder {
+	if groupSize > fecMaxShortMaskSN {
+		groupSize = fecMaxShortMaskSN
+	}
+	return &ulpfecEncoder{payloadType: payloadType, groupSize: groupSize}
+}
+
+// Adds a forwarded media packet to the current group (it is copied), returns the FEC packets of the groups that
+// completes: none, one, or after a sequence jump both the group it ended early and the one it started.
+func (e *ulpfecEncoder) push(packet []byte) [][]byte {
+	if len(packet) < rtpHeaderLength {
+		return nil
+	}
+
+	var fec [][]byte
+	// A packet that does not fit in the current group's mask (e.g. after a sequence jump) ends the group early.
+	if len(e.group) > 0 && uint16(rtpSequenceNumber(packet)-rtpSequenceNumber(e.group[0])) >= fecMaxShortMaskSN {
+		fec = append(fec, e.flush())
+	}
+
+	e.group = append(e.group, append([]byte(nil), packet...))
+	if len(e.group) >= e.groupSize {
+		fec = append(fec, e.flush())
+	}
+	return fec
+}
+
+// Builds the FEC packet protecting the current group and starts a new group.
+func (e *ulpfecEncoder) flush() []byte {
+	group := e.group
+	e.group = nil
+	if len(group) == 0 {
+		return nil
+	}
+
+	snBase := rtpSequenceNumber(group[0])
+	protectionLength := 0
+	for _, packet := range group {
+		if l := len(packet) - rtpHeaderLength; l > protectionLength {
+			protectionLength = l
+		}
+	}
+
+	fec := make([]byte, rtpHeaderLength+fecHeaderLength+fecLevel0Length+protectionLength)
+	last := group[len(group)-1]
+
+	// RTP header of the FEC packet, same SSRC and timestamp as the most recent media packet.
+	fec[0] = 2 << 6
+	fec[1] = e.payloadType & 0x7F
+	binary.BigEndian.PutUint16(fec[2:], e.seq)
+	copy(fec[4:12], last[4:12])
+	e.seq++
+
+	fecHeader := fec[rtpHeaderLength:]
+	level0 := fecHeader[fecHeaderLength:]
+	payload := level0[fecLevel0Length:]
+
+	var mask uint16
+	var lengthRecovery uint16
+	for _, packet := range group {
+		// P, X, CC, M and PT recovery plus TS recovery come from XORing the protected headers.
+		fecHeader[0] ^= packet[0]
+		fecHeader[1] ^= packet[1]
+		for i := 0; i < 4; i++ {
+			fecHeader[4+i] ^= packet[4+i]
+		}
+		lengthRecovery ^= uint16(len(packet) - rtpHeaderLength)
+
+		for i, b := range packet[rtpHeaderLength:] {
+			payload[i] ^= b
+		}
+		mask |= 1 << (15 - uint16(rtpSequenceNumber(packet)-snBase))
+	}
+
+	// E = 0 and L = 0 (short 16 bit mask) occupy the top two bits.
+	fecHeader[0] &= 0x3F
+	binary.BigEndian.PutUint16(fecHeader[2:], snBase)
+	binary.BigEndian.PutUint16(fecHeader[8:], lengthRecovery)
+	binary.BigEndian.PutUint16(level0[0:], uint16(protectionLength))
+	binary.BigEndian.PutUint16(level0[2:], mask)
+	return fec
+}
+
+func rtpSequenceNumber(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[2:])
+}
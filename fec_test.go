@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// Returns the SN base and mask of a level 0 FEC packet with a short mask.
+func fecProtected(fec []byte) (uint16, uint16) {
+	header := fec[rtpHeaderLength:]
+	return binary.BigEndian.Uint16(header[2:]), binary.BigEndian.Uint16(header[fecHeaderLength+2:])
+}
+
+func TestULPFECGroup(t *testing.T) {
+	e := newULPFECEncoder(127, 3)
+	payloads := [][]byte{{1, 2, 3}, {4, 5}, {6}}
+	var fec [][]byte
+	for i, payload := range payloads {
+		if fec != nil {
+			t.Fatalf("FEC packet before the group of 3 was complete")
+		}
+		fec = e.push(marshalTestPacket(t, rtp.Header{PayloadType: 96, SequenceNumber: 100 + uint16(i), Timestamp: 9000, SSRC: 42}, payload))
+	}
+	if len(fec) != 1 {
+		t.Fatalf("%d FEC packets for the group, want 1", len(fec))
+	}
+
+	var packet rtp.Packet
+	if err := packet.Unmarshal(fec[0]); err != nil {
+		t.Fatal(err)
+	}
+	if packet.PayloadType != 127 || packet.SSRC != 42 || packet.Timestamp != 9000 {
+		t.Errorf("FEC packet has payload type %d, SSRC %d and timestamp %d", packet.PayloadType, packet.SSRC, packet.Timestamp)
+	}
+	snBase, mask := fecProtected(fec[0])
+	if snBase != 100 || mask != 0xe000 {
+		t.Errorf("FEC packet protects %#04x from %d, want 0xe000 from 100", mask, snBase)
+	}
+	recovered := fec[0][rtpHeaderLength+fecHeaderLength+fecLevel0Length:]
+	if want := []byte{1 ^ 4 ^ 6, 2 ^ 5, 3}; string(recovered) != string(want) {
+		t.Errorf("FEC payload is %v, want %v", recovered, want)
+	}
+}
+
+// Pushes media packets with the given sequence numbers and returns the SN base and mask of each FEC packet produced,
+// in the order they were.
+func pushTestFEC(t *testing.T, e *ulpfecEncoder, sequenceNumbers ...uint16) [][2]uint16 {
+	t.Helper()
+	var protected [][2]uint16
+	for _, sequenceNumber := range sequenceNumbers {
+		for _, fec := range e.push(marshalTestPacket(t, rtp.Header{SequenceNumber: sequenceNumber}, []byte{1})) {
+			snBase, mask := fecProtected(fec)
+			protected = append(protected, [2]uint16{snBase, mask})
+		}
+	}
+	return protected
+}
+
+func TestULPFECSequenceJump(t *testing.T) {
+	tests := []struct {
+		name            string
+		groupSize       int
+		sequenceNumbers []uint16
+		want            [][2]uint16
+	}{
+		{"jump ends the group early", 4, []uint16{100, 101, 200, 201, 202, 203}, [][2]uint16{{100, 0xc000}, {200, 0xf000}}},
+		{"jump past the mask within a group", 4, []uint16{100, 116}, [][2]uint16{{100, 0x8000}}},
+		{"group size 1 across a jump", 1, []uint16{100, 200, 201}, [][2]uint16{{100, 0x8000}, {200, 0x8000}, {201, 0x8000}}},
+		{"gap within the mask", 4, []uint16{100, 102, 103, 105}, [][2]uint16{{100, 0xb400}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := pushTestFEC(t, newULPFECEncoder(127, test.groupSize), test.sequenceNumbers...)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("FEC packets protect %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestULPFECSequenceNumbers(t *testing.T) {
+	e := newULPFECEncoder(127, 2)
+	var sequenceNumbers []uint16
+	for _, sequenceNumber := range []uint16{100, 200, 201, 202, 203} {
+		for _, fec := range e.push(marshalTestPacket(t, rtp.Header{SequenceNumber: sequenceNumber}, []byte{1})) {
+			sequenceNumbers = append(sequenceNumbers, rtpSequenceNumber(fec))
+		}
+	}
+	if !reflect.DeepEqual(sequenceNumbers, []uint16{0, 1, 2}) {
+		t.Errorf("FEC packets numbered %v, want 0 to 2 with none skipped", sequenceNumbers)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// errFingerprintMismatch - The session was ended because UE's DTLS certificate isn't the one ExpectedFingerprint pins.
+var errFingerprintMismatch = errors.New("UE's DTLS certificate fingerprint doesn't match -ExpectedFingerprint")
+
+// dtlsFingerprints - The DTLS certificate fingerprints of a connected session, as RFC 8122 writes them, e.g.
+// "sha-256 4A:6C:...:D4". Remote is empty until the DTLS handshake has completed.
+type dtlsFingerprints struct {
+	Local  []string `json:"local"`
+	Remote string   `json:"remote"`
+}
+
+// Parses ExpectedFingerprint, a SHA-256 fingerprint as 32 hex bytes separated by colons, optionally prefixed with
+// "sha-256 " as in the a=fingerprint attribute. Returns it the way formatFingerprint writes them.
+func parseFingerprint(value string) (string, error) {
+	hexBytes := strings.TrimSpace(value)
+	if fields := strings.Fields(hexBytes); len(fields) == 2 {
+		if !strings.EqualFold(fields[0], "sha-256") {
+			return "", fmt.Errorf("%q is not a SHA-256 fingerprint, only sha-256 is supported", value)
+		}
+		hexBytes = fields[1]
+	}
+	parts := strings.Split(hexBytes, ":")
+	if len(parts) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 fingerprint of 32 hex bytes separated by colons", value)
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil || len(part) != 2 {
+			return "", fmt.Errorf("%q is not a SHA-256 fingerprint of 32 hex bytes separated by colons", value)
+		}
+	}
+	return "sha-256 " + strings.ToUpper(hexBytes), nil
+}
+
+// e.g. "sha-256 4A:6C:...:D4" for a certificate in DER.
+func formatFingerprint(certificate []byte) string {
+	sum := sha256.Sum256(certificate)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return "sha-256 " + strings.Join(hexBytes, ":")
+}
+
+// Reads our certificates' fingerprints and the one of the certificate UE presented in the DTLS handshake from the
+// peer connection's DTLS transport. UE's is what it actually used, which Pion has already checked against the
+// a=fingerprint of its SDP.
+func readDTLSFingerprints(peerConnection *webrtc.PeerConnection) dtlsFingerprints {
+	var fingerprints dtlsFingerprints
+	transport := peerConnection.SCTP().Transport()
+	if parameters, err := transport.GetLocalParameters(); err == nil {
+		for _, fingerprint := range parameters.Fingerprints {
+			fingerprints.Local = append(fingerprints.Local, fmt.Sprintf("%s %s", fingerprint.Algorithm, strings.ToUpper(fingerprint.Value)))
+		}
+	}
+	if certificate := transport.GetRemoteCertificate(); len(certificate) > 0 {
+		fingerprints.Remote = formatFingerprint(certificate)
+	}
+	return fingerprints
+}
+
+// Logs the fingerprints once the peer connection has connected, returning false if UE's doesn't match
+// ExpectedFingerprint and the session should end.
+func checkDTLSFingerprints(peerConnection *webrtc.PeerConnection) bool {
+	fingerprints := readDTLSFingerprints(peerConnection)
+	sessionPrintln(fmt.Sprintf("DTLS fingerprints: ours %s, UE's %s.", strings.Join(fingerprints.Local, ", "), fingerprints.Remote))
+	if *ExpectedFingerprint == "" {
+		return true
+	}
+	// Already checked by validateFlags.
+	expected, _ := parseFingerprint(*ExpectedFingerprint)
+	if fingerprints.Remote != expected {
+		log.Printf("Error: UE's DTLS certificate fingerprint is %s, -ExpectedFingerprint is %s. Ending the session.", fingerprints.Remote, expected)
+		return false
+	}
+	sessionPrintln("UE's DTLS certificate fingerprint matches -ExpectedFingerprint.")
+	return true
+}
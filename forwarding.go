@@ -0,0 +1,1303 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type udpConn struct {
+	conn        *net.UDPConn
+	address     string
+	port        int
+	payloadType uint8
+	// If non-zero forwarded packets have their SSRC rewritten to this value.
+	ssrc uint32
+	// When FEC is enabled, generates the FEC packets protecting what we forward and the connection they are sent on.
+	fec     *ulpfecEncoder
+	fecConn *net.UDPConn
+	// When forwarding RTCP without rtcp-mux, the connection to the RTCP port (RTP port + 1).
+	rtcpConn *net.UDPConn
+	// With BatchWrites, the video packets waiting to be sent in one syscall.
+	batch *udpBatch
+	// With AutoPort, the local ports claimed for this destination, released when it is closed.
+	claimedPorts []string
+	// Tracks whether the receiver is refusing our packets, onRecovered is called when it starts accepting them again.
+	state       destinationState
+	onRecovered func()
+	// When an RTP packet or keepalive was last written, for NATKeepaliveMs. Only used from the forwarding goroutine.
+	lastWrite time.Time
+	// With WaitForReceiver, whether the receiver has shown up yet.
+	receiver *receiverWatch
+	// With DNSRefreshMs and a hostname as the address, re-resolves it to move the destination when it changes.
+	dns *dnsWatch
+	// Held by the goroutines other than the forwarding one while they use the sockets, which the forwarding one
+	// replaces when DNSRefreshMs moves the destination.
+	mu sync.Mutex
+}
+
+func (u *udpConn) close() {
+	if u.state.down {
+		deadLetters.write(u.state.record(time.Now(), fmt.Sprintf("%s:%d", u.address, u.port), "closed"))
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn.Close()
+	if u.fecConn != nil {
+		u.fecConn.Close()
+	}
+	if u.rtcpConn != nil {
+		u.rtcpConn.Close()
+	}
+	releasePorts(u.claimedPorts)
+}
+
+// Forwards a marshalled RTCP packet, on the RTP socket with rtcp-mux or the separate RTCP socket otherwise.
+func (u *udpConn) writeRTCP(packet []byte) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rtcpConn != nil {
+		logWriteError(fmt.Sprintf("%s:%d", u.address, u.port+1), writeUDP(u.rtcpConn, packet))
+	} else {
+		logWriteError(fmt.Sprintf("%s:%d", u.address, u.port), writeUDP(u.conn, packet))
+	}
+}
+
+// udpConns - Every destination a track is forwarded to.
+type udpConns []*udpConn
+
+// Sends what is still batched for each destination, e.g. the last frame before the track stops or is paused.
+func (u udpConns) flushBatches(stats *trackStats) {
+	now := time.Now()
+	for _, udpConnection := range u {
+		if udpConnection.batch != nil && len(udpConnection.batch.pending) > 0 {
+			flushBatch(udpConnection, stats, now)
+		}
+	}
+}
+
+func (u udpConns) close() {
+	for _, udpConnection := range u {
+		udpConnection.close()
+	}
+}
+
+func (u udpConns) String() string {
+	destinations := make([]string, 0, len(u))
+	for _, udpConnection := range u {
+		destinations = append(destinations, fmt.Sprintf("%s:%d", udpConnection.address, udpConnection.port))
+	}
+	return strings.Join(destinations, ", ")
+}
+
+func createUDPConnection(address string, port int, payloadType uint8) (*udpConn, error) {
+
+	var udpConnection udpConn = udpConn{address: address, port: port, payloadType: payloadType}
+
+	// Create remote addr
+	var raddr *net.UDPAddr
+	var resolveRemoteErr error
+	if raddr, resolveRemoteErr = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", address, port)); resolveRemoteErr != nil {
+		return nil, resolveRemoteErr
+	}
+
+	// Multicast groups are sent to from MulticastInterface if one is set, anything else from Interface
+	var laddr *net.UDPAddr
+	multicast := *ForwardingMulticast && raddr.IP.IsMulticast()
+	if multicast {
+		var multicastErr error
+		if laddr, multicastErr = multicastLocalAddr(raddr); multicastErr != nil {
+			return nil, multicastErr
+		}
+	} else {
+		var interfaceErr error
+		if laddr, interfaceErr = interfaceLocalAddr(raddr); interfaceErr != nil {
+			return nil, interfaceErr
+		}
+	}
+
+	// Dial udp
+	var udpConnErr error
+	if udpConnection.conn, udpConnErr = net.DialUDP("udp", laddr, raddr); udpConnErr != nil {
+		return nil, udpConnErr
+	}
+
+	if multicast {
+		setMulticastTTL(udpConnection.conn, raddr)
+	}
+
+	if *DSCP != "" {
+		// Already checked by validateFlags.
+		dscp, _ := parseDSCP(*DSCP)
+		setDSCP(udpConnection.conn, dscp)
+	}
+	if *UDPSendBufferBytes > 0 {
+		setSendBuffer(udpConnection.conn, *UDPSendBufferBytes)
+	}
+	return &udpConnection, nil
+}
+
+// The interval of a track's RTCP loop, RTCPVideoIntervalMs or RTCPAudioIntervalMs if set, RTCPIntervalMs otherwise.
+func rtcpInterval(kind webrtc.RTPCodecType) time.Duration {
+	intervalMs := *RTCPIntervalMs
+	if kind == webrtc.RTPCodecTypeVideo && *RTCPVideoIntervalMs > 0 {
+		intervalMs = *RTCPVideoIntervalMs
+	} else if kind == webrtc.RTPCodecTypeAudio && *RTCPAudioIntervalMs > 0 {
+		intervalMs = *RTCPAudioIntervalMs
+	}
+	return time.Duration(intervalMs) * time.Millisecond
+}
+
+// Whether a track's RTCP loop has anything to send. With PLI (which only goes to video), REMB, APP keepalives and RTT
+// measurement all off it would only tick, so it isn't started.
+func sendsRTCPOnInterval(kind webrtc.RTPCodecType) bool {
+	return (*RTCPSendPLI && kind == webrtc.RTPCodecTypeVideo) || sendREMB() || *RTCPAppKeepalive || *RTCPMeasureRTT
+}
+
+// Send RTCP message on an interval to the UE side. a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+// Each track has its own loop with the interval for its kind. Stops once done is closed.
+func sendRTCPOnInterval(peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, rtt *rttEstimator, stats *trackStats, done <-chan struct{}) {
+	ticker := time.NewTicker(rtcpInterval(track.Kind()))
+	defer ticker.Stop()
+	var ramp *rembRamp
+	if *REMBRampMs > 0 && sendREMB() {
+		ramp = newREMBRamp(stats.name, time.Now())
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// Until a receiver shows up, UE may as well idle: no keyframes and the lowest bitrate it will go to.
+		waiting := stats.isWaitingForReceiver()
+
+		// Send PLI (picture loss indicator), audio has no pictures to lose
+		if *RTCPSendPLI && track.Kind() == webrtc.RTPCodecTypeVideo && !waiting {
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+
+		// Send REMB (receiver-side estimated maximum bandwidth)
+		if sendREMB() {
+			bitrate := rembBitrate(stats)
+			if waiting {
+				bitrate = 0
+			} else if ramp != nil {
+				bitrate = ramp.bitrate(bitrate, time.Now())
+			}
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate, SSRCs: []uint32{uint32(track.SSRC())}}}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+
+		// Send APP keepalive for setups that want one to keep the encoder active
+		if *RTCPAppKeepalive {
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{marshalAPP(rtt.senderSSRC, uint8(*RTCPAppSubtype), *RTCPAppName)}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+
+		// Send XR RRTR (receiver reference time) so Unreal Engine replies with a DLRR we can compute RTT from
+		if *RTCPMeasureRTT {
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{rtt.nextRRTR(time.Now())}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+	}
+}
+
+// Reads incoming RTCP from Unreal Engine for a track, this also lets Pion's interceptors process it.
+// Any DLRR replies to our RRTRs are used to update the track's RTT.
+// Sender reports update the track's RTP to wall clock mapping, and are forwarded to the destinations if ForwardRTCP is set.
+func readRTCP(receiver *webrtc.RTPReceiver, rtt *rttEstimator, clock *senderReportClock, destinations udpConns, stats *trackStats) {
+	interceptors := currentPacketInterceptors()
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			log.Printf("Stopped reading RTCP for %s track: %s", stats.name, err.Error())
+			return
+		}
+		for _, packet := range packets {
+			if !interceptors.interceptRTCP(stats.name, packet) {
+				continue
+			}
+			if senderReport, ok := packet.(*rtcp.SenderReport); ok {
+				clock.update(senderReport.NTPTime, senderReport.RTPTime)
+				if *ForwardRTCP {
+					destinations.forwardSenderReport(senderReport)
+				}
+			}
+			if d, ok := rtt.handleRTCP(packet, time.Now()); ok {
+				stats.setRTT(d)
+			}
+		}
+	}
+}
+
+// Returned by packetRewriter.rewrite for a packet it drops.
+var errUnexpectedPayloadType = errors.New("unexpected payload type")
+
+// packetRewriter - Turns each packet read from UE into the packet we forward, with the configured payload type, the
+// configured SSRC if there is one and, with AttachCaptureTime, the capture time extension. The payload, sequence number
+// and timestamp are passed through untouched. It does no I/O, so it can be fed packets on its own.
+type packetRewriter struct {
+	name        string
+	payloadType uint8
+	ssrc        uint32
+	// Only set with AttachCaptureTime.
+	captureTimes      *senderReportClock
+	captureTimeID     uint8
+	captureTimeWarned bool
+	unsafeReuseBuffer bool
+	// With StrictPayloadType, the payload type the track was negotiated with. Packets with any other are dropped
+	// rather than relabelled as the configured one.
+	strictPayloadType     bool
+	negotiatedPayloadType uint8
+	payloadTypeWarned     bool
+	// UE's SSRC as of the packet last rewritten, and the SSRC before it if that packet changed it, otherwise 0.
+	sourceSSRC  uint32
+	changedFrom uint32
+	// The packet last rewritten, e.g. for its marker bit and payload.
+	packet rtp.Packet
+	// Adding an extension makes the packet bigger than what we read, so it can't be marshalled back into the read
+	// buffer which its payload still points into.
+	out []byte
+}
+
+func newPacketRewriter(name string, destination *udpConn, clock *senderReportClock) *packetRewriter {
+	r := &packetRewriter{
+		name:              name,
+		payloadType:       destination.payloadType,
+		ssrc:              destination.ssrc,
+		unsafeReuseBuffer: *UnsafeReuseBuffer,
+	}
+	if *AttachCaptureTime {
+		r.captureTimes = clock
+		r.captureTimeID = uint8(*CaptureTimeExtensionID)
+		r.out = make([]byte, 1500+rtpMaxAddedHeaderBytes)
+	}
+	return r
+}
+
+// Rewrites the packet read into b. The packet returned may share memory with b or an earlier packet, so it is only
+// valid until b is reused or rewrite is called again.
+func (r *packetRewriter) rewrite(b []byte) ([]byte, error) {
+	// Unmarshal the packet and update the PayloadType (and SSRC if configured)
+	if err := r.packet.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	if r.strictPayloadType && r.packet.PayloadType != r.negotiatedPayloadType {
+		if !r.payloadTypeWarned {
+			log.Printf("Dropping %s packets with payload type %d, the track was negotiated with %d.", r.name, r.packet.PayloadType, r.negotiatedPayloadType)
+			r.payloadTypeWarned = true
+		}
+		return nil, errUnexpectedPayloadType
+	}
+	r.changedFrom = 0
+	if r.sourceSSRC != 0 && r.packet.SSRC != r.sourceSSRC {
+		r.changedFrom = r.sourceSSRC
+	}
+	r.sourceSSRC = r.packet.SSRC
+	r.packet.PayloadType = r.payloadType
+	if r.ssrc != 0 {
+		r.packet.SSRC = r.ssrc
+	}
+
+	dst := b
+	if r.captureTimes != nil {
+		if captureTime, ok := r.captureTimes.captureTime(r.packet.Timestamp); ok {
+			// e.g. UE used an RFC 3550 extension we can't add to, forward the packet without capture time rather than drop it.
+			if err := r.packet.SetExtension(r.captureTimeID, marshalAbsCaptureTime(captureTime)); err != nil && !r.captureTimeWarned {
+				log.Printf("Could not attach capture time to %s packets: %s", r.name, err.Error())
+				r.captureTimeWarned = true
+			}
+		}
+		dst = r.out
+	}
+
+	// Marshal with updated PayloadType. The payload still points into b, so marshalling back into b is only safe if
+	// the header comes out the same size, otherwise writing the header overwrites the start of the payload.
+	if r.captureTimes == nil && !(r.unsafeReuseBuffer && r.packet.Header.MarshalSize() == r.packet.PayloadOffset) {
+		return r.packet.Marshal()
+	}
+	n, err := r.packet.MarshalTo(dst)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// Reads RTP packets from the track, rewrites their payload type and forwards them to each of the track's sinks.
+// Every sink shares the payload type and SSRC rewriting of the first destination so we only rewrite each packet once.
+// When AttachCaptureTime is set, packets get an abs-capture-time extension derived from the track's sender report clock.
+// If integrity is not nil, packets it finds corrupt are dropped before any of that.
+// If twcc is not nil, the arrival of every packet carrying a transport-wide sequence number in extension twccID is
+// recorded with it.
+func forwardTrack(track *webrtc.TrackRemote, destinations udpConns, sinks trackSinks, integrity *integrityChecker, twcc *twccRecorder, twccID uint8, clock *senderReportClock, stats *trackStats) {
+	udpConnection := destinations[0]
+	var keyframes *keyframeFilter
+	if *KeyframesOnly && track.Kind() == webrtc.RTPCodecTypeVideo {
+		if strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+			keyframes = &keyframeFilter{name: stats.name}
+			sessionPrintln("Only forwarding keyframes of the video track.")
+		} else {
+			log.Printf("-KeyframesOnly only supports H264, forwarding every %s frame.", track.Codec().MimeType)
+		}
+	}
+
+	// Only needed without KeyframesOnly, which never starts mid-GOP anyway.
+	var gate *keyframeGate
+	if *WaitForKeyframe && keyframes == nil && track.Kind() == webrtc.RTPCodecTypeVideo {
+		if strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+			gate = &keyframeGate{name: stats.name}
+			sessionPrintln("Waiting for a keyframe before forwarding the video track.")
+		} else {
+			log.Printf("-WaitForKeyframe only supports H264, forwarding %s from the first packet.", track.Codec().MimeType)
+		}
+	}
+
+	var temporal *temporalLayerFilter
+	if *MaxTemporalLayer >= 0 && track.Kind() == webrtc.RTPCodecTypeVideo {
+		if temporal = newTemporalLayerFilter(track.Codec(), *MaxTemporalLayer); temporal != nil {
+			sessionPrintln(fmt.Sprintf("Only forwarding temporal layers up to %d of the video track.", *MaxTemporalLayer))
+		} else {
+			log.Printf("-MaxTemporalLayer only supports VP8 and VP9, forwarding every %s layer.", track.Codec().MimeType)
+		}
+	}
+
+	var dtx *dtxDetector
+	if *HandleDTX && track.Kind() == webrtc.RTPCodecTypeAudio {
+		if dtx = newDTXDetector(stats.name, track.Codec()); dtx == nil {
+			log.Printf("-HandleDTX only supports Opus, not looking for silence on the %s track.", track.Codec().MimeType)
+		}
+	}
+
+	var underruns *underrunDetector
+	if *UnderrunThresholdMs > 0 {
+		underruns = newUnderrunDetector(stats.name, stats, time.Duration(*UnderrunThresholdMs)*time.Millisecond)
+		underruns.dtx = dtx
+	}
+
+	var markers *markerNormalizer
+	if *NormalizeMarkerBits && track.Kind() == webrtc.RTPCodecTypeVideo {
+		markers = &markerNormalizer{}
+	}
+
+	// Sends a packet that made it through the filters to every sink.
+	interceptors := currentPacketInterceptors()
+	var forwarded rtp.Packet
+	forwardedAny := false
+	wasPaused := false
+	forward := func(packet []byte) {
+		// While paused we keep reading so nothing builds up, the packets just go nowhere.
+		if paused := stats.isPaused(); paused || wasPaused {
+			if paused && !wasPaused {
+				destinations.flushBatches(stats)
+			}
+			wasPaused = paused
+			if paused {
+				return
+			}
+			// Receivers missed frames while we were paused, same as a receiver that was down.
+			if udpConnection.onRecovered != nil {
+				udpConnection.onRecovered()
+			}
+		}
+		if !forwardedAny {
+			forwardedAny = true
+			sessionSetup.mark(setupFirstPacket, time.Now())
+		}
+		if markers != nil {
+			if packet = markers.push(packet); packet == nil {
+				return
+			}
+		}
+		// Parsed once here for all the sinks, the filters may hand us packets they held back rather than the one just read.
+		if err := forwarded.Unmarshal(packet); err != nil {
+			return
+		}
+		if !interceptors.interceptRTP(stats.name, &forwarded) {
+			return
+		}
+		sinks.writeRTP(&forwarded)
+	}
+
+	// Packets are read and dropped until ForwardingStartDelayMs after the track started, giving receivers time to come up.
+	var startAt time.Time
+	if *ForwardingStartDelayMs > 0 {
+		startAt = time.Now().Add(time.Duration(*ForwardingStartDelayMs) * time.Millisecond)
+		sessionPrintln(fmt.Sprintf("Holding back the %s track for %dms before forwarding it.", stats.name, *ForwardingStartDelayMs))
+	}
+
+	rewriter := newPacketRewriter(stats.name, udpConnection, clock)
+	if *StrictPayloadType {
+		rewriter.strictPayloadType, rewriter.negotiatedPayloadType = true, uint8(track.PayloadType())
+	}
+	jitter := &jitterEstimator{clock: clock.clock}
+	// Runs a packet read from the track through the filters, in sequence order if we are reordering.
+	handle := func(raw []byte) {
+		packet, err := rewriter.rewrite(raw)
+		if errors.Is(err, errUnexpectedPayloadType) {
+			return
+		}
+		if err != nil {
+			log.Printf("Dropping %s packet that couldn't be rewritten: %s.", stats.name, err.Error())
+			return
+		}
+		rtpPacket := &rewriter.packet
+		if underruns != nil {
+			underruns.packet(rtpPacket.SequenceNumber, time.Now())
+		}
+		// After the underrun check, which needs to know whether the track was silent before this packet.
+		if dtx != nil {
+			dtx.packet(rtpPacket.Payload, time.Now())
+		}
+		if rewriter.changedFrom != 0 {
+			logSSRCChange(stats.name, rewriter.changedFrom, rewriter.sourceSSRC, rewriter.ssrc)
+			// Like a receiver that was down, the receivers need a fresh keyframe from the restarted encoder. The new
+			// stream's timestamps have nothing to do with the old one's, so the jitter starts over too.
+			if udpConnection.onRecovered != nil {
+				udpConnection.onRecovered()
+			}
+			jitter = &jitterEstimator{clock: clock.clock}
+		}
+		if twcc != nil && twccID != 0 {
+			if extension := rtpPacket.GetExtension(twccID); len(extension) >= 2 {
+				twcc.record(binary.BigEndian.Uint16(extension), uint32(track.SSRC()), time.Now())
+			}
+		}
+		stats.setJitter(jitter.update(rtpPacket.Timestamp, time.Now()))
+		if track.Kind() == webrtc.RTPCodecTypeAudio || rtpPacket.Marker {
+			avSync.packet(stats, track.Kind(), clock, rtpPacket.Timestamp, time.Now())
+		}
+
+		// Drop everything until the start delay is over, then ask for a keyframe so receivers can start decoding. The
+		// filters below only see packets from then on, e.g. WaitForKeyframe waits for the first keyframe after the delay.
+		if !startAt.IsZero() {
+			if time.Now().Before(startAt) {
+				return
+			}
+			startAt = time.Time{}
+			sessionPrintln(fmt.Sprintf("Start delay is over, forwarding the %s track.", stats.name))
+			if udpConnection.onRecovered != nil {
+				udpConnection.onRecovered()
+			}
+		}
+
+		// Drop the temporal layers above the one we forward up to
+		if temporal != nil && !temporal.keep(packet, rtpPacket.Payload) {
+			return
+		}
+
+		// Drop everything until the first keyframe if we are waiting for one
+		if gate != nil && !gate.open {
+			frame := gate.push(packet, rtpPacket.Timestamp, rtpPacket.Payload)
+			if gate.open {
+				sessionPrintln("Got a keyframe, forwarding the video track.")
+			}
+			for _, framePacket := range frame {
+				forward(framePacket)
+			}
+			return
+		}
+
+		// Drop everything but keyframes if we are filtering
+		if keyframes != nil {
+			for _, keyframePacket := range keyframes.push(packet, rtpPacket.Timestamp, rtpPacket.Marker, rtpPacket.Payload) {
+				forward(keyframePacket)
+			}
+			return
+		}
+
+		forward(packet)
+	}
+
+	var reorder *reorderBuffer
+	if *ReorderWindow > 0 {
+		reorder = newReorderBuffer(*ReorderWindow, time.Duration(*ReorderTimeoutMs)*time.Millisecond, stats)
+	}
+	// What the track still holds once it stops forwarding no longer counts against MaxSessionBufferBytes.
+	defer func() {
+		if reorder != nil {
+			reorder.drain(nil)
+		}
+		if keyframes != nil {
+			keyframes.frame.take()
+		}
+		if gate != nil {
+			gate.frame.take()
+		}
+	}()
+
+	var keepalive time.Duration
+	if *NATKeepaliveMs > 0 {
+		keepalive = time.Duration(*NATKeepaliveMs) * time.Millisecond
+		// Counted from when the track starts, a track that never forwards anything gets keepalives too.
+		now := time.Now()
+		for _, destination := range destinations {
+			destination.lastWrite = now
+		}
+	}
+	// The earliest of when to give up on a packet held back and when a destination needs a keepalive, zero if neither.
+	readDeadline := func() time.Time {
+		var deadline time.Time
+		if reorder != nil {
+			deadline = reorder.deadline()
+		}
+		if keepalive > 0 {
+			if due := destinations.keepaliveDue(keepalive); deadline.IsZero() || (!due.IsZero() && due.Before(deadline)) {
+				deadline = due
+			}
+		}
+		return deadline
+	}
+	track.SetReadDeadline(readDeadline())
+
+	b := make([]byte, 1500)
+	for {
+		// Read
+		n, _, readErr := track.Read(b)
+		if readErr != nil {
+			// Only set while packets are held back or with NATKeepaliveMs, carry on reading once we've caught up.
+			if netErr, ok := readErr.(net.Error); ok && netErr.Timeout() && (reorder != nil || keepalive > 0) {
+				if reorder != nil {
+					for _, packet := range reorder.expire(time.Now()) {
+						handle(packet)
+					}
+				}
+				if keepalive > 0 {
+					destinations.sendKeepalives(keepalive, time.Now())
+				}
+				track.SetReadDeadline(readDeadline())
+				continue
+			}
+			// The track ends when the peer connection is closed, e.g. when the session is torn down.
+			log.Printf("Stopped forwarding %s track: %s", stats.name, readErr.Error())
+			return
+		}
+		if integrity != nil && !integrity.check(b[:n], time.Now()) {
+			continue
+		}
+
+		if reorder == nil {
+			handle(b[:n])
+		} else {
+			// The buffer keeps the packets it holds back, so each needs its own copy.
+			for _, packet := range reorder.push(append([]byte(nil), b[:n]...), time.Now()) {
+				handle(packet)
+			}
+		}
+		if *DNSRefreshMs > 0 {
+			destinations.moveResolved(stats.name, stats)
+		}
+		// UE carries on sending while the track is paused, so the read deadline alone would never be reached.
+		if keepalive > 0 {
+			destinations.sendKeepalives(keepalive, time.Now())
+		}
+		if reorder != nil || keepalive > 0 {
+			track.SetReadDeadline(readDeadline())
+		}
+	}
+}
+
+// Logs that UE's SSRC for a track changed mid-stream, e.g. because its encoder restarted, along with what the
+// receivers will see of it.
+func logSSRCChange(name string, previous uint32, current uint32, rewritten uint32) {
+	if rewritten != 0 {
+		log.Printf("Warning: UE changed the SSRC of the %s track from %d to %d mid-stream, e.g. its encoder restarted. The forwarded SSRC stays %d.", name, previous, current, rewritten)
+		return
+	}
+	option := "-VideoSSRC"
+	if strings.HasPrefix(name, "audio") {
+		option = "-AudioSSRC"
+	}
+	log.Printf("Warning: UE changed the SSRC of the %s track from %d to %d mid-stream, e.g. its encoder restarted. Receivers keyed on the SSRC will see a new stream, set %s to keep the forwarded SSRC stable.", name, previous, current, option)
+}
+
+// Forwards one of UE's sender reports to every destination, so receivers can sync the streams to UE's clock.
+// The SSRC is rewritten to match the forwarded RTP and UE's reception reports are dropped as they are about streams the
+// receiver never sees.
+func (u udpConns) forwardSenderReport(senderReport *rtcp.SenderReport) {
+	forwarded := *senderReport
+	forwarded.Reports = nil
+	forwarded.ProfileExtensions = nil
+	if ssrc := u[0].ssrc; ssrc != 0 {
+		forwarded.SSRC = ssrc
+	}
+	packet, err := forwarded.Marshal()
+	if err != nil {
+		log.Printf("Error marshalling forwarded sender report: %s", err.Error())
+		return
+	}
+	for _, udpConnection := range u {
+		udpConnection.writeRTCP(packet)
+	}
+}
+
+// Writes a forwarded RTP packet to every destination.
+func (u udpConns) writeRTP(packet []byte, stats *trackStats) {
+	for _, udpConnection := range u {
+		writeRTP(udpConnection, packet, stats)
+	}
+}
+
+// Writes a forwarded RTP packet to the udp connection.
+// When FEC is enabled the packet is also added to the current FEC group, and the group's FEC packet is sent once it's complete.
+// While the receiver is refusing packets we only send a probe every DestinationProbeIntervalMs, until it's back.
+func writeRTP(udpConnection *udpConn, packet []byte, stats *trackStats) {
+	if !udpConnection.receiverReady() {
+		return
+	}
+	now := time.Now()
+	if !udpConnection.state.shouldWrite(now, time.Duration(*DestinationProbeIntervalMs)*time.Millisecond) {
+		return
+	}
+	udpConnection.lastWrite = now
+
+	if udpConnection.fec != nil {
+		for _, fecPacket := range udpConnection.fec.push(packet) {
+			if !udpConnection.state.down {
+				logWriteError(udpConnection.fecConn.RemoteAddr().String(), writeUDP(udpConnection.fecConn, fecPacket))
+			}
+		}
+	}
+
+	// Probes while the receiver is down are sent on their own so we learn straight away whether it's back.
+	if udpConnection.batch != nil && !udpConnection.state.down {
+		if udpConnection.batch.startsNewFrame(packet) {
+			flushBatch(udpConnection, stats, now)
+		}
+		if udpConnection.batch.add(packet) {
+			flushBatch(udpConnection, stats, now)
+		}
+		return
+	}
+
+	err := writeUDP(udpConnection.conn, packet)
+	logWriteError(fmt.Sprintf("%s:%d", udpConnection.address, udpConnection.port), err)
+	if err == nil {
+		stats.addForwarded(len(packet))
+	} else if !isConnectionRefused(err) {
+		stats.addWriteErrors(1)
+	}
+	udpConnection.wrote(err, now)
+}
+
+// Sends the packets batched for the udp connection.
+// As with single writes, a refusal just means the receiver isn't listening yet (see writeRTP). Any other error is
+// logged and the rest of the batch dropped and counted, the destination stays up.
+func flushBatch(udpConnection *udpConn, stats *trackStats, now time.Time) {
+	pending := len(udpConnection.batch.pending)
+	sizes, err := udpConnection.batch.flush()
+	for _, size := range sizes {
+		stats.addForwarded(size)
+	}
+	if err != nil && !isConnectionRefused(err) {
+		log.Printf("Error writing a batch to %s:%d: %s", udpConnection.address, udpConnection.port, err.Error())
+		stats.addWriteErrors(pending - len(sizes))
+	}
+	udpConnection.wrote(err, now)
+}
+
+// Updates the destination's up/down state with the outcome of a write, err nil if it was sent.
+func (u *udpConn) wrote(err error, now time.Time) {
+	if u.state.wrote(err, now, fmt.Sprintf("%s:%d", u.address, u.port)) && u.onRecovered != nil {
+		u.onRecovered()
+	}
+}
+
+// Writes a datagram to the udp connection, returning the error if it wasn't sent. Failed writes must not take the
+// forwarding down: callers treat the destination as not listening and log errors other than refusals.
+func writeUDP(conn *net.UDPConn, packet []byte) error {
+	_, err := conn.Write(packet)
+	return err
+}
+
+// Reports whether a write failed because nothing listens at the destination (yet).
+// For this particular example, third party applications usually timeout after a short
+// amount of time during which the user doesn't have enough time to provide the answer
+// to the browser.
+// That's why, for this particular example, the user first needs to provide the answer
+// to the browser then open the third party application. Therefore we must not kill
+// the forward on "connection refused" errors
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Logs a failed write to the destination, unless it was only refused.
+func logWriteError(destination string, err error) {
+	if err != nil && !isConnectionRefused(err) {
+		log.Printf("Error writing to %s: %s", destination, err.Error())
+	}
+}
+
+// trackRegistry - Hands out a forwarding slot to each track as it arrives and takes it back when the track ends.
+// The first track of each kind is forwarded to the configured port, any extra tracks (e.g. added by a renegotiation)
+// are forwarded to the configured port plus TrackPortStep per slot so they don't clobber each other.
+// With ForwardAll, every track also gets a port slot shared by all kinds, and the registry keeps which track is
+// forwarded where so the mapping can be logged as tracks come and go.
+type trackRegistry struct {
+	mu     sync.Mutex
+	active map[webrtc.RTPCodecType]map[int]bool
+	// Only used with ForwardAll.
+	ports   map[int]bool
+	mapping map[string]udpConns
+}
+
+func newTrackRegistry() *trackRegistry {
+	return &trackRegistry{active: make(map[webrtc.RTPCodecType]map[int]bool), ports: make(map[int]bool), mapping: make(map[string]udpConns)}
+}
+
+// Returns the preferred port slot for ForwardAll if it's free, otherwise the lowest free one, and marks it as in use.
+func (r *trackRegistry) acquirePort(preferred int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slot := preferred
+	if slot < 0 || r.ports[slot] {
+		slot = 0
+		for r.ports[slot] {
+			slot++
+		}
+	}
+	r.ports[slot] = true
+	return slot
+}
+
+func (r *trackRegistry) releasePort(slot int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ports, slot)
+}
+
+// Records where a track is forwarded to, or with nil destinations that it no longer is, and logs the tracks
+// forwarded now.
+func (r *trackRegistry) mapTrack(name string, destinations udpConns) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if destinations == nil {
+		delete(r.mapping, name)
+	} else {
+		r.mapping[name] = destinations
+	}
+	if len(r.mapping) == 0 {
+		sessionPrintln("No tracks are forwarded now.")
+		return
+	}
+	names := make([]string, 0, len(r.mapping))
+	for name := range r.mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fmt.Sprintf("%s -> %s", name, r.mapping[name]))
+	}
+	sessionPrintln(fmt.Sprintf("Tracks forwarded now: %s.", strings.Join(entries, ", ")))
+}
+
+// Returns the lowest free slot for the kind of track and marks it as in use.
+func (r *trackRegistry) acquire(kind webrtc.RTPCodecType) int {
+	return r.acquirePreferred(kind, -1)
+}
+
+// Like acquire, but takes the preferred slot if it's free so e.g. the second audio m-line always gets the second audio
+// port however the tracks race to arrive.
+func (r *trackRegistry) acquirePreferred(kind webrtc.RTPCodecType, preferred int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active[kind] == nil {
+		r.active[kind] = make(map[int]bool)
+	}
+	index := preferred
+	if index < 0 || r.active[kind][index] {
+		index = 0
+		for r.active[kind][index] {
+			index++
+		}
+	}
+	r.active[kind][index] = true
+	return index
+}
+
+// Returns the position of the receiver's transceiver among all the transceivers, i.e. its order in the SDP, or -1 if
+// it isn't found.
+func transceiverPosition(peerConnection *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) int {
+	for position, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			return position
+		}
+	}
+	return -1
+}
+
+// Returns the position of the receiver's transceiver among the transceivers of its kind, i.e. its order in the SDP, or
+// -1 if it isn't found.
+func transceiverIndex(peerConnection *webrtc.PeerConnection, kind webrtc.RTPCodecType, receiver *webrtc.RTPReceiver) int {
+	index := 0
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() != kind {
+			continue
+		}
+		if transceiver.Receiver() == receiver {
+			return index
+		}
+		index++
+	}
+	return -1
+}
+
+func (r *trackRegistry) release(kind webrtc.RTPCodecType, index int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active[kind], index)
+}
+
+// The name we use for a track in logs and stats, e.g. "video" for the first video track and "video1" for the next.
+func trackName(kind webrtc.RTPCodecType, index int) string {
+	if index == 0 {
+		return kind.String()
+	}
+	return fmt.Sprintf("%s%d", kind.String(), index)
+}
+
+// errPayloadTypeMismatch - The session was ended because, with StrictPayloadType, a track's forwarding payload type
+// differs from the one its codec was negotiated with.
+var errPayloadTypeMismatch = errors.New("a track's forwarding payload type differs from the negotiated one")
+
+// Ends the current session for a payload type mismatch with StrictPayloadType, nil between sessions.
+var payloadTypeMismatchEnder struct {
+	mu         sync.Mutex
+	endSession func()
+}
+
+// Sets how the current session is ended for a payload type mismatch, nil once it has ended.
+func setPayloadTypeMismatchEnder(endSession func()) {
+	payloadTypeMismatchEnder.mu.Lock()
+	defer payloadTypeMismatchEnder.mu.Unlock()
+	payloadTypeMismatchEnder.endSession = endSession
+}
+
+// Ends the current session for a payload type mismatch, once however many tracks mismatch.
+func endSessionForPayloadType() {
+	payloadTypeMismatchEnder.mu.Lock()
+	defer payloadTypeMismatchEnder.mu.Unlock()
+	if payloadTypeMismatchEnder.endSession != nil {
+		payloadTypeMismatchEnder.endSession()
+		payloadTypeMismatchEnder.endSession = nil
+	}
+}
+
+// Explains how the payload type we forward a track with differs from the one its codec was negotiated with, or returns
+// "" if they match. We rewrite every packet to the configured payload type, so a receiver set up from the negotiated
+// codec (or one expecting UE's usual payload types) silently gets nothing it can play.
+func payloadTypeMismatch(kind webrtc.RTPCodecType, configured uint8, codec webrtc.RTPCodecParameters) string {
+	negotiated := uint8(codec.PayloadType)
+	if configured == negotiated {
+		return ""
+	}
+	flagName := "-RTPVideoPayloadType"
+	if kind == webrtc.RTPCodecTypeAudio {
+		flagName = "-RTPAudioPayloadType"
+	}
+	return fmt.Sprintf("%s is %d but %s was negotiated with payload type %d. The forwarded packets carry %d, so the "+
+		"receiver's SDP must map %d to %s. Set %s=%d to forward with the negotiated payload type instead.",
+		flagName, configured, codec.MimeType, negotiated, configured, configured, codec.MimeType, flagName, negotiated)
+}
+
+// Creates the udp connections a track in the given slot forwards to, one for each forwarding address and receiver.
+// Receiver i of each address gets the track on the configured port plus i*ReceiverPortStride, all moved to start at
+// ReceiverPorts' base if set. With ForwardAll the slot is the track's port slot, counted from ForwardAllBasePort whatever
+// the kind.
+// Also update incoming packets with expected PayloadType, the browser may use
+// a different value. We have to modify so our stream matches what rtp-forwarder.sdp expects
+func createTrackUDPConnections(kind webrtc.RTPCodecType, index int, route *routeRule) (udpConns, error) {
+	var port, fecPort int
+	var payloadType, ssrc uint
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		port, fecPort, payloadType, ssrc = *RTPAudioForwardingPort, *RTPAudioFECPort, *RTPAudioPayloadType, *AudioSSRC
+	case webrtc.RTPCodecTypeVideo:
+		port, fecPort, payloadType, ssrc = *RTPVideoForwardingPort, *RTPVideoFECPort, *RTPVideoPayloadType, *VideoSSRC
+	default:
+		return nil, fmt.Errorf("unsupported track type %s", kind.String())
+	}
+	if *ForwardAll {
+		// RTCP without rtcp-mux goes to the port after.
+		port, fecPort = *ForwardAllBasePort, *ForwardAllBasePort+2
+	}
+
+	var destinations udpConns
+	if route != nil {
+		// A RouteScript rule gives the exact destinations, one each. FEC goes two ports up as with ForwardAll.
+		for _, destination := range route.destinations {
+			// Already checked by parseRouteScript.
+			address, portText, _ := net.SplitHostPort(destination)
+			port, _ := strconv.Atoi(portText)
+			udpConnection, err := createForwardingUDPConnection(address, port, port+2, uint8(payloadType), uint32(ssrc))
+			if err != nil {
+				destinations.close()
+				return nil, err
+			}
+			if *BatchWrites && kind == webrtc.RTPCodecTypeVideo {
+				udpConnection.batch = newUDPBatch(udpConnection.conn)
+			}
+			destinations = append(destinations, udpConnection)
+		}
+		return destinations, nil
+	}
+	receivers, shift, err := receiverBlock()
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ReceiverPorts: %w", err)
+	}
+	for _, address := range forwardingAddresses() {
+		for receiver := 0; receiver < receivers; receiver++ {
+			offset := shift + index**TrackPortStep + receiver**ReceiverPortStride
+			udpConnection, err := createForwardingUDPConnection(address, port+offset, fecPort+offset, uint8(payloadType), uint32(ssrc))
+			if err != nil {
+				destinations.close()
+				return nil, err
+			}
+			// Only video frames span several packets, each audio packet is a frame of its own so batching it can't save anything.
+			if *BatchWrites && kind == webrtc.RTPCodecTypeVideo {
+				udpConnection.batch = newUDPBatch(udpConnection.conn)
+			}
+			destinations = append(destinations, udpConnection)
+		}
+	}
+	return destinations, nil
+}
+
+// Parses a ReceiverPorts block, base:count.
+func parseReceiverPorts(value string) (base int, count int, err error) {
+	colon := strings.Index(value, ":")
+	if colon < 0 {
+		return 0, 0, fmt.Errorf("%q is not base:count", value)
+	}
+	if base, err = strconv.Atoi(value[:colon]); err != nil || base < 1 || base > math.MaxUint16 {
+		return 0, 0, fmt.Errorf("%q is not a port from 1 to 65535", value[:colon])
+	}
+	if count, err = strconv.Atoi(value[colon+1:]); err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("%q is not a positive number of receivers", value[colon+1:])
+	}
+	return base, count, nil
+}
+
+// The configured forwarding ports of the first track of each kind, the ones ReceiverPorts moves.
+func configuredForwardingPorts() []int {
+	return forwardingPortsFor(*RTPAudioForwardingPort, *RTPVideoForwardingPort)
+}
+
+// The ports configuredForwardingPorts returns with the given audio and video ports, e.g. as a watched config sets them.
+func forwardingPortsFor(audioPort int, videoPort int) []int {
+	if *ForwardAll {
+		ports := []int{*ForwardAllBasePort}
+		if *ForwardFEC {
+			ports = append(ports, *ForwardAllBasePort+2)
+		}
+		return ports
+	}
+	ports := []int{audioPort, videoPort}
+	if *ForwardFEC {
+		ports = append(ports, *RTPAudioFECPort, *RTPVideoFECPort)
+	}
+	return ports
+}
+
+// How many receivers to forward to at each address, and how far to move the configured ports for ReceiverPorts so
+// the first receiver's lowest port is its base. The error says why ReceiverPorts is invalid, e.g. its last receiver's
+// ports being out of range.
+func receiverBlock() (count int, shift int, err error) {
+	return receiverBlockFor(*ReceiverPorts, *ReceiverCount, *ReceiverPortStride, configuredForwardingPorts())
+}
+
+// The receiverBlock of the given settings, e.g. as a watched config sets them.
+func receiverBlockFor(receiverPorts string, receiverCount int, stride int, ports []int) (count int, shift int, err error) {
+	if receiverPorts == "" {
+		return receiverCount, 0, nil
+	}
+	base, count, err := parseReceiverPorts(receiverPorts)
+	if err != nil {
+		return 0, 0, err
+	}
+	lowest, highest := ports[0], ports[0]
+	for _, port := range ports {
+		if port < lowest {
+			lowest = port
+		}
+		if port > highest {
+			highest = port
+		}
+	}
+	if last := base + (count-1)*stride + highest - lowest; last > math.MaxUint16 {
+		return 0, 0, fmt.Errorf("the last receiver's ports would go up to %d, above 65535", last)
+	}
+	return count, base - lowest, nil
+}
+
+// Creates the udp connection for a single destination, along with its FEC connection if FEC is enabled.
+func createForwardingUDPConnection(address string, port int, fecPort int, payloadType uint8, ssrc uint32) (*udpConn, error) {
+	var claimed []string
+	if *AutoPort {
+		offset, keys, err := claimFreePorts(address, port, fecPort)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 {
+			log.Printf("Port %d on %s is in use, forwarding to port %d instead.", port, address, port+offset)
+		}
+		port, fecPort, claimed = port+offset, fecPort+offset, keys
+	}
+
+	if port > math.MaxUint16 || ((*ForwardRTCP || *WaitForReceiver) && port+1 > math.MaxUint16) || (*ForwardFEC && fecPort > math.MaxUint16) {
+		return nil, fmt.Errorf("forwarding port %d is out of range", port)
+	}
+
+	udpConnection, err := createUDPConnection(address, port, payloadType)
+	if err != nil {
+		releasePorts(claimed)
+		return nil, err
+	}
+	udpConnection.ssrc = ssrc
+	udpConnection.claimedPorts = claimed
+
+	if *ForwardFEC {
+		fecConnection, err := createUDPConnection(address, fecPort, uint8(*FECPayloadType))
+		if err != nil {
+			udpConnection.close()
+			return nil, fmt.Errorf("error creating FEC udp connection: %w", err)
+		}
+		udpConnection.fecConn = fecConnection.conn
+		udpConnection.fec = newULPFECEncoder(uint8(*FECPayloadType), *FECGroupSize)
+	}
+
+	// With rtcp-mux forwarded RTCP shares the RTP socket, otherwise it goes to the next port up as in RFC 3550. That is
+	// also where a receiver sends its RTCP from, which WaitForReceiver listens for.
+	if (*ForwardRTCP || *WaitForReceiver) && !*ForwardRTCPMux {
+		rtcpConnection, err := createUDPConnection(address, port+1, payloadType)
+		if err != nil {
+			udpConnection.close()
+			return nil, fmt.Errorf("error creating RTCP udp connection: %w", err)
+		}
+		udpConnection.rtcpConn = rtcpConnection.conn
+	}
+	return udpConnection, nil
+}
+
+// The addresses in the comma separated ForwardingAddress flag.
+func forwardingAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(*ForwardingAddress, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Wires up forwarding for every track Unreal Engine sends us, including tracks added later by a renegotiation.
+// Each track gets its own udp connection which is closed when the track ends (e.g. it is removed by a renegotiation
+// or the peer connection is closed).
+func setupMediaForwarding(peerConnection *webrtc.PeerConnection) {
+	registry := newTrackRegistry()
+	hints := newCommandHints()
+
+	// Transport-wide sequence numbers are shared by all the tracks, so one recorder gives the feedback for the session.
+	var twcc *twccRecorder
+	if sendTWCC() {
+		twcc = newTWCCRecorder()
+		go twcc.run(peerConnection)
+	}
+
+	// The RTSP session covers every track we offered to receive, the video track and AudioTrackCount audio tracks.
+	var publisher *rtspPublisher
+	if *RTSPUrl != "" {
+		var err error
+		if publisher, err = newRTSPPublisher(*RTSPUrl, *RTSPTransport, 1+*AudioTrackCount); err != nil {
+			log.Printf("Error setting up RTSP publishing: %s", err.Error())
+		}
+	}
+
+	var routes []routeRule
+	if *RouteScript != "" {
+		// Already checked by validateFlags.
+		routes, _ = parseRouteScript(*RouteScript)
+	}
+
+	var muxer *tsMuxer
+	if *MpegTSUrl != "" {
+		var err error
+		if muxer, err = newTSMuxer(*MpegTSUrl, *MpegTSTTL); err != nil {
+			log.Printf("Error setting up MPEG-TS output: %s", err.Error())
+		}
+	}
+
+	var republish *republisher
+	if *RepublishSignallingUrl != "" {
+		var err error
+		if republish, err = newRepublisher(*RepublishSignallingUrl, peerConnection, 1+*AudioTrackCount); err != nil {
+			log.Printf("Error setting up re-publishing: %s", err.Error())
+		}
+	}
+
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+
+		var trackType string = track.Kind().String()
+		sessionPrintln(fmt.Sprintf("Got %s track from Unreal Engine Pixel Streaming WebRTC.", trackType))
+		if !withinGoroutineLimit(trackType) {
+			return
+		}
+
+		index := registry.acquirePreferred(track.Kind(), transceiverIndex(peerConnection, track.Kind(), receiver))
+		defer registry.release(track.Kind(), index)
+		name := trackName(track.Kind(), index)
+
+		slot := index
+		if *ForwardAll {
+			slot = registry.acquirePort(transceiverPosition(peerConnection, receiver))
+			defer registry.releasePort(slot)
+		}
+		var route *routeRule
+		if len(routes) > 0 {
+			if route = matchRoute(routes, routeAttributesOf(track)); route != nil {
+				sessionPrintln(fmt.Sprintf("%s track matches -RouteScript rule %q.", name, route.text))
+			}
+		}
+		destinations, err := createTrackUDPConnections(track.Kind(), slot, route)
+		if err != nil {
+			log.Println(fmt.Sprintf("Error creating udp connection for %s: %s", name, err.Error()))
+			return
+		}
+		if *ForwardAll {
+			registry.mapTrack(name, destinations)
+			defer registry.mapTrack(name, nil)
+		}
+		if mismatch := payloadTypeMismatch(track.Kind(), destinations[0].payloadType, track.Codec()); mismatch != "" {
+			// A watched RTP*PayloadType can get here mid-run, so the session ends rather than the process.
+			if *StrictPayloadType {
+				log.Printf("Payload type mismatch for %s track, not forwarding it and ending the session (-StrictPayloadType). %s", name, mismatch)
+				endSessionForPayloadType()
+				return
+			}
+			log.Printf("Warning: payload type mismatch for %s track. %s", name, mismatch)
+		}
+		sessionPrintln(fmt.Sprintf("Forwarding %s track to %s.", name, destinations))
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			noteVideoCodec(track.Codec().MimeType)
+		}
+		hints.add(name, destinations[0], track)
+
+		// Every output the track goes to, closed together once the track stops forwarding.
+		stats := bridgeStats.track(name)
+		sinks := trackSinks{newUDPSink(destinations, stats)}
+		if publisher != nil {
+			publisher.addTrack(name, newHintedStream(destinations[0], track))
+			sinks = append(sinks, &sharedOutputSink{name, publisher})
+		}
+		if muxer != nil {
+			muxer.addTrack(name, track)
+			sinks = append(sinks, &sharedOutputSink{name, muxer})
+		}
+		if republish != nil {
+			republish.addTrack(name, track)
+			sinks = append(sinks, &sharedOutputSink{name, republish})
+		}
+		if dir := recordTracksDir(); dir != "" {
+			if writer, path, err := createTrackRecorder(track, dir, name); err != nil {
+				log.Println(fmt.Sprintf("Error creating recording for %s: %s", name, err.Error()))
+			} else {
+				sessionPrintln(fmt.Sprintf("Recording %s track to %s.", name, path))
+				sinks = append(sinks, &recordingSink{name: name, path: path, writer: writer})
+			}
+		}
+		defer sinks.close()
+
+		requestKeyframe := func() {
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+
+		// A receiver that was down missed the last keyframe, ask for a new one so it can start decoding straight away.
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			for _, destination := range destinations {
+				destination.onRecovered = requestKeyframe
+			}
+			// Nothing is forwarded until the first keyframe, so ask for one rather than wait for UE's next. With a start
+			// delay, one is asked for once it is over.
+			if *WaitForKeyframe && *ForwardingStartDelayMs == 0 {
+				requestKeyframe()
+			}
+		}
+
+		if *WaitForReceiver {
+			destinations.waitForReceivers(stats)
+			defer destinations.stopWaitingForReceivers()
+		}
+		if *DNSRefreshMs > 0 {
+			destinations.watchDNS(time.Duration(*DNSRefreshMs) * time.Millisecond)
+			defer destinations.stopWatchingDNS()
+		}
+
+		var integrity *integrityChecker
+		if *CheckIntegrity {
+			var payloadTypes []uint8
+			for _, codec := range receiver.GetParameters().Codecs {
+				payloadTypes = append(payloadTypes, uint8(codec.PayloadType))
+			}
+			integrity = newIntegrityChecker(name, payloadTypes, stats, func() {
+				if *OnCorruption == "reconnect" {
+					// Closing the peer connection ends the session, closing it from here would wait on this very loop.
+					go peerConnection.Close()
+				} else if track.Kind() == webrtc.RTPCodecTypeVideo {
+					requestKeyframe()
+				}
+			})
+		}
+		// The arrival time is only recorded for packets that were numbered, i.e. transport-cc was negotiated.
+		var twccID uint8
+		if twcc != nil {
+			twccID = twccExtensionID(receiver)
+		}
+		rtt := newRTTEstimator(rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+		clock := newSenderReportClock(trackClock(track))
+
+		// Closed once we stop forwarding this track so the RTCP loop stops with it.
+		done := make(chan struct{})
+		defer close(done)
+
+		// Send RTCP message on an interval to the UE side, a panic here just restarts the RTCP loop.
+		if sendsRTCPOnInterval(track.Kind()) {
+			go runRecoverable(fmt.Sprintf("%s RTCP loop", name), true, func() {
+				sendRTCPOnInterval(peerConnection, track, rtt, stats, done)
+			})
+		} else {
+			sessionPrintln(fmt.Sprintf("Not sending RTCP on an interval for %s track, there is nothing to send.", name))
+		}
+		go runRecoverable(fmt.Sprintf("%s RTCP read loop", name), false, func() {
+			readRTCP(receiver, rtt, clock, destinations, stats)
+		})
+
+		// A panic while forwarding tears down just this track, restarting would likely hit the same error again.
+		runRecoverable(fmt.Sprintf("%s forwarding loop", name), false, func() {
+			forwardTrack(track, destinations, sinks, integrity, twcc, twccID, clock, stats)
+		})
+		sessionPrintln(fmt.Sprintf("Closed forwarding of %s track to %s.", name, destinations))
+	})
+}
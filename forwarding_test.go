@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPacketRewriterSSRC(t *testing.T) {
+	tests := []struct {
+		name string
+		ssrc uint32
+		want uint32
+	}{
+		{"UE's SSRC kept by default", 0, 0xdeadbeef},
+		{"rewritten to the configured SSRC", 1234, 1234},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewriter := newPacketRewriter("video", &udpConn{payloadType: 96, ssrc: test.ssrc}, nil)
+			in := marshalTestPacket(t, rtp.Header{PayloadType: 102, SequenceNumber: 7, Timestamp: 9000, SSRC: 0xdeadbeef}, []byte{1, 2, 3})
+			out, err := rewriter.rewrite(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var packet rtp.Packet
+			if err := packet.Unmarshal(out); err != nil {
+				t.Fatal(err)
+			}
+			if packet.SSRC != test.want {
+				t.Errorf("SSRC is %d, want %d", packet.SSRC, test.want)
+			}
+			if packet.SequenceNumber != 7 || packet.Timestamp != 9000 {
+				t.Errorf("sequence number %d and timestamp %d changed", packet.SequenceNumber, packet.Timestamp)
+			}
+		})
+	}
+}
+
+func TestPacketRewriterPayloadType(t *testing.T) {
+	tests := []struct {
+		name        string
+		payloadType uint8
+		marker      bool
+		payload     []byte
+		strict      bool
+		dropped     bool
+	}{
+		{"negotiated payload type mapped", 102, false, []byte{1, 2, 3}, false, false},
+		{"marker bit kept", 102, true, []byte{1, 2, 3}, false, false},
+		{"zero-length payload", 102, true, []byte{}, false, false},
+		{"unknown payload type forwarded", 110, false, []byte{1, 2, 3}, false, false},
+		{"negotiated payload type mapped when strict", 102, true, []byte{1, 2, 3}, true, false},
+		{"zero-length payload when strict", 102, false, []byte{}, true, false},
+		{"unknown payload type dropped when strict", 110, false, []byte{1, 2, 3}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewriter := newPacketRewriter("video", &udpConn{payloadType: 96}, nil)
+			rewriter.strictPayloadType, rewriter.negotiatedPayloadType = test.strict, 102
+			in := marshalTestPacket(t, rtp.Header{PayloadType: test.payloadType, Marker: test.marker, SequenceNumber: 65535, Timestamp: 9000, SSRC: 0xdeadbeef}, test.payload)
+			out, err := rewriter.rewrite(in)
+			if test.dropped {
+				if !errors.Is(err, errUnexpectedPayloadType) {
+					t.Errorf("rewrite returned %v, want the packet dropped", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var packet rtp.Packet
+			if err := packet.Unmarshal(out); err != nil {
+				t.Fatal(err)
+			}
+			if packet.PayloadType != 96 {
+				t.Errorf("payload type is %d, want 96", packet.PayloadType)
+			}
+			if packet.Marker != test.marker || packet.SequenceNumber != 65535 || packet.Timestamp != 9000 {
+				t.Errorf("marker %v, sequence number %d and timestamp %d changed", packet.Marker, packet.SequenceNumber, packet.Timestamp)
+			}
+			if len(packet.Payload) != len(test.payload) || len(out) != len(in) {
+				t.Errorf("forwarded %d bytes of payload in %d, want %d in %d", len(packet.Payload), len(out), len(test.payload), len(in))
+			}
+		})
+	}
+}
+
+func TestPacketRewriterReuseBuffer(t *testing.T) {
+	plain := marshalTestPacket(t, rtp.Header{PayloadType: 102, SequenceNumber: 7, Timestamp: 9000, SSRC: 0xdeadbeef}, []byte{1, 2, 3})
+	// A one-byte extension padded out to two words, which Pion marshals back in one so the header shrinks by 4 bytes.
+	padded := append([]byte{0x90, 102, 0, 7, 0, 0, 0x23, 0x28, 0xde, 0xad, 0xbe, 0xef, 0xbe, 0xde, 0, 2, 0x10, 0xaa, 0, 0, 0, 0, 0, 0}, 1, 2, 3)
+	tests := []struct {
+		name   string
+		packet []byte
+		reuse  bool
+		shared bool
+	}{
+		{"new buffer by default", plain, false, false},
+		{"read buffer reused with the flag", plain, true, true},
+		{"new buffer when the header changes size", padded, true, false},
+		{"new buffer by default when the header changes size", padded, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "UnsafeReuseBuffer", strconv.FormatBool(test.reuse))
+			rewriter := newPacketRewriter("video", &udpConn{payloadType: 96}, nil)
+			in := append([]byte(nil), test.packet...)
+			out, err := rewriter.rewrite(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shared := &out[0] == &in[0]; shared != test.shared {
+				t.Errorf("marshalled into the read buffer %v, want %v", shared, test.shared)
+			}
+			if !test.shared && !reflect.DeepEqual(in, test.packet) {
+				t.Errorf("read buffer changed to %v", in)
+			}
+			var packet rtp.Packet
+			if err := packet.Unmarshal(out); err != nil {
+				t.Fatal(err)
+			}
+			if packet.PayloadType != 96 || packet.SequenceNumber != 7 || packet.Timestamp != 9000 {
+				t.Errorf("rewritten as payload type %d, sequence number %d, timestamp %d", packet.PayloadType, packet.SequenceNumber, packet.Timestamp)
+			}
+			if !reflect.DeepEqual(packet.Payload, []byte{1, 2, 3}) {
+				t.Errorf("payload is %v, want 1 2 3", packet.Payload)
+			}
+			if extension := packet.GetExtension(1); packet.Extension && !reflect.DeepEqual(extension, []byte{0xaa}) {
+				t.Errorf("extension 1 is %v, want aa", extension)
+			}
+		})
+	}
+}
+
+func TestPacketRewriterSSRCChange(t *testing.T) {
+	rewriter := newPacketRewriter("video", &udpConn{payloadType: 96, ssrc: 1234}, nil)
+	tests := []struct {
+		ssrc        uint32
+		changedFrom uint32
+	}{
+		{0xdeadbeef, 0},
+		{0xdeadbeef, 0},
+		// UE's encoder restarted.
+		{0xcafe, 0xdeadbeef},
+		{0xcafe, 0},
+		{0xdeadbeef, 0xcafe},
+	}
+	for i, test := range tests {
+		out, err := rewriter.rewrite(marshalTestPacket(t, rtp.Header{PayloadType: 102, SequenceNumber: uint16(i), SSRC: test.ssrc}, []byte{1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewriter.changedFrom != test.changedFrom || rewriter.sourceSSRC != test.ssrc {
+			t.Errorf("packet %d with SSRC %d: changed from %d with source %d, want changed from %d", i, test.ssrc, rewriter.changedFrom, rewriter.sourceSSRC, test.changedFrom)
+		}
+		if ssrc := binary.BigEndian.Uint32(out[8:]); ssrc != 1234 {
+			t.Errorf("packet %d forwarded with SSRC %d, want the configured 1234 throughout", i, ssrc)
+		}
+	}
+}
+
+func TestLogSSRCChange(t *testing.T) {
+	tests := []struct {
+		name      string
+		track     string
+		rewritten uint32
+		want      string
+	}{
+		{"video without a configured SSRC", "video", 0, "set -VideoSSRC"},
+		{"extra audio track without a configured SSRC", "audio1", 0, "set -AudioSSRC"},
+		{"configured SSRC", "video", 1234, "The forwarded SSRC stays 1234."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			logSSRCChange(test.track, 1, 2, test.rewritten)
+			line := logged.String()
+			if !strings.Contains(line, "SSRC of the "+test.track+" track from 1 to 2") || !strings.Contains(line, test.want) {
+				t.Errorf("logged %q, want it to say %q", line, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardSenderReportSSRC(t *testing.T) {
+	destination, receiver := createTestDestination(t, 96)
+	destination.ssrc = 1234
+	udpConns{destination}.forwardSenderReport(&rtcp.SenderReport{
+		SSRC:    0xdeadbeef,
+		NTPTime: 1 << 32,
+		RTPTime: 9000,
+		Reports: []rtcp.ReceptionReport{{SSRC: 42}},
+	})
+
+	packets, err := rtcp.Unmarshal(readTestDatagram(t, receiver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, ok := packets[0].(*rtcp.SenderReport)
+	if !ok {
+		t.Fatalf("forwarded %T, want a sender report", packets[0])
+	}
+	if report.SSRC != 1234 {
+		t.Errorf("sender report SSRC is %d, want the rewritten 1234", report.SSRC)
+	}
+	if len(report.Reports) != 0 {
+		t.Errorf("forwarded %d reception reports, want none", len(report.Reports))
+	}
+	if report.RTPTime != 9000 {
+		t.Errorf("RTP time is %d, want 9000", report.RTPTime)
+	}
+}
+
+func TestRenegotiationAddsVideoTrack(t *testing.T) {
+	listeners, base := listenTestPorts(t, 2, 10)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(base))
+	setFlag(t, "TrackPortStep", "10")
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectForwardedRTP(listeners[0], "video", uint8(*RTPVideoPayloadType), 0, time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// UE renegotiates to add a second video track, which gets the next port.
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video1")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectForwardedRTP(listeners[1], "second video", uint8(*RTPVideoPayloadType), 0, time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// The first track is still forwarded.
+	if err := expectForwardedRTP(listeners[0], "video", uint8(*RTPVideoPayloadType), 0, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseReceiverPorts(t *testing.T) {
+	tests := []struct {
+		value string
+		base  int
+		count int
+		ok    bool
+	}{
+		{"5000:8", 5000, 8, true},
+		{"1:1", 1, 1, true},
+		{"5000", 0, 0, false},
+		{"5000:0", 0, 0, false},
+		{"0:2", 0, 0, false},
+		{"70000:2", 0, 0, false},
+		{"a:2", 0, 0, false},
+		{"5000:b", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			base, count, err := parseReceiverPorts(test.value)
+			if (err == nil) != test.ok {
+				t.Fatalf("error is %v, want ok %v", err, test.ok)
+			}
+			if base != test.base || count != test.count {
+				t.Errorf("parsed as %d:%d, want %d:%d", base, count, test.base, test.count)
+			}
+		})
+	}
+}
+
+func TestReceiverBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+		count int
+		shift int
+		ok    bool
+	}{
+		{"ReceiverCount without a block", map[string]string{"ReceiverCount": "3"}, 3, 0, true},
+		{"block moves audio to its base", map[string]string{"ReceiverPorts": "6000:3"}, 3, 2000, true},
+		{"block moves the lower video port to its base", map[string]string{"ReceiverPorts": "6000:2", "RTPVideoForwardingPort": "3000"}, 2, 3000, true},
+		{"FEC ports count towards the block", map[string]string{"ReceiverPorts": "3000:1", "ForwardFEC": "true", "RTPAudioFECPort": "2000"}, 1, 1000, true},
+		{"ForwardAll moves its base port", map[string]string{"ReceiverPorts": "6000:2", "ForwardAll": "true"}, 2, 1000, true},
+		{"last receiver in range", map[string]string{"ReceiverPorts": "65333:2", "ReceiverPortStride": "200"}, 2, 61333, true},
+		{"last receiver out of range", map[string]string{"ReceiverPorts": "65334:2", "ReceiverPortStride": "200"}, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			count, shift, err := receiverBlock()
+			if (err == nil) != test.ok {
+				t.Fatalf("error is %v, want ok %v", err, test.ok)
+			}
+			if count != test.count || shift != test.shift {
+				t.Errorf("%d receivers shifted by %d, want %d shifted by %d", count, shift, test.count, test.shift)
+			}
+		})
+	}
+}
+
+func TestCreateTrackUDPConnectionsReceiverPorts(t *testing.T) {
+	_, base := listenTestPorts(t, 4, 2)
+	setFlag(t, "ReceiverPorts", strconv.Itoa(base)+":2")
+	setFlag(t, "ReceiverPortStride", "4")
+	setFlag(t, "ForwardingAddress", "127.0.0.1")
+
+	tests := []struct {
+		kind  webrtc.RTPCodecType
+		ports []int
+	}{
+		// Audio and video keep their 2 port offset in each receiver.
+		{webrtc.RTPCodecTypeAudio, []int{base, base + 4}},
+		{webrtc.RTPCodecTypeVideo, []int{base + 2, base + 6}},
+	}
+	for _, test := range tests {
+		t.Run(test.kind.String(), func(t *testing.T) {
+			destinations, err := createTrackUDPConnections(test.kind, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer destinations.close()
+			var ports []int
+			for _, destination := range destinations {
+				ports = append(ports, destination.conn.RemoteAddr().(*net.UDPAddr).Port)
+			}
+			if !reflect.DeepEqual(ports, test.ports) {
+				t.Errorf("forwarding to ports %v, want %v", ports, test.ports)
+			}
+		})
+	}
+}
+
+func TestTwoAudioTracks(t *testing.T) {
+	listeners, base := listenTestPorts(t, 2, 10)
+	setFlag(t, "RTPAudioForwardingPort", strconv.Itoa(base))
+	setFlag(t, "TrackPortStep", "10")
+	setFlag(t, "AudioTrackCount", "2")
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+
+	// e.g. game audio and commentary, each forwarded to its own port in the order of the offer.
+	addTestTrack(t, ue, webrtc.RTPCodecTypeAudio, "game")
+	addTestTrack(t, ue, webrtc.RTPCodecTypeAudio, "commentary")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	ssrcs := make(map[uint32]bool)
+	for i, listener := range listeners {
+		if err := expectForwardedRTP(listener, "audio "+strconv.Itoa(i), uint8(*RTPAudioPayloadType), 0, deadline); err != nil {
+			t.Fatal(err)
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(readTestDatagram(t, listener)); err != nil {
+			t.Fatal(err)
+		}
+		ssrcs[packet.SSRC] = true
+	}
+	// Not one track clobbering the other on both ports.
+	if len(ssrcs) != 2 {
+		t.Errorf("both ports got the same track's packets")
+	}
+}
+
+func TestSendsRTCPOnInterval(t *testing.T) {
+	off := map[string]string{"RTCPSendPLI": "false", "RTCPSendREMB": "false", "RTCPAppKeepalive": "false", "RTCPMeasureRTT": "false"}
+	tests := []struct {
+		name  string
+		on    string
+		video bool
+		audio bool
+	}{
+		{"nothing to send", "", false, false},
+		{"PLI only goes to video", "RTCPSendPLI", true, false},
+		{"REMB", "RTCPSendREMB", true, true},
+		{"APP keepalives", "RTCPAppKeepalive", true, true},
+		{"RTT measurement", "RTCPMeasureRTT", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range off {
+				setFlag(t, name, value)
+			}
+			if test.on != "" {
+				setFlag(t, test.on, "true")
+			}
+			if got := sendsRTCPOnInterval(webrtc.RTPCodecTypeVideo); got != test.video {
+				t.Errorf("video track sends RTCP on an interval %v, want %v", got, test.video)
+			}
+			if got := sendsRTCPOnInterval(webrtc.RTPCodecTypeAudio); got != test.audio {
+				t.Errorf("audio track sends RTCP on an interval %v, want %v", got, test.audio)
+			}
+		})
+	}
+
+	t.Run("REMB without REMB congestion control", func(t *testing.T) {
+		for name, value := range off {
+			setFlag(t, name, value)
+		}
+		setFlag(t, "RTCPSendREMB", "true")
+		setFlag(t, "CongestionControl", "twcc")
+		if sendsRTCPOnInterval(webrtc.RTPCodecTypeAudio) {
+			t.Error("audio track sends RTCP on an interval with only REMB on and transport-cc feedback chosen")
+		}
+	})
+}
+
+func TestRTCPLoopNotStarted(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+		// Whether UE gets PLIs or REMBs.
+		sent bool
+	}{
+		{"PLI and REMB on", nil, true},
+		{"nothing to send", map[string]string{"RTCPSendPLI": "false", "RTCPSendREMB": "false"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, port := listenTestReceiver(t)
+			setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+			setFlag(t, "RTCPVideoIntervalMs", "20")
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			bridge := newTestBridge(t)
+			ue := newTestUE(t)
+			addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+			if err := negotiateLocally(ue, bridge); err != nil {
+				t.Fatal(err)
+			}
+
+			received := make(chan rtcp.Packet, 16)
+			go func() {
+				for {
+					packets, _, err := ue.GetSenders()[0].ReadRTCP()
+					if err != nil {
+						return
+					}
+					for _, packet := range packets {
+						switch packet.(type) {
+						case *rtcp.PictureLossIndication, *rtcp.ReceiverEstimatedMaximumBitrate:
+							select {
+							case received <- packet:
+							default:
+							}
+						}
+					}
+				}
+			}()
+			select {
+			case packet := <-received:
+				if !test.sent {
+					t.Errorf("UE got a %T with nothing to send on an interval", packet)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if test.sent {
+					t.Error("UE got no PLI or REMB within 25 intervals")
+				}
+			}
+		})
+	}
+}
+
+func TestWriteUDPErrors(t *testing.T) {
+	// Nothing listens on the port, so once ICMP port unreachable comes back writes are refused.
+	receiver, port := listenTestReceiver(t)
+	receiver.Close()
+	refused, err := createUDPConnection("127.0.0.1", port, 96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(refused.close)
+	err = writeUDP(refused.conn, []byte{0})
+	for i := 0; err == nil && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+		err = writeUDP(refused.conn, []byte{0})
+	}
+	if !isConnectionRefused(err) {
+		t.Errorf("writing to a closed port returned %v, want a refusal", err)
+	}
+
+	destination, _ := createTestDestination(t, 96)
+	if err = writeUDP(destination.conn, []byte{0}); err != nil {
+		t.Errorf("writing to the test receiver failed: %s", err)
+	}
+	destination.conn.Close()
+	if err = writeUDP(destination.conn, []byte{0}); err == nil || isConnectionRefused(err) {
+		t.Errorf("writing to a closed socket returned %v, want an error other than a refusal", err)
+	}
+	// The forwarding loop drops and counts the packet rather than going down itself.
+	stats := &trackStats{name: "video"}
+	writeRTP(destination, marshalTestPacket(t, rtp.Header{Timestamp: 1000, Marker: true}, testIDRPayload), stats)
+	if destination.state.down {
+		t.Error("destination down after a write error other than a refusal")
+	}
+	if stats.writeErrors != 1 {
+		t.Errorf("%d write errors counted, want 1", stats.writeErrors)
+	}
+}
+
+// With StrictPayloadType a mismatch found when the track arrives ends the session instead of the process.
+func TestStrictPayloadTypeEndsSession(t *testing.T) {
+	listener, port := listenTestReceiver(t)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+	setFlag(t, "RTPVideoPayloadType", "120")
+	setFlag(t, "StrictPayloadType", "true")
+	logged := captureLog(t)
+	ended := make(chan struct{})
+	setPayloadTypeMismatchEnder(func() { close(ended) })
+	t.Cleanup(func() { setPayloadTypeMismatchEnder(nil) })
+
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not ended for the payload type mismatch")
+	}
+	if !strings.Contains(logged.String(), "not forwarding it and ending the session") {
+		t.Errorf("logged %q, want the mismatch", logged.String())
+	}
+	listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := listener.Read(make([]byte, 1500)); err == nil {
+		t.Errorf("forwarded a %d byte packet of the mismatched track", n)
+	}
+}
@@ -4,7 +4,10 @@ go 1.15
 
 require (
 	github.com/gorilla/websocket v1.4.2
+	github.com/pion/dtls/v2 v2.0.4
 	github.com/pion/rtcp v1.2.6
 	github.com/pion/rtp v1.6.2
+	github.com/pion/sdp/v3 v3.0.4
 	github.com/pion/webrtc/v3 v3.0.4
+	golang.org/x/net v0.0.0-20201201195509-5d6afe98e0b7
 )
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// H.264 RTP payload helpers (RFC 6184), just enough to identify which NAL units a packet carries without fully depacketizing it.
+
+const (
+	h264NALTypeIDR  = 5
+	h264NALTypeSPS  = 7
+	h264NALTypePPS  = 8
+	h264NALTypeSTAP = 24
+	h264NALTypeFUA  = 28
+)
+
+// Returns the types of the NAL units carried by an H.264 RTP payload.
+// For fragmented NAL units (FU-A) the type of the fragmented NAL unit is returned for every fragment.
+func h264NALTypes(payload []byte) []uint8 {
+	if len(payload) < 1 {
+		return nil
+	}
+	naluType := payload[0] & 0x1F
+	switch naluType {
+	case h264NALTypeSTAP:
+		types := make([]uint8, 0, 2)
+		// STAP-A: each aggregated NAL unit is prefixed with its 16 bit size
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			rest = rest[2:]
+			if size < 1 || size > len(rest) {
+				break
+			}
+			types = append(types, rest[0]&0x1F)
+			rest = rest[size:]
+		}
+		return types
+	case h264NALTypeFUA:
+		if len(payload) < 2 {
+			return nil
+		}
+		return []uint8{payload[1] & 0x1F}
+	default:
+		return []uint8{naluType}
+	}
+}
+
+// Whether an H.264 RTP payload carries (part of) an IDR frame.
+func isH264Keyframe(payload []byte) bool {
+	for _, naluType := range h264NALTypes(payload) {
+		if naluType == h264NALTypeIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// keyframeFilter - Groups forwarded video packets into frames (by RTP timestamp) and only lets through frames containing an IDR.
+// Packets of each frame are held until the frame ends. Forwarded packets have their sequence numbers shifted back by the
+// packets dropped so far, so the receiver doesn't see the dropped frames as loss but still sees packets lost upstream.
+type keyframeFilter struct {
+	name      string
+	frame     heldFrame
+	timestamp uint32
+	keyframe  bool
+	// How many packets the filter has dropped, subtracted from the sequence numbers of the ones it forwards.
+	dropped uint16
+}
+
+// Adds a marshalled packet (which is copied) to the filter and returns any packets that are now ready to forward.
+func (f *keyframeFilter) push(packet []byte, timestamp uint32, marker bool, payload []byte) [][]byte {
+	var ready [][]byte
+	// A new timestamp means the previous frame is over even if we never saw its marker bit.
+	if len(f.frame.packets) > 0 && timestamp != f.timestamp {
+		ready = f.flush()
+	}
+
+	f.timestamp = timestamp
+	f.frame.add(f.name, packet)
+	f.keyframe = f.keyframe || isH264Keyframe(payload)
+
+	if marker {
+		ready = append(ready, f.flush()...)
+	}
+	return ready
+}
+
+// Finishes the current frame, returning its packets if it was a keyframe.
+func (f *keyframeFilter) flush() [][]byte {
+	frame, keyframe := f.frame.take(), f.keyframe
+	f.keyframe = false
+	if !keyframe {
+		f.dropped += uint16(len(frame))
+		return nil
+	}
+	for _, packet := range frame {
+		binary.BigEndian.PutUint16(packet[2:], binary.BigEndian.Uint16(packet[2:])-f.dropped)
+	}
+	return frame
+}
+
+// keyframeGate - Holds back a video track until its first keyframe (IDR frame), so receivers start decoding on a clean
+// frame instead of mid-GOP. The packets of the latest frame are held, as the SPS and PPS can come before the IDR.
+type keyframeGate struct {
+	name      string
+	open      bool
+	frame     heldFrame
+	timestamp uint32
+}
+
+// Adds a marshalled packet (which is copied) while the gate is closed. Returns nil until a packet of a keyframe arrives,
+// then the packets of that frame so far, after which the gate is open.
+func (g *keyframeGate) push(packet []byte, timestamp uint32, payload []byte) [][]byte {
+	// A new timestamp means the frame held so far wasn't a keyframe.
+	if len(g.frame.packets) > 0 && timestamp != g.timestamp {
+		g.frame.take()
+	}
+	g.timestamp = timestamp
+	g.frame.add(g.name, packet)
+	if !isH264Keyframe(payload) {
+		return nil
+	}
+	g.open = true
+	return g.frame.take()
+}
+
+// heldFrame - The packets of a frame held back by a keyframeFilter or keyframeGate, counted against
+// MaxSessionBufferBytes.
+type heldFrame struct {
+	packets [][]byte
+	bytes   int
+}
+
+// Adds a copy of the packet, then drops the oldest packets while the session is over MaxSessionBufferBytes. The frame
+// they belonged to can't be decoded any more, but a frame of a misbehaving UE that never ends can't eat up the host's
+// memory either.
+func (h *heldFrame) add(name string, packet []byte) {
+	h.packets = append(h.packets, append([]byte(nil), packet...))
+	h.bytes += len(packet)
+	sessionBuffers.add(len(packet))
+	dropped := 0
+	for len(h.packets) > 0 && sessionBuffers.over() {
+		h.bytes -= len(h.packets[0])
+		sessionBuffers.remove(len(h.packets[0]))
+		h.packets = h.packets[1:]
+		dropped++
+	}
+	if dropped > 0 {
+		sessionBuffers.addShed(name, "dropped from a frame held for a keyframe", dropped, time.Now())
+	}
+}
+
+// Returns the held packets and starts a new frame.
+func (h *heldFrame) take() [][]byte {
+	packets := h.packets
+	sessionBuffers.remove(h.bytes)
+	h.packets, h.bytes = nil, 0
+	return packets
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// H.264 payloads of a single NAL unit of each type.
+var (
+	testIDRPayload   = []byte{0x65, 0x88, 0x84}
+	testSlicePayload = []byte{0x41, 0x9a, 0x02}
+)
+
+func TestIsH264Keyframe(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{"IDR", testIDRPayload, true},
+		{"non-IDR slice", testSlicePayload, false},
+		{"STAP-A with SPS, PPS and IDR", []byte{0x78, 0, 2, 0x67, 0x42, 0, 1, 0x68, 0, 2, 0x65, 0x88}, true},
+		{"STAP-A with SPS and PPS only", []byte{0x78, 0, 2, 0x67, 0x42, 0, 1, 0x68}, false},
+		{"FU-A fragment of an IDR", []byte{0x7c, 0x85, 0x88}, true},
+		{"FU-A fragment of a slice", []byte{0x5c, 0x81, 0x9a}, false},
+		{"empty", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isH264Keyframe(test.payload); got != test.want {
+				t.Errorf("isH264Keyframe is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// Pushes a frame of packets to the filter, skipping the sequence numbers in lost as if they never arrived, and returns
+// the sequence numbers of the packets it forwarded.
+func pushTestFrame(t *testing.T, f *keyframeFilter, first uint16, count int, timestamp uint32, keyframe bool, lost ...uint16) []uint16 {
+	t.Helper()
+	payload := testSlicePayload
+	if keyframe {
+		payload = testIDRPayload
+	}
+	var forwarded []uint16
+	for i := 0; i < count; i++ {
+		sequence := first + uint16(i)
+		skip := false
+		for _, l := range lost {
+			skip = skip || l == sequence
+		}
+		if skip {
+			continue
+		}
+		marker := i == count-1
+		packet := marshalTestPacket(t, rtp.Header{SequenceNumber: sequence, Timestamp: timestamp, Marker: marker}, payload)
+		for _, ready := range f.push(packet, timestamp, marker, payload) {
+			forwarded = append(forwarded, binary.BigEndian.Uint16(ready[2:]))
+		}
+	}
+	return forwarded
+}
+
+func TestKeyframeFilterSequenceNumbers(t *testing.T) {
+	f := &keyframeFilter{name: "video"}
+	if got := pushTestFrame(t, f, 100, 3, 1000, true); !reflect.DeepEqual(got, []uint16{100, 101, 102}) {
+		t.Fatalf("first keyframe forwarded as %v", got)
+	}
+	// Two dropped frames of 2 packets each, the next keyframe follows straight on from the last one forwarded.
+	if got := pushTestFrame(t, f, 103, 2, 4000, false); got != nil {
+		t.Fatalf("inter frame forwarded as %v", got)
+	}
+	pushTestFrame(t, f, 105, 2, 7000, false)
+	if got := pushTestFrame(t, f, 107, 3, 10000, true); !reflect.DeepEqual(got, []uint16{103, 104, 105}) {
+		t.Errorf("second keyframe forwarded as %v, want 103 to 105", got)
+	}
+}
+
+func TestKeyframeFilterKeepsUpstreamLoss(t *testing.T) {
+	f := &keyframeFilter{name: "video"}
+	// 101 lost inside the keyframe.
+	if got := pushTestFrame(t, f, 100, 4, 1000, true, 101); !reflect.DeepEqual(got, []uint16{100, 102, 103}) {
+		t.Errorf("keyframe with a lost packet forwarded as %v, want the gap kept", got)
+	}
+	pushTestFrame(t, f, 104, 2, 4000, false)
+	// 106 lost at the start of the next keyframe, between the two forwarded ones.
+	if got := pushTestFrame(t, f, 106, 3, 7000, true, 106); !reflect.DeepEqual(got, []uint16{105, 106}) {
+		t.Errorf("keyframe after a lost packet forwarded as %v, want 105 and 106 leaving 104 missing", got)
+	}
+}
+
+func TestKeyframeFilterFrameWithoutMarker(t *testing.T) {
+	f := &keyframeFilter{name: "video"}
+	packet := marshalTestPacket(t, rtp.Header{SequenceNumber: 1, Timestamp: 1000}, testIDRPayload)
+	if ready := f.push(packet, 1000, false, testIDRPayload); ready != nil {
+		t.Fatalf("forwarded %d packets before the frame ended", len(ready))
+	}
+	// A new timestamp ends the keyframe even though its marker bit never came.
+	next := marshalTestPacket(t, rtp.Header{SequenceNumber: 2, Timestamp: 4000}, testSlicePayload)
+	if ready := f.push(next, 4000, false, testSlicePayload); len(ready) != 1 {
+		t.Errorf("forwarded %d packets of the keyframe, want 1", len(ready))
+	}
+}
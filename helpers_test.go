@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Sets a flag for the duration of the test, the way it would be set on the command line. A list flag is replaced
+// rather than appended to.
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	if list, ok := f.Value.(*stringListFlag); ok {
+		old := *list
+		*list = nil
+		if value != "" {
+			if err := list.Set(value); err != nil {
+				t.Fatalf("setting -%s=%s: %s", name, value, err)
+			}
+		}
+		t.Cleanup(func() { *list = old })
+		return
+	}
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatalf("setting -%s=%s: %s", name, value, err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+}
+
+// Marshals an RTP packet as UE would send it.
+func marshalTestPacket(t *testing.T, header rtp.Header, payload []byte) []byte {
+	t.Helper()
+	header.Version = 2
+	b, err := (&rtp.Packet{Header: header, Payload: payload}).Marshal()
+	if err != nil {
+		t.Fatalf("marshalling test packet: %s", err)
+	}
+	return b
+}
+
+// Listens on a local UDP port standing in for a receiver, closed when the test ends.
+func listenTestReceiver(t *testing.T) (*net.UDPConn, int) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listening for the test receiver: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Reads the next datagram the test receiver gets, failing the test if none arrives within a second.
+func readTestDatagram(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1600)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("reading from the test receiver: %s", err)
+	}
+	return b[:n]
+}
+
+// Creates a destination forwarding to a test receiver on localhost, closed when the test ends.
+func createTestDestination(t *testing.T, payloadType uint8) (*udpConn, *net.UDPConn) {
+	t.Helper()
+	receiver, port := listenTestReceiver(t)
+	destination, err := createUDPConnection("127.0.0.1", port, payloadType)
+	if err != nil {
+		t.Fatalf("creating the test destination: %s", err)
+	}
+	t.Cleanup(destination.close)
+	return destination, receiver
+}
+
+// Listens on count local UDP ports step apart, standing in for the receivers of consecutive tracks or receivers, and
+// returns them along with the first port.
+func listenTestPorts(t *testing.T, count int, step int) ([]*net.UDPConn, int) {
+	t.Helper()
+	for attempt := 0; attempt < 20; attempt++ {
+		first, base := listenTestReceiver(t)
+		listeners := []*net.UDPConn{first}
+		for i := 1; i < count; i++ {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: base + i*step})
+			if err != nil {
+				break
+			}
+			t.Cleanup(func() { conn.Close() })
+			listeners = append(listeners, conn)
+		}
+		if len(listeners) == count {
+			return listeners, base
+		}
+	}
+	t.Fatalf("no %d free ports %d apart", count, step)
+	return nil, 0
+}
+
+// Creates the bridge's peer connection forwarding UE's tracks as setupMediaForwarding does, closed when the test ends.
+func newTestBridge(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	setFlag(t, "CommandHint", "none")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatalf("creating the bridge's peer connection: %s", err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	setupMediaForwarding(bridge)
+	return bridge
+}
+
+// Creates a peer connection standing in for UE, closed when the test ends.
+func newTestUE(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	ue, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("creating the test UE's peer connection: %s", err)
+	}
+	t.Cleanup(func() { ue.Close() })
+	return ue
+}
+
+// Adds a track to the test UE and writes an H264 keyframe or Opus packet to it every 10ms until the test ends.
+func addTestTrack(t *testing.T, ue *webrtc.PeerConnection, kind webrtc.RTPCodecType, id string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}
+	payload := []byte{h264NALTypeIDR | 0x60, 0x88, 0x84, 0x00}
+	if kind == webrtc.RTPCodecTypeAudio {
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: audioClockRate, Channels: 2}
+		payload = []byte{0xfc, 0xff, 0xfe}
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(capability, id, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ue.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		var sequenceNumber uint16
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			sequenceNumber++
+			// Errors are expected until the track is bound.
+			_ = track.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: sequenceNumber, Timestamp: uint32(sequenceNumber) * 1800},
+				Payload: payload,
+			})
+		}
+	}()
+	return track
+}
+
+// lockedBuffer - A buffer the log can write to from any goroutine while the test reads it.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// Captures what is logged until the test ends.
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+	logged := &lockedBuffer{}
+	log.SetOutput(logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return logged
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How far the sequence number can jump between consecutive packets before we call it corruption rather than loss or
+// reordering. At 1200 byte packets that's over a megabyte lost in one go.
+const maxSequenceGap = 1000
+
+// The window CorruptionThreshold counts corrupt packets over.
+const corruptionWindow = 10 * time.Second
+
+// integrityChecker - Checks the packets read from a track for signs of corruption upstream (an RTP version other than
+// 2, a payload type we didn't negotiate, absurd sequence number jumps), so encoder problems can be told apart from
+// forwarding bugs. Only used from the track's forwarding loop.
+type integrityChecker struct {
+	name         string
+	payloadTypes map[uint8]bool
+	stats        *trackStats
+	// Called when CorruptionThreshold corrupt packets are seen within corruptionWindow.
+	onThreshold func()
+
+	lastSequence uint16
+	started      bool
+	windowStart  time.Time
+	windowCount  int
+}
+
+func newIntegrityChecker(name string, payloadTypes []uint8, stats *trackStats, onThreshold func()) *integrityChecker {
+	c := &integrityChecker{name: name, payloadTypes: make(map[uint8]bool), stats: stats, onThreshold: onThreshold}
+	for _, payloadType := range payloadTypes {
+		c.payloadTypes[payloadType] = true
+	}
+	return c
+}
+
+// Checks a packet as read from the track, returns false if it is corrupt and should be dropped rather than forwarded.
+func (c *integrityChecker) check(packet []byte, now time.Time) bool {
+	problem := c.problem(packet)
+	if problem == "" {
+		return true
+	}
+	c.stats.addCorrupt()
+	log.Printf("Dropping corrupt %s packet: %s.", c.name, problem)
+
+	if *CorruptionThreshold == 0 {
+		return false
+	}
+	if now.Sub(c.windowStart) > corruptionWindow {
+		c.windowStart = now
+		c.windowCount = 0
+	}
+	c.windowCount++
+	if c.windowCount == *CorruptionThreshold {
+		log.Printf("%d corrupt %s packets within %s, handling it with -OnCorruption=%s.", c.windowCount, c.name, corruptionWindow, *OnCorruption)
+		c.onThreshold()
+	}
+	return false
+}
+
+// Describes what is wrong with the packet, or "" if nothing obviously is.
+func (c *integrityChecker) problem(packet []byte) string {
+	if len(packet) < 12 {
+		return fmt.Sprintf("%d bytes is shorter than an RTP header", len(packet))
+	}
+	if version := packet[0] >> 6; version != 2 {
+		return fmt.Sprintf("RTP version %d", version)
+	}
+	if payloadType := packet[1] & 0x7f; !c.payloadTypes[payloadType] {
+		return fmt.Sprintf("payload type %d was not negotiated", payloadType)
+	}
+
+	sequence := binary.BigEndian.Uint16(packet[2:4])
+	gap := int16(sequence - c.lastSequence)
+	if c.started && (gap > maxSequenceGap || gap < -maxSequenceGap) {
+		// Carry on from here, if the stream really did jump only the first packet is counted.
+		c.lastSequence = sequence
+		return fmt.Sprintf("sequence number jumped by %d", gap)
+	}
+	if !c.started || gap > 0 {
+		c.lastSequence = sequence
+	}
+	c.started = true
+	return ""
+}
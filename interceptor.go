@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// packetInterceptor - Sees the packets of every track, for code building on the forwarder to inspect, change or drop
+// them, e.g. to scrub header extensions, tag packets or mirror them elsewhere. Embed noopInterceptor to only implement
+// one of the methods.
+//
+// Both methods are called on the track's own goroutines with the track's name, e.g. video or audio1, interceptRTP for
+// each packet that made it through the forwarding filters, just before it goes to the sinks (UDP destinations,
+// recordings, RTSP...), and interceptRTCP for each RTCP packet UE sends on the track, before the bridge uses it and,
+// with ForwardRTCP, forwards it. Interceptors run in the order they were registered and returning false drops the
+// packet for the ones after too. They run for every packet, so they should return quickly and not block: a slow
+// interceptor holds up the track's forwarding and UE's packets queue up behind it.
+type packetInterceptor interface {
+	// The packet can be changed in place, the bridge marshals it again afterwards. It is only valid during the call.
+	interceptRTP(track string, packet *rtp.Packet) bool
+	interceptRTCP(track string, packet rtcp.Packet) bool
+}
+
+// noopInterceptor - Keeps every packet as it is.
+type noopInterceptor struct{}
+
+func (noopInterceptor) interceptRTP(track string, packet *rtp.Packet) bool { return true }
+
+func (noopInterceptor) interceptRTCP(track string, packet rtcp.Packet) bool { return true }
+
+var (
+	packetInterceptorsMu sync.Mutex
+	packetInterceptors   []packetInterceptor
+)
+
+// Registers an interceptor for the packets of every track from then on, before the session starts so it sees them all.
+func registerPacketInterceptor(interceptor packetInterceptor) {
+	packetInterceptorsMu.Lock()
+	defer packetInterceptorsMu.Unlock()
+	packetInterceptors = append(packetInterceptors, interceptor)
+}
+
+// packetInterceptorChain - The interceptors registered when a track started, in order.
+type packetInterceptorChain []packetInterceptor
+
+func currentPacketInterceptors() packetInterceptorChain {
+	packetInterceptorsMu.Lock()
+	defer packetInterceptorsMu.Unlock()
+	return append(packetInterceptorChain{}, packetInterceptors...)
+}
+
+// Runs the packet through the interceptors, returning whether to forward it. The packet's Raw bytes are marshalled
+// again if there were any, so the sinks writing them send what the interceptors made of it.
+func (c packetInterceptorChain) interceptRTP(track string, packet *rtp.Packet) bool {
+	if len(c) == 0 {
+		return true
+	}
+	for _, interceptor := range c {
+		if !interceptor.interceptRTP(track, packet) {
+			return false
+		}
+	}
+	raw, err := packet.Marshal()
+	if err != nil {
+		return false
+	}
+	packet.Raw = raw
+	return true
+}
+
+func (c packetInterceptorChain) interceptRTCP(track string, packet rtcp.Packet) bool {
+	for _, interceptor := range c {
+		if !interceptor.interceptRTCP(track, packet) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Registers an interceptor for the duration of the test.
+func registerTestPacketInterceptor(t *testing.T, interceptor packetInterceptor) {
+	t.Helper()
+	packetInterceptorsMu.Lock()
+	old := packetInterceptors
+	packetInterceptorsMu.Unlock()
+	t.Cleanup(func() {
+		packetInterceptorsMu.Lock()
+		defer packetInterceptorsMu.Unlock()
+		packetInterceptors = old
+	})
+	registerPacketInterceptor(interceptor)
+}
+
+// testInterceptor - Counts the RTP packets it sees of each track and runs rtp on them if set, keeping them unless drop.
+type testInterceptor struct {
+	noopInterceptor
+	drop  bool
+	rtp   func(packet *rtp.Packet)
+	seen  int32
+	track atomic.Value
+}
+
+func (i *testInterceptor) interceptRTP(track string, packet *rtp.Packet) bool {
+	atomic.AddInt32(&i.seen, 1)
+	i.track.Store(track)
+	if i.rtp != nil {
+		i.rtp(packet)
+	}
+	return !i.drop
+}
+
+func (i *testInterceptor) count() int {
+	return int(atomic.LoadInt32(&i.seen))
+}
+
+func TestPacketInterceptorChain(t *testing.T) {
+	raw := marshalTestPacket(t, rtp.Header{SequenceNumber: 1, PayloadType: 102}, testIDRPayload)
+	unmarshal := func() *rtp.Packet {
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte{}, raw...)); err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+
+	t.Run("no interceptors", func(t *testing.T) {
+		packet := unmarshal()
+		if !packetInterceptorChain(nil).interceptRTP("video", packet) {
+			t.Error("packet dropped")
+		}
+		if string(packet.Raw) != string(raw) {
+			t.Error("packet marshalled again")
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		packet := unmarshal()
+		rewrite := &testInterceptor{rtp: func(packet *rtp.Packet) { packet.PayloadType = 96 }}
+		after := &testInterceptor{rtp: func(packet *rtp.Packet) {
+			if packet.PayloadType != 96 {
+				t.Errorf("the next interceptor saw payload type %d", packet.PayloadType)
+			}
+		}}
+		if !(packetInterceptorChain{rewrite, after}).interceptRTP("video", packet) {
+			t.Fatal("packet dropped")
+		}
+		forwarded := &rtp.Packet{}
+		if err := forwarded.Unmarshal(packet.Raw); err != nil {
+			t.Fatal(err)
+		}
+		if forwarded.PayloadType != 96 || forwarded.SequenceNumber != 1 {
+			t.Errorf("forwarding payload type %d sequence number %d, want 96 and 1", forwarded.PayloadType, forwarded.SequenceNumber)
+		}
+	})
+
+	t.Run("dropped", func(t *testing.T) {
+		drop := &testInterceptor{drop: true}
+		after := &testInterceptor{}
+		if (packetInterceptorChain{drop, after}).interceptRTP("video", unmarshal()) {
+			t.Error("packet kept")
+		}
+		if drop.count() != 1 || after.count() != 0 {
+			t.Errorf("interceptors saw %d and %d packets, want 1 and 0", drop.count(), after.count())
+		}
+	})
+}
+
+// testRTCPInterceptor - Drops every RTCP packet.
+type testRTCPInterceptor struct {
+	noopInterceptor
+	seen int
+}
+
+func (i *testRTCPInterceptor) interceptRTCP(track string, packet rtcp.Packet) bool {
+	i.seen++
+	return false
+}
+
+func TestPacketInterceptorChainRTCP(t *testing.T) {
+	drop := &testRTCPInterceptor{}
+	after := &testRTCPInterceptor{}
+	if (packetInterceptorChain{noopInterceptor{}, drop, after}).interceptRTCP("video", &rtcp.PictureLossIndication{}) {
+		t.Error("RTCP packet kept")
+	}
+	if drop.seen != 1 || after.seen != 0 {
+		t.Errorf("interceptors saw %d and %d packets, want 1 and 0", drop.seen, after.seen)
+	}
+	// RTP goes through interceptors only implementing RTCP untouched.
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: testIDRPayload}
+	if !(packetInterceptorChain{drop}).interceptRTP("video", packet) {
+		t.Error("RTP packet dropped")
+	}
+}
+
+func TestPacketInterceptorForwarding(t *testing.T) {
+	listener, port := listenTestReceiver(t)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+	tag := &testInterceptor{rtp: func(packet *rtp.Packet) { packet.SSRC = 1234 }}
+	registerTestPacketInterceptor(t, tag)
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectForwardedRTP(listener, "video", uint8(*RTPVideoPayloadType), 1234, time.Now().Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if tag.count() == 0 {
+		t.Error("interceptor saw no packets")
+	}
+	if track, _ := tag.track.Load().(string); track != "video" {
+		t.Errorf("interceptor saw track %q, want video", track)
+	}
+}
+
+func TestPacketInterceptorDropsForwarding(t *testing.T) {
+	listener, port := listenTestReceiver(t)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+	drop := &testInterceptor{drop: true}
+	registerTestPacketInterceptor(t, drop)
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	if err := negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for drop.count() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("interceptor saw no packets")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	b := make([]byte, 1600)
+	if n, err := listener.Read(b); err == nil {
+		t.Errorf("dropped packet %d forwarded", binary.BigEndian.Uint16(b[2:n]))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The peer connection of the current session, for the control API to read its session descriptions. Nil between
+// sessions.
+var liveSession struct {
+	mu             sync.Mutex
+	peerConnection *webrtc.PeerConnection
+}
+
+// Sets the current session's peer connection, nil once the session has ended.
+func setLivePeerConnection(peerConnection *webrtc.PeerConnection) {
+	liveSession.mu.Lock()
+	defer liveSession.mu.Unlock()
+	liveSession.peerConnection = peerConnection
+}
+
+// Reports whether a session is running.
+func sessionLive() bool {
+	liveSession.mu.Lock()
+	defer liveSession.mu.Unlock()
+	return liveSession.peerConnection != nil
+}
+
+// liveSDP - The current session descriptions as GET /sdp returns them, either is null until it is set.
+type liveSDP struct {
+	Local  *webrtc.SessionDescription `json:"local"`
+	Remote *webrtc.SessionDescription `json:"remote"`
+}
+
+// Returns the current session descriptions, ok is false between sessions.
+func currentSDP() (liveSDP, bool) {
+	liveSession.mu.Lock()
+	defer liveSession.mu.Unlock()
+	if liveSession.peerConnection == nil {
+		return liveSDP{}, false
+	}
+	return liveSDP{Local: liveSession.peerConnection.LocalDescription(), Remote: liveSession.peerConnection.RemoteDescription()}, true
+}
+
+// Returns the current session's DTLS certificate fingerprints, ok is false between sessions.
+func currentFingerprints() (dtlsFingerprints, bool) {
+	liveSession.mu.Lock()
+	defer liveSession.mu.Unlock()
+	if liveSession.peerConnection == nil {
+		return dtlsFingerprints{}, false
+	}
+	return readDTLSFingerprints(liveSession.peerConnection), true
+}
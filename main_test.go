@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestCreatePeerConnectionTransceivers(t *testing.T) {
+	setFlag(t, "AudioTrackCount", "2")
+	peerConnection, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+	kinds := map[webrtc.RTPCodecType]int{}
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Direction() != webrtc.RTPTransceiverDirectionRecvonly {
+			t.Errorf("%s transceiver is %s, want recvonly", transceiver.Kind(), transceiver.Direction())
+		}
+		kinds[transceiver.Kind()]++
+	}
+	if kinds[webrtc.RTPCodecTypeAudio] != 2 || kinds[webrtc.RTPCodecTypeVideo] != 1 {
+		t.Errorf("transceivers are %v, want 2 audio and 1 video", kinds)
+	}
+}
+
+func TestCreatePeerConnectionTransceiverFailure(t *testing.T) {
+	setFlag(t, "AudioTrackCount", "2")
+	// Pion 3.0.4 can't be made to fail adding a recvonly transceiver through its MediaEngine, so the video one fails
+	// here, after the audio ones were added.
+	var added int
+	var failed *webrtc.PeerConnection
+	addTransceiverFromKind = func(peerConnection *webrtc.PeerConnection, kind webrtc.RTPCodecType, init ...webrtc.RtpTransceiverInit) (*webrtc.RTPTransceiver, error) {
+		if kind == webrtc.RTPCodecTypeVideo {
+			failed = peerConnection
+			return nil, errors.New("no video for you")
+		}
+		added++
+		return peerConnection.AddTransceiverFromKind(kind, init...)
+	}
+	t.Cleanup(func() { addTransceiverFromKind = (*webrtc.PeerConnection).AddTransceiverFromKind })
+
+	peerConnection, err := createPeerConnection(nil)
+	if err == nil {
+		peerConnection.Close()
+		t.Fatal("created a peer connection without its video transceiver")
+	}
+	if peerConnection != nil || !strings.Contains(err.Error(), "adding RTP video transceiver") {
+		t.Errorf("returned %v and %q, want no peer connection and an error naming the video transceiver", peerConnection, err)
+	}
+	if added != 2 {
+		t.Errorf("added %d audio transceivers before the video one, want 2", added)
+	}
+	if failed.SignalingState() != webrtc.SignalingStateClosed {
+		t.Errorf("the partially created peer connection was left %s, want it closed", failed.SignalingState())
+	}
+}
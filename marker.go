@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+const rtpMarkerBit = 0x80
+
+// markerNormalizer - Makes the RTP marker bit of forwarded video packets mark exactly the last packet of each frame.
+// We only know a packet was the last of its frame once the next packet arrives with a different timestamp, so one packet
+// is always held back, which delays the end of each frame by up to one frame interval.
+type markerNormalizer struct {
+	held []byte
+}
+
+// Adds a marshalled packet (which is copied), returns the previously held packet with its marker bit fixed, if any.
+func (m *markerNormalizer) push(packet []byte) []byte {
+	previous := m.held
+	m.held = append(m.held[:0:0], packet...)
+	if previous == nil {
+		return nil
+	}
+
+	if rtpTimestamp(previous) != rtpTimestamp(packet) {
+		previous[1] |= rtpMarkerBit
+	} else {
+		previous[1] &^= rtpMarkerBit
+	}
+	return previous
+}
+
+func rtpTimestamp(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[4:])
+}
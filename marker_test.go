@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestMarkerNormalizer(t *testing.T) {
+	tests := []struct {
+		name string
+		// The timestamp and marker bit of each packet as UE sent it.
+		timestamps []uint32
+		markers    []bool
+		// The marker bits forwarded, for all packets but the last which is still held.
+		want []bool
+	}{
+		{"correct markers kept", []uint32{1, 1, 1, 2, 2, 3}, []bool{false, false, true, false, true, true}, []bool{false, false, true, false, true}},
+		{"missing markers added", []uint32{1, 1, 1, 2, 2, 3}, []bool{false, false, false, false, false, false}, []bool{false, false, true, false, true}},
+		{"markers inside a frame cleared", []uint32{1, 1, 1, 2, 2, 3}, []bool{true, true, true, true, true, true}, []bool{false, false, true, false, true}},
+		{"single packet frames", []uint32{1, 2, 3, 4}, []bool{false, true, false, true}, []bool{true, true, true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &markerNormalizer{}
+			var got []bool
+			for i, timestamp := range test.timestamps {
+				packet := marshalTestPacket(t, rtp.Header{SequenceNumber: uint16(i), Timestamp: timestamp, Marker: test.markers[i]}, []byte{byte(i)})
+				forwarded := m.push(packet)
+				if i == 0 {
+					if forwarded != nil {
+						t.Fatal("the first packet was forwarded before the next showed where its frame ends")
+					}
+					continue
+				}
+				var p rtp.Packet
+				if err := p.Unmarshal(forwarded); err != nil {
+					t.Fatal(err)
+				}
+				if p.SequenceNumber != uint16(i-1) || p.Payload[0] != byte(i-1) {
+					t.Fatalf("forwarded packet %d after packet %d, want the one before", p.SequenceNumber, i)
+				}
+				got = append(got, p.Marker)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("marker bits forwarded as %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMarkerNormalizerCopies(t *testing.T) {
+	m := &markerNormalizer{}
+	// The forwarding reuses its read buffer, the held packet must not change with it.
+	buffer := marshalTestPacket(t, rtp.Header{SequenceNumber: 1, Timestamp: 1}, []byte{1})
+	m.push(buffer)
+	copy(buffer, marshalTestPacket(t, rtp.Header{SequenceNumber: 2, Timestamp: 2}, []byte{2}))
+	forwarded := m.push(buffer)
+	if rtpSequenceNumber(forwarded) != 1 || forwarded[rtpHeaderLength] != 1 {
+		t.Errorf("held packet changed with the buffer it was read into")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	tsPacketSize = 188
+	// 7 TS packets (1316 bytes) per datagram, the usual choice as it's the most that fits an Ethernet MTU.
+	tsPacketsPerDatagram = 7
+	tsPMTPID             = 0x1000
+	tsVideoPID           = 0x100
+	tsAudioPID           = 0x101
+	// How often the PAT and PMT are repeated so a receiver joining mid-stream can find the streams.
+	tsTableInterval = 500 * time.Millisecond
+	// How far (in 90kHz ticks) the PTS runs ahead of the PCR, the receiver's buffer to absorb network jitter.
+	tsPTSDelay = 90000 * 4 / 10
+)
+
+// tsStream - A track muxed into the transport stream.
+type tsStream struct {
+	pid        uint16
+	streamType uint8
+	streamID   uint8
+	clock      rtpClock
+	channels   uint16
+	// The RTP timestamp and PTS of the stream's first packet, which every later PTS is derived from.
+	anchored      bool
+	firstRTPTime  uint32
+	firstPTS      int64
+	continuity    uint8
+	frame         []byte
+	frameRTPTime  uint32
+	frameKeyframe bool
+	framePackets  int
+	seenKeyframe  bool
+}
+
+// tsMuxer - Depacketizes the first video (H264) and audio (Opus) tracks, muxes them into a single MPEG-TS and sends it
+// over UDP, for the many players and set-top boxes that take TS over UDP rather than RTP. The PCR follows the wall
+// clock and each stream's PTS follows its RTP timestamps from when its first packet arrived.
+type tsMuxer struct {
+	raddr *net.UDPAddr
+	ttl   int
+
+	mu          sync.Mutex
+	conn        *net.UDPConn
+	start       time.Time
+	streams     map[string]*tsStream
+	patCC       uint8
+	pmtCC       uint8
+	pmtVersion  uint8
+	lastTables  time.Time
+	tablesDirty bool
+	pending     []byte
+}
+
+// Parses a udp://host:port URL to send the transport stream to, multicast destinations are sent to with the TTL.
+func newTSMuxer(rawURL string, ttl int) (*tsMuxer, error) {
+	raddr, err := parseMpegTSURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &tsMuxer{raddr: raddr, ttl: ttl, streams: make(map[string]*tsStream)}, nil
+}
+
+// Connects to the destination for a new transport stream, once the first track arrives.
+func (m *tsMuxer) dial() error {
+	// Sent from Interface if one is set, a multicast group then goes out of it too.
+	laddr, err := interfaceLocalAddr(m.raddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", laddr, m.raddr)
+	if err != nil {
+		return err
+	}
+	if m.raddr.IP.IsMulticast() {
+		if err = ipv4.NewPacketConn(conn).SetMulticastTTL(m.ttl); err != nil {
+			log.Printf("Error setting multicast TTL %d for %s. Error: %s", m.ttl, m.raddr, err.Error())
+		}
+	}
+	m.conn = conn
+	m.start = time.Now()
+	m.pending = nil
+	sessionPrintln(fmt.Sprintf("Muxing the forwarded streams into MPEG-TS to udp://%s.", m.raddr))
+	return nil
+}
+
+func parseMpegTSURL(rawURL string) (*net.UDPAddr, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, fmt.Errorf("%q is not a udp://host:port URL", rawURL)
+	}
+	return net.ResolveUDPAddr("udp", u.Host)
+}
+
+// Adds a forwarded track to the transport stream, only the "video" and "audio" tracks are muxed.
+func (m *tsMuxer) addTrack(name string, track *webrtc.TrackRemote) {
+	if name != "video" && name != "audio" {
+		return
+	}
+	codec := track.Codec()
+	stream := &tsStream{clock: trackClock(track), channels: codec.Channels}
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		// H.264 video.
+		stream.pid, stream.streamType, stream.streamID = tsVideoPID, 0x1B, 0xE0
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		// Private data in private stream 1, identified as Opus by the PMT's registration descriptor.
+		stream.pid, stream.streamType, stream.streamID = tsAudioPID, 0x06, 0xBD
+	default:
+		log.Printf("Muxing %s into MPEG-TS is not supported, the %s track will be left out.", codec.MimeType, name)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		if err := m.dial(); err != nil {
+			log.Printf("Error connecting to MPEG-TS destination %s. Error: %s", m.raddr, err.Error())
+			return
+		}
+	}
+	m.streams[name] = stream
+	m.tablesDirty = true
+}
+
+// Removes a track that stopped forwarding from the transport stream, once the last one has gone the stream ends.
+func (m *tsMuxer) removeTrack(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stream, ok := m.streams[name]
+	if !ok {
+		return
+	}
+	m.resetVideoFrame(stream)
+	delete(m.streams, name)
+	m.tablesDirty = true
+	if len(m.streams) == 0 {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// Takes a forwarded RTP packet of the named track, video is gathered into frames and muxed once each frame is
+// complete, each audio packet is muxed straight away.
+func (m *tsMuxer) writeRTP(name string, rtpPacket *rtp.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stream, ok := m.streams[name]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if !stream.anchored {
+		stream.anchored = true
+		stream.firstRTPTime = rtpPacket.Timestamp
+		stream.firstPTS = m.clock(now) + tsPTSDelay
+	}
+
+	if stream.pid == tsAudioPID {
+		m.writeFrame(stream, opusAccessUnit(rtpPacket.Payload), rtpPacket.Timestamp, false, now)
+		return
+	}
+
+	// A frame is complete at its marker bit, or when a packet of the next frame shows we missed it.
+	if len(stream.frame) > 0 && stream.frameRTPTime != rtpPacket.Timestamp {
+		m.flushVideoFrame(stream, now)
+	}
+	nalus, err := (&codecs.H264Packet{}).Unmarshal(rtpPacket.Payload)
+	if err != nil {
+		return
+	}
+	held := len(stream.frame)
+	if held == 0 {
+		// Starting each access unit with an access unit delimiter, which some TS demuxers require.
+		stream.frame = append(stream.frame[:0], 0x00, 0x00, 0x00, 0x01, 0x09, 0xF0)
+		stream.frameRTPTime = rtpPacket.Timestamp
+		stream.frameKeyframe = false
+		stream.framePackets = 0
+	}
+	stream.frame = append(stream.frame, nalus...)
+	stream.framePackets++
+	sessionBuffers.add(len(stream.frame) - held)
+	// The NAL units can't be split back into packets to drop the oldest ones, so the whole frame goes.
+	if sessionBuffers.over() {
+		sessionBuffers.addShed(name, "dropped with the frame being muxed to MPEG-TS", stream.framePackets, now)
+		m.resetVideoFrame(stream)
+		return
+	}
+	stream.frameKeyframe = stream.frameKeyframe || isH264Keyframe(rtpPacket.Payload)
+	if rtpPacket.Marker {
+		m.flushVideoFrame(stream, now)
+	}
+}
+
+func (m *tsMuxer) flushVideoFrame(stream *tsStream, now time.Time) {
+	// Decoders can't do anything with the frames before the first keyframe.
+	stream.seenKeyframe = stream.seenKeyframe || stream.frameKeyframe
+	if stream.seenKeyframe {
+		m.writeFrame(stream, stream.frame, stream.frameRTPTime, stream.frameKeyframe, now)
+	}
+	m.resetVideoFrame(stream)
+}
+
+// Starts gathering the next frame, the one held so far no longer counts against MaxSessionBufferBytes.
+func (m *tsMuxer) resetVideoFrame(stream *tsStream) {
+	sessionBuffers.remove(len(stream.frame))
+	stream.frame = stream.frame[:0]
+}
+
+// The 90kHz clock the PCR runs on, counting from when the transport stream started.
+func (m *tsMuxer) clock(now time.Time) int64 {
+	return rtpClock(90000).ticks(now.Sub(m.start))
+}
+
+// Muxes an access unit as a PES packet, with the tables first if they are due and a PCR if this stream carries it.
+func (m *tsMuxer) writeFrame(stream *tsStream, accessUnit []byte, rtpTime uint32, keyframe bool, now time.Time) {
+	if m.tablesDirty || keyframe || now.Sub(m.lastTables) >= tsTableInterval {
+		m.writeTables()
+		m.lastTables = now
+	}
+	// Scaled straight to 90kHz, going through a time.Duration would round some PTS down a tick.
+	pts := stream.firstPTS + rtpTimestampDiff(stream.firstRTPTime, rtpTime)*90000/int64(stream.clock)
+	var pcr int64 = -1
+	if stream.pid == m.pcrPID() {
+		pcr = m.clock(now)
+	}
+	m.writePackets(stream.pid, &stream.continuity, pesPacket(stream.streamID, pts, accessUnit), pcr, keyframe)
+	m.sendPending()
+}
+
+// Video carries the PCR when we have it, otherwise audio.
+func (m *tsMuxer) pcrPID() uint16 {
+	if _, ok := m.streams["video"]; ok {
+		return tsVideoPID
+	}
+	return tsAudioPID
+}
+
+// Writes the PAT and the PMT describing the streams we currently have.
+func (m *tsMuxer) writeTables() {
+	if m.tablesDirty {
+		m.pmtVersion = (m.pmtVersion + 1) & 0x1F
+		m.tablesDirty = false
+	}
+	// Program 1, its PMT on tsPMTPID.
+	pat := psiSection(0x00, 0x0001, 0, []byte{0x00, 0x01, 0xE0 | tsPMTPID>>8, tsPMTPID & 0xFF})
+	m.writePackets(0x0000, &m.patCC, append([]byte{0x00}, pat...), -1, false)
+
+	pcrPID := m.pcrPID()
+	program := []byte{0xE0 | byte(pcrPID>>8), byte(pcrPID), 0xF0, 0x00}
+	for _, name := range []string{"video", "audio"} {
+		stream, ok := m.streams[name]
+		if !ok {
+			continue
+		}
+		var descriptors []byte
+		if stream.pid == tsAudioPID {
+			// Registration descriptor "Opus" and the DVB extension descriptor with the channel configuration.
+			channels := byte(stream.channels)
+			if channels == 0 || channels > 2 {
+				channels = 2
+			}
+			descriptors = []byte{0x05, 0x04, 'O', 'p', 'u', 's', 0x7F, 0x02, 0x80, channels}
+		}
+		program = append(program, stream.streamType, 0xE0|byte(stream.pid>>8), byte(stream.pid), 0xF0|byte(len(descriptors)>>8), byte(len(descriptors)))
+		program = append(program, descriptors...)
+	}
+	pmt := psiSection(0x02, 0x0001, m.pmtVersion, program)
+	m.writePackets(tsPMTPID, &m.pmtCC, append([]byte{0x00}, pmt...), -1, false)
+}
+
+// Splits a payload (a PES packet, or a pointer field and PSI section) into TS packets on the PID. The first packet
+// carries the PCR if pcr isn't negative, and is flagged as a random access point for keyframes.
+func (m *tsMuxer) writePackets(pid uint16, continuity *uint8, payload []byte, pcr int64, randomAccess bool) {
+	for first := true; len(payload) > 0; first = false {
+		packet := make([]byte, 4, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid>>8) & 0x1F
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid)
+
+		var adaptation []byte
+		if first && (pcr >= 0 || randomAccess) {
+			adaptation = []byte{0x00}
+			if randomAccess {
+				adaptation[0] |= 0x40
+			}
+			if pcr >= 0 {
+				adaptation[0] |= 0x10
+				// 33 bit base, 6 reserved bits and a 9 bit extension we leave at 0.
+				adaptation = append(adaptation, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7E, 0x00)
+			}
+		}
+		space := tsPacketSize - 4
+		if adaptation != nil {
+			space -= 1 + len(adaptation)
+		}
+		// The last packet is padded out to the full size with adaptation field stuffing.
+		if stuffing := space - len(payload); stuffing > 0 {
+			if adaptation == nil {
+				stuffing--
+				adaptation = []byte{}
+				if stuffing > 0 {
+					adaptation = append(adaptation, 0x00)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				adaptation = append(adaptation, 0xFF)
+			}
+			space = len(payload)
+		}
+
+		packet[3] = 0x10 | *continuity
+		if adaptation != nil {
+			packet[3] |= 0x20
+			packet = append(packet, byte(len(adaptation)))
+			packet = append(packet, adaptation...)
+		}
+		packet = append(packet, payload[:space]...)
+		payload = payload[space:]
+		*continuity = (*continuity + 1) & 0x0F
+		m.pending = append(m.pending, packet...)
+	}
+}
+
+// Sends the muxed TS packets in datagrams of tsPacketsPerDatagram, the remainder waits for the next frame.
+func (m *tsMuxer) sendPending() {
+	const datagramSize = tsPacketSize * tsPacketsPerDatagram
+	for len(m.pending) >= datagramSize {
+		logWriteError(m.conn.RemoteAddr().String(), writeUDP(m.conn, m.pending[:datagramSize]))
+		m.pending = m.pending[datagramSize:]
+	}
+	m.pending = append(m.pending[:0:0], m.pending...)
+}
+
+// A PES packet with a PTS. Video PES packets leave the length at 0 (unbounded) as frames may not fit 16 bits.
+func pesPacket(streamID uint8, pts int64, payload []byte) []byte {
+	pes := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+	pes = append(pes,
+		0x21|byte(pts>>29)&0x0E, byte(pts>>22), 0x01|byte(pts>>14)&0xFE, byte(pts>>7), 0x01|byte(pts<<1)&0xFE)
+	if length := len(pes) - 6 + len(payload); streamID != 0xE0 && length <= 0xFFFF {
+		pes[4], pes[5] = byte(length>>8), byte(length)
+	}
+	return append(pes, payload...)
+}
+
+// An Opus packet with the control header Opus in MPEG-TS puts in front of each one (ETSI TS 102 366 style), giving
+// its size.
+func opusAccessUnit(payload []byte) []byte {
+	accessUnit := []byte{0x7F, 0xE0}
+	size := len(payload)
+	for ; size >= 0xFF; size -= 0xFF {
+		accessUnit = append(accessUnit, 0xFF)
+	}
+	accessUnit = append(accessUnit, byte(size))
+	return append(accessUnit, payload...)
+}
+
+// A long-form PSI section with its CRC, for the PAT (table 0) and PMT (table 2).
+func psiSection(tableID uint8, id uint16, version uint8, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{tableID, 0xB0 | byte(length>>8), byte(length), byte(id >> 8), byte(id), 0xC1 | version<<1, 0x00, 0x00}
+	section = append(section, body...)
+	crc := mpegCRC32(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// The CRC-32/MPEG-2 of the data, unlike hash/crc32's IEEE CRC it isn't bit reflected.
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
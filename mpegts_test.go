@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// The PES packets (or pointer field and PSI section) of each PID in a transport stream, after checking every TS
+// packet's sync byte and continuity counter.
+func demuxTestTS(t *testing.T, ts []byte) map[uint16][][]byte {
+	t.Helper()
+	if len(ts)%tsPacketSize != 0 {
+		t.Fatalf("transport stream is %d bytes, not whole %d byte packets", len(ts), tsPacketSize)
+	}
+	units := map[uint16][][]byte{}
+	continuity := map[uint16]uint8{}
+	for i := 0; i < len(ts); i += tsPacketSize {
+		packet := ts[i : i+tsPacketSize]
+		if packet[0] != 0x47 {
+			t.Fatalf("packet %d has sync byte %#x", i/tsPacketSize, packet[0])
+		}
+		pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1FFF
+		counter := packet[3] & 0x0F
+		if previous, seen := continuity[pid]; seen && counter != (previous+1)&0x0F {
+			t.Errorf("packet %d on PID %#x has continuity counter %d after %d", i/tsPacketSize, pid, counter, previous)
+		}
+		continuity[pid] = counter
+		if packet[3]&0x10 == 0 {
+			t.Fatalf("packet %d on PID %#x has no payload", i/tsPacketSize, pid)
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		if packet[1]&0x40 != 0 {
+			units[pid] = append(units[pid], nil)
+		} else if len(units[pid]) == 0 {
+			t.Fatalf("packet %d on PID %#x continues a unit that never started", i/tsPacketSize, pid)
+		}
+		last := len(units[pid]) - 1
+		units[pid][last] = append(units[pid][last], payload...)
+	}
+	return units
+}
+
+// The PSI section a unit carries after its pointer field, with the CRC checked.
+func testPSISection(t *testing.T, unit []byte) []byte {
+	t.Helper()
+	section := unit[1+int(unit[0]):]
+	length := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	section = section[:3+length]
+	// The CRC-32/MPEG-2 over a section with its CRC is 0.
+	if crc := mpegCRC32(section); crc != 0 {
+		t.Errorf("table %d's CRC doesn't check, the CRC over it is %#x", section[0], crc)
+	}
+	return section
+}
+
+// The PTS and payload of a PES packet.
+func testPESPacket(t *testing.T, pes []byte) (int64, []byte) {
+	t.Helper()
+	if !bytes.Equal(pes[:3], []byte{0x00, 0x00, 0x01}) || pes[7]&0x80 == 0 {
+		t.Fatalf("PES packet % x has no start code or PTS", pes[:9])
+	}
+	p := pes[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, pes[9+int(pes[8]):]
+}
+
+func TestMpegCRC32(t *testing.T) {
+	// The CRC-32/MPEG-2 check value.
+	if crc := mpegCRC32([]byte("123456789")); crc != 0x0376E6E7 {
+		t.Errorf("CRC of 123456789 is %#x, want 0x0376e6e7", crc)
+	}
+}
+
+func TestTSMuxer(t *testing.T) {
+	listener, port := listenTestReceiver(t)
+	muxer, err := newTSMuxer(fmt.Sprintf("udp://127.0.0.1:%d", port), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxer.mu.Lock()
+	if err = muxer.dial(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { muxer.conn.Close() })
+	// Anchored at known RTP timestamps, the 33 bit PTS past 32 bits and the video's RTP timestamp about to wrap.
+	muxer.streams["video"] = &tsStream{pid: tsVideoPID, streamType: 0x1B, streamID: 0xE0, clock: 90000,
+		anchored: true, firstRTPTime: 0xFFFFF000, firstPTS: 1<<32 + 5}
+	muxer.streams["audio"] = &tsStream{pid: tsAudioPID, streamType: 0x06, streamID: 0xBD, clock: 48000, channels: 2,
+		anchored: true, firstRTPTime: 5000, firstPTS: 1<<32 + 5}
+	muxer.tablesDirty = true
+	muxer.mu.Unlock()
+
+	keyframe := append([]byte{h264NALTypeIDR | 0x60}, bytes.Repeat([]byte{0xAB}, 1000)...)
+	delta := append([]byte{0x41}, bytes.Repeat([]byte{0xCD}, 300)...)
+	opus := bytes.Repeat([]byte{0xFC}, 80)
+	muxer.writeRTP("video", &rtp.Packet{Header: rtp.Header{Marker: true, Timestamp: 0xFFFFF000}, Payload: keyframe})
+	muxer.writeRTP("audio", &rtp.Packet{Header: rtp.Header{Timestamp: 5000 + 960}, Payload: opus})
+	// 6000 ticks on, across the wrap.
+	muxer.writeRTP("video", &rtp.Packet{Header: rtp.Header{Marker: true, Timestamp: 6000 - 0x1000}, Payload: delta})
+	for i := 0; i < 20; i++ {
+		muxer.writeRTP("audio", &rtp.Packet{Header: rtp.Header{Timestamp: uint32(5000 + 960*(i+2))}, Payload: opus})
+	}
+
+	var ts []byte
+	buffer := make([]byte, 2048)
+	for {
+		listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := listener.Read(buffer)
+		if err != nil {
+			break
+		}
+		if n != tsPacketSize*tsPacketsPerDatagram {
+			t.Errorf("datagram of %d bytes, want %d TS packets", n, tsPacketsPerDatagram)
+		}
+		ts = append(ts, buffer[:n]...)
+	}
+	muxer.mu.Lock()
+	ts = append(ts, muxer.pending...)
+	muxer.mu.Unlock()
+	units := demuxTestTS(t, ts)
+
+	pat := testPSISection(t, units[0x0000][0])
+	if program := pat[8 : len(pat)-4]; !bytes.Equal(program, []byte{0x00, 0x01, 0xE0 | tsPMTPID>>8, tsPMTPID & 0xFF}) {
+		t.Errorf("PAT lists % x, want program 1 on PID %#x", program, tsPMTPID)
+	}
+	pmt := testPSISection(t, units[tsPMTPID][0])
+	if pcrPID := binary.BigEndian.Uint16(pmt[8:10]) & 0x1FFF; pcrPID != tsVideoPID {
+		t.Errorf("PCR is on PID %#x, want the video's", pcrPID)
+	}
+	want := []byte{0x1B, 0xE1, 0x00, 0xF0, 0x00, 0x06, 0xE1, 0x01, 0xF0, 0x0A, 0x05, 0x04, 'O', 'p', 'u', 's', 0x7F, 0x02, 0x80, 0x02}
+	if streams := pmt[12 : len(pmt)-4]; !bytes.Equal(streams, want) {
+		t.Errorf("PMT streams are % x, want % x", streams, want)
+	}
+
+	video := units[tsVideoPID]
+	if len(video) != 2 {
+		t.Fatalf("got %d video PES packets, want 2", len(video))
+	}
+	pts, payload := testPESPacket(t, video[0])
+	if pts != 1<<32+5 {
+		t.Errorf("first video PTS is %d, want %d", pts, int64(1<<32+5))
+	}
+	if wantAU := append([]byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0, 0x00, 0x00, 0x00, 0x01}, keyframe...); !bytes.Equal(payload, wantAU) {
+		t.Errorf("keyframe access unit is %d bytes, want the delimiter and the %d byte NAL unit", len(payload), len(keyframe))
+	}
+	if pts, _ = testPESPacket(t, video[1]); pts != 1<<32+5+6000 {
+		t.Errorf("second video PTS is %d, want 6000 ticks on", pts)
+	}
+
+	audio := units[tsAudioPID]
+	if len(audio) != 21 {
+		t.Fatalf("got %d audio PES packets, want 21", len(audio))
+	}
+	pts, payload = testPESPacket(t, audio[0])
+	// 960 ticks at 48kHz is 20ms, 1800 ticks at 90kHz.
+	if pts != 1<<32+5+1800 {
+		t.Errorf("first audio PTS is %d, want 1800 ticks on", pts)
+	}
+	if wantAU := append([]byte{0x7F, 0xE0, byte(len(opus))}, opus...); !bytes.Equal(payload, wantAU) {
+		t.Errorf("Opus access unit is % x, want the control header and the packet", payload)
+	}
+	if length := int(binary.BigEndian.Uint16(audio[0][4:6])); length != len(audio[0])-6 {
+		t.Errorf("audio PES length is %d, want %d", length, len(audio[0])-6)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Checks an address in ForwardingAddress can be forwarded to with ForwardingMulticast, i.e. it is an IPv4 or IPv6
+// multicast group.
+func validateMulticastAddress(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address, multicast groups must be given as one", address)
+	}
+	if !ip.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast group (224.0.0.0/4 or ff00::/8)", address)
+	}
+	return nil
+}
+
+// Where to dial a multicast group from so it is sent out of MulticastInterface, or Interface if that isn't set, nil to
+// let the routing table pick.
+// The interface has to be picked before the socket is connected: an IPv4 group is sent from the interface's address,
+// an IPv6 group gets the interface as its zone.
+func multicastLocalAddr(group *net.UDPAddr) (*net.UDPAddr, error) {
+	name := *MulticastInterface
+	if name == "" {
+		name = *Interface
+	}
+	if name == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if group.IP.To4() == nil {
+		group.Zone = iface.Name
+		return nil, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return &net.UDPAddr{IP: ipNet.IP}, nil
+		}
+	}
+	return nil, fmt.Errorf("multicast interface %s has no IPv4 address", iface.Name)
+}
+
+// Sets the TTL (hop limit for IPv6) of the packets a forwarding socket sends to a multicast group. A failure is logged,
+// the socket still sends with the OS default of 1.
+func setMulticastTTL(conn *net.UDPConn, group *net.UDPAddr) {
+	var err error
+	if group.IP.To4() != nil {
+		err = ipv4.NewPacketConn(conn).SetMulticastTTL(*MulticastTTL)
+	} else {
+		err = ipv6.NewPacketConn(conn).SetMulticastHopLimit(*MulticastTTL)
+	}
+	if err != nil {
+		log.Printf("Error setting multicast TTL %d for %s. Error: %s", *MulticastTTL, group, err.Error())
+	}
+}
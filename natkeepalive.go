@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Returns when the first of the destinations that are up will have had nothing written to it for interval and needs a
+// keepalive, zero if none are up.
+func (u udpConns) keepaliveDue(interval time.Duration) time.Time {
+	var due time.Time
+	for _, udpConnection := range u {
+		if udpConnection.state.down || !udpConnection.receiverReady() {
+			continue
+		}
+		if next := udpConnection.lastWrite.Add(interval); due.IsZero() || next.Before(due) {
+			due = next
+		}
+	}
+	return due
+}
+
+// Sends a keepalive to every destination that is up and has had nothing written to it for interval, so NATs and
+// firewalls between us and the receiver keep their binding while no media is forwarded, e.g. while the track is paused.
+// The keepalive is an empty UDP datagram on the RTP socket, as in RFC 6263: unlike an empty RTP packet it takes no
+// sequence number, so receivers don't see a gap, and they drop it as a runt.
+func (u udpConns) sendKeepalives(interval time.Duration, now time.Time) {
+	for _, udpConnection := range u {
+		if udpConnection.state.down || !udpConnection.receiverReady() || now.Sub(udpConnection.lastWrite) < interval {
+			continue
+		}
+		err := writeUDP(udpConnection.conn, []byte{})
+		logWriteError(fmt.Sprintf("%s:%d", udpConnection.address, udpConnection.port), err)
+		udpConnection.wrote(err, now)
+		udpConnection.lastWrite = now
+	}
+}
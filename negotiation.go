@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// errNegotiationFailed - Creating or setting our offer/answer kept failing, so the session was ended rather than carry
+// on without a local description UE can use.
+var errNegotiationFailed = errors.New("negotiation failed")
+
+// Runs attempt, which creates our offer or answer and sets it as the local description, retrying it up to
+// NegotiationRetries times NegotiationRetryDelayMs apart while it fails. Pion's errors here are usually transient, e.g.
+// the signalling state moving on under us, so a retry gets a fresh description rather than sending a broken one.
+// An error already wrapping errNegotiationFailed is returned straight away, a retry can't fix it.
+func retryNegotiation(what string, attempt func() (string, error)) (string, error) {
+	delay := time.Duration(*NegotiationRetryDelayMs) * time.Millisecond
+	for try := 0; ; try++ {
+		description, err := attempt()
+		if err == nil {
+			return description, nil
+		}
+		if errors.Is(err, errNegotiationFailed) {
+			return "", err
+		}
+		if try >= *NegotiationRetries {
+			return "", fmt.Errorf("%w: creating our %s failed %d times, the last: %v", errNegotiationFailed, what, try+1, err)
+		}
+		log.Printf("Error creating our %s, retrying in %s (%d of %d). Error: %s", what, delay, try+1, *NegotiationRetries, err.Error())
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestRetryNegotiation(t *testing.T) {
+	transient := errors.New("signalling state changed")
+	tests := []struct {
+		name    string
+		retries int
+		// How many attempts fail before one succeeds.
+		failures int
+		attempts int
+		ok       bool
+	}{
+		{"first attempt", 2, 0, 1, true},
+		{"transient failure retried", 2, 1, 2, true},
+		{"succeeds on the last retry", 2, 2, 3, true},
+		{"retries used up", 2, 5, 3, false},
+		{"no retries", 0, 1, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "NegotiationRetries", strconv.Itoa(test.retries))
+			setFlag(t, "NegotiationRetryDelayMs", "5")
+			attempts := 0
+			start := time.Now()
+			description, err := retryNegotiation("answer", func() (string, error) {
+				attempts++
+				if attempts <= test.failures {
+					return "", transient
+				}
+				return "v=0", nil
+			})
+			if attempts != test.attempts {
+				t.Errorf("attempted %d times, want %d", attempts, test.attempts)
+			}
+			if elapsed, want := time.Since(start), time.Duration(test.attempts-1)*5*time.Millisecond; elapsed < want {
+				t.Errorf("took %s, want at least %s between the attempts", elapsed, want)
+			}
+			if !test.ok {
+				if !errors.Is(err, errNegotiationFailed) || description != "" {
+					t.Errorf("returned %q, %v, want it to fail the negotiation", description, err)
+				}
+				if err != nil && !strings.Contains(err.Error(), transient.Error()) {
+					t.Errorf("error %q doesn't say why the last attempt failed", err)
+				}
+				return
+			}
+			if err != nil || description != "v=0" {
+				t.Errorf("returned %q, %v, want the description the last attempt created", description, err)
+			}
+		})
+	}
+}
+
+func TestRetryNegotiationFailedAttempt(t *testing.T) {
+	setFlag(t, "NegotiationRetries", "2")
+	setFlag(t, "NegotiationRetryDelayMs", "5")
+	attempts := 0
+	failed := fmt.Errorf("%w: transforming our answer: exit status 1", errNegotiationFailed)
+	_, err := retryNegotiation("answer", func() (string, error) {
+		attempts++
+		return "", failed
+	})
+	if attempts != 1 {
+		t.Errorf("attempted %d times, want 1", attempts)
+	}
+	if err != failed {
+		t.Errorf("returned %v, want the attempt's %v", err, failed)
+	}
+}
+
+func TestSDPTransformFailureNotRetried(t *testing.T) {
+	// Counts its runs and fails.
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "transform.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho run >> "+runs+"\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "SDPTransformCommand", script)
+	setFlag(t, "NegotiationRetries", "2")
+	setFlag(t, "NegotiationRetryDelayMs", "5")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	offer, err := ue.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bridge.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = createAnswer(bridge)
+	if !errors.Is(err, errNegotiationFailed) || !strings.Contains(err.Error(), "transforming our answer") {
+		t.Errorf("returned %v, want it to fail the negotiation on the transform", err)
+	}
+	b, err := ioutil.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "run"); n != 1 {
+		t.Errorf("transform ran %d times, want 1", n)
+	}
+}
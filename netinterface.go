@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Checks Interface names a network interface that is up and has an address to send from.
+func checkInterface(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("interface %s is down", iface.Name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("interface %s has no addresses", iface.Name)
+	}
+	return nil
+}
+
+// Where to dial a destination from so our packets leave from Interface's address, nil if no Interface is set. Picks an
+// address of the interface in the destination's family, for IPv6 a link-local one with the interface as its zone for
+// a link-local destination and a global one for anything else.
+func interfaceLocalAddr(raddr *net.UDPAddr) (*net.UDPAddr, error) {
+	if *Interface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(*Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := raddr.IP.To4() != nil
+	linkLocal := !ipv4 && raddr.IP.IsLinkLocalUnicast()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != ipv4 || (!ipv4 && ipNet.IP.IsLinkLocalUnicast() != linkLocal) {
+			continue
+		}
+		if linkLocal {
+			return &net.UDPAddr{IP: ipNet.IP, Zone: iface.Name}, nil
+		}
+		return &net.UDPAddr{IP: ipNet.IP}, nil
+	}
+	family := "IPv6"
+	if ipv4 {
+		family = "IPv4"
+	}
+	if linkLocal {
+		family = "link-local IPv6"
+	}
+	return nil, fmt.Errorf("interface %s has no %s address to send to %s from", iface.Name, family, raddr.IP)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// How often an oversize track is logged, every oversize packet of a video frame would flood the log.
+const oversizeLogInterval = 10 * time.Second
+
+// oversizeGuard - Checks the size of the packets we are about to send to the UDP destinations against MaxPacketSize,
+// so a destination behind a small MTU shows up in the logs and stats rather than as silent loss at the receiver. RTP
+// can't be split into smaller packets without depacketizing the frames, so an oversize packet is dropped or sent as
+// is. Only used from the track's forwarding loop.
+type oversizeGuard struct {
+	name  string
+	stats *trackStats
+
+	// Oversize packets since the last log line, and the size of the biggest.
+	count   int
+	largest int
+	lastLog time.Time
+}
+
+func newOversizeGuard(name string, stats *trackStats) *oversizeGuard {
+	return &oversizeGuard{name: name, stats: stats}
+}
+
+// Checks a packet that is about to be sent, returns false if it is oversize and should be dropped.
+func (g *oversizeGuard) check(packet []byte, now time.Time) bool {
+	if len(packet) <= *MaxPacketSize {
+		return true
+	}
+	g.stats.addOversize()
+	g.count++
+	if len(packet) > g.largest {
+		g.largest = len(packet)
+	}
+	if g.lastLog.IsZero() || now.Sub(g.lastLog) >= oversizeLogInterval {
+		action := "Dropped"
+		if *OversizePackets == "forward" {
+			action = "Forwarded"
+		}
+		log.Printf("%s %d %s packets over -MaxPacketSize=%d bytes, the largest was %d bytes. The network to the destinations may not carry them.", action, g.count, g.name, *MaxPacketSize, g.largest)
+		g.lastLog = now
+		g.count = 0
+		g.largest = 0
+	}
+	return *OversizePackets == "forward"
+}
+
+// The bitrate to announce in the track's REMB, OversizeREMB once the track has had oversize packets.
+func rembBitrate(stats *trackStats) uint64 {
+	if *OversizeREMB > 0 && stats.oversize() > 0 {
+		return *OversizeREMB
+	}
+	return *REMB
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Serves Go's pprof handlers on localhost:port so profiles can be captured from a running bridge.
+// We use our own mux rather than http.DefaultServeMux so the profiles are never exposed by any other http server we run.
+func startPprofServer(port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	addr := fmt.Sprintf("localhost:%d", port)
+	fmt.Println(fmt.Sprintf("Serving pprof profiles on http://%s/debug/pprof/", addr))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error serving pprof profiles: %s", err.Error())
+		}
+	}()
+}
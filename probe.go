@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+func setupProbeCommand(fs *flag.FlagSet) func() {
+	timeoutMs := fs.Int("TimeoutMs", 30000, "How long (ms) to wait for the negotiation with UE to complete before failing.")
+	return func() {
+		summary, err := runProbe(time.Duration(*timeoutMs) * time.Millisecond)
+		if err != nil {
+			exitWithError(fmt.Errorf("probe failed: %w", err))
+		}
+		fmt.Print(summary)
+	}
+}
+
+// Runs a single session with Cirrus and UE until the offer/answer exchange completes, then ends it without forwarding
+// anything and returns a summary of what UE's session description says it can send. Reconnect doesn't apply, the probe
+// only ever makes one attempt.
+func runProbe(timeout time.Duration) (string, error) {
+	var mu sync.Mutex
+	var summary string
+	startSessionID()
+	_, sessionErr := runSession(func(peerConnection *webrtc.PeerConnection) {
+		var once sync.Once
+		peerConnection.OnSignalingStateChange(func(state webrtc.SignalingState) {
+			remote := peerConnection.RemoteDescription()
+			if state != webrtc.SignalingStateStable || remote == nil {
+				return
+			}
+			once.Do(func() {
+				mu.Lock()
+				summary = summarizeCapabilities(remote)
+				mu.Unlock()
+				sessionPrintln("Negotiated with UE, ending the probe session.")
+				// Closing the peer connection ends the session, not from inside Pion's callback though.
+				go peerConnection.Close()
+			})
+		})
+		time.AfterFunc(timeout, func() { peerConnection.Close() })
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if summary == "" {
+		if sessionErr == nil {
+			sessionErr = errors.New("the session ended")
+		}
+		return "", fmt.Errorf("no offer/answer exchange with UE within %s: %w", timeout, sessionErr)
+	}
+	return summary, nil
+}
+
+// Describes UE's session description, one block per media section with its direction, codecs, header extensions and
+// simulcast layers, then how many tracks UE sends of each kind.
+func summarizeCapabilities(description *webrtc.SessionDescription) string {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(description.SDP)); err != nil {
+		return fmt.Sprintf("UE's %s could not be parsed: %s\n", description.Type, err.Error())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "UE's %s:\n", description.Type)
+	tracks := map[string]int{}
+	dataChannel := false
+	for _, media := range parsed.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind == "application" {
+			dataChannel = true
+			continue
+		}
+
+		mid, _ := media.Attribute("mid")
+		direction := "sendrecv"
+		rtpmaps := map[string]string{}
+		fmtps := map[string]string{}
+		var extensions, rids []string
+		for _, attribute := range media.Attributes {
+			switch attribute.Key {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				direction = attribute.Key
+			case "rtpmap", "fmtp":
+				fields := strings.SplitN(attribute.Value, " ", 2)
+				if len(fields) == 2 && attribute.Key == "rtpmap" {
+					rtpmaps[fields[0]] = fields[1]
+				} else if len(fields) == 2 {
+					fmtps[fields[0]] = fields[1]
+				}
+			case "extmap":
+				extensions = append(extensions, attribute.Value)
+			case "rid":
+				// Only the layers UE sends, e.g. "h send".
+				if fields := strings.Fields(attribute.Value); len(fields) >= 2 && fields[1] == "send" {
+					rids = append(rids, fields[0])
+				}
+			}
+		}
+		if direction == "sendrecv" || direction == "sendonly" {
+			tracks[kind]++
+		}
+
+		fmt.Fprintf(&b, "  %s (mid %s, %s)\n", kind, mid, direction)
+		for _, payloadType := range media.MediaName.Formats {
+			codec := rtpmaps[payloadType]
+			if codec == "" {
+				codec = "no rtpmap"
+			}
+			line := fmt.Sprintf("    codec %s %s", payloadType, codec)
+			if fmtp := fmtps[payloadType]; fmtp != "" {
+				line += " " + fmtp
+			}
+			fmt.Fprintln(&b, line)
+		}
+		for _, extension := range extensions {
+			fmt.Fprintf(&b, "    extension %s\n", extension)
+		}
+		if len(rids) > 0 {
+			fmt.Fprintf(&b, "    simulcast layers %s\n", strings.Join(rids, ", "))
+		}
+	}
+	fmt.Fprintf(&b, "UE sends %d video and %d audio tracks", tracks["video"], tracks["audio"])
+	if dataChannel {
+		b.WriteString(", and offers a data channel")
+	}
+	b.WriteString(".\n")
+	return b.String()
+}
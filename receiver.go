@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How often a destination still waiting for its receiver is sent an empty datagram, so a receiver that sends its
+// RTCP back to where the packets come from learns where to send it, and NATs on the way let its answer through.
+const receiverPrimeInterval = time.Second
+
+// receiverWatch - With WaitForReceiver, holds back a destination's forwarding until its receiver shows it is there
+// by sending us anything, usually an RTCP receiver report or a probe packet, on the destination's RTP socket (an
+// rtcp-mux receiver) or its RTCP socket (RTP port + 1).
+type receiverWatch struct {
+	// 1 once the receiver has been seen, -1 if the track stopped before it was.
+	seen int32
+	done chan struct{}
+	// Where the receiver was first heard from, "RTP port" or "RTCP port".
+	detected chan string
+}
+
+// Reports whether packets may be written to the destination, always true without WaitForReceiver.
+func (u *udpConn) receiverReady() bool {
+	return u.receiver == nil || atomic.LoadInt32(&u.receiver.seen) == 1
+}
+
+// Starts waiting for each destination's receiver, the track counts as waiting until the first is seen. Once a
+// receiver is seen its destination is forwarded to, and onRecovered asks UE for a keyframe for it.
+func (u udpConns) waitForReceivers(stats *trackStats) {
+	stats.setWaitingForReceiver(true)
+	for _, udpConnection := range u {
+		udpConnection.receiver = &receiverWatch{done: make(chan struct{}), detected: make(chan string, 2)}
+		name := fmt.Sprintf("%s:%d", udpConnection.address, udpConnection.port)
+		sessionPrintln(fmt.Sprintf("Waiting for the receiver at %s to send RTCP or a probe before forwarding %s to it.", name, stats.name))
+
+		udpConnection.startReceiverListeners()
+		go func(udpConnection *udpConn) {
+			ticker := time.NewTicker(receiverPrimeInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-udpConnection.receiver.done:
+					return
+				case where := <-udpConnection.receiver.detected:
+					if !atomic.CompareAndSwapInt32(&udpConnection.receiver.seen, 0, 1) {
+						return
+					}
+					close(udpConnection.receiver.done)
+					stats.setWaitingForReceiver(false)
+					sessionPrintln(fmt.Sprintf("The receiver at %s sent a packet to our %s, forwarding %s to it.", name, where, stats.name))
+					if udpConnection.onRecovered != nil {
+						udpConnection.onRecovered()
+					}
+					return
+				case <-ticker.C:
+					// Refusals are expected while nothing listens, the read side skips them.
+					udpConnection.mu.Lock()
+					logWriteError(name, writeUDP(udpConnection.conn, []byte{}))
+					if udpConnection.rtcpConn != nil {
+						logWriteError(fmt.Sprintf("%s:%d", udpConnection.address, udpConnection.port+1), writeUDP(udpConnection.rtcpConn, []byte{}))
+					}
+					udpConnection.mu.Unlock()
+				}
+			}
+		}(udpConnection)
+	}
+}
+
+// Listens for the receiver on the destination's RTP socket and, if it has one, its RTCP socket.
+func (u *udpConn) startReceiverListeners() {
+	go listenForReceiver(u.conn, "RTP port", u.receiver.done, u.receiver.detected)
+	if u.rtcpConn != nil {
+		go listenForReceiver(u.rtcpConn, "RTCP port", u.receiver.done, u.receiver.detected)
+	}
+}
+
+// Stops waiting for the receivers that haven't been seen, when the track stops forwarding.
+func (u udpConns) stopWaitingForReceivers() {
+	for _, udpConnection := range u {
+		if udpConnection.receiver != nil && atomic.CompareAndSwapInt32(&udpConnection.receiver.seen, 0, -1) {
+			close(udpConnection.receiver.done)
+		}
+	}
+}
+
+// Reads from one of a destination's sockets until the receiver sends something, reporting where it arrived. The
+// sockets are connected, so only packets from the receiver's address and port get here. Stops once done is closed,
+// or when the socket is closed.
+func listenForReceiver(conn *net.UDPConn, where string, done <-chan struct{}, detected chan<- string) {
+	b := make([]byte, 1500)
+	for {
+		// Wakes up now and then to see whether to stop, the forwarding needs the socket's errors to itself after that.
+		conn.SetReadDeadline(time.Now().Add(receiverPrimeInterval))
+		_, err := conn.Read(b)
+		select {
+		case <-done:
+			conn.SetReadDeadline(time.Time{})
+			return
+		default:
+		}
+		if err == nil {
+			detected <- where
+			return
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			continue
+		}
+		// ICMP port unreachable from our own priming while nothing listens.
+		if opError, ok := err.(*net.OpError); ok && strings.Contains(opError.Err.Error(), "connection refused") {
+			continue
+		}
+		return
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiverPrimingWriteError(t *testing.T) {
+	destination, _ := createTestDestination(t, 96)
+	stats := &trackStats{name: "video"}
+	// Every prime fails with something other than a refusal, which must not take the process down.
+	destination.conn.Close()
+	udpConns{destination}.waitForReceivers(stats)
+	t.Cleanup(func() { udpConns{destination}.stopWaitingForReceivers() })
+	time.Sleep(receiverPrimeInterval + receiverPrimeInterval/2)
+	if destination.receiverReady() {
+		t.Error("destination ready without its receiver being seen")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// errPeerFailed - The session ended because the WebRTC peer connection failed.
+var errPeerFailed = errors.New("peer connection failed")
+
+// errSessionExpired - The session was ended because it reached MaxSessionDurationMs.
+var errSessionExpired = errors.New("session reached its maximum duration")
+
+// reconnectBackoff - Exponential backoff between reconnection attempts.
+// With jitter set (full jitter) each delay is instead picked uniformly between 0 and the exponential delay, so many
+// bridges that lost the same Cirrus don't all reconnect in lockstep.
+type reconnectBackoff struct {
+	initial  time.Duration
+	max      time.Duration
+	attempts int
+	jitter   *rand.Rand
+}
+
+// Returns how long to wait before the next attempt and counts the attempt.
+func (b *reconnectBackoff) next() time.Duration {
+	delay := b.initial
+	for i := 0; i < b.attempts && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempts++
+	if b.jitter != nil && delay > 0 {
+		delay = time.Duration(b.jitter.Int63n(int64(delay) + 1))
+	}
+	return delay
+}
+
+func (b *reconnectBackoff) reset() {
+	b.attempts = 0
+}
+
+// The round trip time (ns) of the last websocket ping to Cirrus that was answered, 0 until one is.
+var signallingRTTNanos int64
+
+func signallingRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&signallingRTTNanos))
+}
+
+// Sends websocket pings to Cirrus every interval and expects a pong back within two intervals.
+// Each pong pushes the read deadline back, so if pongs stop arriving the pending ReadMessage in the
+// control loop fails with a timeout and the session is torn down (and reconnected if enabled).
+// Each ping carries the time it was sent, which the pong echoes back, so the pongs also measure the signalling round
+// trip time for free.
+// Returns a function that stops the pings.
+func startWSKeepalive(wsConn *websocket.Conn, interval time.Duration) func() {
+	pongWait := 2 * interval
+	atomic.StoreInt64(&signallingRTTNanos, 0)
+	wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	wsConn.SetPongHandler(func(appData string) error {
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			rtt := time.Since(time.Unix(0, sent))
+			atomic.StoreInt64(&signallingRTTNanos, int64(rtt))
+			if *LogSignallingRTT {
+				log.Printf("Signalling round trip to Cirrus: %s.", rtt.Round(time.Microsecond))
+			}
+		}
+		return wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl is safe to call concurrently with the other websocket writes.
+				if err := wsConn.WriteControl(websocket.PingMessage, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), time.Now().Add(interval)); err != nil {
+					log.Printf("Error sending websocket ping: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Called when the peer connection has failed, attempts an ICE restart if OnPeerFailed asks for one.
+// Returns true if the session can carry on (the restart offer was sent), false if the session should be torn down so
+// the main loop, the only place that reconnects or exits, can act on OnPeerFailed.
+func handlePeerFailed(wsConn signallingConn, peerConnection *webrtc.PeerConnection) bool {
+	sessionPrintln(fmt.Sprintf("Peer connection failed, handling it with -OnPeerFailed=%s.", *OnPeerFailed))
+	if *OnPeerFailed != "ice-restart" {
+		return false
+	}
+	// Only the offerer can restart ICE, in answerer mode we would need UE to send a new offer.
+	if !*InitiateOffer {
+		log.Println("Cannot ICE restart in answerer mode, reconnecting instead.")
+		return false
+	}
+	// Without the restart offer there's nothing to recover with.
+	return sendOffer(wsConn, peerConnection, &webrtc.OfferOptions{ICERestart: true}) == nil
+}
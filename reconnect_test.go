@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Negotiates the bridge with the test UE in offerer mode until the signalling is stable, returning the offer we sent.
+func negotiateTestOfferer(t *testing.T, conn *fakeSignallingConn, bridge *webrtc.PeerConnection, ue *webrtc.PeerConnection) []byte {
+	t.Helper()
+	if err := sendOffer(conn, bridge, nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, _ := conn.waitForWrite(t, "offer")
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(offer, &desc); err != nil {
+		t.Fatal(err)
+	}
+	if err := ue.SetRemoteDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := ue.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	message, err := json.Marshal(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = handleRemoteAnswer(message, bridge, conn, &candidateQueue{}); err != nil {
+		t.Fatal(err)
+	}
+	if bridge.SignalingState() != webrtc.SignalingStateStable {
+		t.Fatalf("signalling state is %s after UE's answer", bridge.SignalingState())
+	}
+	return offer
+}
+
+func TestHandlePeerFailed(t *testing.T) {
+	tests := []struct {
+		name          string
+		onPeerFailed  string
+		initiateOffer bool
+		writeErr      error
+		// Whether the session carries on with an ICE restart rather than being ended.
+		carriesOn bool
+	}{
+		{"reconnect", "reconnect", true, nil, false},
+		{"exit", "exit", true, nil, false},
+		{"ice-restart as the offerer", "ice-restart", true, nil, true},
+		{"ice-restart in answerer mode reconnects", "ice-restart", false, nil, false},
+		{"ice-restart offer not sent", "ice-restart", true, errors.New("broken pipe"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "OnPeerFailed", test.onPeerFailed)
+			setFlag(t, "InitiateOffer", fmt.Sprint(test.initiateOffer))
+			bridge, err := createPeerConnection(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bridge.Close()
+			conn := newFakeSignallingConn()
+			first := negotiateTestOfferer(t, conn, bridge, newTestUE(t))
+			conn.writeErr = test.writeErr
+
+			if got := handlePeerFailed(conn, bridge); got != test.carriesOn {
+				t.Errorf("handlePeerFailed returned %v, want %v", got, test.carriesOn)
+			}
+			restarts, others := conn.takeWritten(t, "offer")
+			if len(others) > 0 || len(restarts) != map[bool]int{false: 0, true: 1}[test.carriesOn] {
+				t.Fatalf("wrote %d offers and %d other messages", len(restarts), len(others))
+			}
+			if test.carriesOn && iceUfrag(t, first) == iceUfrag(t, restarts[0]) {
+				t.Errorf("restart offer kept the ICE ufrag %s", iceUfrag(t, first))
+			}
+		})
+	}
+}
+
+// The a=ice-ufrag of a JSON session description we sent.
+func iceUfrag(t *testing.T, message []byte) string {
+	t.Helper()
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(message, &desc); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if ufrag, ok := media.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	ufrag, _ := parsed.Attribute("ice-ufrag")
+	return ufrag
+}
+
+func TestAfterSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		connected    bool
+		reconnect    bool
+		onPeerFailed string
+		want         sessionEnd
+	}{
+		{"peer failed with reconnect", withExitCode(exitPeerFailed, errPeerFailed), true, false, "reconnect", reconnectSession},
+		{"peer failed with ice-restart", withExitCode(exitPeerFailed, errPeerFailed), true, false, "ice-restart", reconnectSession},
+		{"peer failed with exit", withExitCode(exitPeerFailed, errPeerFailed), true, true, "exit", exitSession},
+		{"expired", errSessionExpired, true, false, "exit", restartSession},
+		{"codec fallback", errCodecFallback, false, false, "reconnect", restartSession},
+		{"config changed", errConfigChanged, true, false, "reconnect", restartSession},
+		{"negotiation failed without -Reconnect", fmt.Errorf("%w: sending our answer", errNegotiationFailed), false, false, "reconnect", reconnectSession},
+		{"writes failed without -Reconnect", errSignallingWriteFailed, true, false, "reconnect", reconnectSession},
+		{"connection dropped with -Reconnect", io.EOF, true, true, "reconnect", reconnectSession},
+		{"connection dropped after connecting", io.EOF, true, false, "reconnect", stopSessions},
+		{"connection dropped before connecting", io.EOF, false, false, "reconnect", exitSession},
+		{"fingerprint mismatch after connecting", errFingerprintMismatch, true, false, "reconnect", exitSession},
+		{"payload type mismatch", withExitCode(exitConfig, errPayloadTypeMismatch), true, false, "reconnect", exitSession},
+		{"payload type mismatch with -Reconnect", withExitCode(exitConfig, errPayloadTypeMismatch), true, true, "reconnect", reconnectSession},
+		{"clean end", nil, false, false, "reconnect", stopSessions},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "Reconnect", fmt.Sprint(test.reconnect))
+			setFlag(t, "OnPeerFailed", test.onPeerFailed)
+			if got := afterSession(test.err, test.connected); got != test.want {
+				t.Errorf("afterSession is %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	b := reconnectBackoff{initial: 100 * time.Millisecond, max: time.Second}
+	var got []time.Duration
+	for i := 0; i < 6; i++ {
+		got = append(got, b.next())
+	}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delays are %v, want %v", got, want)
+	}
+	b.reset()
+	if delay := b.next(); delay != 100*time.Millisecond {
+		t.Errorf("delay after a reset is %s, want the initial 100ms", delay)
+	}
+}
+
+func TestReconnectBackoffJitter(t *testing.T) {
+	b := reconnectBackoff{initial: 100 * time.Millisecond, max: time.Second, jitter: rand.New(rand.NewSource(1))}
+	// Full jitter: each delay is between 0 and the exponential delay, and they are spread across that range.
+	for attempt, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second} {
+		var lowest, highest time.Duration = ceiling, 0
+		for i := 0; i < 200; i++ {
+			b.attempts = attempt
+			delay := b.next()
+			if delay < 0 || delay > ceiling {
+				t.Fatalf("attempt %d: delay %s is outside 0 to %s", attempt, delay, ceiling)
+			}
+			if delay < lowest {
+				lowest = delay
+			}
+			if delay > highest {
+				highest = delay
+			}
+		}
+		if lowest > ceiling/4 || highest < ceiling*3/4 {
+			t.Errorf("attempt %d: delays only spread from %s to %s of 0 to %s", attempt, lowest, highest, ceiling)
+		}
+	}
+}
+
+func TestReconnectBackoffJitterNoDelay(t *testing.T) {
+	b := reconnectBackoff{jitter: rand.New(rand.NewSource(1))}
+	if delay := b.next(); delay != 0 {
+		t.Errorf("jittered delay with no initial delay is %s", delay)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+func setupRecordCommand(fs *flag.FlagSet) func() {
+	recordDir := fs.String("RecordDir", ".", "The directory to write the recordings to, each track of each session gets its own file.")
+	return func() {
+		runSessions(func(peerConnection *webrtc.PeerConnection) {
+			setupMediaRecording(peerConnection, *recordDir)
+		})
+	}
+}
+
+// Where forwarded tracks are also recorded with RecordTracksDir or RecordAndForward, "" if they aren't.
+func recordTracksDir() string {
+	if *RecordTracksDir == "" && *RecordAndForward {
+		return "."
+	}
+	return *RecordTracksDir
+}
+
+// Creates the writer that records the track, H264 video to an Annex B .h264 file and Opus audio to an .ogg file.
+func createTrackRecorder(track *webrtc.TrackRemote, dir string, name string) (media.Writer, string, error) {
+	base := filepath.Join(dir, fmt.Sprintf("%s-%s", name, time.Now().Format("20060102-150405")))
+	codec := track.Codec()
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		path := base + ".h264"
+		writer, err := h264writer.New(path)
+		return writer, path, err
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		path := base + ".ogg"
+		writer, err := oggwriter.New(path, codec.ClockRate, codec.Channels)
+		return writer, path, err
+	default:
+		return nil, "", fmt.Errorf("recording %s is not supported", codec.MimeType)
+	}
+}
+
+// Wires up recording of every track Unreal Engine sends us to files in dir, in place of forwarding them.
+func setupMediaRecording(peerConnection *webrtc.PeerConnection, dir string) {
+	registry := newTrackRegistry()
+
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		index := registry.acquire(track.Kind())
+		defer registry.release(track.Kind(), index)
+		name := trackName(track.Kind(), index)
+
+		writer, path, err := createTrackRecorder(track, dir, name)
+		if err != nil {
+			log.Println(fmt.Sprintf("Error creating recording for %s: %s", name, err.Error()))
+			return
+		}
+		defer func() {
+			if err := writer.Close(); err != nil {
+				log.Println(fmt.Sprintf("Error closing recording %s: %s", path, err.Error()))
+			}
+		}()
+		sessionPrintln(fmt.Sprintf("Recording %s track to %s.", name, path))
+
+		stats := bridgeStats.track(name)
+		rtt := newRTTEstimator(rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+		clock := newSenderReportClock(trackClock(track))
+
+		done := make(chan struct{})
+		defer close(done)
+
+		// The RTCP loop's PLIs matter even more here, the H264 recording can only start on a keyframe.
+		if sendsRTCPOnInterval(track.Kind()) {
+			go runRecoverable(fmt.Sprintf("%s RTCP loop", name), true, func() {
+				sendRTCPOnInterval(peerConnection, track, rtt, stats, done)
+			})
+		} else {
+			sessionPrintln(fmt.Sprintf("Not sending RTCP on an interval for %s track, there is nothing to send.", name))
+		}
+		go runRecoverable(fmt.Sprintf("%s RTCP read loop", name), false, func() {
+			readRTCP(receiver, rtt, clock, nil, stats)
+		})
+
+		runRecoverable(fmt.Sprintf("%s recording loop", name), false, func() {
+			for {
+				packet, _, err := track.ReadRTP()
+				if err != nil {
+					return
+				}
+				if err := writer.WriteRTP(packet); err != nil {
+					log.Println(fmt.Sprintf("Error writing %s recording: %s", name, err.Error()))
+					return
+				}
+				stats.addForwarded(len(packet.Payload))
+			}
+		})
+		sessionPrintln(fmt.Sprintf("Closed recording of %s track to %s.", name, path))
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// rembRamp - With REMBRampMs, raises the bitrate a track's REMB announces from REMBRampStart to the usual bitrate over
+// the ramp, rather than announcing the full bitrate from the start of the session. The bitrate grows by the same
+// factor every step, as a bandwidth estimate does, instead of the same amount: with the default 400Mbps REMB a linear
+// ramp would be past anything a cold link can take within its first step. Only used from the track's RTCP loop.
+type rembRamp struct {
+	name     string
+	from     uint64
+	duration time.Duration
+	start    time.Time
+	done     bool
+}
+
+func newREMBRamp(name string, now time.Time) *rembRamp {
+	return &rembRamp{name: name, from: *REMBRampStart, duration: time.Duration(*REMBRampMs) * time.Millisecond, start: now}
+}
+
+// Returns the bitrate to announce now, ceiling being what would be announced without the ramp, and logs each step.
+func (r *rembRamp) bitrate(ceiling uint64, now time.Time) uint64 {
+	if r.done {
+		return ceiling
+	}
+	progress := float64(now.Sub(r.start)) / float64(r.duration)
+	if progress >= 1 || r.from >= ceiling {
+		r.done = true
+		sessionPrintln(fmt.Sprintf("REMB ramp for %s track done after %s, announcing %d bps.", r.name, now.Sub(r.start).Round(time.Millisecond), ceiling))
+		return ceiling
+	}
+	bitrate := uint64(float64(r.from) * math.Pow(float64(ceiling)/float64(r.from), progress))
+	sessionPrintln(fmt.Sprintf("REMB ramp for %s track at %d%%, announcing %d bps of %d bps.", r.name, int(progress*100), bitrate, ceiling))
+	return bitrate
+}
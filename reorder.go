@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The largest ReorderWindow, beyond that a receiver is better off with a real jitter buffer.
+const maxReorderWindow = 512
+
+// reorderBuffer - Holds back a track's packets that arrive ahead of a missing one, for ReorderWindow, so receivers that
+// can't reorder get them in sequence order. Unlike a jitter buffer it only delays packets while one is missing: a
+// packet that arrives in order goes straight through. Once the window is full or the oldest held packet has waited
+// ReorderTimeoutMs, the missing ones are given up as lost, and packets only arriving after that are dropped as late.
+// Only used from the track's forwarding loop.
+type reorderBuffer struct {
+	window  int
+	timeout time.Duration
+	stats   *trackStats
+
+	// Ring of held packets, a packet is held at its sequence number modulo the ring's size. That is a power of two at
+	// least the window, so it divides the sequence numbers' range and no two packets within a window share a slot,
+	// even across the wrap around.
+	slots   []heldPacket
+	held    int
+	next    uint16
+	started bool
+}
+
+type heldPacket struct {
+	packet  []byte
+	arrived time.Time
+}
+
+func newReorderBuffer(window int, timeout time.Duration, stats *trackStats) *reorderBuffer {
+	size := 1
+	for size < window {
+		size *= 2
+	}
+	return &reorderBuffer{window: window, timeout: timeout, stats: stats, slots: make([]heldPacket, size)}
+}
+
+// Takes a packet read from the track, which the buffer keeps, and returns the packets now ready to forward in order.
+func (r *reorderBuffer) push(packet []byte, now time.Time) [][]byte {
+	sequence := binary.BigEndian.Uint16(packet[2:])
+	if !r.started {
+		r.next, r.started = sequence, true
+	}
+	ahead := int(int16(sequence - r.next))
+	switch {
+	case ahead < 0 && ahead >= -maxSequenceGap:
+		// Its place has been given up on, or it is a duplicate of one forwarded already.
+		r.stats.addLate()
+		return nil
+	case ahead < 0 || ahead > maxSequenceGap:
+		// UE's sequence numbers jumped, e.g. its encoder restarted. Nothing held will be followed by its missing
+		// packets, so forward what we have and start over from this one.
+		released := r.drain(nil)
+		r.next = sequence + 1
+		return append(released, packet)
+	}
+
+	var released [][]byte
+	// Make room by giving up on missing packets until this one fits in the window.
+	for ahead >= r.window {
+		released = r.skip(released)
+		ahead = int(int16(sequence - r.next))
+	}
+	slot := &r.slots[int(sequence)&(len(r.slots)-1)]
+	if slot.packet != nil {
+		r.stats.addLate()
+		return released
+	}
+	*slot = heldPacket{packet: packet, arrived: now}
+	r.held++
+	sessionBuffers.add(len(packet))
+	released = r.release(released)
+	// Over MaxSessionBufferBytes, stop waiting for the missing packets rather than hold on to what follows them.
+	skippedFrom := len(released)
+	for r.held > 0 && sessionBuffers.over() {
+		released = r.skip(released)
+	}
+	if len(released) > skippedFrom {
+		sessionBuffers.addShed(r.stats.name, "forwarded without waiting for the missing ones", len(released)-skippedFrom, now)
+	}
+	return released
+}
+
+// Returns when to give up on the missing packet if nothing else arrives, zero if nothing is held.
+func (r *reorderBuffer) deadline() time.Time {
+	var oldest time.Time
+	for i := range r.slots {
+		if arrived := r.slots[i].arrived; r.slots[i].packet != nil && (oldest.IsZero() || arrived.Before(oldest)) {
+			oldest = arrived
+		}
+	}
+	if oldest.IsZero() {
+		return oldest
+	}
+	return oldest.Add(r.timeout)
+}
+
+// Gives up on the missing packets the held ones have waited ReorderTimeoutMs for, returning the packets that are then
+// ready to forward.
+func (r *reorderBuffer) expire(now time.Time) [][]byte {
+	var released [][]byte
+	for r.held > 0 && !now.Before(r.deadline()) {
+		released = r.skip(released)
+	}
+	return released
+}
+
+// Forwards every held packet in order, leaving the gaps unfilled.
+func (r *reorderBuffer) drain(released [][]byte) [][]byte {
+	for r.held > 0 {
+		released = r.skip(released)
+	}
+	return released
+}
+
+// Gives up on the missing packet at next and releases what follows it in sequence.
+func (r *reorderBuffer) skip(released [][]byte) [][]byte {
+	if slot := &r.slots[int(r.next)&(len(r.slots)-1)]; slot.packet != nil {
+		released = append(released, slot.packet)
+		sessionBuffers.remove(len(slot.packet))
+		*slot = heldPacket{}
+		r.held--
+	}
+	r.next++
+	return r.release(released)
+}
+
+// Releases the held packets from next on for as long as they are in sequence.
+func (r *reorderBuffer) release(released [][]byte) [][]byte {
+	for {
+		slot := &r.slots[int(r.next)&(len(r.slots)-1)]
+		if slot.packet == nil {
+			return released
+		}
+		released = append(released, slot.packet)
+		sessionBuffers.remove(len(slot.packet))
+		*slot = heldPacket{}
+		r.held--
+		r.next++
+	}
+}
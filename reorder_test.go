@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Returns the sequence numbers of the packets.
+func testSequenceNumbers(packets [][]byte) []uint16 {
+	var sequences []uint16
+	for _, packet := range packets {
+		sequences = append(sequences, binary.BigEndian.Uint16(packet[2:]))
+	}
+	return sequences
+}
+
+func TestReorderBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushed []uint16
+		want   []uint16
+		late   uint64
+		// Still held once everything was pushed.
+		held []uint16
+	}{
+		{"in order", []uint16{1, 2, 3}, []uint16{1, 2, 3}, 0, nil},
+		{"swapped pair", []uint16{1, 3, 2, 4}, []uint16{1, 2, 3, 4}, 0, nil},
+		{"waiting for a missing packet", []uint16{1, 3, 4}, []uint16{1}, 0, []uint16{3, 4}},
+		{"missing packet given up when the window is full", []uint16{1, 3, 4, 5, 6}, []uint16{1, 3, 4, 5, 6}, 0, nil},
+		{"late after being given up", []uint16{1, 3, 4, 5, 6, 2}, []uint16{1, 3, 4, 5, 6}, 1, nil},
+		{"duplicate of a forwarded packet", []uint16{1, 2, 2}, []uint16{1, 2}, 1, nil},
+		{"duplicate of a held packet", []uint16{1, 3, 3}, []uint16{1}, 1, []uint16{3}},
+		{"across the wrap around", []uint16{65534, 0, 65535, 1}, []uint16{65534, 65535, 0, 1}, 0, nil},
+		{"jump forward", []uint16{1, 3, 5000}, []uint16{1, 3, 5000}, 0, nil},
+		{"jump back", []uint16{5000, 5002, 1, 2}, []uint16{5000, 5002, 1, 2}, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := &trackStats{name: "video"}
+			r := newReorderBuffer(4, 20*time.Millisecond, stats)
+			now := time.Now()
+			var released [][]byte
+			for _, sequence := range test.pushed {
+				released = append(released, r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: sequence}, []byte{1}), now)...)
+			}
+			held := testSequenceNumbers(r.drain(nil))
+			if got := testSequenceNumbers(released); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("forwarded %v, want %v", got, test.want)
+			}
+			if stats.latePackets != test.late {
+				t.Errorf("%d late packets, want %d", stats.latePackets, test.late)
+			}
+			if !reflect.DeepEqual(held, test.held) {
+				t.Errorf("held %v, want %v", held, test.held)
+			}
+		})
+	}
+}
+
+func TestReorderBufferTimeout(t *testing.T) {
+	stats := &trackStats{name: "video"}
+	r := newReorderBuffer(8, 20*time.Millisecond, stats)
+	start := time.Now()
+	if deadline := r.deadline(); !deadline.IsZero() {
+		t.Errorf("deadline %s with nothing held", deadline)
+	}
+	r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: 1}, []byte{1}), start)
+	r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: 3}, []byte{1}), start)
+	r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: 5}, []byte{1}), start.Add(10*time.Millisecond))
+	if deadline := r.deadline(); !deadline.Equal(start.Add(20 * time.Millisecond)) {
+		t.Errorf("deadline is %s after the oldest held packet, want 20ms", deadline.Sub(start))
+	}
+	if released := r.expire(start.Add(19 * time.Millisecond)); released != nil {
+		t.Errorf("forwarded %v before the timeout", testSequenceNumbers(released))
+	}
+	// 2 is given up on, 4 is still within the timeout of 5.
+	if released := testSequenceNumbers(r.expire(start.Add(20 * time.Millisecond))); !reflect.DeepEqual(released, []uint16{3}) {
+		t.Errorf("forwarded %v at the timeout, want 3", released)
+	}
+	if released := testSequenceNumbers(r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: 4}, []byte{1}), start.Add(25*time.Millisecond))); !reflect.DeepEqual(released, []uint16{4, 5}) {
+		t.Errorf("forwarded %v when 4 arrived, want 4 and 5", released)
+	}
+	if released := r.push(marshalTestPacket(t, rtp.Header{SequenceNumber: 2}, []byte{1}), start.Add(30*time.Millisecond)); released != nil || stats.latePackets != 1 {
+		t.Errorf("2 after its timeout forwarded %v with %d late, want it dropped as late", testSequenceNumbers(released), stats.latePackets)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// How long we wait for the rest of UE's tracks after the first one before offering whatever we have.
+const republishTrackWait = 3 * time.Second
+
+// republishedTrack - A track from UE and the sendonly track that re-publishes it.
+type republishedTrack struct {
+	remote *webrtc.TrackRemote
+	local  *webrtc.TrackLocalStaticRTP
+}
+
+// republisher - Re-publishes a session's tracks to another WebRTC peer (e.g. an SFU), turning the bridge into a
+// WebRTC-to-WebRTC relay. The outbound peer connection is signalled the way we signal UE, over a Cirrus style websocket
+// with us as the offerer. Packets are passed through without transcoding and keyframe requests and bandwidth
+// estimates from the peer are passed back to UE. Like the RTSP publisher, the offer needs every track, so it is only
+// made once all the tracks we offered to receive have arrived, or republishTrackWait after the first one.
+type republisher struct {
+	url      *url.URL
+	ue       *webrtc.PeerConnection
+	expected int
+
+	mu             sync.Mutex
+	names          []string
+	tracks         map[string]*republishedTrack
+	active         int
+	timer          *time.Timer
+	started        bool
+	peerConnection *webrtc.PeerConnection
+	wsConn         *websocket.Conn
+}
+
+func newRepublisher(rawURL string, ue *webrtc.PeerConnection, expected int) (*republisher, error) {
+	u, err := parseRepublishURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &republisher{url: u, ue: ue, expected: expected, tracks: make(map[string]*republishedTrack)}, nil
+}
+
+func parseRepublishURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a ws:// or wss:// URL", rawURL)
+	}
+	return u, nil
+}
+
+// Adds a track from UE to the tracks we re-publish, starting the outbound peer connection once we have them all.
+func (r *republisher) addTrack(name string, track *webrtc.TrackRemote) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active++
+	if r.started {
+		log.Printf("%s track arrived after re-publishing to %s started, it will not be re-published.", name, r.url.Host)
+		return
+	}
+	// Same codec as UE sends so the packets pass straight through, Pion rewrites their SSRC and payload type to match
+	// what the outbound peer connection negotiated.
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+	if err != nil {
+		log.Printf("Error creating re-published %s track. Error: %s", name, err.Error())
+		return
+	}
+	r.names = append(r.names, name)
+	r.tracks[name] = &republishedTrack{remote: track, local: local}
+	if len(r.names) >= r.expected {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		go r.start()
+	} else if r.timer == nil {
+		r.timer = time.AfterFunc(republishTrackWait, r.start)
+	}
+}
+
+// Removes a track that stopped forwarding, once the last one has gone the outbound peer connection is closed.
+func (r *republisher) removeTrack(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active--
+	if r.active > 0 {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.closeLocked()
+}
+
+// Passes a forwarded packet of the named track on to the outbound peer connection, a no-op until it is connected.
+func (r *republisher) writeRTP(name string, packet *rtp.Packet) {
+	r.mu.Lock()
+	track, ok := r.tracks[name]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	// The outbound peer connection negotiates no header extensions, so UE's are stripped rather than sent with IDs
+	// that mean nothing (or something else) to the peer. The packet is shared with the other outputs, so a copy is.
+	outbound := *packet
+	outbound.Header.Extension = false
+	outbound.Header.ExtensionProfile = 0
+	outbound.Header.Extensions = nil
+	// Errors are the peer going away, which the outbound connection's state handling deals with.
+	track.local.WriteRTP(&outbound)
+}
+
+// Creates the outbound peer connection with a sendonly track for each of the tracks we have, and offers it to the
+// peer over its signalling server.
+func (r *republisher) start() {
+	r.mu.Lock()
+	if r.started || r.active == 0 {
+		r.mu.Unlock()
+		return
+	}
+	r.started = true
+	tracks := make([]*republishedTrack, 0, len(r.names))
+	for _, name := range r.names {
+		tracks = append(tracks, r.tracks[name])
+	}
+	r.mu.Unlock()
+
+	// Connecting runs without the lock so forwarding carries on meanwhile.
+	peerConnection, wsConn, err := r.connect(tracks)
+	if err != nil {
+		log.Printf("Error re-publishing to %s. Error: %s", r.url.Host, err.Error())
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peerConnection, r.wsConn = peerConnection, wsConn
+	if r.active == 0 {
+		// Every track ended while we were connecting.
+		r.closeLocked()
+		return
+	}
+	sessionPrintln(fmt.Sprintf("Re-publishing %s to %s.", strings.Join(r.names, ", "), r.url.Host))
+}
+
+func (r *republisher) connect(tracks []*republishedTrack) (*webrtc.PeerConnection, *websocket.Conn, error) {
+	m := webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, fmt.Errorf("registering default codecs: %w", err)
+	}
+	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(&m)).NewPeerConnection(webrtc.Configuration{SDPSemantics: webrtc.SDPSemanticsUnifiedPlan})
+	if err != nil {
+		return nil, nil, fmt.Errorf("making new peer connection: %w", err)
+	}
+	for _, track := range tracks {
+		sender, err := peerConnection.AddTrack(track.local)
+		if err != nil {
+			peerConnection.Close()
+			return nil, nil, fmt.Errorf("adding %s track: %w", track.remote.Kind(), err)
+		}
+		go r.relayFeedback(sender, track.remote)
+	}
+
+	wsConn, _, err := websocket.DefaultDialer.Dial(r.url.String(), nil)
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, fmt.Errorf("websocket dialing error: %w", err)
+	}
+
+	// Same signalling as with UE, just with us always making the offer.
+	pendingCandidates := &candidateQueue{}
+	peerConnection.OnICECandidate(func(localIceCandidate *webrtc.ICECandidate) {
+		if localIceCandidate == nil || *DisableTrickle {
+			return
+		}
+		if !pendingCandidates.queue(localIceCandidate) {
+			sendLocalIceCandidate(wsConn, localIceCandidate)
+		}
+	})
+	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
+		if connectionState == webrtc.PeerConnectionStateFailed {
+			log.Printf("Re-publishing peer connection to %s failed, stopped re-publishing.", r.url.Host)
+			wsConn.Close()
+		}
+	})
+	if err = r.sendOffer(wsConn, peerConnection); err != nil {
+		wsConn.Close()
+		peerConnection.Close()
+		return nil, nil, fmt.Errorf("offering: %w", err)
+	}
+	go func() {
+		r.controlLoop(wsConn, peerConnection, pendingCandidates)
+		peerConnection.Close()
+	}()
+	return peerConnection, wsConn, nil
+}
+
+// Creates our offer and sends it to the peer. Unlike UE's sendOffer it leaves out ExtensionID and
+// SDPTransformCommand, which are for UE's leg.
+func (r *republisher) sendOffer(wsConn signallingConn, peerConnection *webrtc.PeerConnection) error {
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	// The promise must be created before SetLocalDescription starts the gathering.
+	gatheringComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if *DisableTrickle {
+		waitForGathering(gatheringComplete, time.Duration(*ICEGatheringTimeoutMs)*time.Millisecond)
+		offer = *peerConnection.LocalDescription()
+	}
+	offerString, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	return writeWSMessage(wsConn, string(offerString))
+}
+
+// Reads the peer's signalling until the websocket closes, applying its answer and ICE candidates and answering its
+// pings. Unlike UE's startControlLoop it leaves the session setup timings and ExtensionID checks alone, they are about
+// UE's leg, and a message it can't use is logged and skipped. Returns the websocket read error that ended it.
+func (r *republisher) controlLoop(wsConn signallingConn, peerConnection *webrtc.PeerConnection, pendingCandidates *candidateQueue) error {
+	for {
+		_, message, err := readLimitedMessage(wsConn, int64(*WSMaxMessageBytes))
+		if tooBig, ok := err.(*messageTooBigError); ok {
+			log.Printf("Skipping re-publishing websocket message from %s: %s", r.url.Host, tooBig.Error())
+			continue
+		}
+		if err != nil {
+			wsConn.Close()
+			return err
+		}
+
+		var objmap map[string]json.RawMessage
+		var messageType string
+		if err = json.Unmarshal(message, &objmap); err == nil {
+			err = json.Unmarshal(objmap["type"], &messageType)
+		}
+		if err != nil {
+			log.Printf("Skipping re-publishing websocket message from %s. Error: %s", r.url.Host, err.Error())
+			continue
+		}
+		switch messageType {
+		case "answer":
+			err = r.handleAnswer(message, peerConnection, wsConn, pendingCandidates)
+		case "iceCandidate":
+			var candidate webrtc.ICECandidateInit
+			if err = json.Unmarshal(objmap["candidate"], &candidate); err == nil {
+				err = peerConnection.AddICECandidate(candidate)
+			}
+		case "ping":
+			handlePing(objmap, wsConn)
+		}
+		if err != nil {
+			log.Printf("Error handling %s message from %s. Error: %s", messageType, r.url.Host, err.Error())
+		}
+	}
+}
+
+// Applies the peer's answer to our offer and sends the local ICE candidates gathered meanwhile.
+func (r *republisher) handleAnswer(message []byte, peerConnection *webrtc.PeerConnection, wsConn signallingConn, pendingCandidates *candidateQueue) error {
+	answer := webrtc.SessionDescription{}
+	if err := json.Unmarshal(message, &answer); err != nil {
+		return err
+	}
+	if err := checkSDPSize("answer", answer.SDP); err != nil {
+		return err
+	}
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		return err
+	}
+	sessionPrintln(fmt.Sprintf("Added session description from re-publishing peer %s.", r.url.Host))
+	for _, localIceCandidate := range pendingCandidates.flush() {
+		sendLocalIceCandidate(wsConn, localIceCandidate)
+	}
+	return nil
+}
+
+// Reads the RTCP the peer sends about a re-published track, and passes its keyframe requests and bandwidth estimates
+// back to UE for the track they were re-published from. Receiver reports and NACKs are about the outbound leg, which
+// Pion handles, so they are not passed back.
+func (r *republisher) relayFeedback(sender *webrtc.RTPSender, remote *webrtc.TrackRemote) {
+	ssrc := uint32(remote.SSRC())
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		var feedback []rtcp.Packet
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				feedback = append(feedback, &rtcp.PictureLossIndication{MediaSSRC: ssrc})
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				feedback = append(feedback, &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: p.Bitrate, SSRCs: []uint32{ssrc}})
+			}
+		}
+		if len(feedback) > 0 {
+			if err := r.ue.WriteRTCP(feedback); err != nil {
+				sessionPrintln(err)
+			}
+		}
+	}
+}
+
+// Closes the outbound peer connection and its signalling, must be called with mu held.
+func (r *republisher) closeLocked() {
+	if r.wsConn != nil {
+		r.wsConn.Close()
+		r.wsConn = nil
+	}
+	if r.peerConnection != nil {
+		r.peerConnection.Close()
+		r.peerConnection = nil
+	}
+}
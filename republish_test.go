@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Returns the remote tracks a peer connection gets from the test UE sending a track of each kind, closed when the
+// test ends.
+func newTestRemoteTracks(t *testing.T, kinds ...webrtc.RTPCodecType) []*webrtc.TrackRemote {
+	t.Helper()
+	ue := newTestUE(t)
+	for _, kind := range kinds {
+		addTestTrack(t, ue, kind, kind.String())
+	}
+	receiver := newTestUE(t)
+	arrived := make(chan *webrtc.TrackRemote, len(kinds))
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		arrived <- track
+	})
+	if err := negotiateLocally(ue, receiver); err != nil {
+		t.Fatal(err)
+	}
+	var tracks []*webrtc.TrackRemote
+	for range kinds {
+		select {
+		case track := <-arrived:
+			tracks = append(tracks, track)
+		case <-time.After(5 * time.Second):
+			t.Fatal("UE's tracks didn't arrive within 5s")
+		}
+	}
+	return tracks
+}
+
+// Creates a peer connection for the republisher to offer from, with a sendonly track like connect adds.
+func newTestOutboundLeg(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	outbound := newTestUE(t)
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = outbound.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	return outbound
+}
+
+func TestRepublisherTrackWait(t *testing.T) {
+	tracks := newTestRemoteTracks(t, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio)
+	r, err := newRepublisher("ws://127.0.0.1:1/", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waits for the rest of the tracks.
+	r.addTrack("video", tracks[0])
+	r.mu.Lock()
+	waiting := r.timer != nil && !r.started
+	r.mu.Unlock()
+	if !waiting {
+		t.Fatal("started with one of two tracks")
+	}
+
+	// The last track ending stops the wait, and the timer firing late doesn't start anything.
+	r.removeTrack("video")
+	if r.timer.Stop() {
+		t.Error("the wait is still running after the last track ended")
+	}
+	r.start()
+	if r.started || r.peerConnection != nil {
+		t.Error("started with no tracks")
+	}
+
+	// Tracks arriving once started are left out.
+	logged := captureLog(t)
+	r.started = true
+	r.addTrack("audio", tracks[1])
+	if len(r.names) != 1 || r.tracks["audio"] != nil {
+		t.Errorf("re-publishing %v after starting, want only video", r.names)
+	}
+	if !strings.Contains(logged.String(), "will not be re-published") {
+		t.Errorf("logged %q, want the late track", logged.String())
+	}
+}
+
+func TestRepublisherSendOffer(t *testing.T) {
+	// For UE's leg only, a transform that always fails mustn't fail this offer.
+	setFlag(t, "SDPTransformCommand", "false")
+	outbound := newTestOutboundLeg(t)
+	wsConn := newFakeSignallingConn()
+	r := &republisher{}
+	if err := r.sendOffer(wsConn, outbound); err != nil {
+		t.Fatal(err)
+	}
+	sent, _ := wsConn.waitForWrite(t, "offer")
+	var offer webrtc.SessionDescription
+	if err := json.Unmarshal(sent, &offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.SDP != outbound.LocalDescription().SDP {
+		t.Error("sent offer isn't our local description")
+	}
+
+	failed := newFakeSignallingConn()
+	failed.writeErr = errors.New("connection reset")
+	if err := r.sendOffer(failed, newTestOutboundLeg(t)); err == nil {
+		t.Error("failed write not returned")
+	}
+}
+
+// The outbound leg's signalling applies the peer's answer without touching UE's leg.
+func TestRepublisherControlLoop(t *testing.T) {
+	setFlag(t, "ExtensionID", "mid:5")
+	sessionSetup.reset(time.Now())
+	t.Cleanup(func() { sessionSetup.reset(time.Time{}) })
+	outbound := newTestOutboundLeg(t)
+	wsConn := newFakeSignallingConn()
+	r := &republisher{url: &url.URL{Host: "sfu.example"}}
+	if err := r.sendOffer(wsConn, outbound); err != nil {
+		t.Fatal(err)
+	}
+	peer := newTestUE(t)
+	if err := peer.SetRemoteDescription(*outbound.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := peer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = peer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := captureLog(t)
+	wsConn.incoming <- []byte("not json")
+	wsConn.incoming <- []byte(`{"type":"ping","time":1}`)
+	wsConn.incoming <- []byte(`{"type":"iceCandidate","candidate":{"candidate":"nonsense"}}`)
+	wsConn.send(t, answer)
+	close(wsConn.incoming)
+	if err = r.controlLoop(wsConn, outbound, &candidateQueue{}); err == nil {
+		t.Error("control loop ended without the read error")
+	}
+
+	if outbound.RemoteDescription() == nil {
+		t.Error("peer's answer not applied")
+	}
+	if pongs, _ := wsConn.takeWritten(t, "pong"); len(pongs) != 1 {
+		t.Errorf("answered %d pings, want 1", len(pongs))
+	}
+	if !strings.Contains(logged.String(), "Skipping re-publishing websocket message") || !strings.Contains(logged.String(), "Error handling iceCandidate message") {
+		t.Errorf("logged %q, want the bad messages skipped", logged.String())
+	}
+	if strings.Contains(logged.String(), "-ExtensionID pins") {
+		t.Errorf("logged %q, UE's ExtensionID was checked against the peer's answer", logged.String())
+	}
+	sessionSetup.mu.Lock()
+	negotiated := sessionSetup.phases[setupNegotiated]
+	sessionSetup.mu.Unlock()
+	if !negotiated.IsZero() {
+		t.Error("the peer's answer marked UE's session negotiated")
+	}
+	if !wsConn.closed {
+		t.Error("websocket not closed")
+	}
+}
+
+// Re-publishes a track to a peer behind a signalling server: the offer and answer, packets without UE's header
+// extensions, and closing once the track ends.
+func TestRepublish(t *testing.T) {
+	setFlag(t, "DisableTrickle", "true")
+	captureLog(t)
+	tracks := newTestRemoteTracks(t, webrtc.RTPCodecTypeVideo)
+
+	received := make(chan *rtp.Packet, 1)
+	closed := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrading: %s", err)
+			return
+		}
+		defer conn.Close()
+		var offer webrtc.SessionDescription
+		if err = conn.ReadJSON(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+			t.Errorf("read %v, %v, want our offer", offer.Type, err)
+			return
+		}
+		peer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer peer.Close()
+		peer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			if packet, _, err := track.ReadRTP(); err == nil {
+				received <- packet
+			}
+		})
+		if err = peer.SetRemoteDescription(offer); err != nil {
+			t.Error(err)
+			return
+		}
+		answer, _ := peer.CreateAnswer(nil)
+		gathered := webrtc.GatheringCompletePromise(peer)
+		peer.SetLocalDescription(answer)
+		<-gathered
+		conn.WriteJSON(peer.LocalDescription())
+		// Until we close the websocket.
+		for {
+			if _, _, err = conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	// Stands in for UE's leg, for the feedback passed back.
+	r, err := newRepublisher("ws"+strings.TrimPrefix(server.URL, "http"), newTestUE(t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.addTrack("video", tracks[0])
+
+	packet := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, Marker: true, PayloadType: 102, SequenceNumber: 1, Timestamp: 1800, SSRC: 1234},
+		Payload: []byte{h264NALTypeIDR | 0x60, 0x88, 0x84, 0x00},
+	}
+	if err = packet.SetExtension(3, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	var got *rtp.Packet
+	deadline := time.After(10 * time.Second)
+	for got == nil {
+		r.writeRTP("video", packet)
+		select {
+		case got = <-received:
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no packet re-published within 10s")
+		}
+		packet.SequenceNumber++
+	}
+	if got.Extension || len(got.Extensions) != 0 {
+		t.Errorf("re-published packet has UE's header extensions %v", got.Extensions)
+	}
+	if !packet.Extension || len(packet.GetExtension(3)) != 2 {
+		t.Error("UE's packet lost its header extension, which the other outputs still need")
+	}
+
+	r.removeTrack("video")
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket still open after the last track ended")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peerConnection != nil || r.wsConn != nil {
+		t.Error("outbound peer connection not closed")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The track attributes a RouteScript rule can match on.
+var routeAttributes = []string{"kind", "codec", "rid", "ssrc"}
+
+// routeCondition - One attribute test of a rule, e.g. codec=vp8|vp9 or rid!=l.
+type routeCondition struct {
+	attribute string
+	values    []string
+	negate    bool
+}
+
+// routeRule - A RouteScript rule: a track matching all of its conditions is forwarded to its destinations instead of
+// ForwardingAddress and the usual ports. A rule without conditions (*) matches every track.
+type routeRule struct {
+	text         string
+	conditions   []routeCondition
+	destinations []string
+}
+
+// Parses a RouteScript, rules separated by ";" such as
+//
+//	kind=video && rid=h -> 10.0.0.5:5004; kind=video -> 127.0.0.1:6004, 127.0.0.1:7004; * -> 127.0.0.1:4000
+//
+// Each rule is conditions, "->" and a comma separated list of host:port destinations. Conditions are joined with "&&"
+// and are attribute=value or attribute!=value, where value may list alternatives separated by "|".
+func parseRouteScript(script string) ([]routeRule, error) {
+	var rules []routeRule
+	for _, text := range strings.Split(script, ";") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		rule, err := parseRouteRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", text, err)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return rules, nil
+}
+
+func parseRouteRule(text string) (routeRule, error) {
+	rule := routeRule{text: text}
+	parts := strings.Split(text, "->")
+	if len(parts) != 2 {
+		return rule, fmt.Errorf("expected conditions -> destinations")
+	}
+
+	if conditions := strings.TrimSpace(parts[0]); conditions != "*" {
+		for _, condition := range strings.Split(conditions, "&&") {
+			parsed, err := parseRouteCondition(strings.TrimSpace(condition))
+			if err != nil {
+				return rule, err
+			}
+			rule.conditions = append(rule.conditions, parsed)
+		}
+	}
+
+	for _, destination := range strings.Split(parts[1], ",") {
+		destination = strings.TrimSpace(destination)
+		host, port, err := net.SplitHostPort(destination)
+		if err != nil {
+			return rule, fmt.Errorf("destination %q is not host:port", destination)
+		}
+		if number, err := strconv.Atoi(port); err != nil || host == "" || number < 1 || number > 65535 {
+			return rule, fmt.Errorf("destination %q is not host:port", destination)
+		}
+		rule.destinations = append(rule.destinations, destination)
+	}
+	return rule, nil
+}
+
+func parseRouteCondition(text string) (routeCondition, error) {
+	var condition routeCondition
+	separator := strings.Index(text, "=")
+	if separator < 1 {
+		return condition, fmt.Errorf("condition %q is not attribute=value or attribute!=value", text)
+	}
+	attribute := text[:separator]
+	if strings.HasSuffix(attribute, "!") {
+		condition.negate = true
+		attribute = attribute[:len(attribute)-1]
+	}
+	condition.attribute = strings.ToLower(strings.TrimSpace(attribute))
+	known := false
+	for _, name := range routeAttributes {
+		known = known || name == condition.attribute
+	}
+	if !known {
+		return condition, fmt.Errorf("unknown attribute %q, expected one of %s", condition.attribute, strings.Join(routeAttributes, ", "))
+	}
+	for _, value := range strings.Split(text[separator+1:], "|") {
+		if value = strings.TrimSpace(value); value == "" {
+			return condition, fmt.Errorf("condition %q has an empty value", text)
+		}
+		condition.values = append(condition.values, value)
+	}
+	return condition, nil
+}
+
+// The attributes of a track as RouteScript sees them. The codec is its MIME subtype, e.g. H264 or opus, and the RID is
+// empty for a track that isn't a simulcast layer.
+func routeAttributesOf(track *webrtc.TrackRemote) map[string]string {
+	codec := track.Codec().MimeType
+	if slash := strings.Index(codec, "/"); slash >= 0 {
+		codec = codec[slash+1:]
+	}
+	return map[string]string{
+		"kind":  track.Kind().String(),
+		"codec": codec,
+		"rid":   track.RID(),
+		"ssrc":  strconv.FormatUint(uint64(track.SSRC()), 10),
+	}
+}
+
+// Reports whether a track with these attributes matches every condition of the rule. Kinds and codecs are compared
+// ignoring case, RIDs and SSRCs exactly.
+func (r *routeRule) matches(attributes map[string]string) bool {
+	for _, condition := range r.conditions {
+		actual := attributes[condition.attribute]
+		equal := false
+		for _, value := range condition.values {
+			if condition.attribute == "kind" || condition.attribute == "codec" {
+				equal = equal || strings.EqualFold(value, actual)
+			} else {
+				equal = equal || value == actual
+			}
+		}
+		if equal == condition.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the first rule the track matches, nil if there is none and the track goes to the usual destinations.
+func matchRoute(rules []routeRule, attributes map[string]string) *routeRule {
+	for i := range rules {
+		if rules[i].matches(attributes) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
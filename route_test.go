@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRouteScript(t *testing.T) {
+	rules, err := parseRouteScript(" kind=video && rid=h -> 10.0.0.5:5004; kind=video -> 127.0.0.1:6004, 127.0.0.1:7004 ;; * -> [::1]:4000;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []routeRule{
+		{
+			text:         "kind=video && rid=h -> 10.0.0.5:5004",
+			conditions:   []routeCondition{{attribute: "kind", values: []string{"video"}}, {attribute: "rid", values: []string{"h"}}},
+			destinations: []string{"10.0.0.5:5004"},
+		},
+		{
+			text:         "kind=video -> 127.0.0.1:6004, 127.0.0.1:7004",
+			conditions:   []routeCondition{{attribute: "kind", values: []string{"video"}}},
+			destinations: []string{"127.0.0.1:6004", "127.0.0.1:7004"},
+		},
+		{text: "* -> [::1]:4000", destinations: []string{"[::1]:4000"}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("parsed as %+v, want %+v", rules, want)
+	}
+}
+
+func TestParseRouteScriptErrors(t *testing.T) {
+	for _, script := range []string{
+		"",
+		" ; ",
+		"kind=video",
+		"kind=video -> 127.0.0.1:6004 -> 127.0.0.1:7004",
+		"kind=video -> 127.0.0.1",
+		"kind=video -> :6004",
+		"kind=video -> 127.0.0.1:0",
+		"kind=video -> 127.0.0.1:65536",
+		"kind=video -> 127.0.0.1:rtp",
+		"kind=video -> 127.0.0.1:6004,",
+		"kind=video && -> 127.0.0.1:6004",
+		"* -> 127.0.0.1:6004; bitrate=high -> 127.0.0.1:7004",
+	} {
+		t.Run(script, func(t *testing.T) {
+			if rules, err := parseRouteScript(script); err == nil {
+				t.Errorf("parsed as %+v, want an error", rules)
+			}
+		})
+	}
+}
+
+func TestParseRouteCondition(t *testing.T) {
+	tests := []struct {
+		text string
+		want routeCondition
+		ok   bool
+	}{
+		{"kind=video", routeCondition{attribute: "kind", values: []string{"video"}}, true},
+		{"codec = vp8 | vp9", routeCondition{attribute: "codec", values: []string{"vp8", "vp9"}}, true},
+		{"rid!=l", routeCondition{attribute: "rid", values: []string{"l"}, negate: true}, true},
+		{"SSRC=1234", routeCondition{attribute: "ssrc", values: []string{"1234"}}, true},
+		{"kind", routeCondition{}, false},
+		{"=video", routeCondition{}, false},
+		{"!=video", routeCondition{}, false},
+		{"port=4000", routeCondition{}, false},
+		{"kind=", routeCondition{}, false},
+		{"codec=vp8||vp9", routeCondition{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			condition, err := parseRouteCondition(test.text)
+			if (err == nil) != test.ok {
+				t.Fatalf("error is %v, want ok %v", err, test.ok)
+			}
+			if test.ok && !reflect.DeepEqual(condition, test.want) {
+				t.Errorf("parsed as %+v, want %+v", condition, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	rules, err := parseRouteScript("kind=video && rid=h -> 10.0.0.5:5004; kind=video && codec!=h264 -> 127.0.0.1:6004; ssrc=42|43 -> 127.0.0.1:7004; kind=audio -> 127.0.0.1:8004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		// The index of the rule matched, -1 for none.
+		want int
+	}{
+		{"first rule wins", map[string]string{"kind": "video", "codec": "VP8", "rid": "h", "ssrc": "1"}, 0},
+		{"negated codec", map[string]string{"kind": "video", "codec": "VP8", "rid": "l", "ssrc": "1"}, 1},
+		{"kind and codec ignore case", map[string]string{"kind": "VIDEO", "codec": "vp9", "rid": "", "ssrc": "1"}, 1},
+		{"RIDs compare exactly", map[string]string{"kind": "video", "codec": "H264", "rid": "H", "ssrc": "43"}, 2},
+		{"one of several SSRCs", map[string]string{"kind": "video", "codec": "H264", "rid": "", "ssrc": "42"}, 2},
+		{"kind only", map[string]string{"kind": "audio", "codec": "opus", "rid": "", "ssrc": "1"}, 3},
+		{"no rule", map[string]string{"kind": "video", "codec": "H264", "rid": "", "ssrc": "1"}, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched := matchRoute(rules, test.attributes)
+			switch {
+			case test.want < 0 && matched != nil:
+				t.Errorf("matched %q, want no rule", matched.text)
+			case test.want >= 0 && matched != &rules[test.want]:
+				t.Errorf("matched %v, want %q", matched, rules[test.want].text)
+			}
+		})
+	}
+}
+
+func TestMatchRouteCatchAll(t *testing.T) {
+	rules, err := parseRouteScript("kind=audio -> 127.0.0.1:8004; * -> 127.0.0.1:4000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched := matchRoute(rules, map[string]string{"kind": "video"}); matched != &rules[1] {
+		t.Errorf("matched %v, want the catch-all", matched)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/pion/rtcp"
+)
+
+const rtcpTypeApplicationDefined = 204
+
+// Builds an RTCP APP packet (RFC 3550 section 6.7) with the given subtype and 4 character name and no application data.
+// UE's pixel streaming plugin does not document an APP format, so we only send the name/subtype some setups key on.
+func marshalAPP(senderSSRC uint32, subtype uint8, name string) *rtcp.RawPacket {
+	b := make([]byte, 12)
+	b[0] = 2<<6 | subtype&0x1F
+	b[1] = rtcpTypeApplicationDefined
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)/4-1))
+	binary.BigEndian.PutUint32(b[4:], senderSSRC)
+	copy(b[8:12], name)
+	packet := rtcp.RawPacket(b)
+	return &packet
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// How long we wait for the rest of UE's tracks after the first one before announcing whatever we have.
+	rtspTrackWait = 3 * time.Second
+	// How often we send OPTIONS while recording so the server doesn't time the session out.
+	rtspKeepaliveInterval = 30 * time.Second
+	rtspTimeout           = 10 * time.Second
+	rtspDefaultPort       = "554"
+	// How many interleaved frames can wait for the RTSP connection, newer ones are dropped once it's full.
+	rtspQueueLength = 256
+)
+
+// rtspPublisher - Pushes a session's forwarded streams to an RTSP server (ANNOUNCE, SETUP and RECORD), so RTSP clients
+// and recorders (e.g. an NVR) can consume them. The SDP we announce needs every track, so the RTSP session only starts
+// once all the tracks we offered to receive have arrived, or rtspTrackWait after the first one.
+type rtspPublisher struct {
+	url       *url.URL
+	transport string
+	expected  int
+
+	mu        sync.Mutex
+	names     []string
+	streams   map[string]hintedStream
+	active    int
+	timer     *time.Timer
+	started   bool
+	recording bool
+	session   *rtspSession
+	stop      chan struct{}
+}
+
+// rtspSession - An RTSP session we have set up, with where each track's RTP goes: an interleaved channel on the
+// control connection (TCP) or a socket and server address (UDP). Interleaved frames are queued for writeFrames, so
+// a slow server drops frames rather than holding up the forwarding.
+type rtspSession struct {
+	client     *rtspClient
+	channels   map[string]int
+	udpConns   map[string]*net.UDPConn
+	udpTargets map[string]*net.UDPAddr
+	frames     chan []byte
+	dropped    int
+}
+
+func (s *rtspSession) close() {
+	s.client.conn.Close()
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+}
+
+func newRTSPPublisher(rawURL string, transport string, expected int) (*rtspPublisher, error) {
+	u, err := parseRTSPURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &rtspPublisher{url: u, transport: transport, expected: expected, streams: make(map[string]hintedStream)}, nil
+}
+
+func parseRTSPURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an rtsp://host/path URL", rawURL)
+	}
+	return u, nil
+}
+
+// Adds a forwarded track to the streams we publish, starting the RTSP session once we have them all.
+func (p *rtspPublisher) addTrack(name string, stream hintedStream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+	if p.started {
+		log.Printf("%s track arrived after the RTSP session to %s started, it will not be published.", name, p.url.Host)
+		return
+	}
+	p.names = append(p.names, name)
+	p.streams[name] = stream
+	if len(p.names) >= p.expected {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		go p.start()
+	} else if p.timer == nil {
+		p.timer = time.AfterFunc(rtspTrackWait, p.start)
+	}
+}
+
+// Removes a track that stopped forwarding, once the last one has gone the RTSP session is torn down.
+func (p *rtspPublisher) removeTrack(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.active > 0 {
+		return
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.closeLocked()
+}
+
+// Announces the tracks we have, sets each one up and starts recording.
+func (p *rtspPublisher) start() {
+	p.mu.Lock()
+	if p.started || p.active == 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.started = true
+	names := append([]string(nil), p.names...)
+	streams := make([]hintedStream, len(names))
+	for i, name := range names {
+		streams[i] = p.streams[name]
+	}
+	p.mu.Unlock()
+
+	// The handshake runs without the lock so forwarding carries on, packets are only published once we're recording.
+	client, err := dialRTSP(p.url)
+	if err != nil {
+		log.Printf("Error connecting to RTSP server %s. Error: %s", p.url.Host, err.Error())
+		return
+	}
+	session := &rtspSession{
+		client:     client,
+		channels:   make(map[string]int),
+		udpConns:   make(map[string]*net.UDPConn),
+		udpTargets: make(map[string]*net.UDPAddr),
+	}
+	if err = p.handshake(session, names, streams); err != nil {
+		log.Printf("Error publishing to RTSP server %s. Error: %s", p.url.Host, err.Error())
+		session.close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.session = session
+	if p.active == 0 {
+		// Every track ended while we were connecting.
+		p.closeLocked()
+		return
+	}
+	p.recording = true
+	p.stop = make(chan struct{})
+	go client.discardIncoming()
+	go p.keepalive(p.stop)
+	if len(session.channels) > 0 {
+		session.frames = make(chan []byte, rtspQueueLength)
+		go p.writeFrames(session, p.stop)
+	}
+	sessionPrintln(fmt.Sprintf("Publishing %s to %s over RTSP/%s.", strings.Join(names, ", "), p.url.Redacted(), strings.ToUpper(p.transport)))
+}
+
+func (p *rtspPublisher) handshake(session *rtspSession, names []string, streams []hintedStream) error {
+	client := session.client
+	if _, err := client.do("OPTIONS", client.baseURL, nil, ""); err != nil {
+		return err
+	}
+	if _, err := client.do("ANNOUNCE", client.baseURL, map[string]string{"Content-Type": "application/sdp"}, announceSDP(streams)); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", 2*i, 2*i+1)
+		if p.transport == "udp" {
+			conn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return err
+			}
+			session.udpConns[name] = conn
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;mode=record", port, port+1)
+		}
+		resp, err := client.do("SETUP", fmt.Sprintf("%s/trackID=%d", client.baseURL, i), map[string]string{"Transport": transport}, "")
+		if err != nil {
+			return err
+		}
+		if p.transport == "udp" {
+			serverPort, err := rtspServerPort(resp.header.Get("Transport"))
+			if err != nil {
+				return err
+			}
+			session.udpTargets[name] = &net.UDPAddr{IP: client.conn.RemoteAddr().(*net.TCPAddr).IP, Port: serverPort}
+		} else {
+			session.channels[name] = 2 * i
+		}
+	}
+
+	_, err := client.do("RECORD", client.baseURL, map[string]string{"Range": "npt=0.000-"}, "")
+	return err
+}
+
+// Publishes a forwarded RTP packet of the named track, a no-op until we're recording.
+func (p *rtspPublisher) writeRTP(name string, packet *rtp.Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.recording {
+		return
+	}
+
+	raw := packet.Raw
+	if conn, ok := p.session.udpConns[name]; ok {
+		// Like the UDP forwarding, a refused or dropped datagram isn't worth ending the RTSP session over.
+		conn.WriteToUDP(raw, p.session.udpTargets[name])
+		return
+	}
+	channel, ok := p.session.channels[name]
+	if !ok {
+		return
+	}
+	// RFC 2326 section 10.12 interleaved binary data: '$', the channel, a 16 bit length and the packet.
+	frame := make([]byte, 4+len(raw))
+	frame[0], frame[1] = '$', byte(channel)
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(raw)))
+	copy(frame[4:], raw)
+	select {
+	case p.session.frames <- frame:
+	default:
+		p.session.dropped++
+	}
+}
+
+// Writes the session's queued interleaved frames to the RTSP connection until stop is closed, stopping the
+// publishing if a write fails.
+func (p *rtspPublisher) writeFrames(session *rtspSession, stop <-chan struct{}) {
+	conn := session.client.conn
+	for {
+		var frame []byte
+		select {
+		case <-stop:
+			return
+		case frame = <-session.frames:
+		}
+		conn.SetWriteDeadline(time.Now().Add(rtspTimeout))
+		if _, err := conn.Write(frame); err != nil {
+			p.mu.Lock()
+			// Unless the session was already torn down, which closes the connection under the write.
+			if p.session == session {
+				log.Printf("Error writing to RTSP server %s, stopped publishing. Error: %s", p.url.Host, err.Error())
+				p.closeLocked()
+			}
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (p *rtspPublisher) keepalive(stop <-chan struct{}) {
+	ticker := time.NewTicker(rtspKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		if p.recording {
+			// The reply is read and dropped by discardIncoming.
+			client := p.session.client
+			client.conn.SetWriteDeadline(time.Now().Add(rtspTimeout))
+			client.send("OPTIONS", client.baseURL, nil, "")
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Tears down the RTSP session (best effort) and closes its connections, must be called with mu held.
+func (p *rtspPublisher) closeLocked() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	if p.session != nil {
+		if p.recording {
+			client := p.session.client
+			client.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			client.send("TEARDOWN", client.baseURL, nil, "")
+		}
+		if p.session.dropped > 0 {
+			log.Printf("Dropped %d RTP packets the RTSP server %s didn't keep up with.", p.session.dropped, p.url.Host)
+		}
+		p.session.close()
+		p.session = nil
+	}
+	p.recording = false
+}
+
+// The SDP we ANNOUNCE, the same codec description as the command hint's SDP with a control URL per track.
+func announceSDP(streams []hintedStream) string {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		"s=Unreal Engine Pixel Streaming",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+	}
+	for i, stream := range streams {
+		lines = append(lines, fmt.Sprintf("m=%s 0 RTP/AVP %d", stream.kind, stream.payloadType))
+		lines = append(lines, codecSDPLines(stream)...)
+		lines = append(lines, fmt.Sprintf("a=control:trackID=%d", i))
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+var rtspServerPortPattern = regexp.MustCompile(`server_port=(\d+)`)
+
+// The server's RTP port from a SETUP response's Transport header.
+func rtspServerPort(transport string) (int, error) {
+	match := rtspServerPortPattern.FindStringSubmatch(transport)
+	if match == nil {
+		return 0, fmt.Errorf("no server_port in RTSP transport %q", transport)
+	}
+	return strconv.Atoi(match[1])
+}
+
+// rtspClient - The RTSP control connection, sending requests and reading their responses one at a time.
+type rtspClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	baseURL string
+	user    *url.Userinfo
+	cseq    int
+	session string
+	// Set once the server has asked for digest authentication.
+	realm string
+	nonce string
+}
+
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+}
+
+func dialRTSP(u *url.URL) (*rtspClient, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), rtspDefaultPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, rtspTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials go in the Authorization header, not the request URLs.
+	base := *u
+	base.User = nil
+	return &rtspClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		baseURL: strings.TrimSuffix(base.String(), "/"),
+		user:    u.User,
+	}, nil
+}
+
+// Sends a request and waits for its response, retrying once with credentials if the server asks for them.
+func (c *rtspClient) do(method string, uri string, headers map[string]string, body string) (*rtspResponse, error) {
+	c.conn.SetDeadline(time.Now().Add(rtspTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	for attempt := 0; ; attempt++ {
+		if err := c.send(method, uri, headers, body); err != nil {
+			return nil, err
+		}
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if resp.status == 401 && attempt == 0 && c.user != nil {
+			c.realm, c.nonce = parseDigestChallenge(resp.header.Get("WWW-Authenticate"))
+			continue
+		}
+		if resp.status != 200 {
+			return nil, fmt.Errorf("RTSP %s failed with status %d", method, resp.status)
+		}
+		if session := resp.header.Get("Session"); session != "" {
+			// e.g. "12345678;timeout=60", only the ID is sent back.
+			c.session = strings.TrimSpace(strings.SplitN(session, ";", 2)[0])
+		}
+		return resp, nil
+	}
+}
+
+func (c *rtspClient) send(method string, uri string, headers map[string]string, body string) error {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: ue-rtp-forwarder\r\n", method, uri, c.cseq)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", auth)
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+func (c *rtspClient) readResponse() (*rtspResponse, error) {
+	tp := textproto.NewReader(c.reader)
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("malformed RTSP status line %q", statusLine)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed RTSP status line %q", statusLine)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		if _, err = io.CopyN(ioutil.Discard, c.reader, int64(length)); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspResponse{status: status, header: header}, nil
+}
+
+// Reads and drops whatever the server sends while we're recording (keepalive responses, interleaved RTCP), so its
+// writes never block. Returns once the connection is closed.
+func (c *rtspClient) discardIncoming() {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] == '$' {
+			header := make([]byte, 4)
+			if _, err = io.ReadFull(c.reader, header); err != nil {
+				return
+			}
+			if _, err = io.CopyN(ioutil.Discard, c.reader, int64(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		if _, err = c.readResponse(); err != nil {
+			return
+		}
+	}
+}
+
+// The Authorization header for a request, digest (RFC 2617 without qop) once challenged, otherwise basic.
+func (c *rtspClient) authorization(method string, uri string) string {
+	if c.user == nil {
+		return ""
+	}
+	password, _ := c.user.Password()
+	if c.nonce == "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user.Username()+":"+password))
+	}
+	md5Hex := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	response := md5Hex(md5Hex(c.user.Username()+":"+c.realm+":"+password) + ":" + c.nonce + ":" + md5Hex(method+":"+uri))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		c.user.Username(), c.realm, c.nonce, uri, response)
+}
+
+var digestParamPattern = regexp.MustCompile(`(realm|nonce)="([^"]*)"`)
+
+// The realm and nonce of a digest WWW-Authenticate challenge, empty for a basic challenge.
+func parseDigestChallenge(challenge string) (string, string) {
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(challenge)), "digest") {
+		return "", ""
+	}
+	var realm, nonce string
+	for _, match := range digestParamPattern.FindAllStringSubmatch(challenge, -1) {
+		if match[1] == "realm" {
+			realm = match[2]
+		} else {
+			nonce = match[2]
+		}
+	}
+	return realm, nonce
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+type testRTSPRequest struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+	body   string
+}
+
+// testRTSPServer - The server end of one RTSP connection, read and answered a request at a time by the test.
+type testRTSPServer struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+	reader   *bufio.Reader
+}
+
+func listenTestRTSP(t *testing.T) *testRTSPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for the test RTSP server: %s", err)
+	}
+	server := &testRTSPServer{t: t, listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		if server.conn != nil {
+			server.conn.Close()
+		}
+	})
+	return server
+}
+
+func (s *testRTSPServer) url(userinfo string) string {
+	return "rtsp://" + userinfo + s.listener.Addr().String() + "/ue"
+}
+
+func (s *testRTSPServer) accept() {
+	s.t.Helper()
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.t.Fatalf("accepting the RTSP connection: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+}
+
+// Reads the next request, failing the test unless it's the given method.
+func (s *testRTSPServer) read(method string) testRTSPRequest {
+	s.t.Helper()
+	tp := textproto.NewReader(s.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		s.t.Fatalf("reading the %s request: %s", method, err)
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] != method || parts[2] != "RTSP/1.0" {
+		s.t.Fatalf("got request %q, want %s", line, method)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		s.t.Fatalf("reading the %s headers: %s", method, err)
+	}
+	body := make([]byte, 0)
+	if length, _ := strconv.Atoi(header.Get("Content-Length")); length > 0 {
+		body = make([]byte, length)
+		if _, err = io.ReadFull(s.reader, body); err != nil {
+			s.t.Fatalf("reading the %s body: %s", method, err)
+		}
+	}
+	return testRTSPRequest{method: parts[0], uri: parts[1], header: header, body: string(body)}
+}
+
+// Answers the request with the status and headers, given as "Name: value".
+func (s *testRTSPServer) respond(request testRTSPRequest, status int, headers ...string) {
+	s.t.Helper()
+	response := fmt.Sprintf("RTSP/1.0 %d Status\r\nCSeq: %s\r\n", status, request.header.Get("CSeq"))
+	for _, header := range headers {
+		response += header + "\r\n"
+	}
+	if _, err := io.WriteString(s.conn, response+"\r\n"); err != nil {
+		s.t.Fatalf("answering %s: %s", request.method, err)
+	}
+}
+
+func testRTSPStream() hintedStream {
+	return hintedStream{
+		kind:        webrtc.RTPCodecTypeVideo,
+		payloadType: 96,
+		codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: "video/H264", ClockRate: 90000, SDPFmtpLine: "packetization-mode=1",
+		}},
+	}
+}
+
+// Waits until the publisher is recording or, with recording false, has stopped.
+func waitRTSPRecording(t *testing.T, p *rtspPublisher, recording bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		got := p.recording
+		p.mu.Unlock()
+		if got == recording {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("publisher recording is %v, want %v", got, recording)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		realm     string
+		nonce     string
+	}{
+		{`Digest realm="MediaMTX", nonce="abc123"`, "MediaMTX", "abc123"},
+		{`digest nonce="abc123", realm="MediaMTX", stale=FALSE`, "MediaMTX", "abc123"},
+		{`Basic realm="MediaMTX"`, "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		realm, nonce := parseDigestChallenge(test.challenge)
+		if realm != test.realm || nonce != test.nonce {
+			t.Errorf("parseDigestChallenge(%q) returned %q, %q, want %q, %q", test.challenge, realm, nonce, test.realm, test.nonce)
+		}
+	}
+}
+
+func TestRTSPDigestAuthentication(t *testing.T) {
+	server := listenTestRTSP(t)
+	u, _ := url.Parse(server.url("user:secret@"))
+	client, err := dialRTSP(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.conn.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.do("OPTIONS", client.baseURL, nil, "")
+		done <- err
+	}()
+
+	server.accept()
+	first := server.read("OPTIONS")
+	// Basic until the server asks for digest, and never in the request URL.
+	if got := first.header.Get("Authorization"); got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("first request authorized with %q, want basic", got)
+	}
+	if strings.Contains(first.uri, "secret") {
+		t.Errorf("request URL %q has the credentials", first.uri)
+	}
+	server.respond(first, 401, `WWW-Authenticate: Digest realm="MediaMTX", nonce="abc123"`)
+
+	second := server.read("OPTIONS")
+	md5Hex := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	response := md5Hex(md5Hex("user:MediaMTX:secret") + ":abc123:" + md5Hex("OPTIONS:"+first.uri))
+	want := fmt.Sprintf(`Digest username="user", realm="MediaMTX", nonce="abc123", uri="%s", response="%s"`, first.uri, response)
+	if got := second.header.Get("Authorization"); got != want {
+		t.Errorf("retry authorized with %q, want %q", got, want)
+	}
+	if first.header.Get("CSeq") == second.header.Get("CSeq") {
+		t.Errorf("retry reused CSeq %s", second.header.Get("CSeq"))
+	}
+	server.respond(second, 200)
+	if err = <-done; err != nil {
+		t.Errorf("OPTIONS failed: %s", err)
+	}
+
+	// Turned down again, the request fails rather than retrying forever.
+	go func() {
+		_, err := client.do("OPTIONS", client.baseURL, nil, "")
+		done <- err
+	}()
+	server.respond(server.read("OPTIONS"), 401, `WWW-Authenticate: Digest realm="MediaMTX", nonce="def456"`)
+	server.respond(server.read("OPTIONS"), 401, `WWW-Authenticate: Digest realm="MediaMTX", nonce="def456"`)
+	if err = <-done; err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("returned %v, want a 401 error", err)
+	}
+}
+
+func TestRTSPServerPort(t *testing.T) {
+	tests := []struct {
+		transport string
+		port      int
+		err       bool
+	}{
+		{"RTP/AVP;unicast;client_port=5000-5001;server_port=6000-6001", 6000, false},
+		{"RTP/AVP;unicast;server_port=6000-6001;client_port=5000-5001;ssrc=1234", 6000, false},
+		{"RTP/AVP;unicast;server_port=6000;mode=record", 6000, false},
+		{"RTP/AVP;unicast;client_port=5000-5001", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		port, err := rtspServerPort(test.transport)
+		if (err != nil) != test.err || port != test.port {
+			t.Errorf("rtspServerPort(%q) returned %d, %v, want %d", test.transport, port, err, test.port)
+		}
+	}
+}
+
+func TestAnnounceSDP(t *testing.T) {
+	setFlag(t, "AttachCaptureTime", "false")
+	audio := hintedStream{
+		kind:        webrtc.RTPCodecTypeAudio,
+		payloadType: 111,
+		codec: webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1",
+		}},
+	}
+	got := announceSDP([]hintedStream{testRTSPStream(), audio})
+	want := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=Unreal Engine Pixel Streaming\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1\r\n" +
+		"a=control:trackID=0\r\n" +
+		"m=audio 0 RTP/AVP 111\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+		"a=control:trackID=1\r\n"
+	if got != want {
+		t.Errorf("announced\n%s\nwant\n%s", got, want)
+	}
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(got)); err != nil || len(parsed.MediaDescriptions) != 2 {
+		t.Errorf("announced SDP doesn't parse to two tracks: %v", err)
+	}
+}
+
+// Publishes over TCP: the handshake, a packet in a '$' frame on the track's channel and the teardown.
+func TestRTSPPublishInterleaved(t *testing.T) {
+	setFlag(t, "AttachCaptureTime", "false")
+	server := listenTestRTSP(t)
+	publisher, err := newRTSPPublisher(server.url(""), "tcp", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher.addTrack("video", testRTSPStream())
+
+	server.accept()
+	server.respond(server.read("OPTIONS"), 200)
+	announce := server.read("ANNOUNCE")
+	if announce.header.Get("Content-Type") != "application/sdp" || announce.body != announceSDP([]hintedStream{testRTSPStream()}) {
+		t.Errorf("announced %q as %q, want the tracks' SDP", announce.body, announce.header.Get("Content-Type"))
+	}
+	server.respond(announce, 200)
+	setup := server.read("SETUP")
+	if want := server.url("") + "/trackID=0"; setup.uri != want {
+		t.Errorf("set up %s, want %s", setup.uri, want)
+	}
+	if got := setup.header.Get("Transport"); got != "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record" {
+		t.Errorf("set up transport %q, want interleaved channels 0-1", got)
+	}
+	server.respond(setup, 200, "Session: 12345678;timeout=60", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	record := server.read("RECORD")
+	if got := record.header.Get("Session"); got != "12345678" {
+		t.Errorf("RECORD has session %q, want 12345678", got)
+	}
+	server.respond(record, 200)
+	waitRTSPRecording(t, publisher, true)
+
+	raw := marshalTestPacket(t, rtp.Header{PayloadType: 96, SequenceNumber: 7, SSRC: 1}, []byte{1, 2, 3})
+	publisher.writeRTP("video", &rtp.Packet{Raw: raw})
+	frame := make([]byte, 4+len(raw))
+	if _, err = io.ReadFull(server.reader, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != '$' || frame[1] != 0 || int(binary.BigEndian.Uint16(frame[2:])) != len(raw) || !bytes.Equal(frame[4:], raw) {
+		t.Errorf("got frame % x, want '$', channel 0, length %d and the packet", frame, len(raw))
+	}
+	// Unknown tracks aren't published.
+	publisher.writeRTP("audio", &rtp.Packet{Raw: raw})
+
+	publisher.removeTrack("video")
+	teardown := server.read("TEARDOWN")
+	if got := teardown.header.Get("Session"); got != "12345678" {
+		t.Errorf("TEARDOWN has session %q, want 12345678", got)
+	}
+}
+
+// A server that stops reading fills the queue, then packets are dropped without holding up the caller.
+func TestRTSPQueueFull(t *testing.T) {
+	logged := captureLog(t)
+	client, server := net.Pipe()
+	publisher := &rtspPublisher{url: &url.URL{Host: "rtsp.example"}, recording: true}
+	publisher.session = &rtspSession{
+		client:   &rtspClient{conn: client},
+		channels: map[string]int{"video": 0},
+		frames:   make(chan []byte, rtspQueueLength),
+	}
+	raw := marshalTestPacket(t, rtp.Header{PayloadType: 96, SSRC: 1}, []byte{1})
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < rtspQueueLength+3; i++ {
+			publisher.writeRTP("video", &rtp.Packet{Raw: raw})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeRTP blocked on the full queue")
+	}
+	if publisher.session.dropped != 3 {
+		t.Errorf("dropped %d packets, want 3", publisher.session.dropped)
+	}
+	// Closed first so the teardown doesn't wait on the pipe.
+	server.Close()
+	publisher.mu.Lock()
+	publisher.closeLocked()
+	publisher.mu.Unlock()
+	if !strings.Contains(logged.String(), "Dropped 3 RTP packets") {
+		t.Errorf("logged %q, want the dropped packets", logged.String())
+	}
+}
+
+// A failed write to the server stops the publishing.
+func TestRTSPWriteError(t *testing.T) {
+	captureLog(t)
+	client, server := net.Pipe()
+	publisher := &rtspPublisher{url: &url.URL{Host: "rtsp.example"}, recording: true, stop: make(chan struct{})}
+	session := &rtspSession{
+		client:   &rtspClient{conn: client},
+		channels: map[string]int{"video": 0},
+		frames:   make(chan []byte, rtspQueueLength),
+	}
+	publisher.session = session
+	go publisher.writeFrames(session, publisher.stop)
+	server.Close()
+
+	publisher.writeRTP("video", &rtp.Packet{Raw: marshalTestPacket(t, rtp.Header{PayloadType: 96, SSRC: 1}, []byte{1})})
+	waitRTSPRecording(t, publisher, false)
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if publisher.session != nil || publisher.stop != nil {
+		t.Error("session not torn down after the failed write")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// RTT measurement using RTCP extended reports (RFC 3611).
+// As a pure receiver we cannot use SR/RR report blocks to measure RTT, so instead we send a
+// Receiver Reference Time Report (RRTR) block and Unreal Engine (libwebrtc) replies with a
+// DLRR block containing the middle 32 bits of our NTP timestamp (LRR) and how long it held onto it (DLRR).
+// RTT = now - LRR - DLRR, all in compact NTP (1/65536 seconds) units.
+
+const (
+	rtcpTypeExtendedReport = 207
+	xrBlockTypeRRTR        = 4
+	xrBlockTypeDLRR        = 5
+)
+
+// ntpEpochOffset - Seconds between the NTP epoch (1900) and the unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// The middle 32 bits of a 64 bit NTP timestamp, as used by LSR/LRR fields.
+func toCompactNTP(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
+
+func compactNTPToDuration(compact uint32) time.Duration {
+	return time.Duration(uint64(compact) * uint64(time.Second) >> 16)
+}
+
+// Builds an RTCP XR packet with a single RRTR block.
+func marshalRRTR(senderSSRC uint32, ntp uint64) rtcp.RawPacket {
+	b := make([]byte, 20)
+	b[0] = 2 << 6 // version 2, no padding
+	b[1] = rtcpTypeExtendedReport
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)/4-1))
+	binary.BigEndian.PutUint32(b[4:], senderSSRC)
+	b[8] = xrBlockTypeRRTR
+	binary.BigEndian.PutUint16(b[10:], 2)
+	binary.BigEndian.PutUint64(b[12:], ntp)
+	return rtcp.RawPacket(b)
+}
+
+// dlrrReport - A DLRR sub-block that refers to our SSRC.
+type dlrrReport struct {
+	lastRR         uint32
+	delaySinceLast uint32
+}
+
+// Looks through an RTCP XR packet for a DLRR sub-block referring to ssrc.
+func findDLRR(b []byte, ssrc uint32) (dlrrReport, bool) {
+	if len(b) < 8 || b[1] != rtcpTypeExtendedReport {
+		return dlrrReport{}, false
+	}
+	length := (int(binary.BigEndian.Uint16(b[2:])) + 1) * 4
+	if length > len(b) {
+		return dlrrReport{}, false
+	}
+
+	blocks := b[8:length]
+	for len(blocks) >= 4 {
+		blockType := blocks[0]
+		blockLength := int(binary.BigEndian.Uint16(blocks[2:])) * 4
+		if 4+blockLength > len(blocks) {
+			return dlrrReport{}, false
+		}
+		if blockType == xrBlockTypeDLRR {
+			for sub := blocks[4 : 4+blockLength]; len(sub) >= 12; sub = sub[12:] {
+				if binary.BigEndian.Uint32(sub) == ssrc {
+					return dlrrReport{lastRR: binary.BigEndian.Uint32(sub[4:]), delaySinceLast: binary.BigEndian.Uint32(sub[8:])}, true
+				}
+			}
+		}
+		blocks = blocks[4+blockLength:]
+	}
+	return dlrrReport{}, false
+}
+
+// rttEstimator - Computes RTT from DLRR replies to the RRTRs we send for a single track.
+type rttEstimator struct {
+	mu sync.Mutex
+	// The SSRC we put on our outgoing RRTRs, Unreal Engine addresses its DLRR replies to it.
+	senderSSRC uint32
+	// Compact NTP timestamps of the RRTRs we have sent and not had a reply for yet.
+	pending map[uint32]bool
+}
+
+func newRTTEstimator(senderSSRC uint32) *rttEstimator {
+	return &rttEstimator{senderSSRC: senderSSRC, pending: make(map[uint32]bool)}
+}
+
+// Creates the next RRTR to send and remembers when it was sent.
+func (e *rttEstimator) nextRRTR(now time.Time) rtcp.Packet {
+	ntp := toNTPTime(now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Only keep a handful of outstanding reports, older ones are never going to be answered.
+	if len(e.pending) > 16 {
+		e.pending = make(map[uint32]bool)
+	}
+	e.pending[toCompactNTP(ntp)] = true
+	rrtr := marshalRRTR(e.senderSSRC, ntp)
+	return &rrtr
+}
+
+// Checks an incoming RTCP packet for a DLRR reply to one of our RRTRs, returns the RTT if found.
+func (e *rttEstimator) handleRTCP(packet rtcp.Packet, now time.Time) (time.Duration, bool) {
+	raw, ok := packet.(*rtcp.RawPacket)
+	if !ok {
+		return 0, false
+	}
+	report, ok := findDLRR(*raw, e.senderSSRC)
+	if !ok {
+		return 0, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// Ignore replies that do not correlate with a report we sent.
+	if !e.pending[report.lastRR] {
+		return 0, false
+	}
+	delete(e.pending, report.lastRR)
+
+	rtt := toCompactNTP(toNTPTime(now)) - report.lastRR - report.delaySinceLast
+	// Clock weirdness can make the subtraction wrap around, anything over a minute is not a real RTT.
+	if d := compactNTPToDuration(rtt); d < time.Minute {
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// messageField - A field of a signalling message as the forwarder reads it, with the JSON kind it must have and, for
+// objects, the fields inside it.
+type messageField struct {
+	name     string
+	kind     string
+	required bool
+	fields   []messageField
+}
+
+// The schemas of the Cirrus messages the forwarder handles, keyed by type. They only cover the fields we read, any
+// other field is allowed, so the schemas catch what would break us rather than every difference from a given Cirrus.
+var messageSchemas = map[string][]messageField{
+	"offer":       {{name: "sdp", kind: "string", required: true}},
+	"answer":      {{name: "sdp", kind: "string", required: true}},
+	"playerCount": {{name: "count", kind: "number", required: true}},
+	"ping":        {{name: "time", kind: "number"}},
+	"iceCandidate": {{name: "candidate", kind: "object", required: true, fields: []messageField{
+		{name: "candidate", kind: "string", required: true},
+		{name: "sdpMid", kind: "string"},
+		{name: "sdpMLineIndex", kind: "number"},
+		{name: "usernameFragment", kind: "string"},
+	}}},
+	"config": {{name: "peerConnectionOptions", kind: "object", fields: []messageField{
+		{name: "iceServers", kind: "array"},
+		{name: "bundlePolicy", kind: "string"},
+		{name: "rtcpMuxPolicy", kind: "string"},
+		{name: "iceTransportPolicy", kind: "string"},
+	}}},
+}
+
+// Logs where a signalling message doesn't match the schema of its type, for ValidateMessages. Messages of a type
+// without a schema are only checked for having a type. The message is handled as usual either way, this only says why
+// handling it may fail.
+func logSchemaViolations(message []byte) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(message, &object); err != nil {
+		log.Printf("Signalling message is not a JSON object: %s", err.Error())
+		return
+	}
+	raw, ok := object["type"]
+	if !ok {
+		log.Println("Signalling message has no type.")
+		return
+	}
+	var messageType string
+	if err := json.Unmarshal(raw, &messageType); err != nil {
+		log.Printf("Signalling message type is %s, expected a string.", describeKind(jsonKind(raw)))
+		return
+	}
+	schema, ok := messageSchemas[messageType]
+	if !ok {
+		return
+	}
+	for _, violation := range schemaViolations(object, schema, "") {
+		log.Printf("Signalling %s message doesn't match its schema: %s.", messageType, violation)
+	}
+}
+
+// Checks the fields of an object against a schema, prefix is the path of the object for nested fields.
+func schemaViolations(object map[string]json.RawMessage, schema []messageField, prefix string) []string {
+	var violations []string
+	for _, field := range schema {
+		path := prefix + field.name
+		raw, ok := object[field.name]
+		kind := jsonKind(raw)
+		if !ok || kind == "null" {
+			if field.required {
+				violations = append(violations, fmt.Sprintf("%s is missing", path))
+			}
+			continue
+		}
+		if kind != field.kind {
+			violations = append(violations, fmt.Sprintf("%s is %s, expected %s", path, describeKind(kind), describeKind(field.kind)))
+			continue
+		}
+		if len(field.fields) > 0 {
+			var nested map[string]json.RawMessage
+			json.Unmarshal(raw, &nested)
+			violations = append(violations, schemaViolations(nested, field.fields, path+".")...)
+		}
+	}
+	return violations
+}
+
+// The kind of a JSON value from its first character, the value is known to be valid JSON.
+func jsonKind(raw json.RawMessage) string {
+	value := strings.TrimSpace(string(raw))
+	if value == "" {
+		return "null"
+	}
+	switch value[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+// e.g. "an object" or "a string".
+func describeKind(kind string) string {
+	switch kind {
+	case "object", "array":
+		return "an " + kind
+	case "null":
+		return "null"
+	default:
+		return "a " + kind
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Describes a media section for logs, e.g. "video(mid=1)".
+func mediaSectionName(media *sdp.MediaDescription) string {
+	mid, _ := media.Attribute("mid")
+	return fmt.Sprintf("%s(mid=%s)", media.MediaName.Media, mid)
+}
+
+// Checks that the answer's media sections are in the same order, with the same kinds and MIDs, as the offer's.
+// Some UE versions are strict about m-line ordering in unified plan and reject answers that don't line up.
+func checkMediaSectionOrder(offer, answer *sdp.SessionDescription) error {
+	if len(offer.MediaDescriptions) != len(answer.MediaDescriptions) {
+		return fmt.Errorf("offer has %d media sections but answer has %d", len(offer.MediaDescriptions), len(answer.MediaDescriptions))
+	}
+	for i, offered := range offer.MediaDescriptions {
+		answered := answer.MediaDescriptions[i]
+		offeredMid, _ := offered.Attribute("mid")
+		answeredMid, _ := answered.Attribute("mid")
+		if offered.MediaName.Media != answered.MediaName.Media || offeredMid != answeredMid {
+			return fmt.Errorf("media section %d is %s in the offer but %s in the answer", i, mediaSectionName(offered), mediaSectionName(answered))
+		}
+	}
+	return nil
+}
+
+// Reorders the answer's media sections by MID to follow the offer, returns false if the sections can't be matched up.
+func reorderMediaSections(offer, answer *sdp.SessionDescription) bool {
+	byMid := make(map[string]*sdp.MediaDescription, len(answer.MediaDescriptions))
+	for _, media := range answer.MediaDescriptions {
+		mid, ok := media.Attribute("mid")
+		if !ok {
+			return false
+		}
+		byMid[mid] = media
+	}
+
+	ordered := make([]*sdp.MediaDescription, 0, len(offer.MediaDescriptions))
+	for _, offered := range offer.MediaDescriptions {
+		mid, _ := offered.Attribute("mid")
+		media, ok := byMid[mid]
+		if !ok || media.MediaName.Media != offered.MediaName.Media {
+			return false
+		}
+		ordered = append(ordered, media)
+	}
+	if len(ordered) != len(answer.MediaDescriptions) {
+		return false
+	}
+	answer.MediaDescriptions = ordered
+	return true
+}
+
+// Makes sure the media sections of our answer line up with UE's offer, reordering them if Pion didn't keep the offer's order.
+// Logs a warning on mismatch, if the sections can't be reordered the answer is returned unchanged. Pion won't take a
+// local answer that differs from the one it created, so this only changes the answer we send.
+func alignAnswerWithOffer(offer, answer webrtc.SessionDescription) webrtc.SessionDescription {
+	parsedOffer, err := offer.Unmarshal()
+	if err != nil {
+		log.Printf("Error parsing offer to check answer media section order. Error: %s", err.Error())
+		return answer
+	}
+	// Parsed afresh rather than with answer.Unmarshal, which returns Pion's own copy that reordering would change.
+	parsedAnswer := &sdp.SessionDescription{}
+	if err = parsedAnswer.Unmarshal([]byte(answer.SDP)); err != nil {
+		log.Printf("Error parsing answer to check media section order. Error: %s", err.Error())
+		return answer
+	}
+
+	orderErr := checkMediaSectionOrder(parsedOffer, parsedAnswer)
+	if orderErr == nil {
+		return answer
+	}
+	log.Printf("Warning: answer media sections do not match the offer, %s.", orderErr.Error())
+
+	if !reorderMediaSections(parsedOffer, parsedAnswer) {
+		log.Println("Warning: could not reorder answer media sections to match the offer, sending answer as is.")
+		return answer
+	}
+	munged, err := parsedAnswer.Marshal()
+	if err != nil {
+		log.Printf("Error marshalling reordered answer, sending answer as is. Error: %s", err.Error())
+		return answer
+	}
+	sessionPrintln("Reordered answer media sections to match the offer.")
+	return webrtc.SessionDescription{Type: answer.Type, SDP: string(munged)}
+}
+
+// The direction attributes a media section can have.
+var directionAttributes = map[string]bool{"sendrecv": true, "sendonly": true, "recvonly": true, "inactive": true}
+
+// Overrides the direction our answer advertises for its audio and video sections with AnswerDirection, for receivers
+// and SFUs that expect sendrecv even though we only receive. Pion doesn't let us change a transceiver's direction, so
+// the answer we send is rewritten instead, sections we rejected are left alone. On error the answer is returned unchanged.
+func applyAnswerDirection(answer webrtc.SessionDescription) webrtc.SessionDescription {
+	if *AnswerDirection == "recvonly" {
+		return answer
+	}
+	// Parsed afresh as in alignAnswerWithOffer, so Pion's own copy of the answer keeps its directions.
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		log.Printf("Error parsing answer to set its direction, sending answer as is. Error: %s", err.Error())
+		return answer
+	}
+	for _, media := range parsed.MediaDescriptions {
+		if (media.MediaName.Media != "audio" && media.MediaName.Media != "video") || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		for i, attribute := range media.Attributes {
+			if directionAttributes[attribute.Key] {
+				media.Attributes[i] = sdp.NewPropertyAttribute(*AnswerDirection)
+			}
+		}
+	}
+	munged, err := parsed.Marshal()
+	if err != nil {
+		log.Printf("Error marshalling answer with its direction set, sending answer as is. Error: %s", err.Error())
+		return answer
+	}
+	return webrtc.SessionDescription{Type: answer.Type, SDP: string(munged)}
+}
+
+// Checks an SDP from UE is within MaxSDPBytes before Pion parses it, logging its size if it isn't. The websocket
+// message it came in is already limited by WSMaxMessageBytes, this bounds the SDP we hand to the parser on its own.
+func checkSDPSize(sdpType string, sdp string) error {
+	if *MaxSDPBytes > 0 && len(sdp) > *MaxSDPBytes {
+		log.Printf("Error: the %s SDP from UE is %d bytes, more than -MaxSDPBytes %d, ignoring it.", sdpType, len(sdp), *MaxSDPBytes)
+		return fmt.Errorf("%s SDP of %d bytes is over -MaxSDPBytes %d", sdpType, len(sdp), *MaxSDPBytes)
+	}
+	return nil
+}
+
+// How many SDPs we have saved to each path, so every session's (and renegotiation's) SDP gets a file of its own.
+var savedSDPs = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// Saves an SDP for bug reports and regression tests, to path suffixed with the session ID and a count, e.g.
+// offer.sdp becomes offer-<session ID>-1.sdp. The files are only readable by us as the SDP holds the session's ICE
+// credentials, and only the file name is logged.
+func saveSDP(path string, sdp string) {
+	savedSDPs.Lock()
+	savedSDPs.counts[path]++
+	count := savedSDPs.counts[path]
+	savedSDPs.Unlock()
+
+	ext := filepath.Ext(path)
+	suffix := fmt.Sprintf("-%d", count)
+	if id, _ := currentSessionID.Load().(string); id != "" {
+		suffix = fmt.Sprintf("-%s%s", id, suffix)
+	}
+	name := strings.TrimSuffix(path, ext) + suffix + ext
+	if err := ioutil.WriteFile(name, []byte(sdp), 0600); err != nil {
+		log.Printf("Error saving SDP to %s. Error: %s", name, err.Error())
+		return
+	}
+	sessionPrintln(fmt.Sprintf("Saved SDP to %s.", name))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Builds a session description with a media section for each kind:mid in sections, e.g. "audio:0", in order.
+func testSDP(sections ...string) string {
+	var b strings.Builder
+	b.WriteString("v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n")
+	for _, section := range sections {
+		kind, mid := section[:strings.Index(section, ":")], section[strings.Index(section, ":")+1:]
+		payloadType := "111"
+		if kind == "video" {
+			payloadType = "102"
+		}
+		b.WriteString("m=" + kind + " 9 UDP/TLS/RTP/SAVPF " + payloadType + "\r\nc=IN IP4 0.0.0.0\r\na=mid:" + mid + "\r\na=recvonly\r\n")
+	}
+	return b.String()
+}
+
+// Returns the kind:mid of each media section of the SDP.
+func testSDPSections(t *testing.T, s string) []string {
+	t.Helper()
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(s)); err != nil {
+		t.Fatalf("parsing %q: %s", s, err)
+	}
+	var sections []string
+	for _, media := range parsed.MediaDescriptions {
+		mid, _ := media.Attribute("mid")
+		sections = append(sections, media.MediaName.Media+":"+mid)
+	}
+	return sections
+}
+
+func TestAlignAnswerWithOffer(t *testing.T) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: testSDP("audio:0", "video:1")}
+	tests := []struct {
+		name   string
+		answer []string
+		want   []string
+	}{
+		{"in the offer's order", []string{"audio:0", "video:1"}, []string{"audio:0", "video:1"}},
+		{"reordered to the offer's", []string{"video:1", "audio:0"}, []string{"audio:0", "video:1"}},
+		{"unknown MID left as is", []string{"video:2", "audio:0"}, []string{"video:2", "audio:0"}},
+		{"kind mismatch left as is", []string{"audio:1", "video:0"}, []string{"audio:1", "video:0"}},
+		{"missing section left as is", []string{"audio:0"}, []string{"audio:0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: testSDP(test.answer...)}
+			aligned := alignAnswerWithOffer(offer, answer)
+			if got := testSDPSections(t, aligned.SDP); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("answer sections are %v, want %v", got, test.want)
+			}
+			if aligned.Type != webrtc.SDPTypeAnswer {
+				t.Errorf("answer became an %s", aligned.Type)
+			}
+		})
+	}
+}
+
+func TestAnswerFollowsTwoSectionOffer(t *testing.T) {
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	ue := newTestUE(t)
+	// Video first, the opposite of the order our transceivers were added in.
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	addTestTrack(t, ue, webrtc.RTPCodecTypeAudio, "audio")
+	offer, err := ue.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err = bridge.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer we send must also be one Pion accepted as our local description.
+	sent, err := createAnswer(bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(sent), &answer); err != nil {
+		t.Fatal(err)
+	}
+	want := testSDPSections(t, offer.SDP)
+	if got := testSDPSections(t, answer.SDP); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("answer sections are %v, want the offer's %v", got, want)
+	}
+	if err = ue.SetRemoteDescription(answer); err != nil {
+		t.Errorf("UE could not apply our answer: %s", err)
+	}
+}
+
+// Returns the direction attribute of each media section of the SDP.
+func testSDPDirections(t *testing.T, parsed *sdp.SessionDescription) []string {
+	t.Helper()
+	var directions []string
+	for _, media := range parsed.MediaDescriptions {
+		direction := ""
+		for _, attribute := range media.Attributes {
+			if directionAttributes[attribute.Key] {
+				direction = attribute.Key
+			}
+		}
+		directions = append(directions, direction)
+	}
+	return directions
+}
+
+func TestApplyAnswerDirection(t *testing.T) {
+	// A rejected video section and a data channel, neither of which gets a direction.
+	extra := "m=video 0 UDP/TLS/RTP/SAVPF 102\r\nc=IN IP4 0.0.0.0\r\na=mid:2\r\na=inactive\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\na=mid:3\r\na=sendrecv\r\n"
+	tests := []struct {
+		direction string
+		want      []string
+	}{
+		{"recvonly", []string{"recvonly", "recvonly", "inactive", "sendrecv"}},
+		{"sendrecv", []string{"sendrecv", "sendrecv", "inactive", "sendrecv"}},
+	}
+	for _, test := range tests {
+		t.Run(test.direction, func(t *testing.T) {
+			setFlag(t, "AnswerDirection", test.direction)
+			answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: testSDP("audio:0", "video:1") + extra}
+			sent := applyAnswerDirection(answer)
+			parsed := &sdp.SessionDescription{}
+			if err := parsed.Unmarshal([]byte(sent.SDP)); err != nil {
+				t.Fatal(err)
+			}
+			if got := testSDPDirections(t, parsed); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("answer directions are %v, want %v", got, test.want)
+			}
+			if sent.Type != webrtc.SDPTypeAnswer {
+				t.Errorf("answer became an %s", sent.Type)
+			}
+		})
+	}
+}
+
+func TestApplyAnswerDirectionKeepsParsedAnswer(t *testing.T) {
+	setFlag(t, "AnswerDirection", "sendrecv")
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: testSDP("audio:0", "video:1")}
+	// The copy Pion keeps of an answer it parsed, which it goes on using as our local description.
+	parsed, err := answer.Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyAnswerDirection(answer)
+	if got := testSDPDirections(t, parsed); strings.Join(got, " ") != "recvonly recvonly" {
+		t.Errorf("Pion's parsed answer changed to %v", got)
+	}
+}
+
+func TestAnswerDirectionSent(t *testing.T) {
+	setFlag(t, "AnswerDirection", "sendrecv")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeAudio, "audio")
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+	offer, err := ue.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err = bridge.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err := createAnswer(bridge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(sent), &answer); err != nil {
+		t.Fatal(err)
+	}
+	parsed := &sdp.SessionDescription{}
+	if err = parsed.Unmarshal([]byte(answer.SDP)); err != nil {
+		t.Fatal(err)
+	}
+	if got := testSDPDirections(t, parsed); strings.Join(got, " ") != "sendrecv sendrecv" {
+		t.Errorf("sent answer directions are %v, want sendrecv", got)
+	}
+	// Our local description is still the recvonly one Pion created.
+	local, err := bridge.LocalDescription().Unmarshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testSDPDirections(t, local); strings.Join(got, " ") != "recvonly recvonly" {
+		t.Errorf("local description directions are %v, want recvonly", got)
+	}
+	if err = ue.SetRemoteDescription(answer); err != nil {
+		t.Errorf("UE could not apply our answer: %s", err)
+	}
+}
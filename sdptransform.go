@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// Runs SDPTransformCommand on our offer or answer as we send it to UE, for the SDP tweaks the flags don't cover.
+// Pion keeps the description it created as the local one. The command gets the SDP on stdin and SDP_TYPE (offer or answer) in its environment, and
+// writes the SDP to use to stdout. Its arguments are split on spaces and it isn't run through a shell. It must exit
+// with 0 within SDPTransformTimeoutMs and print an SDP that parses, otherwise the negotiation fails. It isn't retried
+// as NegotiationRetries says, as our description is already set as the local one.
+func transformLocalSDP(description webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	args := strings.Fields(*SDPTransformCommand)
+	if len(args) == 0 {
+		return description, nil
+	}
+	timeout := time.Duration(*SDPTransformTimeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "SDP_TYPE="+description.Type.String())
+	cmd.Stdin = strings.NewReader(description.SDP)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		log.Printf("-SDPTransformCommand for our %s wrote to stderr: %s", description.Type, message)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return description, fmt.Errorf("-SDPTransformCommand did not finish within %s", timeout)
+	}
+	if err != nil {
+		return description, fmt.Errorf("-SDPTransformCommand failed: %w", err)
+	}
+
+	transformed := stdout.String()
+	if err = (&sdp.SessionDescription{}).Unmarshal([]byte(transformed)); err != nil {
+		return description, fmt.Errorf("-SDPTransformCommand printed an SDP that doesn't parse: %w", err)
+	}
+	if transformed != description.SDP {
+		sessionPrintln(fmt.Sprintf("-SDPTransformCommand changed our %s.", description.Type))
+	}
+	return webrtc.SessionDescription{Type: description.Type, SDP: transformed}, nil
+}
+
+// Checks SDPTransformCommand's program can be found, so a typo fails at startup rather than on every negotiation.
+func checkSDPTransformCommand() error {
+	args := strings.Fields(*SDPTransformCommand)
+	if len(args) == 0 {
+		return nil
+	}
+	_, err := exec.LookPath(args[0])
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func setupSelftestCommand(fs *flag.FlagSet) func() {
+	timeoutMs := fs.Int("TimeoutMs", 10000, "How long (ms) to wait for the test media to arrive on the RTP ports before failing.")
+	soakCycles := fs.Int("SoakCycles", 0, "When non-zero, run the selftest this many times in a row as a soak test, connecting, forwarding for SoakCycleMs and disconnecting each time, then report how many cycles failed and whether goroutines or open files leaked.")
+	soakCycleMs := fs.Int("SoakCycleMs", 2000, "How long (ms) each soak test cycle keeps forwarding once the test media has arrived.")
+	return func() {
+		if *soakCycles < 0 || *soakCycleMs < 0 {
+			exitConfigError("Invalid -SoakCycles %d or -SoakCycleMs %d, must be 0 or more.", *soakCycles, *soakCycleMs)
+		}
+		if *soakCycles > 0 {
+			if err := runSoak(*soakCycles, time.Duration(*timeoutMs)*time.Millisecond, time.Duration(*soakCycleMs)*time.Millisecond); err != nil {
+				exitWithError(fmt.Errorf("soak test failed: %w", err))
+			}
+			fmt.Println("Soak test passed.")
+			return
+		}
+		if err := runSelftest(time.Duration(*timeoutMs)*time.Millisecond, 0); err != nil {
+			exitWithError(fmt.Errorf("selftest failed: %w", err))
+		}
+		fmt.Println("Selftest passed.")
+	}
+}
+
+// Negotiates the forwarder's peer connection with an in-process peer standing in for UE, streams test media from it
+// and checks the forwarded RTP arrives on the configured local ports with the configured payload types and SSRCs. It
+// then keeps streaming for hold before closing both peer connections.
+func runSelftest(timeout time.Duration, hold time.Duration) error {
+	// Listen before anything is forwarded so the first packets aren't refused.
+	videoListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: *RTPVideoForwardingPort})
+	if err != nil {
+		return fmt.Errorf("error listening on the video port: %w", err)
+	}
+	defer videoListener.Close()
+	audioListener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: *RTPAudioForwardingPort})
+	if err != nil {
+		return fmt.Errorf("error listening on the audio port: %w", err)
+	}
+	defer audioListener.Close()
+
+	// The test streams aren't worth writing an SDP and command hint for.
+	*CommandHint = "none"
+
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		return fmt.Errorf("error creating peer connection: %w", err)
+	}
+	defer bridge.Close()
+	setupMediaForwarding(bridge)
+
+	ue, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return fmt.Errorf("error creating test peer connection: %w", err)
+	}
+	defer ue.Close()
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}, "video", "selftest")
+	if err != nil {
+		return err
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: audioClockRate, Channels: 2}, "audio", "selftest")
+	if err != nil {
+		return err
+	}
+	if _, err = ue.AddTrack(videoTrack); err != nil {
+		return err
+	}
+	if _, err = ue.AddTrack(audioTrack); err != nil {
+		return err
+	}
+
+	if err = negotiateLocally(bridge, ue); err != nil {
+		return fmt.Errorf("error negotiating with the test peer: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go writeSelftestMedia(videoTrack, audioTrack, done)
+
+	deadline := time.Now().Add(timeout)
+	if err = expectForwardedRTP(videoListener, "video", uint8(*RTPVideoPayloadType), uint32(*VideoSSRC), deadline); err != nil {
+		return err
+	}
+	if err = expectForwardedRTP(audioListener, "audio", uint8(*RTPAudioPayloadType), uint32(*AudioSSRC), deadline); err != nil {
+		return err
+	}
+	time.Sleep(hold)
+	return nil
+}
+
+// Runs an offer/answer between the two peer connections without trickle, the offerer playing the bridge's part.
+func negotiateLocally(offerer *webrtc.PeerConnection, answerer *webrtc.PeerConnection) error {
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	offerGathered := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-offerGathered
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		return err
+	}
+
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	answerGathered := webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	<-answerGathered
+	return offerer.SetRemoteDescription(*answerer.LocalDescription())
+}
+
+// Writes a frame of fake H264 keyframe and Opus packet every 20ms until done is closed.
+func writeSelftestMedia(videoTrack *webrtc.TrackLocalStaticRTP, audioTrack *webrtc.TrackLocalStaticRTP, done <-chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	var sequenceNumber uint16
+	var frame uint32
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sequenceNumber++
+		frame++
+		// Errors are expected until the tracks are bound, the check just waits for the packets that make it.
+		_ = videoTrack.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: sequenceNumber, Timestamp: frame * videoClockRate / 50},
+			Payload: []byte{h264NALTypeIDR | 0x60, 0x88, 0x84, 0x00},
+		})
+		_ = audioTrack.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: sequenceNumber, Timestamp: frame * audioClockRate / 50},
+			Payload: []byte{0xfc, 0xff, 0xfe},
+		})
+	}
+}
+
+// Waits until a forwarded RTP packet arrives on the listener and checks its payload type and, if set, SSRC.
+func expectForwardedRTP(listener *net.UDPConn, kind string, payloadType uint8, ssrc uint32, deadline time.Time) error {
+	if err := listener.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	b := make([]byte, 1500)
+	n, _, err := listener.ReadFrom(b)
+	if err != nil {
+		return fmt.Errorf("no %s arrived on %s: %w", kind, listener.LocalAddr(), err)
+	}
+	packet := &rtp.Packet{}
+	if err = packet.Unmarshal(b[:n]); err != nil {
+		return fmt.Errorf("the forwarded %s is not RTP: %w", kind, err)
+	}
+	if packet.PayloadType != payloadType {
+		return fmt.Errorf("the forwarded %s has payload type %d, expected %d", kind, packet.PayloadType, payloadType)
+	}
+	if ssrc != 0 && packet.SSRC != ssrc {
+		return fmt.Errorf("the forwarded %s has SSRC %d, expected %d", kind, packet.SSRC, ssrc)
+	}
+	fmt.Println(fmt.Sprintf("Forwarded %s arrived on %s with payload type %d and SSRC %d.", kind, listener.LocalAddr(), packet.PayloadType, packet.SSRC))
+	return nil
+}
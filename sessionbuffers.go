@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// How often shedding packets to stay within MaxSessionBufferBytes is logged at most, it can happen on every packet.
+const bufferShedLogInterval = 10 * time.Second
+
+// bufferBudget - Accounts for the bytes of the packets a session's tracks hold back, across all of them: the packets
+// the reorder buffers hold while one is missing, and the frames held to look for a keyframe (WaitForKeyframe and
+// KeyframesOnly). Those are bounded by the stream UE sends, so a misbehaving UE, e.g. one that never ends a frame,
+// could otherwise have them grow without limit. Once the session holds more than MaxSessionBufferBytes, the holder
+// that just added a packet sheds its oldest ones until the session is back within it. Updated from the tracks'
+// forwarding loops, started over with each session.
+type bufferBudget struct {
+	limit int64
+	used  int64
+	// Packets dropped and when that was last logged, in Unix nanoseconds.
+	shed       uint64
+	lastLogged int64
+}
+
+var sessionBuffers = &bufferBudget{}
+
+// Starts the accounting over for a new session, with MaxSessionBufferBytes as the limit.
+func (b *bufferBudget) reset() {
+	atomic.StoreInt64(&b.limit, int64(*MaxSessionBufferBytes))
+	atomic.StoreInt64(&b.used, 0)
+	atomic.StoreUint64(&b.shed, 0)
+	atomic.StoreInt64(&b.lastLogged, 0)
+}
+
+func (b *bufferBudget) add(bytes int) {
+	atomic.AddInt64(&b.used, int64(bytes))
+}
+
+func (b *bufferBudget) remove(bytes int) {
+	atomic.AddInt64(&b.used, -int64(bytes))
+}
+
+// Whether the session holds more than MaxSessionBufferBytes, always false without a limit.
+func (b *bufferBudget) over() bool {
+	limit := atomic.LoadInt64(&b.limit)
+	return limit > 0 && atomic.LoadInt64(&b.used) > limit
+}
+
+// Counts packets a track's holder shed to get back within the limit, what says what happened to them, e.g. "dropped
+// from the frame held for a keyframe". Logged at most every bufferShedLogInterval, with the packets shed since by any
+// track.
+func (b *bufferBudget) addShed(name string, what string, packets int, now time.Time) {
+	shed := atomic.AddUint64(&b.shed, uint64(packets))
+	last := atomic.LoadInt64(&b.lastLogged)
+	if now.UnixNano()-last < int64(bufferShedLogInterval) || !atomic.CompareAndSwapInt64(&b.lastLogged, last, now.UnixNano()) {
+		return
+	}
+	atomic.AddUint64(&b.shed, -shed)
+	log.Printf("Warning: the session held more than -MaxSessionBufferBytes %d, shedding held packets to stay within it (%d since the last warning, the latest %s on the %s track).", atomic.LoadInt64(&b.limit), shed, what, name)
+}
+
+// Whether a new track may be forwarded with MaxSessionGoroutines, each one starts a few goroutines of its own. Logs why
+// not if it may not.
+func withinGoroutineLimit(kind string) bool {
+	if *MaxSessionGoroutines <= 0 {
+		return true
+	}
+	if goroutines := runtime.NumGoroutine(); goroutines > *MaxSessionGoroutines {
+		log.Printf("Warning: not forwarding the new %s track, the bridge already runs %d goroutines, more than -MaxSessionGoroutines %d.", kind, goroutines, *MaxSessionGoroutines)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// The ID of the signalling session in progress, log lines and printed messages are tagged with it.
+var currentSessionID atomic.Value
+
+// Starts tagging output with the ID of a new session: SessionID if set, otherwise a random UUID for each session.
+func startSessionID() {
+	id := *SessionID
+	if id == "" {
+		id = newSessionUUID()
+	}
+	currentSessionID.Store(id)
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix(fmt.Sprintf("[%s] ", id))
+}
+
+// A random (version 4) UUID.
+func newSessionUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Like fmt.Println, but tagged with the session ID the same way log lines are.
+func sessionPrintln(a ...interface{}) {
+	if id, _ := currentSessionID.Load().(string); id != "" {
+		a = append([]interface{}{fmt.Sprintf("[%s]", id)}, a...)
+	}
+	fmt.Println(a...)
+}
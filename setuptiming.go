@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The steps of setting up a session, in the order they happen.
+const (
+	setupSignalling = iota
+	setupNegotiated
+	setupICEConnected
+	setupFirstPacket
+	setupPhaseCount
+)
+
+var setupPhaseNames = [setupPhaseCount]string{"websocket", "negotiated", "ice", "first-packet"}
+
+// setupTimings - When each step of setting up the current session happened, from dialing Cirrus to forwarding the
+// first packet, so the "time to first frame" can be broken down to see where setup latency comes from.
+type setupTimings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases [setupPhaseCount]time.Time
+}
+
+var sessionSetup = &setupTimings{}
+
+// Starts timing a new session's setup, from when we start dialing Cirrus.
+func (t *setupTimings) reset(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.start = now
+	t.phases = [setupPhaseCount]time.Time{}
+}
+
+// Records that a step of the setup happened, only the first time counts so e.g. renegotiations don't move it.
+// Once the first packet is forwarded the breakdown is logged.
+func (t *setupTimings) mark(phase int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() || !t.phases[phase].IsZero() {
+		return
+	}
+	t.phases[phase] = now
+	if phase == setupFirstPacket {
+		log.Printf("Session setup took %s (%s).", now.Sub(t.start).Round(time.Millisecond), t.breakdownLocked())
+	}
+}
+
+// e.g. "websocket=12ms negotiated=+80ms ice=+150ms first-packet=+20ms", each phase from the one before it.
+func (t *setupTimings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		return ""
+	}
+	return t.breakdownLocked()
+}
+
+func (t *setupTimings) breakdownLocked() string {
+	parts := make([]string, 0, setupPhaseCount)
+	previous := t.start
+	for phase, at := range t.phases {
+		if at.IsZero() {
+			parts = append(parts, fmt.Sprintf("%s=-", setupPhaseNames[phase]))
+			continue
+		}
+		prefix := "+"
+		if phase == setupSignalling {
+			prefix = ""
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s%s", setupPhaseNames[phase], prefix, at.Sub(previous).Round(time.Millisecond)))
+		previous = at
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// signallingConn - The parts of the Cirrus websocket connection the signalling code uses.
+// *websocket.Conn satisfies it, having the control loop and handlers depend on this instead lets them be driven by a
+// fake connection that feeds scripted messages and records what we send.
+type signallingConn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// How many times WSMaxMessageBytes a frame has to be before gorilla fails the connection instead of us skipping the message.
+const wsHardReadLimitFactor = 16
+
+// messageTooBigError - Returned by readLimitedMessage when a message was skipped for exceeding the limit, the connection is still usable.
+type messageTooBigError struct {
+	size  int64
+	limit int64
+}
+
+func (e *messageTooBigError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the limit of %d bytes", e.size, e.limit)
+}
+
+// Reads the next message from the signalling connection, at most limit bytes of it are held in memory.
+// Larger messages are drained and a *messageTooBigError is returned so the caller can skip them and carry on reading.
+func readLimitedMessage(conn signallingConn, limit int64) (int, []byte, error) {
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if int64(len(message)) > limit {
+		rest, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return messageType, nil, err
+		}
+		return messageType, nil, &messageTooBigError{size: int64(len(message)) + rest, limit: limit}
+	}
+	return messageType, message, nil
+}
+
+// Serialises writes to the signalling connection.
+var wsWriteMu sync.Mutex
+
+// errSignallingWriteFailed - The session was ended because MaxWSWriteErrors writes to Cirrus failed in a row, the
+// connection is most likely broken even though reading from it hasn't failed yet.
+var errSignallingWriteFailed = errors.New("writing to the signalling connection kept failing")
+
+// The current session's writes to Cirrus that failed in a row, and how to end the session once MaxWSWriteErrors have.
+// Only writes to conn count, not e.g. the re-publishing connection's. Guarded by wsWriteMu.
+var wsWriteFailures struct {
+	conn       signallingConn
+	count      int
+	endSession func()
+}
+
+// Sets the session's connection to Cirrus and how to end the session once its writes keep failing, nil once it has
+// ended.
+func setWSWriteFailureEnder(conn signallingConn, endSession func()) {
+	wsWriteMu.Lock()
+	defer wsWriteMu.Unlock()
+	wsWriteFailures.conn, wsWriteFailures.count, wsWriteFailures.endSession = conn, 0, endSession
+}
+
+// Counts a write to conn, ending the session once MaxWSWriteErrors in a row have failed. Called with wsWriteMu held.
+func countWSWrite(conn signallingConn, err error) {
+	// The control loop reads through the config's replayConn, its writes go straight to the websocket.
+	if replay, ok := conn.(*replayConn); ok {
+		conn = replay.signallingConn
+	}
+	if conn != wsWriteFailures.conn || wsWriteFailures.conn == nil {
+		return
+	}
+	if err == nil {
+		wsWriteFailures.count = 0
+		return
+	}
+	wsWriteFailures.count++
+	if *MaxWSWriteErrors > 0 && wsWriteFailures.count >= *MaxWSWriteErrors && wsWriteFailures.endSession != nil {
+		log.Printf("%d writes to Cirrus failed in a row (-MaxWSWriteErrors), ending the session to reconnect.", wsWriteFailures.count)
+		wsWriteFailures.endSession()
+		wsWriteFailures.endSession = nil
+	}
+}
+
+// candidateQueue - Holds our local ICE candidates until UE's session description has been applied, after which
+// candidates should be sent straight away. Pion gathers candidates on its own goroutines so this is safe for concurrent use.
+type candidateQueue struct {
+	mu         sync.Mutex
+	candidates []*webrtc.ICECandidate
+	flushed    bool
+}
+
+// Queues the candidate if we are still waiting on UE's session description, returns false if it should be sent now instead.
+func (q *candidateQueue) queue(candidate *webrtc.ICECandidate) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.flushed {
+		return false
+	}
+	q.candidates = append(q.candidates, candidate)
+	return true
+}
+
+// Returns the queued candidates to send, from now on candidates are no longer queued.
+func (q *candidateQueue) flush() []*webrtc.ICECandidate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	candidates := q.candidates
+	q.candidates = nil
+	q.flushed = true
+	return candidates
+}
+
+// signallingHandler - Handles a custom Cirrus message type, given the raw message. Returning an error logs it and, with
+// StrictSignalling and StrictSignallingDisconnect, ends the session.
+type signallingHandler func(message []byte, wsConn signallingConn, peerConnection *webrtc.PeerConnection) error
+
+var (
+	signallingHandlersMu sync.Mutex
+	signallingHandlers   = make(map[string]signallingHandler)
+)
+
+// Registers a handler for a message type the control loop does not handle itself, e.g. one a customised Cirrus or
+// UE plugin sends. Built in types (offer, answer, iceCandidate, ...) can't be overridden.
+func registerSignallingHandler(messageType string, handler signallingHandler) {
+	signallingHandlersMu.Lock()
+	defer signallingHandlersMu.Unlock()
+	signallingHandlers[messageType] = handler
+}
+
+func lookupSignallingHandler(messageType string) (signallingHandler, bool) {
+	signallingHandlersMu.Lock()
+	defer signallingHandlersMu.Unlock()
+	handler, ok := signallingHandlers[messageType]
+	return handler, ok
+}
+
+// unexpectedMessageError - A signalling message we could not make sense of, an error with StrictSignalling.
+type unexpectedMessageError struct {
+	reason string
+}
+
+func (e *unexpectedMessageError) Error() string {
+	return fmt.Sprintf("unexpected signalling message: %s", e.reason)
+}
+
+// Reports a message we could not make sense of. Without StrictSignalling it's only logged, with it it's logged as an
+// error and, if StrictSignallingDisconnect is set, returned so the control loop ends the session.
+func unexpectedMessage(format string, args ...interface{}) error {
+	err := &unexpectedMessageError{reason: fmt.Sprintf(format, args...)}
+	if !*StrictSignalling {
+		log.Println(err.reason)
+		return nil
+	}
+	log.Printf("Error: %s", err.Error())
+	if *StrictSignallingDisconnect {
+		return err
+	}
+	return nil
+}
+
+// Checks a session description UE sent fits the negotiation's signalling state, as a peer that mixed up which side
+// offers would send one that doesn't. An answer only makes sense while our offer is waiting for it, which is the case
+// in offerer mode (InitiateOffer) or after an ICE restart offer. An offer makes sense while no offer of ours is
+// outstanding, i.e. in answerer mode, and in either mode once negotiated, when UE renegotiates. Setting one that
+// doesn't fit would fail in Pion or leave the negotiation in a state neither side expects. Returns whether to apply
+// it, and the error from unexpectedMessage if the session should end.
+func checkRemoteDescriptionRole(sdpType webrtc.SDPType, state webrtc.SignalingState) (bool, error) {
+	switch {
+	case sdpType == webrtc.SDPTypeAnswer && state != webrtc.SignalingStateHaveLocalOffer:
+		return false, unexpectedMessage("Got an answer from UE but we have no offer waiting for one (signalling state %s), ignoring it. Check UE isn't also waiting for an offer, see -InitiateOffer.", state)
+	case sdpType == webrtc.SDPTypeOffer && state == webrtc.SignalingStateHaveLocalOffer:
+		return false, unexpectedMessage("Got an offer from UE while our offer is waiting for its answer (signalling state %s), ignoring it. UE and the bridge should not both offer, see -InitiateOffer.", state)
+	}
+	return true, nil
+}
+
+// malformedMessages - Counts the signalling messages in a row that didn't unmarshal, for MaxSignallingErrors.
+type malformedMessages struct {
+	consecutive int
+}
+
+// Records how handling a message went, err being why it didn't unmarshal or nil if it did. Returns an error once
+// MaxSignallingErrors messages in a row haven't.
+func (m *malformedMessages) add(err error) error {
+	if err == nil {
+		m.consecutive = 0
+		return nil
+	}
+	m.consecutive++
+	if *MaxSignallingErrors == 0 || m.consecutive < *MaxSignallingErrors {
+		return nil
+	}
+	log.Printf("%d signalling messages in a row didn't unmarshal, giving up on the signalling. -MaxSignallingErrors is %d.", m.consecutive, *MaxSignallingErrors)
+	return fmt.Errorf("%d malformed signalling messages in a row, the last: %w", m.consecutive, err)
+}
+
+// Splits a websocket message holding several JSON objects, concatenated or one per line (NDJSON), into one message per
+// object. Whatever follows an object that doesn't parse is kept as a message of its own, so the control loop reports
+// it like any other malformed message.
+func splitSignallingMessages(message []byte) [][]byte {
+	var messages [][]byte
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	offset := 0
+	for {
+		var object json.RawMessage
+		if err := decoder.Decode(&object); err != nil {
+			if rest := bytes.TrimSpace(message[offset:]); err != io.EOF && len(rest) > 0 {
+				messages = append(messages, rest)
+			}
+			// e.g. an empty message, which is reported as malformed as usual.
+			if len(messages) == 0 {
+				return [][]byte{message}
+			}
+			return messages
+		}
+		messages = append(messages, object)
+		offset = int(decoder.InputOffset())
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeSignallingConn - Stands in for the Cirrus websocket, the control loop reads the messages sent on incoming and
+// everything it writes is recorded. Closing incoming is the connection dropping.
+type fakeSignallingConn struct {
+	incoming chan []byte
+
+	mu      sync.Mutex
+	written [][]byte
+	// Returned by WriteMessage while set.
+	writeErr error
+	closed   bool
+	// Signalled whenever a message is written.
+	wrote chan struct{}
+	// How many written messages waitForWrite and takeWritten have looked at.
+	seen int
+}
+
+func newFakeSignallingConn(messages ...string) *fakeSignallingConn {
+	conn := &fakeSignallingConn{incoming: make(chan []byte, len(messages)+16), wrote: make(chan struct{}, 1)}
+	for _, message := range messages {
+		conn.incoming <- []byte(message)
+	}
+	return conn
+}
+
+func (c *fakeSignallingConn) NextReader() (int, io.Reader, error) {
+	message, ok := <-c.incoming
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return websocket.TextMessage, bytes.NewReader(message), nil
+}
+
+func (c *fakeSignallingConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	c.written = append(c.written, append([]byte(nil), data...))
+	select {
+	case c.wrote <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *fakeSignallingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Sends a message to the control loop as if it came from Cirrus.
+func (c *fakeSignallingConn) send(t *testing.T, message interface{}) {
+	t.Helper()
+	b, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.incoming <- b
+}
+
+// Returns the types of the messages written so far.
+func (c *fakeSignallingConn) writtenTypes(t *testing.T) []string {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var types []string
+	for _, message := range c.written {
+		types = append(types, messageTypeOf(t, message))
+	}
+	return types
+}
+
+// Returns the messages of the given type written since the last call, along with those of other types.
+func (c *fakeSignallingConn) takeWritten(t *testing.T, messageType string) (matching [][]byte, others [][]byte) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ; c.seen < len(c.written); c.seen++ {
+		if message := c.written[c.seen]; messageTypeOf(t, message) == messageType {
+			matching = append(matching, message)
+		} else {
+			others = append(others, message)
+		}
+	}
+	return matching, others
+}
+
+// Waits for a message of the given type to be written and returns it, failing the test if none is within 5s. The
+// messages of other types written before it are returned too, later messages are left for the next call.
+func (c *fakeSignallingConn) waitForWrite(t *testing.T, messageType string) ([]byte, [][]byte) {
+	t.Helper()
+	var skipped [][]byte
+	deadline := time.After(5 * time.Second)
+	for {
+		c.mu.Lock()
+		for c.seen < len(c.written) {
+			message := c.written[c.seen]
+			c.seen++
+			if messageTypeOf(t, message) == messageType {
+				c.mu.Unlock()
+				return message, skipped
+			}
+			skipped = append(skipped, message)
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.wrote:
+		case <-deadline:
+			t.Fatalf("no %s message written within 5s", messageType)
+		}
+	}
+}
+
+func messageTypeOf(t *testing.T, message []byte) string {
+	t.Helper()
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(message, &typed); err != nil {
+		t.Fatalf("wrote %q, which doesn't unmarshal: %s", message, err)
+	}
+	return typed.Type
+}
+
+// Runs the control loop on conn until the test ends, returning where its error goes.
+func runTestControlLoop(t *testing.T, conn *fakeSignallingConn, peerConnection *webrtc.PeerConnection, pendingCandidates *candidateQueue) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- startControlLoop(conn, peerConnection, pendingCandidates) }()
+	t.Cleanup(func() {
+		close(conn.incoming)
+		<-done
+	})
+	return done
+}
+
+// Sends our local candidates the way runSession does, queueing them until UE's description is applied.
+func trickleTestCandidates(peerConnection *webrtc.PeerConnection, conn signallingConn, pendingCandidates *candidateQueue) {
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil && !pendingCandidates.queue(candidate) {
+			sendLocalIceCandidate(conn, candidate)
+		}
+	})
+}
+
+// Adds the candidates the bridge sends to the test UE until the bridge's ICE connects, failing the test if it doesn't
+// within 10s.
+func connectTestUE(t *testing.T, conn *fakeSignallingConn, ue *webrtc.PeerConnection, connected <-chan struct{}) {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		candidates, _ := conn.takeWritten(t, "iceCandidate")
+		addTestCandidates(t, ue, candidates)
+		select {
+		case <-connected:
+			return
+		case <-conn.wrote:
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("ICE did not connect within 10s")
+		}
+	}
+}
+
+func notifyICEConnected(peerConnection *webrtc.PeerConnection) <-chan struct{} {
+	connected := make(chan struct{})
+	var once sync.Once
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+	return connected
+}
+
+// Sets the test UE's offer or answer as its local description and returns it, along with UE's candidates as the
+// iceCandidate messages Cirrus would relay. The description carries no candidates so they only reach the bridge
+// through those messages.
+func setTestUEDescription(t *testing.T, ue *webrtc.PeerConnection, desc webrtc.SessionDescription) (webrtc.SessionDescription, []ueICECandidateResp) {
+	t.Helper()
+	var mu sync.Mutex
+	var candidates []ueICECandidateResp
+	ue.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			candidates = append(candidates, ueICECandidateResp{Type: "iceCandidate", Candidate: candidate.ToJSON()})
+		}
+	})
+	gathered := webrtc.GatheringCompletePromise(ue)
+	if err := ue.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	mu.Lock()
+	defer mu.Unlock()
+	return desc, candidates
+}
+
+// Adds the candidates in the bridge's iceCandidate messages to the test UE.
+func addTestCandidates(t *testing.T, ue *webrtc.PeerConnection, messages [][]byte) {
+	t.Helper()
+	for _, message := range messages {
+		var candidate ueICECandidateResp
+		if err := json.Unmarshal(message, &candidate); err != nil {
+			t.Fatal(err)
+		}
+		if err := ue.AddICECandidate(candidate.Candidate); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestControlLoopMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    map[string]string
+		messages []string
+		// The types of the messages we write back, in order.
+		written []string
+		// Whether the loop gives up on the signalling rather than carrying on until the connection drops.
+		endsSession bool
+	}{
+		{name: "ping", messages: []string{`{"type":"ping","time":1234}`}, written: []string{"pong"}},
+		{name: "ping without RespondToPing", flags: map[string]string{"RespondToPing": "false"}, messages: []string{`{"type":"ping","time":1234}`}},
+		{name: "playerCount", messages: []string{`{"type":"playerCount","count":2}`}},
+		{name: "config", messages: []string{`{"type":"config","peerConnectionOptions":{}}`}},
+		{name: "config without options", messages: []string{`{"type":"config"}`}},
+		{name: "unrequested pong", messages: []string{`{"type":"pong","time":1}`}},
+		{name: "unrequested pong with StrictSignallingDisconnect", flags: map[string]string{"StrictSignalling": "true", "StrictSignallingDisconnect": "true"}, messages: []string{`{"type":"pong","time":1}`}, endsSession: true},
+		{name: "unknown type", messages: []string{`{"type":"bogus"}`}},
+		{name: "unknown type with StrictSignallingDisconnect", flags: map[string]string{"StrictSignalling": "true", "StrictSignallingDisconnect": "true"}, messages: []string{`{"type":"bogus"}`}, endsSession: true},
+		{name: "bad player counts skipped", messages: []string{`{"type":"playerCount","count":"two"}`, `{"type":"playerCount","count":"three"}`}},
+		{name: "bad player counts with MaxSignallingErrors", flags: map[string]string{"MaxSignallingErrors": "2"}, messages: []string{`{"type":"playerCount","count":"two"}`, `{"type":"playerCount","count":"three"}`}, endsSession: true},
+		{name: "ping after a bad message", flags: map[string]string{"MaxSignallingErrors": "2"}, messages: []string{`not json`, `{"type":"ping","time":1}`, `not json`}, written: []string{"pong"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			conn := newFakeSignallingConn(test.messages...)
+			close(conn.incoming)
+
+			err := startControlLoop(conn, nil, &candidateQueue{})
+			if test.endsSession == (err == io.EOF) {
+				t.Errorf("control loop returned %v, want it to end the session: %v", err, test.endsSession)
+			}
+			if !conn.closed {
+				t.Error("control loop did not close the connection")
+			}
+			if got := conn.writtenTypes(t); !reflect.DeepEqual(got, test.written) {
+				t.Errorf("wrote %v, want %v", got, test.written)
+			}
+		})
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	bad := errors.New("bad")
+	tests := []struct {
+		name   string
+		max    string
+		errs   []error
+		endsAt int
+	}{
+		{"skipped without MaxSignallingErrors", "0", []error{bad, bad, bad, bad}, -1},
+		{"first with a maximum of 1", "1", []error{nil, bad, bad}, 1},
+		{"in a row", "3", []error{bad, bad, bad, bad}, 2},
+		{"count reset by a good message", "3", []error{bad, bad, nil, bad, bad, nil, bad, bad, bad}, 8},
+		{"never enough in a row", "2", []error{bad, nil, bad, nil, bad}, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "MaxSignallingErrors", test.max)
+			malformed := &malformedMessages{}
+			endsAt := -1
+			for i, err := range test.errs {
+				if err = malformed.add(err); err != nil {
+					if !errors.Is(err, bad) {
+						t.Errorf("error %q doesn't wrap the last message's", err)
+					}
+					endsAt = i
+					break
+				}
+			}
+			if endsAt != test.endsAt {
+				t.Errorf("gave up at message %d, want %d", endsAt, test.endsAt)
+			}
+		})
+	}
+}
+
+func TestControlLoopMalformedMessages(t *testing.T) {
+	// Every kind of message that doesn't unmarshal counts towards MaxSignallingErrors.
+	common := []string{
+		`not json`,
+		`{"type":1}`,
+		`{"type":"playerCount","count":"two"}`,
+		`{"type":"config","peerConnectionOptions":"none"}`,
+		`{"type":"iceCandidate","candidate":"none"}`,
+	}
+	tests := []struct {
+		name string
+		// Whether we offered, so an answer is unmarshalled rather than an offer.
+		offered  bool
+		messages []string
+	}{
+		{"answerer", false, append([]string{`{"type":"offer","sdp":1}`}, common...)},
+		{"offerer", true, append([]string{`{"type":"answer","sdp":1}`}, common...)},
+	}
+	for _, test := range tests {
+		for _, max := range []int{len(test.messages), len(test.messages) + 1} {
+			endsSession := max == len(test.messages)
+			t.Run(fmt.Sprintf("%s with MaxSignallingErrors %d", test.name, max), func(t *testing.T) {
+				setFlag(t, "MaxSignallingErrors", fmt.Sprint(max))
+				bridge, err := createPeerConnection(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { bridge.Close() })
+				if test.offered {
+					offer, err := bridge.CreateOffer(nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err = bridge.SetLocalDescription(offer); err != nil {
+						t.Fatal(err)
+					}
+				}
+				conn := newFakeSignallingConn(test.messages...)
+				close(conn.incoming)
+
+				err = startControlLoop(conn, bridge, &candidateQueue{})
+				if endsSession == (err == io.EOF) {
+					t.Errorf("control loop returned %v, want it to end the session: %v", err, endsSession)
+				}
+				if endsSession && (err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%d malformed signalling messages in a row", max))) {
+					t.Errorf("control loop returned %v, want it to count %d malformed messages", err, max)
+				}
+			})
+		}
+	}
+}
+
+func TestControlLoopPong(t *testing.T) {
+	conn := newFakeSignallingConn(`{"type":"ping","time":1234.5}`)
+	close(conn.incoming)
+	startControlLoop(conn, nil, &candidateQueue{})
+	if len(conn.written) != 1 || string(conn.written[0]) != `{"type":"pong","time":1234.5}` {
+		t.Errorf("replied %q, want a pong with the ping's time", conn.written)
+	}
+}
+
+func TestControlLoopOffer(t *testing.T) {
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	connected := notifyICEConnected(bridge)
+	ue := newTestUE(t)
+	addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+
+	conn := newFakeSignallingConn()
+	pendingCandidates := &candidateQueue{}
+	trickleTestCandidates(bridge, conn, pendingCandidates)
+	loop := runTestControlLoop(t, conn, bridge, pendingCandidates)
+
+	// Answerer mode: UE offers through the control loop, then trickles its candidates.
+	offer, err := ue.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer, ueCandidates := setTestUEDescription(t, ue, offer)
+	conn.send(t, offer)
+
+	message, skipped := conn.waitForWrite(t, "answer")
+	if len(skipped) > 0 {
+		t.Errorf("wrote %d messages before the answer, our candidates should wait for it", len(skipped))
+	}
+	var answer webrtc.SessionDescription
+	if err = json.Unmarshal(message, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("UE could not apply our answer: %s", err)
+	}
+	for _, candidate := range ueCandidates {
+		conn.send(t, candidate)
+	}
+	connectTestUE(t, conn, ue, connected)
+
+	select {
+	case err := <-loop:
+		t.Fatalf("control loop ended: %v", err)
+	default:
+	}
+}
+
+func TestControlLoopAnswer(t *testing.T) {
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+	connected := notifyICEConnected(bridge)
+	ue := newTestUE(t)
+
+	conn := newFakeSignallingConn()
+	pendingCandidates := &candidateQueue{}
+	trickleTestCandidates(bridge, conn, pendingCandidates)
+
+	// Offerer mode: we offer, UE answers through the control loop.
+	if err = sendOffer(conn, bridge, nil); err != nil {
+		t.Fatal(err)
+	}
+	message, _ := conn.waitForWrite(t, "offer")
+	var offer webrtc.SessionDescription
+	if err = json.Unmarshal(message, &offer); err != nil {
+		t.Fatal(err)
+	}
+	if err = ue.SetRemoteDescription(offer); err != nil {
+		t.Fatalf("UE could not apply our offer: %s", err)
+	}
+	answer, err := ue.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, ueCandidates := setTestUEDescription(t, ue, answer)
+
+	if candidates, _ := conn.takeWritten(t, "iceCandidate"); len(candidates) > 0 {
+		t.Errorf("sent %d candidates before UE answered", len(candidates))
+	}
+	runTestControlLoop(t, conn, bridge, pendingCandidates)
+	conn.send(t, answer)
+	for _, candidate := range ueCandidates {
+		conn.send(t, candidate)
+	}
+	connectTestUE(t, conn, ue, connected)
+	if bridge.SignalingState() != webrtc.SignalingStateStable {
+		t.Errorf("signalling state is %s after UE's answer, want stable", bridge.SignalingState())
+	}
+}
+
+func TestControlLoopAnswerWithoutOffer(t *testing.T) {
+	setFlag(t, "StrictSignalling", "true")
+	setFlag(t, "StrictSignallingDisconnect", "true")
+	bridge, err := createPeerConnection(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close() })
+
+	conn := newFakeSignallingConn(`{"type":"answer","sdp":"v=0\r\n"}`)
+	close(conn.incoming)
+	var unexpected *unexpectedMessageError
+	if err := startControlLoop(conn, bridge, &candidateQueue{}); !errors.As(err, &unexpected) {
+		t.Errorf("control loop returned %v for an answer to no offer, want an unexpected message", err)
+	}
+}
+
+func TestCheckRemoteDescriptionRole(t *testing.T) {
+	tests := []struct {
+		sdpType webrtc.SDPType
+		state   webrtc.SignalingState
+		apply   bool
+	}{
+		{webrtc.SDPTypeOffer, webrtc.SignalingStateStable, true},
+		{webrtc.SDPTypeOffer, webrtc.SignalingStateHaveLocalOffer, false},
+		{webrtc.SDPTypeOffer, webrtc.SignalingStateHaveRemoteOffer, true},
+		{webrtc.SDPTypeAnswer, webrtc.SignalingStateHaveLocalOffer, true},
+		{webrtc.SDPTypeAnswer, webrtc.SignalingStateStable, false},
+		{webrtc.SDPTypeAnswer, webrtc.SignalingStateHaveRemoteOffer, false},
+	}
+	for _, strict := range []bool{false, true} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s in %s strict %v", test.sdpType, test.state, strict), func(t *testing.T) {
+				setFlag(t, "StrictSignalling", fmt.Sprint(strict))
+				setFlag(t, "StrictSignallingDisconnect", fmt.Sprint(strict))
+				apply, err := checkRemoteDescriptionRole(test.sdpType, test.state)
+				if apply != test.apply {
+					t.Errorf("apply is %v, want %v", apply, test.apply)
+				}
+				// Only a mismatch ends the session, and only with StrictSignallingDisconnect.
+				var unexpected *unexpectedMessageError
+				if wantErr := strict && !test.apply; errors.As(err, &unexpected) != wantErr {
+					t.Errorf("error is %v, want an unexpected message %v", err, wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestControlLoopOfferWhileOffering(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		endsSession bool
+	}{
+		{"ignored", false, false},
+		{"ends the session with StrictSignallingDisconnect", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "StrictSignalling", fmt.Sprint(test.strict))
+			setFlag(t, "StrictSignallingDisconnect", fmt.Sprint(test.strict))
+			bridge, err := createPeerConnection(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { bridge.Close() })
+			// Our offer is waiting for UE's answer, and UE offers too.
+			offer, err := bridge.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = bridge.SetLocalDescription(offer); err != nil {
+				t.Fatal(err)
+			}
+			ue := newTestUE(t)
+			addTestTrack(t, ue, webrtc.RTPCodecTypeVideo, "video")
+			ueOffer, err := ue.CreateOffer(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := newFakeSignallingConn()
+			conn.send(t, ueOffer)
+			close(conn.incoming)
+
+			err = startControlLoop(conn, bridge, &candidateQueue{})
+			var unexpected *unexpectedMessageError
+			if errors.As(err, &unexpected) != test.endsSession {
+				t.Errorf("control loop returned %v, want it to end the session: %v", err, test.endsSession)
+			}
+			if bridge.RemoteDescription() != nil || bridge.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+				t.Errorf("UE's offer was applied, signalling state is %s", bridge.SignalingState())
+			}
+			if got := conn.writtenTypes(t); len(got) != 0 {
+				t.Errorf("wrote %v, want no answer", got)
+			}
+		})
+	}
+}
+
+// Registers a signalling handler for the duration of the test.
+func registerTestSignallingHandler(t *testing.T, messageType string, handler signallingHandler) {
+	t.Helper()
+	registerSignallingHandler(messageType, handler)
+	t.Cleanup(func() {
+		signallingHandlersMu.Lock()
+		defer signallingHandlersMu.Unlock()
+		delete(signallingHandlers, messageType)
+	})
+}
+
+func TestControlLoopCustomHandler(t *testing.T) {
+	var handled []string
+	registerTestSignallingHandler(t, "custom", func(message []byte, wsConn signallingConn, peerConnection *webrtc.PeerConnection) error {
+		handled = append(handled, string(message))
+		return writeWSMessage(wsConn, `{"type":"customReply"}`)
+	})
+	// Built in types can't be overridden.
+	registerTestSignallingHandler(t, "ping", func(message []byte, wsConn signallingConn, peerConnection *webrtc.PeerConnection) error {
+		t.Error("handler registered for ping was called")
+		return nil
+	})
+
+	conn := newFakeSignallingConn(`{"type":"custom","value":1}`, `{"type":"ping","time":1}`)
+	close(conn.incoming)
+	if err := startControlLoop(conn, nil, &candidateQueue{}); err != io.EOF {
+		t.Errorf("control loop returned %v, want it to carry on until the connection dropped", err)
+	}
+	if !reflect.DeepEqual(handled, []string{`{"type":"custom","value":1}`}) {
+		t.Errorf("handler got %q", handled)
+	}
+	if got := conn.writtenTypes(t); !reflect.DeepEqual(got, []string{"customReply", "pong"}) {
+		t.Errorf("wrote %v, want the handler's reply and our pong", got)
+	}
+}
+
+func TestControlLoopCustomHandlerError(t *testing.T) {
+	handlerErr := errors.New("bad custom message")
+	registerTestSignallingHandler(t, "custom", func(message []byte, wsConn signallingConn, peerConnection *webrtc.PeerConnection) error {
+		return handlerErr
+	})
+	tests := []struct {
+		name   string
+		strict bool
+		want   error
+	}{
+		{"logged", false, io.EOF},
+		{"ends the session with StrictSignallingDisconnect", true, handlerErr},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, "StrictSignalling", fmt.Sprint(test.strict))
+			setFlag(t, "StrictSignallingDisconnect", fmt.Sprint(test.strict))
+			conn := newFakeSignallingConn(`{"type":"custom"}`)
+			close(conn.incoming)
+			if err := startControlLoop(conn, nil, &candidateQueue{}); err != test.want {
+				t.Errorf("control loop returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestMaxWSWriteErrors(t *testing.T) {
+	setFlag(t, "MaxWSWriteErrors", "3")
+	conn, other := newFakeSignallingConn(), newFakeSignallingConn()
+	ended := 0
+	setWSWriteFailureEnder(conn, func() { ended++ })
+	t.Cleanup(func() { setWSWriteFailureEnder(nil, nil) })
+	setWriteErr := func(err error) {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		conn.writeErr = err
+	}
+	write := func(c *fakeSignallingConn) error {
+		return writeWSMessage(c, `{"type":"pong"}`)
+	}
+
+	broken := errors.New("broken pipe")
+	setWriteErr(broken)
+	for i := 0; i < 2; i++ {
+		if err := write(conn); !errors.Is(err, broken) {
+			t.Fatalf("write returned %v, want the connection's error", err)
+		}
+	}
+	// A write that gets through starts the count again, other connections' writes don't count.
+	setWriteErr(nil)
+	if err := write(conn); err != nil {
+		t.Fatal(err)
+	}
+	setWriteErr(broken)
+	other.writeErr = broken
+	for i := 0; i < 2; i++ {
+		write(conn)
+		write(other)
+	}
+	if ended != 0 {
+		t.Fatalf("session ended after 2 failed writes in a row, want it to carry on until 3")
+	}
+	write(conn)
+	if ended != 1 {
+		t.Fatalf("session ended %d times after 3 failed writes in a row, want once", ended)
+	}
+	// Only ended once, however many writes fail after.
+	write(conn)
+	if ended != 1 {
+		t.Errorf("session ended %d times, want once", ended)
+	}
+}
+
+func TestMaxWSWriteErrorsDisabled(t *testing.T) {
+	setFlag(t, "MaxWSWriteErrors", "0")
+	conn := newFakeSignallingConn()
+	conn.writeErr = errors.New("broken pipe")
+	ended := false
+	setWSWriteFailureEnder(conn, func() { ended = true })
+	t.Cleanup(func() { setWSWriteFailureEnder(nil, nil) })
+	for i := 0; i < 10; i++ {
+		writeWSMessage(conn, `{"type":"pong"}`)
+	}
+	if ended {
+		t.Error("session ended with -MaxWSWriteErrors 0, want the failures only logged")
+	}
+}
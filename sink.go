@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// sink - Somewhere a track's forwarded packets go, e.g. the track's UDP destinations or a recording. Every sink of a
+// track gets every packet that made it through the forwarding filters, in order, from the track's forwarding loop.
+// The packet and its Raw bytes are only valid during the call, a sink that holds on to them must copy them.
+type sink interface {
+	// An error marks the sink down, see trackSinks.
+	writeRTP(packet *rtp.Packet) error
+	// Called once the track stops forwarding.
+	close()
+}
+
+// trackSinks - The sinks a track is forwarded to. A sink whose write fails is marked down and gets no more packets,
+// e.g. a recording on a full disk, while the track's other sinks carry on. It is still closed with the others.
+type trackSinks []sink
+
+func (s trackSinks) writeRTP(packet *rtp.Packet) {
+	for i, sink := range s {
+		if err := sink.writeRTP(packet); err != nil {
+			log.Printf("Error writing %s. Stopped writing to it, the track's other outputs carry on.", err.Error())
+			s[i] = downSink{sink}
+		}
+	}
+}
+
+func (s trackSinks) close() {
+	for _, sink := range s {
+		sink.close()
+	}
+}
+
+// downSink - A sink that failed, which drops the packets but is still closed.
+type downSink struct {
+	sink
+}
+
+func (downSink) writeRTP(packet *rtp.Packet) error { return nil }
+
+// udpSink - Forwards a track to its UDP destinations, dropping or flagging the packets over MaxPacketSize first.
+// A destination that can't be written to is marked down and probed on its own, so the sink never fails as a whole.
+type udpSink struct {
+	destinations udpConns
+	stats        *trackStats
+	oversize     *oversizeGuard
+}
+
+func newUDPSink(destinations udpConns, stats *trackStats) *udpSink {
+	s := &udpSink{destinations: destinations, stats: stats}
+	if *MaxPacketSize > 0 {
+		s.oversize = newOversizeGuard(stats.name, stats)
+	}
+	return s
+}
+
+func (s *udpSink) writeRTP(packet *rtp.Packet) error {
+	if s.oversize != nil && !s.oversize.check(packet.Raw, time.Now()) {
+		return nil
+	}
+	s.destinations.writeRTP(packet.Raw, s.stats)
+	return nil
+}
+
+func (s *udpSink) close() {
+	// The track's last frame may still be batched.
+	s.destinations.flushBatches(s.stats)
+	s.destinations.close()
+}
+
+// sharedOutput - An output all of a session's tracks go to together, e.g. the RTSP session or the MPEG-TS mux, which
+// tells the tracks apart by name.
+type sharedOutput interface {
+	writeRTP(name string, packet *rtp.Packet)
+	removeTrack(name string)
+}
+
+// sharedOutputSink - One track's part of a sharedOutput.
+type sharedOutputSink struct {
+	name   string
+	output sharedOutput
+}
+
+func (s *sharedOutputSink) writeRTP(packet *rtp.Packet) error {
+	s.output.writeRTP(s.name, packet)
+	return nil
+}
+
+func (s *sharedOutputSink) close() {
+	s.output.removeTrack(s.name)
+}
+
+// recordingSink - Records a track to a file with one of Pion's media writers, the way the record command does. A
+// write error stops the recording but not the forwarding to the other sinks.
+type recordingSink struct {
+	name   string
+	path   string
+	writer media.Writer
+}
+
+func (s *recordingSink) writeRTP(packet *rtp.Packet) error {
+	if err := s.writer.WriteRTP(packet); err != nil {
+		return fmt.Errorf("the %s recording %s: %w", s.name, s.path, err)
+	}
+	return nil
+}
+
+func (s *recordingSink) close() {
+	if err := s.writer.Close(); err != nil {
+		log.Println(fmt.Sprintf("Error closing recording %s: %s", s.path, err.Error()))
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// mockSink - Keeps the sequence numbers of the packets it was given and whether it was closed. Fails from the
+// failAt'th write on.
+type mockSink struct {
+	sequenceNumbers []uint16
+	writes          int
+	failAt          int
+	closed          bool
+}
+
+func (s *mockSink) writeRTP(packet *rtp.Packet) error {
+	s.writes++
+	if s.failAt > 0 && s.writes >= s.failAt {
+		return errors.New("the mock sink: disk full")
+	}
+	s.sequenceNumbers = append(s.sequenceNumbers, packet.SequenceNumber)
+	return nil
+}
+
+func (s *mockSink) close() {
+	s.closed = true
+}
+
+// mockWriter - A media.Writer that fails from the failAt'th write on.
+type mockWriter struct {
+	writes int
+	failAt int
+	closed bool
+}
+
+func (w *mockWriter) WriteRTP(packet *rtp.Packet) error {
+	w.writes++
+	if w.failAt > 0 && w.writes >= w.failAt {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func (w *mockWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+// mockSharedOutput - Keeps which tracks wrote to it and which were removed.
+type mockSharedOutput struct {
+	written []string
+	removed []string
+}
+
+func (o *mockSharedOutput) writeRTP(name string, packet *rtp.Packet) {
+	o.written = append(o.written, name)
+}
+
+func (o *mockSharedOutput) removeTrack(name string) {
+	o.removed = append(o.removed, name)
+}
+
+func TestTrackSinks(t *testing.T) {
+	first, second := &mockSink{}, &mockSink{}
+	sinks := trackSinks{first, second}
+	for sequence := uint16(1); sequence <= 3; sequence++ {
+		raw := marshalTestPacket(t, rtp.Header{SequenceNumber: sequence}, []byte{byte(sequence)})
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(raw); err != nil {
+			t.Fatal(err)
+		}
+		packet.Raw = raw
+		sinks.writeRTP(packet)
+	}
+	for i, sink := range []*mockSink{first, second} {
+		if !reflect.DeepEqual(sink.sequenceNumbers, []uint16{1, 2, 3}) {
+			t.Errorf("sink %d got %v, want every packet in order", i, sink.sequenceNumbers)
+		}
+		if sink.closed {
+			t.Errorf("sink %d closed while the track forwards", i)
+		}
+	}
+	sinks.close()
+	if !first.closed || !second.closed {
+		t.Errorf("sinks closed %v and %v, want both", first.closed, second.closed)
+	}
+}
+
+func TestTrackSinksFailure(t *testing.T) {
+	failing, other := &mockSink{failAt: 2}, &mockSink{}
+	writer := &mockWriter{}
+	recording := &recordingSink{name: "video", path: "video.h264", writer: writer}
+	sinks := trackSinks{failing, recording, other}
+	logged := captureLog(t)
+	for sequence := uint16(1); sequence <= 4; sequence++ {
+		sinks.writeRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sequence}})
+	}
+	// Only the failing sink is down, it isn't written to again.
+	if failing.writes != 2 || !reflect.DeepEqual(failing.sequenceNumbers, []uint16{1}) {
+		t.Errorf("failing sink written %d times and got %v, want it stopped after the failed second write", failing.writes, failing.sequenceNumbers)
+	}
+	if writer.writes != 4 {
+		t.Errorf("recording written %d times, want it to keep recording all 4 packets", writer.writes)
+	}
+	if !reflect.DeepEqual(other.sequenceNumbers, []uint16{1, 2, 3, 4}) {
+		t.Errorf("other sink got %v, want every packet", other.sequenceNumbers)
+	}
+	if !strings.Contains(logged.String(), "Error writing the mock sink: disk full.") {
+		t.Errorf("logged %q, want the failing sink's error", logged.String())
+	}
+	sinks.close()
+	if !failing.closed || !writer.closed || !other.closed {
+		t.Errorf("sinks closed %v, %v and %v, want all of them, the failed one too", failing.closed, writer.closed, other.closed)
+	}
+}
+
+func TestRecordingSinkWriteError(t *testing.T) {
+	writer := &mockWriter{failAt: 2}
+	recording := &recordingSink{name: "video", path: "video.h264", writer: writer}
+	other := &mockSink{}
+	sinks := trackSinks{recording, other}
+	for sequence := uint16(1); sequence <= 4; sequence++ {
+		sinks.writeRTP(&rtp.Packet{Header: rtp.Header{SequenceNumber: sequence}})
+	}
+	if writer.writes != 2 {
+		t.Errorf("recording written %d times, want it stopped after the failed second write", writer.writes)
+	}
+	// The other sinks carry on.
+	if len(other.sequenceNumbers) != 4 {
+		t.Errorf("other sink got %d packets, want 4", len(other.sequenceNumbers))
+	}
+	sinks.close()
+	if !writer.closed {
+		t.Error("failed recording not closed")
+	}
+}
+
+func TestSharedOutputSink(t *testing.T) {
+	output := &mockSharedOutput{}
+	sinks := trackSinks{&sharedOutputSink{"video", output}, &sharedOutputSink{"audio", output}}
+	sinks.writeRTP(&rtp.Packet{})
+	sinks.close()
+	if !reflect.DeepEqual(output.written, []string{"video", "audio"}) {
+		t.Errorf("shared output written by %v", output.written)
+	}
+	if !reflect.DeepEqual(output.removed, []string{"video", "audio"}) {
+		t.Errorf("shared output had %v removed", output.removed)
+	}
+}
+
+func TestRecordAlongsideForwarding(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "RecordTracksDir", dir)
+	testRecordAlongsideForwarding(t, dir)
+}
+
+func TestRecordAndForward(t *testing.T) {
+	// Records to the working directory without RecordTracksDir.
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	setFlag(t, "RecordAndForward", "true")
+	testRecordAlongsideForwarding(t, dir)
+}
+
+// Forwards a video track to a test receiver, checking it is also recorded to dir.
+func testRecordAlongsideForwarding(t *testing.T, dir string) {
+	listener, port := listenTestReceiver(t)
+	setFlag(t, "RTPVideoForwardingPort", strconv.Itoa(port))
+	bridge := newTestBridge(t)
+	ue := newTestUE(t)
+	// Pion's H264 writer only starts on a keyframe with its SPS in a STAP-A, which addTestTrack doesn't send.
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: videoClockRate}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ue.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err = negotiateLocally(ue, bridge); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sequence := uint16(0); ; sequence++ {
+		keyframe := &rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, SequenceNumber: sequence, Timestamp: uint32(sequence) * 3000}, Payload: []byte{0x78, 0, 2, 0x67, 0x42, 0, 1, 0x68, 0, 2, 0x65, 0x88}}
+		if err := track.WriteRTP(keyframe); err != nil {
+			t.Fatal(err)
+		}
+		recordings, err := filepath.Glob(filepath.Join(dir, "video-*.h264"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(recordings) == 1 {
+			if info, err := os.Stat(recordings[0]); err == nil && info.Size() > 0 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no video recorded in %s, found %v", dir, recordings)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Forwarded as well as recorded.
+	if err := expectForwardedRTP(listener, "video", uint8(*RTPVideoPayloadType), 0, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	}
+}
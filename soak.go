@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"time"
+)
+
+// How long a soak test waits after the last cycle for the closed sessions' goroutines and sockets to go away before
+// counting them as leaked.
+const soakSettleTimeout = 5 * time.Second
+
+// soakSnapshot - The resources a soak test checks for leaks. Files is -1 where they can't be counted.
+type soakSnapshot struct {
+	goroutines int
+	files      int
+}
+
+// Counts the goroutines and, where /proc/self/fd exists (Linux), the open file descriptors, sockets included.
+func takeSoakSnapshot() soakSnapshot {
+	snapshot := soakSnapshot{goroutines: runtime.NumGoroutine(), files: -1}
+	if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		snapshot.files = len(entries)
+	}
+	return snapshot
+}
+
+func (s soakSnapshot) String() string {
+	if s.files < 0 {
+		return fmt.Sprintf("%d goroutines", s.goroutines)
+	}
+	return fmt.Sprintf("%d goroutines, %d open files", s.goroutines, s.files)
+}
+
+// Reports whether s has more goroutines or open files than baseline.
+func (s soakSnapshot) exceeds(baseline soakSnapshot) bool {
+	return s.goroutines > baseline.goroutines || (s.files >= 0 && s.files > baseline.files)
+}
+
+// Runs the selftest cycles times in a row, each connecting, forwarding for hold and disconnecting, to exercise the
+// setup and cleanup of sessions. The first cycle warms up what stays around for the life of the process, e.g. Pion's
+// and the stats' goroutines, so the resources are counted after it and again after the last. Fails if any cycle
+// failed or if more of them are left over than after the first once they've had soakSettleTimeout to go away.
+func runSoak(cycles int, timeout time.Duration, hold time.Duration) error {
+	passed, failed := 0, 0
+	var baseline soakSnapshot
+	for cycle := 1; cycle <= cycles; cycle++ {
+		fmt.Println(fmt.Sprintf("Soak test cycle %d of %d...", cycle, cycles))
+		if err := runSelftest(timeout, hold); err != nil {
+			failed++
+			fmt.Println(fmt.Sprintf("Soak test cycle %d failed: %s", cycle, err.Error()))
+		} else {
+			passed++
+		}
+		if cycle == 1 {
+			baseline = settleSoak(soakSnapshot{}, time.Second)
+			fmt.Println(fmt.Sprintf("After the first cycle: %s.", baseline))
+		}
+	}
+
+	final := settleSoak(baseline, soakSettleTimeout)
+	fmt.Println(fmt.Sprintf("Soak test: %d of %d cycles passed, %d failed.", passed, cycles, failed))
+	fmt.Println(fmt.Sprintf("After the last cycle: %s.", final))
+	leaked := cycles > 1 && final.exceeds(baseline)
+	if leaked && final.goroutines > baseline.goroutines {
+		fmt.Println(fmt.Sprintf("Leaked %d goroutines over %d cycles.", final.goroutines-baseline.goroutines, cycles-1))
+	}
+	if leaked && final.files >= 0 && final.files > baseline.files {
+		fmt.Println(fmt.Sprintf("Leaked %d open files over %d cycles.", final.files-baseline.files, cycles-1))
+	}
+
+	switch {
+	case failed > 0 && leaked:
+		return fmt.Errorf("%d of %d cycles failed and resources leaked", failed, cycles)
+	case failed > 0:
+		return fmt.Errorf("%d of %d cycles failed", failed, cycles)
+	case leaked:
+		return fmt.Errorf("resources leaked over %d cycles", cycles-1)
+	}
+	return nil
+}
+
+// Waits up to timeout for the closed session's goroutines and sockets to go away, i.e. until there are no more of them
+// than in target, and returns what is left. A zero target just waits out the timeout.
+func settleSoak(target soakSnapshot, timeout time.Duration) soakSnapshot {
+	deadline := time.Now().Add(timeout)
+	for {
+		snapshot := takeSoakSnapshot()
+		if (target.goroutines > 0 && !snapshot.exceeds(target)) || !time.Now().Before(deadline) {
+			return snapshot
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// Asks the kernel for a send buffer of the given size on the connection and logs what it granted, which may be
+// clamped to the OS limit (and on Linux is double what was asked for, to leave room for bookkeeping).
+func setSendBuffer(conn *net.UDPConn, bytes int) {
+	if err := conn.SetWriteBuffer(bytes); err != nil {
+		log.Printf("Error setting UDP send buffer of %d bytes on the connection to %s. Error: %s", bytes, conn.RemoteAddr(), err.Error())
+		return
+	}
+	granted, err := sendBufferSize(conn)
+	if err != nil {
+		log.Printf("Set UDP send buffer of %d bytes on the connection to %s, could not read back the size granted: %s", bytes, conn.RemoteAddr(), err.Error())
+		return
+	}
+	log.Printf("UDP send buffer on the connection to %s is %d bytes (asked for %d).", conn.RemoteAddr(), granted, bytes)
+}
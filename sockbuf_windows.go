@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Windows doesn't let us read SO_SNDBUF back through the syscall package, so we can't say what was granted.
+func sendBufferSize(conn *net.UDPConn) (int, error) {
+	return 0, errors.New("not supported on Windows")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackStats - Counters for a single forwarded track. Updated from the forwarding/RTCP goroutines so all access is atomic.
+type trackStats struct {
+	packetsForwarded uint64
+	bytesForwarded   uint64
+	// Last measured round-trip time to Unreal Engine in nanoseconds, 0 if not measured yet.
+	rttNanos int64
+	// Interarrival jitter of the packets from Unreal Engine in nanoseconds.
+	jitterNanos int64
+	// Packets from Unreal Engine dropped by the integrity check.
+	corruptPackets uint64
+	// Packets over MaxPacketSize.
+	oversizePackets uint64
+	// Times no packet arrived for over UnderrunThresholdMs.
+	underruns uint64
+	// Packets that arrived too late for ReorderWindow, or twice.
+	latePackets uint64
+	// Packets lost to a write error other than the destination refusing them.
+	writeErrors uint64
+	// Non-zero while forwarding of the track is paused through the control API.
+	paused int32
+	// Non-zero while WaitForReceiver holds back the track until a receiver shows up.
+	waitingForReceiver int32
+	// For audio tracks, how far the video is behind them in nanoseconds (negative when ahead), see avSyncMonitor. Only
+	// valid while hasSyncOffset is non-zero.
+	syncOffsetNanos int64
+	hasSyncOffset   int32
+	name            string
+}
+
+func (s *trackStats) addForwarded(bytes int) {
+	atomic.AddUint64(&s.packetsForwarded, 1)
+	atomic.AddUint64(&s.bytesForwarded, uint64(bytes))
+}
+
+func (s *trackStats) setRTT(rtt time.Duration) {
+	atomic.StoreInt64(&s.rttNanos, int64(rtt))
+}
+
+func (s *trackStats) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rttNanos))
+}
+
+func (s *trackStats) setJitter(jitter time.Duration) {
+	atomic.StoreInt64(&s.jitterNanos, int64(jitter))
+}
+
+func (s *trackStats) jitter() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.jitterNanos))
+}
+
+func (s *trackStats) addCorrupt() {
+	atomic.AddUint64(&s.corruptPackets, 1)
+}
+
+func (s *trackStats) addOversize() {
+	atomic.AddUint64(&s.oversizePackets, 1)
+}
+
+func (s *trackStats) oversize() uint64 {
+	return atomic.LoadUint64(&s.oversizePackets)
+}
+
+func (s *trackStats) addUnderrun() {
+	atomic.AddUint64(&s.underruns, 1)
+}
+
+func (s *trackStats) addLate() {
+	atomic.AddUint64(&s.latePackets, 1)
+}
+
+func (s *trackStats) addWriteErrors(packets int) {
+	atomic.AddUint64(&s.writeErrors, uint64(packets))
+}
+
+func (s *trackStats) setPaused(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	atomic.StoreInt32(&s.paused, value)
+}
+
+func (s *trackStats) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+func (s *trackStats) setWaitingForReceiver(waiting bool) {
+	var value int32
+	if waiting {
+		value = 1
+	}
+	atomic.StoreInt32(&s.waitingForReceiver, value)
+}
+
+func (s *trackStats) isWaitingForReceiver() bool {
+	return atomic.LoadInt32(&s.waitingForReceiver) != 0
+}
+
+func (s *trackStats) setSyncOffset(offset time.Duration) {
+	atomic.StoreInt64(&s.syncOffsetNanos, int64(offset))
+	atomic.StoreInt32(&s.hasSyncOffset, 1)
+}
+
+func (s *trackStats) clearSyncOffset() {
+	atomic.StoreInt32(&s.hasSyncOffset, 0)
+}
+
+// Returns the audio track's offset to the video, false if it hasn't been measured.
+func (s *trackStats) syncOffset() (time.Duration, bool) {
+	if atomic.LoadInt32(&s.hasSyncOffset) == 0 {
+		return 0, false
+	}
+	return time.Duration(atomic.LoadInt64(&s.syncOffsetNanos)), true
+}
+
+func (s *trackStats) String() string {
+	line := fmt.Sprintf("%s: packets=%d bytes=%d rtt=%s jitter=%s corrupt=%d", s.name,
+		atomic.LoadUint64(&s.packetsForwarded), atomic.LoadUint64(&s.bytesForwarded), s.rtt(), s.jitter(),
+		atomic.LoadUint64(&s.corruptPackets))
+	if oversize := s.oversize(); oversize > 0 {
+		line += fmt.Sprintf(" oversize=%d", oversize)
+	}
+	if underruns := atomic.LoadUint64(&s.underruns); underruns > 0 {
+		line += fmt.Sprintf(" underruns=%d", underruns)
+	}
+	if late := atomic.LoadUint64(&s.latePackets); late > 0 {
+		line += fmt.Sprintf(" late=%d", late)
+	}
+	if writeErrors := atomic.LoadUint64(&s.writeErrors); writeErrors > 0 {
+		line += fmt.Sprintf(" write-errors=%d", writeErrors)
+	}
+	if offset, ok := s.syncOffset(); ok {
+		line += fmt.Sprintf(" av-sync=%s", offset.Round(time.Millisecond))
+	}
+	if s.isPaused() {
+		line += " paused"
+	}
+	if s.isWaitingForReceiver() {
+		line += " waiting"
+	}
+	return line
+}
+
+// statsRegistry - Keeps the stats of every track we have forwarded, keyed by track name (e.g. "video").
+type statsRegistry struct {
+	mu     sync.Mutex
+	tracks map[string]*trackStats
+}
+
+var bridgeStats = &statsRegistry{tracks: make(map[string]*trackStats)}
+
+// Returns the stats for the named track, creating them if this is the first time we have seen this track.
+func (r *statsRegistry) track(name string) *trackStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.tracks[name]
+	if !ok {
+		s = &trackStats{name: name}
+		r.tracks[name] = s
+	}
+	return s
+}
+
+// Returns the stats of all tracks sorted by name.
+func (r *statsRegistry) all() []*trackStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	all := make([]*trackStats, 0, len(r.tracks))
+	for _, s := range r.tracks {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+// Logs the stats of every track on an interval, never returns.
+func logStatsOnInterval(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		all := bridgeStats.all()
+		if len(all) == 0 {
+			continue
+		}
+		lines := make([]string, 0, len(all))
+		for _, s := range all {
+			lines = append(lines, s.String())
+		}
+		if setup := sessionSetup.String(); setup != "" {
+			lines = append(lines, fmt.Sprintf("setup: %s", setup))
+		}
+		if rtt := signallingRTT(); rtt > 0 {
+			lines = append(lines, fmt.Sprintf("signalling-rtt: %s", rtt.Round(time.Microsecond)))
+		}
+		log.Printf("Stats - %s", strings.Join(lines, ", "))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The largest datagram we send, so the metrics fit in one packet on a typical 1500 byte MTU.
+const statsdMaxDatagram = 1432
+
+// What the counters of a track were at the last flush, StatsD counters are sent as the increase since then.
+type statsdCounters struct {
+	packets   uint64
+	bytes     uint64
+	corrupt   uint64
+	underruns uint64
+}
+
+// statsdSink - Sends the forwarding stats to a StatsD server (or Telegraf's StatsD input) over UDP: counters for
+// packets, bytes, corrupt packets and underruns, timers for RTT, jitter and the audio's offset to the video, a gauge for whether a track is paused, and
+// a counter for ICE candidate pair changes.
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]statsdCounters
+	// candidatePairChanges at the last flush.
+	lastPairChanges uint64
+}
+
+func newStatsDSink(address string, prefix string) (*statsdSink, error) {
+	// Dialing UDP only resolves the address, it doesn't matter whether the server is up yet.
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, prefix: prefix, last: make(map[string]statsdCounters)}, nil
+}
+
+// Sends the stats on an interval, never returns.
+func (s *statsdSink) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flush(bridgeStats.all())
+	}
+}
+
+// Sends every track's metrics, e.g. "ue_rtp_forwarder.video.packets:1204|c", packing as many lines into each datagram
+// as fit.
+func (s *statsdSink) flush(all []*trackStats) {
+	var lines []string
+	for _, stats := range all {
+		current := statsdCounters{
+			packets:   atomic.LoadUint64(&stats.packetsForwarded),
+			bytes:     atomic.LoadUint64(&stats.bytesForwarded),
+			corrupt:   atomic.LoadUint64(&stats.corruptPackets),
+			underruns: atomic.LoadUint64(&stats.underruns),
+		}
+		previous := s.last[stats.name]
+		s.last[stats.name] = current
+		paused := 0
+		if stats.isPaused() {
+			paused = 1
+		}
+		metric := s.prefix + "." + stats.name + "."
+		lines = append(lines,
+			fmt.Sprintf("%spackets:%d|c", metric, current.packets-previous.packets),
+			fmt.Sprintf("%sbytes:%d|c", metric, current.bytes-previous.bytes),
+			fmt.Sprintf("%scorrupt:%d|c", metric, current.corrupt-previous.corrupt),
+			fmt.Sprintf("%sunderruns:%d|c", metric, current.underruns-previous.underruns),
+			fmt.Sprintf("%sjitter_ms:%.3f|ms", metric, stats.jitter().Seconds()*1000),
+			fmt.Sprintf("%spaused:%d|g", metric, paused))
+		if rtt := stats.rtt(); rtt > 0 {
+			lines = append(lines, fmt.Sprintf("%srtt_ms:%.3f|ms", metric, rtt.Seconds()*1000))
+		}
+		// A timer rather than a gauge, StatsD reads a gauge with a sign as a change to its value.
+		if offset, ok := stats.syncOffset(); ok {
+			lines = append(lines, fmt.Sprintf("%sav_sync_ms:%.3f|ms", metric, offset.Seconds()*1000))
+		}
+	}
+	pairChanges := atomic.LoadUint64(&candidatePairChanges)
+	lines = append(lines, fmt.Sprintf("%s.ice_pair_changes:%d|c", s.prefix, pairChanges-s.lastPairChanges))
+	s.lastPairChanges = pairChanges
+	if rtt := signallingRTT(); rtt > 0 {
+		lines = append(lines, fmt.Sprintf("%s.signalling_rtt_ms:%.3f|ms", s.prefix, rtt.Seconds()*1000))
+	}
+
+	var datagram []string
+	size := 0
+	for _, line := range lines {
+		if len(datagram) > 0 && size+1+len(line) > statsdMaxDatagram {
+			s.write(datagram)
+			datagram, size = nil, 0
+		}
+		datagram = append(datagram, line)
+		size += len(line) + 1
+	}
+	if len(datagram) > 0 {
+		s.write(datagram)
+	}
+}
+
+func (s *statsdSink) write(lines []string) {
+	// Errors are e.g. the server being down (ICMP port unreachable), the next flush tries again.
+	if _, err := s.conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+		log.Printf("Error sending stats to StatsD: %s", err.Error())
+	}
+}
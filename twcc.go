@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// How often we send UE transport-cc feedback, libwebrtc expects it every 50-100ms to steer its bitrate.
+const twccFeedbackInterval = 100 * time.Millisecond
+
+// The units transport-cc feedback counts time in.
+const (
+	twccReferenceUnit = 64 * time.Millisecond
+	twccDeltaUnit     = 250 * time.Microsecond
+	// The longest run a run length chunk can hold.
+	twccMaxRunLength = 1<<13 - 1
+)
+
+// Whether CongestionControl has us send REMB, RTCPSendREMB=false still turns it off as it always has.
+func sendREMB() bool {
+	return *RTCPSendREMB && (*CongestionControl == "remb" || *CongestionControl == "both")
+}
+
+// Whether CongestionControl has us send transport-cc feedback.
+func sendTWCC() bool {
+	return *CongestionControl == "twcc" || *CongestionControl == "both"
+}
+
+// Negotiates transport-cc with UE when CongestionControl asks for it: the transport-wide sequence number header
+// extension UE numbers its packets with, and the transport-cc RTCP feedback type on every codec, without which
+// libwebrtc doesn't use the feedback.
+func registerCongestionControl(m *webrtc.MediaEngine) error {
+	if !sendTWCC() {
+		return nil
+	}
+	for _, kind := range bothKinds {
+		// EnableExtension=transport-cc registered it already.
+		registered := false
+		for _, value := range *EnableExtension {
+			if extension, _ := parseHeaderExtension(value); extension.uri == sdp.TransportCCURI {
+				registered = true
+			}
+		}
+		if !registered {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+				return fmt.Errorf("registering %s for %s: %w", sdp.TransportCCURI, kind, err)
+			}
+		}
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, kind)
+	}
+	return nil
+}
+
+// The ID UE's packets on this receiver carry the transport-wide sequence number in, 0 if it wasn't negotiated.
+func twccExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+type twccArrival struct {
+	seq uint16
+	at  time.Time
+}
+
+// twccRecorder - Records when the packets of every track arrive by their transport-wide sequence number, which UE
+// shares across the tracks of the session, and turns them into transport-cc feedback
+// (draft-holmer-rmcat-transport-wide-cc-extensions-01) that UE's bandwidth estimator works from.
+type twccRecorder struct {
+	mu         sync.Mutex
+	senderSSRC uint32
+	mediaSSRC  uint32
+	epoch      time.Time
+	arrivals   []twccArrival
+	// The sequence number the next feedback starts from, packets before it were already reported.
+	nextSeq    uint16
+	started    bool
+	fbPktCount uint8
+}
+
+func newTWCCRecorder() *twccRecorder {
+	return &twccRecorder{senderSSRC: rand.Uint32(), epoch: time.Now()}
+}
+
+// Records the arrival of one of UE's packets, ssrc is the stream it belongs to.
+func (r *twccRecorder) record(seq uint16, ssrc uint32, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mediaSSRC == 0 {
+		r.mediaSSRC = ssrc
+	}
+	r.arrivals = append(r.arrivals, twccArrival{seq, at})
+}
+
+// Sends UE the feedback for the packets since the last feedback on an interval, until the peer connection is closed.
+func (r *twccRecorder) run(peerConnection *webrtc.PeerConnection) {
+	ticker := time.NewTicker(twccFeedbackInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		if feedback := r.feedback(); feedback != nil {
+			if rtcpErr := peerConnection.WriteRTCP([]rtcp.Packet{feedback}); rtcpErr != nil {
+				sessionPrintln(rtcpErr)
+			}
+		}
+	}
+}
+
+// Builds the feedback for the packets recorded since the last feedback, nil if there are none. Packets missing from
+// the sequence are reported as lost, and ones arriving after they were reported lost are left out.
+func (r *twccRecorder) feedback() *rtcp.TransportLayerCC {
+	r.mu.Lock()
+	arrivals := r.arrivals
+	r.arrivals = nil
+	if len(arrivals) == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	if !r.started {
+		r.nextSeq, r.started = arrivals[0].seq, true
+		for _, arrival := range arrivals {
+			if int16(arrival.seq-r.nextSeq) < 0 {
+				r.nextSeq = arrival.seq
+			}
+		}
+	}
+	base := r.nextSeq
+
+	// Order by sequence number relative to the base, keeping the first arrival of any duplicates.
+	received := make(map[uint16]time.Time, len(arrivals))
+	last := -1
+	for _, arrival := range arrivals {
+		offset := int(int16(arrival.seq - base))
+		if _, duplicate := received[uint16(offset)]; offset < 0 || duplicate {
+			continue
+		}
+		received[uint16(offset)] = arrival.at
+		if offset > last {
+			last = offset
+		}
+	}
+	if last < 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	r.nextSeq = base + uint16(last) + 1
+	feedback := &rtcp.TransportLayerCC{
+		SenderSSRC:         r.senderSSRC,
+		MediaSSRC:          r.mediaSSRC,
+		BaseSequenceNumber: base,
+		PacketStatusCount:  uint16(last + 1),
+		FbPktCount:         r.fbPktCount,
+	}
+	r.fbPktCount++
+	epoch := r.epoch
+	r.mu.Unlock()
+
+	offsets := make([]int, 0, len(received))
+	for offset := range received {
+		offsets = append(offsets, int(offset))
+	}
+	sort.Ints(offsets)
+
+	// Deltas are from the reference time for the first packet, then from the packet before in sequence order.
+	first := received[uint16(offsets[0])].Sub(epoch)
+	reference := first / twccReferenceUnit
+	feedback.ReferenceTime = uint32(reference) & 0xFFFFFF
+	previous := int64((reference * twccReferenceUnit) / twccDeltaUnit)
+
+	symbols := make([]uint16, last+1)
+	for _, offset := range offsets {
+		at := int64(received[uint16(offset)].Sub(epoch) / twccDeltaUnit)
+		delta := at - previous
+		previous = at
+		symbol := rtcp.TypeTCCPacketReceivedSmallDelta
+		if delta < 0 || delta > 0xFF {
+			symbol = rtcp.TypeTCCPacketReceivedLargeDelta
+			// Beyond what a large delta holds the arrival times are meaningless to UE anyway.
+			if delta > 0x7FFF {
+				delta = 0x7FFF
+			} else if delta < -0x8000 {
+				delta = -0x8000
+			}
+		}
+		symbols[offset] = symbol
+		feedback.RecvDeltas = append(feedback.RecvDeltas, &rtcp.RecvDelta{Type: symbol, Delta: delta * int64(twccDeltaUnit/time.Microsecond)})
+	}
+	for start := 0; start < len(symbols); {
+		end := start + 1
+		for end < len(symbols) && symbols[end] == symbols[start] && end-start < twccMaxRunLength {
+			end++
+		}
+		feedback.PacketChunks = append(feedback.PacketChunks, &rtcp.RunLengthChunk{
+			Type:               rtcp.TypeTCCRunLengthChunk,
+			PacketStatusSymbol: symbols[start],
+			RunLength:          uint16(end - start),
+		})
+		start = end
+	}
+
+	// The header's length is in 32 bit words, padding included.
+	unpadded := 20 + 2*len(feedback.PacketChunks)
+	for _, delta := range feedback.RecvDeltas {
+		unpadded++
+		if delta.Type == rtcp.TypeTCCPacketReceivedLargeDelta {
+			unpadded++
+		}
+	}
+	feedback.Header = rtcp.Header{
+		Padding: unpadded%4 != 0,
+		Count:   rtcp.FormatTCC,
+		Type:    rtcp.TypeTransportSpecificFeedback,
+		Length:  feedback.Len()/4 - 1,
+	}
+	return feedback
+}
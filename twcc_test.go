@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Marshals the feedback and parses it back as UE would.
+func unmarshalTestTWCC(t *testing.T, feedback *rtcp.TransportLayerCC) *rtcp.TransportLayerCC {
+	t.Helper()
+	if feedback == nil {
+		t.Fatal("no feedback")
+	}
+	b, err := feedback.Marshal()
+	if err != nil {
+		t.Fatalf("marshalling the feedback: %s", err)
+	}
+	if len(b)%4 != 0 {
+		t.Errorf("feedback is %d bytes, not padded to 32 bits", len(b))
+	}
+	packets, err := rtcp.Unmarshal(b)
+	if err != nil {
+		t.Fatalf("unmarshalling the feedback: %s", err)
+	}
+	parsed, ok := packets[0].(*rtcp.TransportLayerCC)
+	if len(packets) != 1 || !ok {
+		t.Fatalf("feedback parsed as %v, want one transport-cc packet", packets)
+	}
+	return parsed
+}
+
+// The status symbol of each packet the feedback covers, from its chunks.
+func testTWCCStatuses(t *testing.T, feedback *rtcp.TransportLayerCC) []uint16 {
+	t.Helper()
+	var statuses []uint16
+	for _, chunk := range feedback.PacketChunks {
+		switch chunk := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := 0; i < int(chunk.RunLength); i++ {
+				statuses = append(statuses, chunk.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			statuses = append(statuses, chunk.SymbolList...)
+		}
+	}
+	if len(statuses) < int(feedback.PacketStatusCount) {
+		t.Fatalf("chunks have %d statuses, fewer than the status count %d", len(statuses), feedback.PacketStatusCount)
+	}
+	return statuses[:feedback.PacketStatusCount]
+}
+
+// The receive delta of each received packet in microseconds.
+func testTWCCDeltas(feedback *rtcp.TransportLayerCC) []int64 {
+	var deltas []int64
+	for _, delta := range feedback.RecvDeltas {
+		deltas = append(deltas, delta.Delta)
+	}
+	return deltas
+}
+
+func TestTWCCFeedback(t *testing.T) {
+	const (
+		small = rtcp.TypeTCCPacketReceivedSmallDelta
+		large = rtcp.TypeTCCPacketReceivedLargeDelta
+		lost  = rtcp.TypeTCCPacketNotReceived
+	)
+	type arrival struct {
+		seq uint16
+		ms  int
+	}
+	tests := []struct {
+		name     string
+		arrivals []arrival
+		base     uint16
+		statuses []uint16
+		// 64ms units.
+		reference uint32
+		deltas    []int64
+	}{
+		{"in order", []arrival{{10, 100}, {11, 101}, {12, 103}}, 10, []uint16{small, small, small}, 1, []int64{36000, 1000, 2000}},
+		{"lost packet", []arrival{{10, 100}, {11, 101}, {13, 103}}, 10, []uint16{small, small, lost, small}, 1, []int64{36000, 1000, 2000}},
+		{"out of order", []arrival{{11, 101}, {10, 100}, {12, 102}}, 10, []uint16{small, small, small}, 1, []int64{36000, 1000, 1000}},
+		{"duplicate", []arrival{{10, 100}, {10, 150}, {11, 101}}, 10, []uint16{small, small}, 1, []int64{36000, 1000}},
+		{"sequence wrap", []arrival{{65534, 100}, {65535, 101}, {0, 102}, {1, 103}}, 65534, []uint16{small, small, small, small}, 1, []int64{36000, 1000, 1000, 1000}},
+		{"beyond a small delta", []arrival{{10, 100}, {11, 200}}, 10, []uint16{small, large}, 1, []int64{36000, 100000}},
+		// A later packet arriving first is a negative delta.
+		{"negative delta", []arrival{{10, 100}, {11, 90}}, 10, []uint16{small, large}, 1, []int64{36000, -10000}},
+		// The largest delta a large delta holds, 0x7FFF 250us units.
+		{"delta clamped", []arrival{{10, 100}, {11, 20100}}, 10, []uint16{small, large}, 1, []int64{36000, 0x7FFF * 250}},
+		{"first delta over the reference", []arrival{{10, 127}}, 10, []uint16{small}, 1, []int64{63000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			epoch := time.Now()
+			recorder := &twccRecorder{senderSSRC: 1, epoch: epoch}
+			for _, arrival := range test.arrivals {
+				recorder.record(arrival.seq, 1234, epoch.Add(time.Duration(arrival.ms)*time.Millisecond))
+			}
+			feedback := unmarshalTestTWCC(t, recorder.feedback())
+			if feedback.SenderSSRC != 1 || feedback.MediaSSRC != 1234 {
+				t.Errorf("feedback is from SSRC %d about %d, want 1 about 1234", feedback.SenderSSRC, feedback.MediaSSRC)
+			}
+			if feedback.BaseSequenceNumber != test.base {
+				t.Errorf("base sequence number is %d, want %d", feedback.BaseSequenceNumber, test.base)
+			}
+			if int(feedback.PacketStatusCount) != len(test.statuses) {
+				t.Errorf("status count is %d, want %d", feedback.PacketStatusCount, len(test.statuses))
+			}
+			if got := testTWCCStatuses(t, feedback); !reflect.DeepEqual(got, test.statuses) {
+				t.Errorf("statuses are %v, want %v", got, test.statuses)
+			}
+			if feedback.ReferenceTime != test.reference {
+				t.Errorf("reference time is %d, want %d", feedback.ReferenceTime, test.reference)
+			}
+			if got := testTWCCDeltas(feedback); !reflect.DeepEqual(got, test.deltas) {
+				t.Errorf("deltas are %v, want %v", got, test.deltas)
+			}
+		})
+	}
+}
+
+// Each feedback carries on from the last: packets it reported lost that arrive later are left out.
+func TestTWCCFeedbackContinues(t *testing.T) {
+	epoch := time.Now()
+	recorder := &twccRecorder{epoch: epoch}
+	at := func(ms int) time.Time { return epoch.Add(time.Duration(ms) * time.Millisecond) }
+	if recorder.feedback() != nil {
+		t.Error("feedback with no packets recorded")
+	}
+
+	recorder.record(65535, 1234, at(100))
+	recorder.record(1, 1234, at(102))
+	first := unmarshalTestTWCC(t, recorder.feedback())
+	if first.BaseSequenceNumber != 65535 || first.PacketStatusCount != 3 || first.FbPktCount != 0 {
+		t.Errorf("first feedback is %d packets from %d, count %d, want 3 from 65535, count 0", first.PacketStatusCount, first.BaseSequenceNumber, first.FbPktCount)
+	}
+
+	// 0 was already reported lost.
+	recorder.record(0, 1234, at(150))
+	recorder.record(2, 1234, at(160))
+	second := unmarshalTestTWCC(t, recorder.feedback())
+	if second.BaseSequenceNumber != 2 || second.PacketStatusCount != 1 || second.FbPktCount != 1 {
+		t.Errorf("second feedback is %d packets from %d, count %d, want 1 from 2, count 1", second.PacketStatusCount, second.BaseSequenceNumber, second.FbPktCount)
+	}
+	if got := testTWCCDeltas(second); !reflect.DeepEqual(got, []int64{32000}) {
+		t.Errorf("second feedback's deltas are %v, want the 160ms arrival from the 128ms reference", got)
+	}
+
+	// Only packets already reported.
+	recorder.record(1, 1234, at(170))
+	if feedback := recorder.feedback(); feedback != nil {
+		t.Errorf("feedback %v for packets already reported", feedback)
+	}
+}
+
+// A run of lost packets longer than a run length chunk holds is split over several chunks.
+func TestTWCCFeedbackLongRun(t *testing.T) {
+	epoch := time.Now()
+	recorder := &twccRecorder{epoch: epoch}
+	recorder.record(0, 1234, epoch.Add(100*time.Millisecond))
+	recorder.record(twccMaxRunLength+2, 1234, epoch.Add(101*time.Millisecond))
+	feedback := unmarshalTestTWCC(t, recorder.feedback())
+	statuses := testTWCCStatuses(t, feedback)
+	if len(statuses) != twccMaxRunLength+3 || statuses[0] != rtcp.TypeTCCPacketReceivedSmallDelta || statuses[len(statuses)-1] != rtcp.TypeTCCPacketReceivedSmallDelta {
+		t.Fatalf("got %d statuses, want %d with the first and last received", len(statuses), twccMaxRunLength+3)
+	}
+	for i, status := range statuses[1 : len(statuses)-1] {
+		if status != rtcp.TypeTCCPacketNotReceived {
+			t.Fatalf("status %d is %d, want lost", i+1, status)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// underrunDetector - Notices when no packet of a track arrived for longer than UnderrunThresholdMs, and tells from the
+// sequence numbers whether UE stopped sending (none are missing, e.g. its encoder stalled) or the packets were lost on
+// the way (the sequence number jumped). Only used from the track's forwarding loop.
+type underrunDetector struct {
+	name      string
+	stats     *trackStats
+	threshold time.Duration
+	// With HandleDTX, an Opus track's silence, the gaps during it aren't underruns.
+	dtx *dtxDetector
+
+	last         time.Time
+	lastSequence uint16
+}
+
+func newUnderrunDetector(name string, stats *trackStats, threshold time.Duration) *underrunDetector {
+	return &underrunDetector{name: name, stats: stats, threshold: threshold}
+}
+
+// Notes a packet read from the track, counting and logging an underrun if it ends one.
+func (d *underrunDetector) packet(sequence uint16, now time.Time) {
+	if !d.last.IsZero() {
+		if gap := now.Sub(d.last); gap > d.threshold && (d.dtx == nil || !d.dtx.silent) {
+			d.stats.addUnderrun()
+			// Wraps around like the sequence numbers, a reordered packet counts as none missing.
+			missing := sequence - d.lastSequence - 1
+			if missing == 0 || missing > maxSequenceGap {
+				log.Printf("Underrun on %s track: no packets from UE for %s and none are missing, UE stopped sending (e.g. its encoder stalled).", d.name, gap.Round(time.Millisecond))
+			} else {
+				log.Printf("Underrun on %s track: no packets from UE for %s and %d are missing, they were lost on the way.", d.name, gap.Round(time.Millisecond), missing)
+			}
+		}
+	}
+	d.last = now
+	d.lastSequence = sequence
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Returns the temporal layer (TID) a VP8 packet belongs to from its payload descriptor (RFC 7741 section 4.2), ok is
+// false if the descriptor doesn't say, e.g. UE isn't encoding temporal layers.
+func vp8TemporalLayer(payload []byte) (tid uint8, ok bool) {
+	// X: the extension byte with I, L, T and K follows.
+	if len(payload) < 2 || payload[0]&0x80 == 0 {
+		return 0, false
+	}
+	extension := payload[1]
+	i := 2
+	if extension&0x80 != 0 {
+		// PictureID, two bytes if its M bit is set.
+		if len(payload) <= i {
+			return 0, false
+		}
+		if payload[i]&0x80 != 0 {
+			i += 2
+		} else {
+			i++
+		}
+	}
+	if extension&0x40 != 0 {
+		// TL0PICIDX.
+		i++
+	}
+	if extension&0x20 == 0 || len(payload) <= i {
+		return 0, false
+	}
+	// TID is the top two bits of the TID/Y/KEYIDX byte.
+	return payload[i] >> 6, true
+}
+
+// Returns the temporal layer (TID) a VP9 packet belongs to from its payload descriptor (draft-ietf-payload-vp9 section
+// 4.2), ok is false if it has no layer indices.
+func vp9TemporalLayer(payload []byte) (tid uint8, ok bool) {
+	if len(payload) < 1 {
+		return 0, false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 {
+		// I: PictureID, two bytes if its M bit is set.
+		if len(payload) <= i {
+			return 0, false
+		}
+		if payload[i]&0x80 != 0 {
+			i += 2
+		} else {
+			i++
+		}
+	}
+	// L: the layer indices follow, TID is their top three bits.
+	if payload[0]&0x20 == 0 || len(payload) <= i {
+		return 0, false
+	}
+	return payload[i] >> 5, true
+}
+
+// temporalLayerFilter - Drops the packets of a VP8 or VP9 track's temporal layers above MaxTemporalLayer, giving a
+// lower framerate stream without transcoding. Each packet says its own layer, so unlike the keyframe filter nothing is
+// held back. The packets we keep have their sequence numbers shifted down by the number of packets dropped so far, so
+// the receiver doesn't see the dropped layers as loss but still sees packets lost upstream. Packets that don't say
+// their layer are kept. Only used from the track's forwarding loop.
+type temporalLayerFilter struct {
+	maxLayer uint8
+	layer    func(payload []byte) (uint8, bool)
+	// How many packets the filter has dropped, subtracted from the sequence numbers of the ones it forwards.
+	dropped uint16
+}
+
+// Returns a filter for the track, nil if its codec has no temporal layers we can read.
+func newTemporalLayerFilter(codec webrtc.RTPCodecParameters, maxLayer int) *temporalLayerFilter {
+	f := &temporalLayerFilter{maxLayer: uint8(maxLayer)}
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		f.layer = vp8TemporalLayer
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		f.layer = vp9TemporalLayer
+	default:
+		return nil
+	}
+	return f
+}
+
+// Reports whether to forward the marshalled packet, renumbering it in place if so.
+func (f *temporalLayerFilter) keep(packet []byte, payload []byte) bool {
+	if tid, ok := f.layer(payload); ok && tid > f.maxLayer {
+		f.dropped++
+		return false
+	}
+	binary.BigEndian.PutUint16(packet[2:], binary.BigEndian.Uint16(packet[2:])-f.dropped)
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestVP8TemporalLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		tid     uint8
+		ok      bool
+	}{
+		{"TID only", []byte{0x90, 0x20, 0x40}, 1, true},
+		{"after a 7 bit PictureID", []byte{0x80, 0xa0, 0x05, 0x80}, 2, true},
+		{"after a 15 bit PictureID", []byte{0x80, 0xa0, 0x85, 0x01, 0xc0}, 3, true},
+		{"after PictureID and TL0PICIDX", []byte{0x80, 0xe0, 0x05, 0x17, 0x40}, 1, true},
+		{"base layer", []byte{0x80, 0x20, 0x00}, 0, true},
+		{"no extension", []byte{0x10, 0x9d}, 0, false},
+		{"extension without TID", []byte{0x80, 0x80, 0x05}, 0, false},
+		{"truncated", []byte{0x80, 0x20}, 0, false},
+		{"truncated PictureID", []byte{0x80, 0xa0}, 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tid, ok := vp8TemporalLayer(test.payload)
+			if tid != test.tid || ok != test.ok {
+				t.Errorf("layer is %d %v, want %d %v", tid, ok, test.tid, test.ok)
+			}
+		})
+	}
+}
+
+func TestVP9TemporalLayer(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		tid     uint8
+		ok      bool
+	}{
+		{"layer indices only", []byte{0x20, 0x40}, 2, true},
+		{"after a 7 bit PictureID", []byte{0xa0, 0x05, 0x20}, 1, true},
+		{"after a 15 bit PictureID", []byte{0xa0, 0x85, 0x01, 0x60}, 3, true},
+		{"no layer indices", []byte{0x80, 0x05, 0x20}, 0, false},
+		{"truncated", []byte{0x20}, 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tid, ok := vp9TemporalLayer(test.payload)
+			if tid != test.tid || ok != test.ok {
+				t.Errorf("layer is %d %v, want %d %v", tid, ok, test.tid, test.ok)
+			}
+		})
+	}
+}
+
+func TestTemporalLayerFilter(t *testing.T) {
+	vp8 := func(tid uint8) []byte { return []byte{0x80, 0x20, tid << 6} }
+	vp9 := func(tid uint8) []byte { return []byte{0x20, tid << 5} }
+	tests := []struct {
+		name     string
+		codec    string
+		payload  func(tid uint8) []byte
+		maxLayer int
+		first    uint16
+		tids     []uint8
+		lost     []uint16
+		want     []uint16
+	}{
+		{"VP8 base layer", webrtc.MimeTypeVP8, vp8, 0, 10, []uint8{0, 1, 0, 1, 0, 1}, nil, []uint16{10, 11, 12}},
+		{"VP9 up to layer 1", webrtc.MimeTypeVP9, vp9, 1, 10, []uint8{0, 2, 1, 2, 0, 2}, nil, []uint16{10, 11, 12}},
+		{"every layer kept", webrtc.MimeTypeVP8, vp8, 2, 10, []uint8{0, 2, 1, 2}, nil, []uint16{10, 11, 12, 13}},
+		// 14 would have been forwarded as 12, the receiver still sees it missing.
+		{"VP8 with an upstream gap", webrtc.MimeTypeVP8, vp8, 0, 10, []uint8{0, 1, 0, 1, 0, 1, 0}, []uint16{14}, []uint16{10, 11, 13}},
+		{"VP9 with an upstream gap", webrtc.MimeTypeVP9, vp9, 0, 10, []uint8{0, 1, 0, 1, 0, 1, 0}, []uint16{14}, []uint16{10, 11, 13}},
+		// We can't tell which layer a lost packet was in, so it leaves a gap even if it was one we'd have dropped.
+		{"dropped layer's packet lost upstream", webrtc.MimeTypeVP8, vp8, 0, 10, []uint8{0, 1, 0, 1, 0}, []uint16{13}, []uint16{10, 11, 13}},
+		{"across the sequence number wrap", webrtc.MimeTypeVP8, vp8, 0, 65534, []uint8{0, 1, 0, 1, 0}, nil, []uint16{65534, 65535, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newTemporalLayerFilter(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: test.codec}}, test.maxLayer)
+			var forwarded []uint16
+			for i, tid := range test.tids {
+				sequence := test.first + uint16(i)
+				skip := false
+				for _, l := range test.lost {
+					skip = skip || l == sequence
+				}
+				if skip {
+					continue
+				}
+				payload := test.payload(tid)
+				packet := marshalTestPacket(t, rtp.Header{SequenceNumber: sequence}, payload)
+				if f.keep(packet, payload) {
+					forwarded = append(forwarded, binary.BigEndian.Uint16(packet[2:]))
+				}
+			}
+			if !reflect.DeepEqual(forwarded, test.want) {
+				t.Errorf("forwarded as %v, want %v", forwarded, test.want)
+			}
+		})
+	}
+}
+
+func TestTemporalLayerFilterCodecs(t *testing.T) {
+	for _, mimeType := range []string{webrtc.MimeTypeH264, webrtc.MimeTypeOpus} {
+		if f := newTemporalLayerFilter(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType}}, 0); f != nil {
+			t.Errorf("%s has a temporal layer filter", mimeType)
+		}
+	}
+}